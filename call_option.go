@@ -0,0 +1,93 @@
+package datastore
+
+import "context"
+
+// A CallOption is an option for a single call, it is carried on the context.
+// The middlewares read it by MiddlewareInfo.CallOptions.
+type CallOption interface {
+	Apply(*CallOptions)
+}
+
+// CallOptions is the set of CallOption.
+type CallOptions struct {
+	// SkipCache makes the cache middlewares neither read nor fill the cache.
+	// The writes still invalidate the cache.
+	SkipCache bool
+	// StrongRead makes the cache middlewares read from Datastore instead of the cache, and fill the cache by the result.
+	StrongRead bool
+	// NoRetry makes the retry middleware try the RPC only once.
+	NoRetry bool
+	// NoSplit makes the split middleware pass the operation as is.
+	NoSplit bool
+}
+
+type contextCallOptions struct{}
+
+// WithCallOptions returns the context that carries the options for the calls by it.
+// The options are added to the options that ctx already carries.
+func WithCallOptions(ctx context.Context, opts ...CallOption) context.Context {
+	callOpts := CallOptionsFromContext(ctx)
+	for _, opt := range opts {
+		opt.Apply(&callOpts)
+	}
+
+	return context.WithValue(ctx, contextCallOptions{}, callOpts)
+}
+
+// CallOptionsFromContext returns the options carried by ctx.
+func CallOptionsFromContext(ctx context.Context) CallOptions {
+	if ctx == nil {
+		return CallOptions{}
+	}
+	callOpts, _ := ctx.Value(contextCallOptions{}).(CallOptions)
+	return callOpts
+}
+
+// CallOptions returns the options of the call.
+func (info *MiddlewareInfo) CallOptions() CallOptions {
+	return CallOptionsFromContext(info.Context)
+}
+
+// SkipCache returns a CallOption that bypasses the cache.
+func SkipCache() CallOption {
+	return withSkipCache{}
+}
+
+type withSkipCache struct{}
+
+func (w withSkipCache) Apply(o *CallOptions) {
+	o.SkipCache = true
+}
+
+// StrongRead returns a CallOption that reads the latest entities from Datastore, and refreshes the cache.
+func StrongRead() CallOption {
+	return withStrongRead{}
+}
+
+type withStrongRead struct{}
+
+func (w withStrongRead) Apply(o *CallOptions) {
+	o.StrongRead = true
+}
+
+// NoRetry returns a CallOption that disables the retry.
+func NoRetry() CallOption {
+	return withNoRetry{}
+}
+
+type withNoRetry struct{}
+
+func (w withNoRetry) Apply(o *CallOptions) {
+	o.NoRetry = true
+}
+
+// NoSplit returns a CallOption that disables the split of the operation.
+func NoSplit() CallOption {
+	return withNoSplit{}
+}
+
+type withNoSplit struct{}
+
+func (w withNoSplit) Apply(o *CallOptions) {
+	o.NoSplit = true
+}
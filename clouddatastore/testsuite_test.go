@@ -15,6 +15,7 @@ import (
 	_ "go.mercari.io/datastore/testsuite/dsmiddleware/localcache"
 	_ "go.mercari.io/datastore/testsuite/dsmiddleware/rpcretry"
 	_ "go.mercari.io/datastore/testsuite/favcliptools"
+	_ "go.mercari.io/datastore/testsuite/lease"
 	_ "go.mercari.io/datastore/testsuite/realworld/recursivebatch"
 	_ "go.mercari.io/datastore/testsuite/realworld/tbf"
 
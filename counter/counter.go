@@ -0,0 +1,275 @@
+package counter
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/dsmiddleware/storagecache"
+)
+
+const (
+	defaultShards                = 20
+	defaultShardKind             = "CounterShard"
+	defaultConfigKind            = "CounterConfig"
+	defaultConfigRefreshInterval = 1 * time.Minute
+	defaultMaxRetries            = 3
+
+	// cacheKind is used only for the key of the cached total, no entity is saved in this Kind.
+	cacheKind     = "CounterTotal"
+	propTotal     = "Total"
+	propUpdatedAt = "UpdatedAt"
+)
+
+type shard struct {
+	Count int64 `datastore:",noindex"`
+}
+
+type config struct {
+	Shards int `datastore:",noindex"`
+}
+
+// New returns the Counter identified by name.
+func New(client datastore.Client, name string, opts ...Option) *Counter {
+	c := &Counter{
+		client:                client,
+		name:                  name,
+		initialShards:         defaultShards,
+		shardKind:             defaultShardKind,
+		configKind:            defaultConfigKind,
+		configRefreshInterval: defaultConfigRefreshInterval,
+		maxRetries:            defaultMaxRetries,
+		rnd:                   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	for _, opt := range opts {
+		opt.Apply(c)
+	}
+
+	if c.initialShards <= 0 {
+		c.initialShards = 1
+	}
+	if c.logf == nil {
+		c.logf = func(ctx context.Context, format string, args ...interface{}) {}
+	}
+
+	return c
+}
+
+// A Option is an option for Counter.
+type Option interface {
+	Apply(*Counter)
+}
+
+// Counter is the sharded counter.
+// Counter is safe for concurrent use by multiple goroutines.
+type Counter struct {
+	client datastore.Client
+	name   string
+
+	initialShards         int
+	shardKind             string
+	configKind            string
+	configRefreshInterval time.Duration
+	maxRetries            int
+	cache                 storagecache.Storage
+	logf                  func(ctx context.Context, format string, args ...interface{})
+
+	m              sync.Mutex
+	rnd            *rand.Rand
+	shards         int
+	shardsLoadedAt time.Time
+}
+
+// Name returns the name of the counter.
+func (c *Counter) Name() string {
+	return c.name
+}
+
+func (c *Counter) configKey() datastore.Key {
+	return c.client.NameKey(c.configKind, c.name, nil)
+}
+
+func (c *Counter) shardKey(idx int) datastore.Key {
+	return c.client.NameKey(c.shardKind, fmt.Sprintf("%s-%d", c.name, idx), nil)
+}
+
+func (c *Counter) cacheKey() datastore.Key {
+	return c.client.NameKey(cacheKind, c.name, nil)
+}
+
+func (c *Counter) randIntn(n int) int {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.rnd.Intn(n)
+}
+
+func (c *Counter) loadShards(ctx context.Context) (int, error) {
+	c.m.Lock()
+	if c.shards != 0 && time.Since(c.shardsLoadedAt) < c.configRefreshInterval {
+		shards := c.shards
+		c.m.Unlock()
+		return shards, nil
+	}
+	c.m.Unlock()
+
+	cfg := &config{}
+	err := c.client.Get(ctx, c.configKey(), cfg)
+	if err == datastore.ErrNoSuchEntity {
+		cfg.Shards = c.initialShards
+	} else if err != nil {
+		return 0, err
+	}
+	if cfg.Shards < c.initialShards {
+		// shards can't be fewer than WithShards, the shard count never shrinks.
+		cfg.Shards = c.initialShards
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.shards = cfg.Shards
+	c.shardsLoadedAt = time.Now()
+
+	return c.shards, nil
+}
+
+// Shards returns the current shard count.
+func (c *Counter) Shards(ctx context.Context) (int, error) {
+	return c.loadShards(ctx)
+}
+
+// Grow increases the shard count to n. It does nothing if the shard count is already n or more.
+func (c *Counter) Grow(ctx context.Context, n int) error {
+	var shards int
+	_, err := c.client.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		cfg := &config{}
+		err := tx.Get(c.configKey(), cfg)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if cfg.Shards < c.initialShards {
+			cfg.Shards = c.initialShards
+		}
+		if n <= cfg.Shards {
+			shards = cfg.Shards
+			return nil
+		}
+
+		cfg.Shards = n
+		shards = n
+		_, err = tx.Put(c.configKey(), cfg)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	c.logf(ctx, "counter.Grow: name=%s shards=%d", c.name, shards)
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.shards = shards
+	c.shardsLoadedAt = time.Now()
+
+	return nil
+}
+
+// Increment adds delta to the counter.
+// When the transaction conflicts, it retries on another shard.
+func (c *Counter) Increment(ctx context.Context, delta int64) error {
+	shards, err := c.loadShards(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; ; i++ {
+		idx := c.randIntn(shards)
+		_, err = c.client.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+			s := &shard{}
+			err := tx.Get(c.shardKey(idx), s)
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			s.Count += delta
+			_, err = tx.Put(c.shardKey(idx), s)
+			return err
+		})
+		if err != datastore.ErrConcurrentTransaction || c.maxRetries <= i {
+			return err
+		}
+
+		c.logf(ctx, "counter.Increment: name=%s shard=%d conflicted, retry=%d", c.name, idx, i+1)
+	}
+}
+
+// Count returns the total of the counter.
+// The total is read from the cache if WithCache is specified and the cached total exists.
+func (c *Counter) Count(ctx context.Context) (int64, error) {
+	if c.cache != nil {
+		cis, err := c.cache.GetMulti(ctx, []datastore.Key{c.cacheKey()})
+		if err != nil {
+			// cache is not mandatory. ignore the error and read from Datastore.
+			c.logf(ctx, "counter.Count: name=%s cache.GetMulti err=%s", c.name, err.Error())
+		} else if len(cis) == 1 && cis[0] != nil {
+			for _, p := range cis[0].PropertyList {
+				if v, ok := p.Value.(int64); ok && p.Name == propTotal {
+					return v, nil
+				}
+			}
+		}
+	}
+
+	return c.CountWithoutCache(ctx)
+}
+
+// CountWithoutCache returns the total of the counter from all shards, and updates the cached total.
+func (c *Counter) CountWithoutCache(ctx context.Context) (int64, error) {
+	shards, err := c.loadShards(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	keys := make([]datastore.Key, 0, shards)
+	for i := 0; i < shards; i++ {
+		keys = append(keys, c.shardKey(i))
+	}
+	list := make([]*shard, len(keys))
+	err = c.client.GetMulti(ctx, keys, list)
+	if merr, ok := err.(datastore.MultiError); ok {
+		for _, err := range merr {
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return 0, merr
+			}
+		}
+	} else if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, s := range list {
+		if s != nil {
+			total += s.Count
+		}
+	}
+
+	if c.cache != nil {
+		err = c.cache.SetMulti(ctx, []*storagecache.CacheItem{
+			{
+				Key: c.cacheKey(),
+				PropertyList: datastore.PropertyList{
+					{Name: propTotal, Value: total, NoIndex: true},
+					{Name: propUpdatedAt, Value: time.Now(), NoIndex: true},
+				},
+			},
+		})
+		if err != nil {
+			c.logf(ctx, "counter.CountWithoutCache: name=%s cache.SetMulti err=%s", c.name, err.Error())
+		}
+	}
+
+	return total, nil
+}
@@ -0,0 +1,186 @@
+package counter
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"go.mercari.io/datastore/dsmiddleware/localcache"
+	"go.mercari.io/datastore/internal/testutils"
+)
+
+func TestCounter_Basic(t *testing.T) {
+	ctx, client, cleanUp := testutils.SetupCloudDatastore(t)
+	defer cleanUp()
+
+	c := New(client, "test", WithShards(5))
+
+	for i := 0; i < 10; i++ {
+		err := c.Increment(ctx, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := c.Increment(ctx, -5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	total, err := c.Count(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 15 {
+		t.Errorf("unexpected: %v", total)
+	}
+
+	// other counter is independent
+	total, err = New(client, "other").Count(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 0 {
+		t.Errorf("unexpected: %v", total)
+	}
+}
+
+func TestCounter_Concurrent(t *testing.T) {
+	ctx, client, cleanUp := testutils.SetupCloudDatastore(t)
+	defer cleanUp()
+
+	c := New(client, "test", WithShards(10), WithMaxRetries(10))
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errCh <- c.Increment(ctx, 1)
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	total, err := c.Count(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 20 {
+		t.Errorf("unexpected: %v", total)
+	}
+}
+
+func TestCounter_Grow(t *testing.T) {
+	ctx, client, cleanUp := testutils.SetupCloudDatastore(t)
+	defer cleanUp()
+
+	c := New(client, "test", WithShards(2))
+
+	err := c.Increment(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Grow(ctx, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards, err := c.Shards(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shards != 8 {
+		t.Errorf("unexpected: %v", shards)
+	}
+
+	// never shrinks
+	err = c.Grow(ctx, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another instance reads the shard count from Datastore
+	c2 := New(client, "test", WithShards(2))
+	shards, err = c2.Shards(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shards != 8 {
+		t.Errorf("unexpected: %v", shards)
+	}
+
+	for i := 0; i < 10; i++ {
+		err = c2.Increment(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	total, err := c.Count(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 13 {
+		t.Errorf("unexpected: %v", total)
+	}
+}
+
+func TestCounter_WithCache(t *testing.T) {
+	ctx, client, cleanUp := testutils.SetupCloudDatastore(t)
+	defer cleanUp()
+
+	ch := localcache.New()
+	c := New(client, "test", WithCache(ch))
+
+	err := c.Increment(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	total, err := c.Count(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 {
+		t.Errorf("unexpected: %v", total)
+	}
+	if v := ch.CacheLen(); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	err = c.Increment(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// read from cache
+	total, err = c.Count(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 {
+		t.Errorf("unexpected: %v", total)
+	}
+
+	total, err = c.CountWithoutCache(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 {
+		t.Errorf("unexpected: %v", total)
+	}
+
+	total, err = c.Count(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 {
+		t.Errorf("unexpected: %v", total)
+	}
+}
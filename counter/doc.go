@@ -0,0 +1,23 @@
+/*
+Package counter provides the sharded counter built on transactions.
+
+Incrementing a single entity at a high rate causes contention, and the transaction fails by ErrConcurrentTransaction.
+Counter spreads the increments over N shard entities chosen at random,
+and the total is the sum of all shards.
+
+	c := counter.New(client, "page-view", counter.WithShards(20))
+	err := c.Increment(ctx, 1)
+	...
+	total, err := c.Count(ctx)
+
+The shard count can be grown online by Grow.
+Other instances notice the new shard count after WithConfigRefreshInterval.
+The shard count never shrinks because the count in the removed shards would be lost.
+
+Count can read the total through the storagecache.Storage like localcache or rediscache by WithCache.
+The cached total is not updated by Increment, it is refreshed when the storage expires the item
+or CountWithoutCache is called.
+
+Counter accepts any datastore.Client, boom users can pass the Client field of boom.Boom.
+*/
+package counter // import "go.mercari.io/datastore/counter"
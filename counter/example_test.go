@@ -0,0 +1,53 @@
+package counter_test
+
+import (
+	"context"
+	"fmt"
+
+	"go.mercari.io/datastore/boom"
+	"go.mercari.io/datastore/clouddatastore"
+	"go.mercari.io/datastore/counter"
+	"go.mercari.io/datastore/dsmiddleware/localcache"
+	"go.mercari.io/datastore/internal/testutils"
+)
+
+func Example_howToUse() {
+	ctx := context.Background()
+	client, err := clouddatastore.FromContext(ctx)
+	if err != nil {
+		panic(err)
+	}
+	defer client.Close()
+	defer testutils.CleanUpAllEntities(ctx, client)
+
+	c := counter.New(client, "page-view", counter.WithShards(20), counter.WithCache(localcache.New()))
+
+	err = c.Increment(ctx, 1)
+	if err != nil {
+		panic(err)
+	}
+
+	total, err := c.Count(ctx)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(total)
+}
+
+func Example_withBoom() {
+	ctx := context.Background()
+	client, err := clouddatastore.FromContext(ctx)
+	if err != nil {
+		panic(err)
+	}
+	defer client.Close()
+	defer testutils.CleanUpAllEntities(ctx, client)
+
+	bm := boom.FromClient(ctx, client)
+
+	c := counter.New(bm.Client, "page-view")
+	err = c.Increment(ctx, 1)
+	if err != nil {
+		panic(err)
+	}
+}
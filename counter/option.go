@@ -0,0 +1,88 @@
+package counter
+
+import (
+	"context"
+	"time"
+
+	"go.mercari.io/datastore/dsmiddleware/storagecache"
+)
+
+// WithShards specifies the initial shard count. default is 20.
+func WithShards(n int) Option {
+	return &withShards{n}
+}
+
+type withShards struct{ n int }
+
+func (w *withShards) Apply(o *Counter) {
+	o.initialShards = w.n
+}
+
+// WithShardKind specifies the Kind of shard entities. default is "CounterShard".
+func WithShardKind(kind string) Option {
+	return &withShardKind{kind}
+}
+
+type withShardKind struct{ kind string }
+
+func (w *withShardKind) Apply(o *Counter) {
+	o.shardKind = w.kind
+}
+
+// WithConfigKind specifies the Kind of the entity that holds the shard count. default is "CounterConfig".
+func WithConfigKind(kind string) Option {
+	return &withConfigKind{kind}
+}
+
+type withConfigKind struct{ kind string }
+
+func (w *withConfigKind) Apply(o *Counter) {
+	o.configKind = w.kind
+}
+
+// WithConfigRefreshInterval specifies how long the shard count is kept in memory. default is 1 minute.
+func WithConfigRefreshInterval(d time.Duration) Option {
+	return &withConfigRefreshInterval{d}
+}
+
+type withConfigRefreshInterval struct{ d time.Duration }
+
+func (w *withConfigRefreshInterval) Apply(o *Counter) {
+	o.configRefreshInterval = w.d
+}
+
+// WithMaxRetries specifies how many times Increment retries on another shard when the transaction conflicts. default is 3.
+func WithMaxRetries(n int) Option {
+	return &withMaxRetries{n}
+}
+
+type withMaxRetries struct{ n int }
+
+func (w *withMaxRetries) Apply(o *Counter) {
+	o.maxRetries = w.n
+}
+
+// WithCache specifies the storage that caches the total.
+// The expiration of the cached total follows the setting of the storage.
+func WithCache(s storagecache.Storage) Option {
+	return &withCache{s}
+}
+
+type withCache struct{ s storagecache.Storage }
+
+func (w *withCache) Apply(o *Counter) {
+	o.cache = w.s
+}
+
+// WithLogger creates a Option that uses the specified logger.
+func WithLogger(logf func(ctx context.Context, format string, args ...interface{})) Option {
+	return &withLogger{logf}
+}
+
+type withLogger struct {
+	logf func(ctx context.Context, format string, args ...interface{})
+}
+
+func (w *withLogger) Apply(o *Counter) {
+	o.logf = w.logf
+}
@@ -49,6 +49,11 @@ For easy RET retry with all RPCs, it is better to implement it as middleware.
 
 Please refer to https://godoc.org/go.mercari.io/datastore/dsmiddleware if you want to know the middleware already provided.
 
+The behavior of the middlewares can be changed for each call by CallOption carried on the context.
+
+	ctx = datastore.WithCallOptions(ctx, datastore.StrongRead(), datastore.NoRetry())
+	err := client.Get(ctx, key, obj)
+
 
 Provide the same interface between AppEngine and Cloud Datastore
 
@@ -43,6 +43,11 @@ DatastoreにEntityをPutしたら、MemcacheやRedisにSetしておく。
 
 既に用意されているミドルウェアが知りたい場合は https://godoc.org/go.mercari.io/datastore/dsmiddleware を参照してください。
 
+ミドルウェアの振る舞いは、contextに載せたCallOptionで呼び出し毎に変更できます。
+
+	ctx = datastore.WithCallOptions(ctx, datastore.StrongRead(), datastore.NoRetry())
+	err := client.Get(ctx, key, obj)
+
 
 AppEngineとCloudで同一のインタフェースを提供する
 
@@ -1,9 +1,7 @@
 package aememcache
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
 	"time"
 
 	"go.mercari.io/datastore"
@@ -13,15 +11,19 @@ import (
 )
 
 var _ storagecache.Storage = &cacheHandler{}
+var _ storagecache.LockStorage = &cacheHandler{}
 var _ datastore.Middleware = &cacheHandler{}
 
+const defaultLockDuration = 32 * time.Second
+
 // New AE Memcache middleware creates & returns.
 func New(opts ...CacheOption) interface {
 	datastore.Middleware
 	storagecache.Storage
 } {
 	ch := &cacheHandler{
-		stOpts: &storagecache.Options{},
+		stOpts:       &storagecache.Options{},
+		lockDuration: defaultLockDuration,
 	}
 
 	for _, opt := range opts {
@@ -39,6 +41,9 @@ func New(opts ...CacheOption) interface {
 			return "mercari:aememcache:" + key.Encode()
 		}
 	}
+	if ch.codec == nil {
+		ch.codec = storagecache.NewGobCodec()
+	}
 
 	return ch
 }
@@ -47,10 +52,13 @@ type cacheHandler struct {
 	datastore.Middleware
 	stOpts *storagecache.Options
 
-	raiseMemcacheError bool
-	expireDuration     time.Duration
-	logf               func(ctx context.Context, format string, args ...interface{})
-	cacheKey           func(key datastore.Key) string
+	raiseMemcacheError     bool
+	expireDuration         time.Duration
+	negativeExpireDuration time.Duration
+	lockDuration           time.Duration
+	logf                   func(ctx context.Context, format string, args ...interface{})
+	cacheKey               func(key datastore.Key) string
+	codec                  storagecache.Codec
 }
 
 // A CacheOption is an cache option for a AE Memcache middleware.
@@ -67,17 +75,15 @@ func (ch *cacheHandler) SetMulti(ctx context.Context, cis []*storagecache.CacheI
 		if ci.Key.Incomplete() {
 			panic("incomplete key incoming")
 		}
-		var buf bytes.Buffer
-		enc := gob.NewEncoder(&buf)
-		err := enc.Encode(ci.PropertyList)
+		b, err := ch.codec.Encode(ci)
 		if err != nil {
-			ch.logf(ctx, "dsmiddleware/aememcache.SetMulti: gob.Encode error key=%s err=%s", ci.Key.String(), err.Error())
+			ch.logf(ctx, "dsmiddleware/aememcache.SetMulti: encode error key=%s err=%s", ci.Key.String(), err.Error())
 			continue
 		}
 		itemList = append(itemList, &memcache.Item{
 			Key:        ch.cacheKey(ci.Key),
-			Value:      buf.Bytes(),
-			Expiration: ch.expireDuration,
+			Value:      b,
+			Expiration: ch.expiration(ci),
 		})
 	}
 
@@ -124,6 +130,27 @@ func (ch *cacheHandler) SetMulti(ctx context.Context, cis []*storagecache.CacheI
 	return nil
 }
 
+// expiration returns the expiration of the item.
+func (ch *cacheHandler) expiration(ci *storagecache.CacheItem) time.Duration {
+	if !ci.NoSuchEntity {
+		if ch.expireDuration <= 0 {
+			return 0
+		}
+		return atLeastSecond(ch.expireDuration)
+	}
+
+	// memcache treats 0 as no expiration, so the tombstone lives 1 second at least.
+	return atLeastSecond(ch.negativeExpireDuration)
+}
+
+// atLeastSecond rounds d up to 1 second, memcache ignores the expiration less than 1 second.
+func atLeastSecond(d time.Duration) time.Duration {
+	if d < time.Second {
+		return time.Second
+	}
+	return d
+}
+
 func (ch *cacheHandler) GetMulti(ctx context.Context, keys []datastore.Key) ([]*storagecache.CacheItem, error) {
 
 	ch.logf(ctx, "dsmiddleware/aememcache.GetMulti: incoming len=%d", len(keys))
@@ -157,26 +184,20 @@ func (ch *cacheHandler) GetMulti(ctx context.Context, keys []datastore.Key) ([]*
 	hit, miss := 0, 0
 	for idx, key := range keys {
 		item, ok := itemMap[ch.cacheKey(key)]
-		if !ok {
+		if !ok || storagecache.IsLockValue(item.Value) {
 			resultList[idx] = nil
 			miss++
 			continue
 		}
-		buf := bytes.NewBuffer(item.Value)
-		dec := gob.NewDecoder(buf)
-		var ps datastore.PropertyList
-		err = dec.Decode(&ps)
+		ci, err := ch.codec.Decode(key, item.Value)
 		if err != nil {
 			resultList[idx] = nil
-			ch.logf(ctx, "dsmiddleware/aememcache.GetMulti: gob.Decode error key=%s err=%s", key.String(), err.Error())
+			ch.logf(ctx, "dsmiddleware/aememcache.GetMulti: decode error key=%s err=%s", key.String(), err.Error())
 			miss++
 			continue
 		}
 
-		resultList[idx] = &storagecache.CacheItem{
-			Key:          key,
-			PropertyList: ps,
-		}
+		resultList[idx] = ci
 		hit++
 	}
 
@@ -8,6 +8,7 @@ import (
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/favclip/testerator/v2"
 	_ "github.com/favclip/testerator/v2/datastore"
@@ -640,3 +641,23 @@ func TestAEMemcacheCache_MultiError(t *testing.T) {
 		t.Errorf("unexpected: %v", v)
 	}
 }
+
+func TestAEMemcacheCache_Expiration(t *testing.T) {
+	ch := &cacheHandler{
+		expireDuration:         500 * time.Millisecond,
+		negativeExpireDuration: 0,
+	}
+
+	// memcache ignores the expiration less than 1 second, and 0 means no expiration.
+	if v := ch.expiration(&storagecache.CacheItem{}); v != time.Second {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := ch.expiration(&storagecache.CacheItem{NoSuchEntity: true}); v != time.Second {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	ch.expireDuration = 0
+	if v := ch.expiration(&storagecache.CacheItem{}); v != 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
@@ -0,0 +1,119 @@
+package aememcache
+
+import (
+	"bytes"
+	"context"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/dsmiddleware/storagecache"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func (ch *cacheHandler) LockMulti(ctx context.Context, keys []datastore.Key) error {
+	ch.logf(ctx, "dsmiddleware/aememcache.LockMulti: incoming len=%d", len(keys))
+
+	lock := storagecache.NewLockValue()
+	itemList := make([]*memcache.Item, 0, len(keys))
+	for _, key := range keys {
+		itemList = append(itemList, &memcache.Item{
+			Key:        ch.cacheKey(key),
+			Value:      lock,
+			Expiration: atLeastSecond(ch.lockDuration),
+		})
+	}
+
+	return memcache.SetMulti(ctx, itemList)
+}
+
+func (ch *cacheHandler) AddLockMulti(ctx context.Context, keys []datastore.Key) ([][]byte, error) {
+	ch.logf(ctx, "dsmiddleware/aememcache.AddLockMulti: incoming len=%d", len(keys))
+
+	lock := storagecache.NewLockValue()
+	itemList := make([]*memcache.Item, 0, len(keys))
+	for _, key := range keys {
+		itemList = append(itemList, &memcache.Item{
+			Key:        ch.cacheKey(key),
+			Value:      lock,
+			Expiration: atLeastSecond(ch.lockDuration),
+		})
+	}
+
+	locks := make([][]byte, len(keys))
+	err := memcache.AddMulti(ctx, itemList)
+	merr, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return locks, err
+	}
+
+	locked := 0
+	for idx := range keys {
+		// ErrNotStored means the entity is cached, or the other locks it.
+		if merr != nil && merr[idx] != nil {
+			continue
+		}
+		locks[idx] = lock
+		locked++
+	}
+
+	ch.logf(ctx, "dsmiddleware/aememcache.AddLockMulti: locked=%d", locked)
+
+	return locks, nil
+}
+
+func (ch *cacheHandler) CompareAndSwapMulti(ctx context.Context, cis []*storagecache.CacheItem, locks [][]byte) error {
+	ch.logf(ctx, "dsmiddleware/aememcache.CompareAndSwapMulti: incoming len=%d", len(cis))
+
+	cacheKeys := make([]string, 0, len(cis))
+	for _, ci := range cis {
+		if ci.Key.Incomplete() {
+			panic("incomplete key incoming")
+		}
+		cacheKeys = append(cacheKeys, ch.cacheKey(ci.Key))
+	}
+	// the items have the cas id to swap.
+	itemMap, err := memcache.GetMulti(ctx, cacheKeys)
+	if err != nil {
+		return err
+	}
+
+	itemList := make([]*memcache.Item, 0, len(cis))
+	conflicted := 0
+	for idx, ci := range cis {
+		item, ok := itemMap[cacheKeys[idx]]
+		if !ok || !bytes.Equal(item.Value, locks[idx]) {
+			conflicted++
+			continue
+		}
+		b, err := ch.codec.Encode(ci)
+		if err != nil {
+			ch.logf(ctx, "dsmiddleware/aememcache.CompareAndSwapMulti: encode error key=%s err=%s", ci.Key.String(), err.Error())
+			continue
+		}
+		item.Value = b
+		item.Expiration = ch.expiration(ci)
+		itemList = append(itemList, item)
+	}
+
+	swapped := len(itemList)
+	if len(itemList) != 0 {
+		err = memcache.CompareAndSwapMulti(ctx, itemList)
+		if merr, ok := err.(appengine.MultiError); ok {
+			for _, err := range merr {
+				if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+					// the other writer or reader wins, the cache isn't filled.
+					swapped--
+					conflicted++
+				} else if err != nil {
+					return merr
+				}
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+
+	ch.logf(ctx, "dsmiddleware/aememcache.CompareAndSwapMulti: swapped=%d conflicted=%d", swapped, conflicted)
+
+	return nil
+}
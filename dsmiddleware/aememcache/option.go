@@ -95,3 +95,66 @@ type withCacheKey struct {
 func (w *withCacheKey) Apply(o *cacheHandler) {
 	o.cacheKey = w.cacheKey
 }
+
+// WithStatsRecorder creates a ClientOption that reports cache hits and misses to the specified recorder.
+func WithStatsRecorder(r storagecache.StatsRecorder) CacheOption {
+	return &withStatsRecorder{r}
+}
+
+type withStatsRecorder struct{ r storagecache.StatsRecorder }
+
+func (w *withStatsRecorder) Apply(o *cacheHandler) {
+	o.stOpts.StatsRecorder = w.r
+}
+
+// WithNegativeExpireDuration creates a ClientOption that caches ErrNoSuchEntity as the tombstone,
+// and expires it at a specified time.
+func WithNegativeExpireDuration(d time.Duration) CacheOption {
+	return &withNegativeExpireDuration{d}
+}
+
+type withNegativeExpireDuration struct{ d time.Duration }
+
+func (w *withNegativeExpireDuration) Apply(o *cacheHandler) {
+	o.negativeExpireDuration = w.d
+	o.stOpts.NegativeCache = 0 < w.d
+}
+
+// WithCodec creates a ClientOption that serializes the cache by the specified codec.
+// The default is storagecache.NewGobCodec.
+func WithCodec(c storagecache.Codec) CacheOption {
+	return &withCodec{c}
+}
+
+type withCodec struct{ c storagecache.Codec }
+
+func (w *withCodec) Apply(o *cacheHandler) {
+	o.codec = w.c
+}
+
+// WithCoalescing creates a ClientOption that makes the concurrent cache misses of the same key share one fetch from Datastore.
+func WithCoalescing() CacheOption {
+	return &withCoalescing{}
+}
+
+type withCoalescing struct{}
+
+func (w *withCoalescing) Apply(o *cacheHandler) {
+	o.stOpts.Coalesce = true
+}
+
+// WithLockProtocol creates a ClientOption that locks the keys during the writes, and fills the cache by compare-and-swap.
+// The reader that read the entity before the write never fills the cache by it after the write.
+// The lock expires at a specified time, the default is 32 seconds if d is 0.
+func WithLockProtocol(d time.Duration) CacheOption {
+	return &withLockProtocol{d}
+}
+
+type withLockProtocol struct{ d time.Duration }
+
+func (w *withLockProtocol) Apply(o *cacheHandler) {
+	if 0 < w.d {
+		o.lockDuration = w.d
+	}
+	o.stOpts.LockProtocol = true
+}
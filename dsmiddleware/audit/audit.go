@@ -0,0 +1,424 @@
+package audit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.mercari.io/datastore"
+)
+
+var _ datastore.Middleware = &auditHandler{}
+
+// Op represents the type of the operation that changed the entity.
+type Op string
+
+const (
+	// OpPut represents the put operation.
+	OpPut Op = "put"
+	// OpDelete represents the delete operation.
+	OpDelete Op = "delete"
+)
+
+// Event represents who changed which properties of the entity and when.
+type Event struct {
+	Kind    string
+	Key     datastore.Key
+	Op      Op
+	Actor   string
+	Time    time.Time
+	Changes []*Change
+}
+
+// Sink receives audit events.
+type Sink interface {
+	Emit(ctx context.Context, events []*Event) error
+}
+
+// SinkFunc is an adapter to use the function as Sink.
+type SinkFunc func(ctx context.Context, events []*Event) error
+
+// Emit calls f(ctx, events).
+func (f SinkFunc) Emit(ctx context.Context, events []*Event) error {
+	return f(ctx, events)
+}
+
+type contextActor struct{}
+
+// WithActor returns the context that holds the actor of the changes.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, contextActor{}, actor)
+}
+
+// ActorFromContext returns the actor that WithActor set.
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(contextActor{}).(string)
+	return actor
+}
+
+type contextSkip struct{}
+
+// WithoutAudit returns the context that the operations with it are not audited.
+// Sink that writes into Datastore uses it to avoid auditing the audit entities themselves.
+func WithoutAudit(ctx context.Context) context.Context {
+	return context.WithValue(ctx, contextSkip{}, true)
+}
+
+type contextTx struct{}
+
+// txEvent is an audit event in the transaction, it is emitted in PostCommit.
+type txEvent struct {
+	Event      *Event
+	PendingKey datastore.PendingKey
+}
+
+// New audit middleware creates & returns.
+func New(sink Sink, opts ...Option) datastore.Middleware {
+	ah := &auditHandler{
+		sink:      sink,
+		actorFunc: ActorFromContext,
+		now:       time.Now,
+	}
+
+	for _, opt := range opts {
+		opt.Apply(ah)
+	}
+
+	if ah.logf == nil {
+		ah.logf = func(ctx context.Context, format string, args ...interface{}) {}
+	}
+
+	return ah
+}
+
+// A Option is an option for audit.
+type Option interface {
+	Apply(*auditHandler)
+}
+
+type auditHandler struct {
+	sink          Sink
+	actorFunc     func(ctx context.Context) string
+	filters       []func(key datastore.Key) bool
+	emitUnchanged bool
+	now           func() time.Time
+	logf          func(ctx context.Context, format string, args ...interface{})
+
+	m sync.Mutex
+}
+
+func (ah *auditHandler) target(ctx context.Context, key datastore.Key) bool {
+	if skip, _ := ctx.Value(contextSkip{}).(bool); skip {
+		return false
+	}
+	for _, f := range ah.filters {
+		if !f(key) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// targetIdxs returns indexes of the target keys.
+func (ah *auditHandler) targetIdxs(ctx context.Context, keys []datastore.Key) []int {
+	var idxs []int
+	for idx, key := range keys {
+		if ah.target(ctx, key) {
+			idxs = append(idxs, idx)
+		}
+	}
+
+	return idxs
+}
+
+// getBefore loads the current entities by get. Missing entity is represented as nil.
+func (ah *auditHandler) getBefore(keys []datastore.Key, idxs []int, get func(keys []datastore.Key, psList []datastore.PropertyList) error) ([]datastore.PropertyList, error) {
+	psList := make([]datastore.PropertyList, len(keys))
+
+	var getIdxs []int
+	var getKeys []datastore.Key
+	for _, idx := range idxs {
+		if keys[idx].Incomplete() {
+			continue
+		}
+		getIdxs = append(getIdxs, idx)
+		getKeys = append(getKeys, keys[idx])
+	}
+	if len(getKeys) == 0 {
+		return psList, nil
+	}
+
+	getPsList := make([]datastore.PropertyList, len(getKeys))
+	err := get(getKeys, getPsList)
+	merr, ok := err.(datastore.MultiError)
+	if ok {
+		for _, err := range merr {
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return nil, merr
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	for i, idx := range getIdxs {
+		if merr != nil && merr[i] != nil {
+			continue
+		}
+		psList[idx] = getPsList[i]
+	}
+
+	return psList, nil
+}
+
+func (ah *auditHandler) newEvent(ctx context.Context, key datastore.Key, op Op, before, after datastore.PropertyList) *Event {
+	changes := Diff(before, after)
+	if len(changes) == 0 && !ah.emitUnchanged {
+		return nil
+	}
+
+	return &Event{
+		Kind:    key.Kind(),
+		Key:     key,
+		Op:      op,
+		Actor:   ah.actorFunc(ctx),
+		Time:    ah.now(),
+		Changes: changes,
+	}
+}
+
+func (ah *auditHandler) emit(ctx context.Context, events []*Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	err := ah.sink.Emit(ctx, events)
+	if err != nil {
+		// the entities are already saved, the error can't be returned to the caller.
+		ah.logf(ctx, "dsmiddleware/audit: error on sink.Emit len=%d err=%s", len(events), err.Error())
+	}
+}
+
+func (ah *auditHandler) appendTxEvents(info *datastore.MiddlewareInfo, txEvents []*txEvent) {
+	if len(txEvents) == 0 {
+		return
+	}
+
+	ah.m.Lock()
+	defer ah.m.Unlock()
+
+	txEventMap, ok := info.Context.Value(contextTx{}).(map[datastore.Transaction][]*txEvent)
+	if !ok {
+		txEventMap = make(map[datastore.Transaction][]*txEvent)
+		info.Context = context.WithValue(info.Context, contextTx{}, txEventMap)
+	}
+	txEventMap[info.Transaction] = append(txEventMap[info.Transaction], txEvents...)
+}
+
+func (ah *auditHandler) AllocateIDs(info *datastore.MiddlewareInfo, keys []datastore.Key) ([]datastore.Key, error) {
+	return info.Next.AllocateIDs(info, keys)
+}
+
+func (ah *auditHandler) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.Key, error) {
+	next := info.Next
+	idxs := ah.targetIdxs(info.Context, keys)
+	if len(idxs) == 0 {
+		return next.PutMultiWithoutTx(info, keys, psList)
+	}
+
+	beforeList, err := ah.getBefore(keys, idxs, func(keys []datastore.Key, psList []datastore.PropertyList) error {
+		return next.GetMultiWithoutTx(info, keys, psList)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	retKeys, err := next.PutMultiWithoutTx(info, keys, psList)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]*Event, 0, len(idxs))
+	for _, idx := range idxs {
+		event := ah.newEvent(info.Context, retKeys[idx], OpPut, beforeList[idx], psList[idx])
+		if event != nil {
+			events = append(events, event)
+		}
+	}
+	ah.emit(info.Context, events)
+
+	return retKeys, nil
+}
+
+func (ah *auditHandler) PutMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.PendingKey, error) {
+	next := info.Next
+	idxs := ah.targetIdxs(info.Context, keys)
+	if len(idxs) == 0 {
+		return next.PutMultiWithTx(info, keys, psList)
+	}
+
+	beforeList, err := ah.getBefore(keys, idxs, func(keys []datastore.Key, psList []datastore.PropertyList) error {
+		return next.GetMultiWithTx(info, keys, psList)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pKeys, err := next.PutMultiWithTx(info, keys, psList)
+	if err != nil {
+		return nil, err
+	}
+
+	txEvents := make([]*txEvent, 0, len(idxs))
+	for _, idx := range idxs {
+		event := ah.newEvent(info.Context, keys[idx], OpPut, beforeList[idx], psList[idx])
+		if event == nil {
+			continue
+		}
+		te := &txEvent{Event: event}
+		if keys[idx].Incomplete() {
+			te.PendingKey = pKeys[idx]
+		}
+		txEvents = append(txEvents, te)
+	}
+	ah.appendTxEvents(info, txEvents)
+
+	return pKeys, nil
+}
+
+func (ah *auditHandler) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	return info.Next.GetMultiWithoutTx(info, keys, psList)
+}
+
+func (ah *auditHandler) GetMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	return info.Next.GetMultiWithTx(info, keys, psList)
+}
+
+func (ah *auditHandler) DeleteMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	next := info.Next
+	idxs := ah.targetIdxs(info.Context, keys)
+	if len(idxs) == 0 {
+		return next.DeleteMultiWithoutTx(info, keys)
+	}
+
+	beforeList, err := ah.getBefore(keys, idxs, func(keys []datastore.Key, psList []datastore.PropertyList) error {
+		return next.GetMultiWithoutTx(info, keys, psList)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = next.DeleteMultiWithoutTx(info, keys)
+	if err != nil {
+		return err
+	}
+
+	events := make([]*Event, 0, len(idxs))
+	for _, idx := range idxs {
+		if beforeList[idx] == nil {
+			// the entity doesn't exist
+			continue
+		}
+		event := ah.newEvent(info.Context, keys[idx], OpDelete, beforeList[idx], nil)
+		if event != nil {
+			events = append(events, event)
+		}
+	}
+	ah.emit(info.Context, events)
+
+	return nil
+}
+
+func (ah *auditHandler) DeleteMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	next := info.Next
+	idxs := ah.targetIdxs(info.Context, keys)
+	if len(idxs) == 0 {
+		return next.DeleteMultiWithTx(info, keys)
+	}
+
+	beforeList, err := ah.getBefore(keys, idxs, func(keys []datastore.Key, psList []datastore.PropertyList) error {
+		return next.GetMultiWithTx(info, keys, psList)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = next.DeleteMultiWithTx(info, keys)
+	if err != nil {
+		return err
+	}
+
+	txEvents := make([]*txEvent, 0, len(idxs))
+	for _, idx := range idxs {
+		if beforeList[idx] == nil {
+			// the entity doesn't exist
+			continue
+		}
+		event := ah.newEvent(info.Context, keys[idx], OpDelete, beforeList[idx], nil)
+		if event != nil {
+			txEvents = append(txEvents, &txEvent{Event: event})
+		}
+	}
+	ah.appendTxEvents(info, txEvents)
+
+	return nil
+}
+
+func (ah *auditHandler) PostCommit(info *datastore.MiddlewareInfo, tx datastore.Transaction, commit datastore.Commit) error {
+	ah.m.Lock()
+	txEventMap, ok := info.Context.Value(contextTx{}).(map[datastore.Transaction][]*txEvent)
+	var txEvents []*txEvent
+	if ok {
+		txEvents = txEventMap[tx]
+		delete(txEventMap, tx)
+	}
+	ah.m.Unlock()
+
+	if len(txEvents) == 0 {
+		// the transaction has no changes, or the middleware that drops Context of the transaction loses the events.
+		ah.logf(info.Context, "dsmiddleware/audit.PostCommit: no events are recorded in the transaction")
+		return info.Next.PostCommit(info, tx, commit)
+	}
+
+	events := make([]*Event, 0, len(txEvents))
+	for _, te := range txEvents {
+		if te.PendingKey != nil {
+			te.Event.Key = commit.Key(te.PendingKey)
+		}
+		events = append(events, te.Event)
+	}
+
+	// don't pass txCtx to appengine.APICall
+	// otherwise, `transaction context has expired` will be occur
+	ah.emit(info.Client.Context(), events)
+
+	return info.Next.PostCommit(info, tx, commit)
+}
+
+func (ah *auditHandler) PostRollback(info *datastore.MiddlewareInfo, tx datastore.Transaction) error {
+	ah.m.Lock()
+	txEventMap, ok := info.Context.Value(contextTx{}).(map[datastore.Transaction][]*txEvent)
+	if ok {
+		delete(txEventMap, tx)
+	}
+	ah.m.Unlock()
+
+	return info.Next.PostRollback(info, tx)
+}
+
+func (ah *auditHandler) Run(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) datastore.Iterator {
+	return info.Next.Run(info, q, qDump)
+}
+
+func (ah *auditHandler) GetAll(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, psList *[]datastore.PropertyList) ([]datastore.Key, error) {
+	return info.Next.GetAll(info, q, qDump, psList)
+}
+
+func (ah *auditHandler) Next(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, iter datastore.Iterator, ps *datastore.PropertyList) (datastore.Key, error) {
+	return info.Next.Next(info, q, qDump, iter, ps)
+}
+
+func (ah *auditHandler) Count(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) (int, error) {
+	return info.Next.Count(info, q, qDump)
+}
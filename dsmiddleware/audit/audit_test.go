@@ -0,0 +1,349 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/internal/testutils"
+)
+
+type Data struct {
+	Name string
+	Age  int
+	Tags []string
+}
+
+type captureSink struct {
+	events []*Event
+}
+
+func (s *captureSink) Emit(ctx context.Context, events []*Event) error {
+	s.events = append(s.events, events...)
+	return nil
+}
+
+func TestDiff(t *testing.T) {
+	now := time.Now()
+	before := datastore.PropertyList{
+		{Name: "A", Value: "foo"},
+		{Name: "B", Value: int64(1)},
+		{Name: "C", Value: now},
+		{Name: "D", Value: "a"},
+		{Name: "D", Value: "b"},
+	}
+	after := datastore.PropertyList{
+		{Name: "A", Value: "foo"},
+		{Name: "B", Value: int64(2)},
+		{Name: "C", Value: now.In(time.UTC)},
+		{Name: "D", Value: "a"},
+		{Name: "E", Value: true},
+	}
+
+	changes := Diff(before, after)
+	if len(changes) != 3 {
+		t.Fatalf("unexpected: %v", len(changes))
+	}
+	if v := changes[0]; v.Name != "B" || v.Before != int64(1) || v.After != int64(2) {
+		t.Errorf("unexpected: %+v", v)
+	}
+	if v := changes[1]; v.Name != "D" || v.After != "a" {
+		t.Errorf("unexpected: %+v", v)
+	}
+	if v, ok := changes[1].Before.([]interface{}); !ok || len(v) != 2 {
+		t.Errorf("unexpected: %+v", changes[1].Before)
+	}
+	if v := changes[2]; v.Name != "E" || v.Before != nil || v.After != true {
+		t.Errorf("unexpected: %+v", v)
+	}
+
+	if v := Diff(before, before); len(v) != 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := Diff(nil, after); len(v) != 5 {
+		t.Errorf("unexpected: %v", len(v))
+	}
+}
+
+func TestAudit_WithoutTx(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	sink := &captureSink{}
+	client.AppendMiddleware(New(sink, WithIncludeKinds("Data")))
+	client.AppendMiddleware(ms)
+
+	ctx = WithActor(ctx, "alice")
+
+	key, err := client.Put(ctx, client.IncompleteKey("Data", nil), &Data{Name: "foo", Age: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.events) != 1 {
+		t.Fatalf("unexpected: %v", len(sink.events))
+	}
+	if v := sink.events[0]; !v.Key.Equal(key) || v.Op != OpPut || v.Actor != "alice" || len(v.Changes) != 2 || v.Time.IsZero() {
+		t.Errorf("unexpected: %+v", v)
+	}
+	// Put by the incomplete key doesn't get the entity.
+	if v := ms.Calls("GetMultiWithoutTx"); v != 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	sink.events = nil
+	_, err = client.Put(ctx, key, &Data{Name: "foo", Age: 11})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.events) != 1 {
+		t.Fatalf("unexpected: %v", len(sink.events))
+	}
+	if v := sink.events[0].Changes; len(v) != 1 || v[0].Name != "Age" || v[0].Before != int64(10) || v[0].After != int64(11) {
+		t.Errorf("unexpected: %+v", v)
+	}
+
+	// no changes, no events.
+	sink.events = nil
+	_, err = client.Put(ctx, key, &Data{Name: "foo", Age: 11})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.events) != 0 {
+		t.Errorf("unexpected: %v", len(sink.events))
+	}
+
+	// other kind is not audited.
+	_, err = client.Put(ctx, client.NameKey("Other", "a", nil), &Data{Name: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.events) != 0 {
+		t.Errorf("unexpected: %v", len(sink.events))
+	}
+
+	err = client.DeleteMulti(ctx, []datastore.Key{key, client.NameKey("Data", "missing", nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.events) != 1 {
+		t.Fatalf("unexpected: %v", len(sink.events))
+	}
+	if v := sink.events[0]; !v.Key.Equal(key) || v.Op != OpDelete || len(v.Changes) != 2 || v.Changes[0].After != nil {
+		t.Errorf("unexpected: %+v", v)
+	}
+}
+
+func TestAudit_SinkError(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	var logs int
+	logf := func(ctx context.Context, format string, args ...interface{}) {
+		t.Logf(format, args...)
+		logs++
+	}
+	sink := SinkFunc(func(ctx context.Context, events []*Event) error {
+		return errors.New("error")
+	})
+	client.AppendMiddleware(New(sink, WithLogger(logf)))
+	client.AppendMiddleware(ms)
+
+	_, err := client.Put(ctx, client.NameKey("Data", "a", nil), &Data{Name: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logs != 1 {
+		t.Errorf("unexpected: %v", logs)
+	}
+}
+
+func TestAudit_EntitySink(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	client.AppendMiddleware(New(NewEntitySink(client), WithActorFunc(func(ctx context.Context) string {
+		return "system"
+	})))
+	client.AppendMiddleware(ms)
+
+	key := client.NameKey("Data", "a", nil)
+	_, err := client.Put(ctx, key, &Data{Name: "foo", Tags: []string{"a", "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var psList []datastore.PropertyList
+	_, err = client.GetAll(ctx, client.NewQuery(defaultEntityKind), &psList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the audit entity itself is not audited.
+	if len(psList) != 1 {
+		t.Fatalf("unexpected: %v", len(psList))
+	}
+
+	m := propertyMap(psList[0])
+	if v := m["Kind"]; v != "Data" {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v, ok := m["EntityKey"].(datastore.Key); !ok || !v.Equal(key) {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := m["Actor"]; v != "system" {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v, ok := m["ChangedProperties"].([]interface{}); !ok || len(v) != 3 {
+		t.Errorf("unexpected: %v", m["ChangedProperties"])
+	}
+	if v := m["Changes"]; v != `[{"name":"Age","after":0},{"name":"Name","after":"foo"},{"name":"Tags","after":["a","b"]}]` {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestAudit_Transaction(t *testing.T) {
+	ctx, client, cleanUp := testutils.SetupCloudDatastore(t)
+	defer cleanUp()
+
+	sink := &captureSink{}
+	mw := New(sink, WithIncludeKinds("Data"))
+	client.AppendMiddleware(mw)
+	defer func() {
+		client.RemoveMiddleware(mw)
+	}()
+
+	ctx = WithActor(ctx, "alice")
+
+	key := client.NameKey("Data", "a", nil)
+	_, err := client.Put(ctx, key, &Data{Name: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.events = nil
+
+	var pKey datastore.PendingKey
+	commit, err := client.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		_, err := tx.Put(key, &Data{Name: "bar"})
+		if err != nil {
+			return err
+		}
+		pKey, err = tx.Put(client.IncompleteKey("Data", nil), &Data{Name: "baz"})
+		if err != nil {
+			return err
+		}
+
+		// emitted after commit.
+		if len(sink.events) != 0 {
+			t.Errorf("unexpected: %v", len(sink.events))
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.events) != 2 {
+		t.Fatalf("unexpected: %v", len(sink.events))
+	}
+	if v := sink.events[0]; v.Actor != "alice" || len(v.Changes) != 1 || v.Changes[0].Before != "foo" || v.Changes[0].After != "bar" {
+		t.Errorf("unexpected: %+v", v)
+	}
+	if v := sink.events[1]; !v.Key.Equal(commit.Key(pKey)) {
+		t.Errorf("unexpected: %+v", v)
+	}
+
+	sink.events = nil
+	errRollback := errors.New("rollback")
+	_, err = client.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		err := tx.Delete(key)
+		if err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatalf("unexpected: %v", err)
+	}
+	if len(sink.events) != 0 {
+		t.Errorf("unexpected: %v", len(sink.events))
+	}
+}
+
+func TestAudit_TransactionOnMemory(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	var logs []string
+	logf := func(ctx context.Context, format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	sink := &captureSink{}
+	mw := New(sink, WithIncludeKinds("Data"), WithLogger(logf))
+
+	key := client.NameKey("Data", "a", nil)
+	_, err := ms.PutMultiWithoutTx(&datastore.MiddlewareInfo{Context: ctx, Client: client}, []datastore.Key{key}, []datastore.PropertyList{{{Name: "Name", Value: "foo"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := ms.NewTransaction(WithActor(ctx, "alice"), client, mw, ms)
+	pKeys, err := tx.PutMultiWithTx(
+		[]datastore.Key{key, client.IncompleteKey("Data", nil)},
+		[]datastore.PropertyList{{{Name: "Name", Value: "bar"}}, {{Name: "Name", Value: "baz"}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the events are emitted by the commit.
+	if len(sink.events) != 0 {
+		t.Fatalf("unexpected: %v", len(sink.events))
+	}
+	commit, err := tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.events) != 2 {
+		t.Fatalf("unexpected: %v", len(sink.events))
+	}
+	if v := sink.events[0]; !v.Key.Equal(key) || v.Op != OpPut || v.Actor != "alice" || len(v.Changes) != 1 || v.Changes[0].Before != "foo" {
+		t.Errorf("unexpected: %+v", v)
+	}
+	if v := sink.events[1]; !v.Key.Equal(commit.Key(pKeys[1])) || v.Key.Incomplete() {
+		t.Errorf("unexpected: %+v", v)
+	}
+	if len(logs) != 0 {
+		t.Errorf("unexpected: %v", logs)
+	}
+
+	// the rolled back changes aren't emitted.
+	sink.events = nil
+	tx = ms.NewTransaction(ctx, client, mw, ms)
+	err = tx.DeleteMultiWithTx([]datastore.Key{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.events) != 0 {
+		t.Errorf("unexpected: %v", len(sink.events))
+	}
+
+	// the commit without the events is logged.
+	tx = ms.NewTransaction(ctx, client, mw, ms)
+	_, err = tx.PutMultiWithTx([]datastore.Key{client.NameKey("Other", "a", nil)}, []datastore.PropertyList{{{Name: "Name", Value: "foo"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.events) != 0 {
+		t.Errorf("unexpected: %v", len(sink.events))
+	}
+	if len(logs) != 1 {
+		t.Errorf("unexpected: %v", logs)
+	}
+}
@@ -0,0 +1,109 @@
+package audit
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"go.mercari.io/datastore"
+)
+
+// Change represents the change of a property.
+// Before is nil when the property is added, After is nil when the property is removed.
+type Change struct {
+	Name   string
+	Before interface{}
+	After  interface{}
+}
+
+// propertyMap groups properties by name.
+// The properties that have the same name are represented as []interface{}, like the flatten struct slice.
+func propertyMap(ps datastore.PropertyList) map[string]interface{} {
+	m := make(map[string]interface{}, len(ps))
+	for _, p := range ps {
+		v, ok := m[p.Name]
+		if !ok {
+			m[p.Name] = p.Value
+			continue
+		}
+		if list, ok := v.([]interface{}); ok {
+			m[p.Name] = append(list, p.Value)
+		} else {
+			m[p.Name] = []interface{}{v, p.Value}
+		}
+	}
+
+	return m
+}
+
+// Diff returns property level changes between before and after in order of the property name.
+func Diff(before, after datastore.PropertyList) []*Change {
+	bm := propertyMap(before)
+	am := propertyMap(after)
+
+	names := make([]string, 0, len(bm)+len(am))
+	for name := range bm {
+		names = append(names, name)
+	}
+	for name := range am {
+		if _, ok := bm[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var changes []*Change
+	for _, name := range names {
+		bv, bok := bm[name]
+		av, aok := am[name]
+		if bok && aok && valueEqual(bv, av) {
+			continue
+		}
+		changes = append(changes, &Change{Name: name, Before: bv, After: av})
+	}
+
+	return changes
+}
+
+func valueEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case nil:
+		return b == nil
+	case int64, bool, string, float64, datastore.GeoPoint:
+		return a == b
+	case time.Time:
+		bt, ok := b.(time.Time)
+		return ok && a.Equal(bt)
+	case []byte:
+		bb, ok := b.([]byte)
+		return ok && bytes.Equal(a, bb)
+	case datastore.Key:
+		bk, ok := b.(datastore.Key)
+		return ok && a.Equal(bk)
+	case *datastore.Entity:
+		be, ok := b.(*datastore.Entity)
+		if !ok || (a == nil) != (be == nil) {
+			return false
+		}
+		if a == nil {
+			return true
+		}
+		if (a.Key == nil) != (be.Key == nil) || (a.Key != nil && !a.Key.Equal(be.Key)) {
+			return false
+		}
+		return len(Diff(a.Properties, be.Properties)) == 0
+	case []interface{}:
+		bl, ok := b.([]interface{})
+		if !ok || len(a) != len(bl) {
+			return false
+		}
+		for idx := range a {
+			if !valueEqual(a[idx], bl[idx]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return false
+}
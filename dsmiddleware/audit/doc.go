@@ -0,0 +1,21 @@
+/*
+Package audit emits audit events that describe who changed which properties of the entities.
+
+Before Put and Delete of the target Kind, this middleware gets the current entities
+(in the same transaction if it is present), and computes the property level diff against the new entities.
+The events are passed to Sink after the operation succeeds, or after the commit in the transaction.
+The events in the rolled back transaction are discarded.
+The events in the transaction are kept in Context of the transaction until the commit,
+and the commit that has no events is logged by WithLogger to find the lost events.
+The actor of the change is taken from the context by ActorFromContext, or the function specified by WithActorFunc.
+
+	client.AppendMiddleware(audit.New(audit.NewEntitySink(client), audit.WithIncludeKinds("User")))
+	...
+	ctx = audit.WithActor(ctx, "admin@example.com")
+	_, err = client.Put(ctx, key, user)
+
+NewEntitySink returns the Sink that saves the events as "AuditLog" entities.
+The error of Sink is logged and not returned, because the entities are already saved.
+Put by the incomplete key costs no additional Get.
+*/
+package audit // import "go.mercari.io/datastore/dsmiddleware/audit"
@@ -0,0 +1,93 @@
+package audit
+
+import (
+	"context"
+
+	"go.mercari.io/datastore"
+)
+
+// WithIncludeKinds creates a Option that selects the Kind specified as the target.
+func WithIncludeKinds(kinds ...string) Option {
+	return &withIncludeKinds{kinds}
+}
+
+type withIncludeKinds struct{ kinds []string }
+
+func (w *withIncludeKinds) Apply(o *auditHandler) {
+	o.filters = append(o.filters, func(key datastore.Key) bool {
+		for _, incKind := range w.kinds {
+			if key.Kind() == incKind {
+				return true
+			}
+		}
+
+		return false
+	})
+}
+
+// WithExcludeKinds creates a Option that selects the Kind unspecified as the target.
+func WithExcludeKinds(kinds ...string) Option {
+	return &withExcludeKinds{kinds}
+}
+
+type withExcludeKinds struct{ kinds []string }
+
+func (w *withExcludeKinds) Apply(o *auditHandler) {
+	o.filters = append(o.filters, func(key datastore.Key) bool {
+		for _, excKind := range w.kinds {
+			if key.Kind() == excKind {
+				return false
+			}
+		}
+
+		return true
+	})
+}
+
+// WithActorFunc specifies the function that takes the actor from the context. default is ActorFromContext.
+func WithActorFunc(f func(ctx context.Context) string) Option {
+	return &withActorFunc{f}
+}
+
+type withActorFunc struct {
+	f func(ctx context.Context) string
+}
+
+func (w *withActorFunc) Apply(o *auditHandler) {
+	o.actorFunc = w.f
+}
+
+// WithUnchanged creates a Option that emits the event even if no property is changed by Put.
+func WithUnchanged() Option {
+	return &withUnchanged{}
+}
+
+type withUnchanged struct{}
+
+func (w *withUnchanged) Apply(o *auditHandler) {
+	o.emitUnchanged = true
+}
+
+// WithLogger creates a Option that uses the specified logger.
+func WithLogger(logf func(ctx context.Context, format string, args ...interface{})) Option {
+	return &withLogger{logf}
+}
+
+type withLogger struct {
+	logf func(ctx context.Context, format string, args ...interface{})
+}
+
+func (w *withLogger) Apply(o *auditHandler) {
+	o.logf = w.logf
+}
+
+// WithEntityKind specifies the Kind of audit entities. default is "AuditLog".
+func WithEntityKind(kind string) EntitySinkOption {
+	return &withEntityKind{kind}
+}
+
+type withEntityKind struct{ kind string }
+
+func (w *withEntityKind) Apply(o *EntitySink) {
+	o.kind = w.kind
+}
@@ -0,0 +1,112 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+
+	"go.mercari.io/datastore"
+)
+
+const defaultEntityKind = "AuditLog"
+
+var _ Sink = &EntitySink{}
+
+// NewEntitySink returns the Sink that saves the events as entities.
+// Each event is saved as one entity, the changes are saved as the JSON string.
+func NewEntitySink(client datastore.Client, opts ...EntitySinkOption) *EntitySink {
+	s := &EntitySink{
+		client: client,
+		kind:   defaultEntityKind,
+	}
+
+	for _, opt := range opts {
+		opt.Apply(s)
+	}
+
+	return s
+}
+
+// A EntitySinkOption is an option for EntitySink.
+type EntitySinkOption interface {
+	Apply(*EntitySink)
+}
+
+// EntitySink saves the events as entities of the Kind specified by WithEntityKind.
+type EntitySink struct {
+	client datastore.Client
+	kind   string
+}
+
+type jsonChange struct {
+	Name   string      `json:"name"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// Emit saves the events.
+func (s *EntitySink) Emit(ctx context.Context, events []*Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	keys := make([]datastore.Key, 0, len(events))
+	psList := make([]datastore.PropertyList, 0, len(events))
+	for _, event := range events {
+		names := make([]interface{}, 0, len(event.Changes))
+		changes := make([]*jsonChange, 0, len(event.Changes))
+		for _, change := range event.Changes {
+			names = append(names, change.Name)
+			changes = append(changes, &jsonChange{
+				Name:   change.Name,
+				Before: jsonValue(change.Before),
+				After:  jsonValue(change.After),
+			})
+		}
+		b, err := json.Marshal(changes)
+		if err != nil {
+			return err
+		}
+
+		keys = append(keys, s.client.IncompleteKey(s.kind, nil))
+		psList = append(psList, datastore.PropertyList{
+			{Name: "Kind", Value: event.Kind},
+			{Name: "EntityKey", Value: event.Key},
+			{Name: "Op", Value: string(event.Op)},
+			{Name: "Actor", Value: event.Actor},
+			{Name: "Time", Value: event.Time},
+			{Name: "ChangedProperties", Value: names},
+			{Name: "Changes", Value: string(b), NoIndex: true},
+		})
+	}
+
+	_, err := s.client.PutMulti(WithoutAudit(ctx), keys, psList)
+	return err
+}
+
+// jsonValue converts the property value to the value that encoding/json can marshal.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case datastore.Key:
+		if v == nil {
+			return nil
+		}
+		return v.Encode()
+	case *datastore.Entity:
+		if v == nil {
+			return nil
+		}
+		m := make(map[string]interface{}, len(v.Properties))
+		for name, pv := range propertyMap(v.Properties) {
+			m[name] = jsonValue(pv)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, 0, len(v))
+		for _, lv := range v {
+			list = append(list, jsonValue(lv))
+		}
+		return list
+	}
+
+	return v
+}
@@ -0,0 +1,233 @@
+package chain
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"go.mercari.io/datastore"
+)
+
+var _ datastore.Middleware = &Chain{}
+var _ datastore.Middleware = &link{}
+
+// Chain is the middleware that applies the middlewares First-In First-Apply, as Client.AppendMiddleware does.
+// The last middleware passes the calls to the middleware next to the chain.
+type Chain struct {
+	mws []datastore.Middleware
+}
+
+// New chain middleware creates & returns.
+func New(mws ...datastore.Middleware) *Chain {
+	return &Chain{mws: append([]datastore.Middleware(nil), mws...)}
+}
+
+// Append returns the new chain that has the middlewares after the middlewares of c.
+func (c *Chain) Append(mws ...datastore.Middleware) *Chain {
+	list := make([]datastore.Middleware, 0, len(c.mws)+len(mws))
+	list = append(list, c.mws...)
+	list = append(list, mws...)
+	return &Chain{mws: list}
+}
+
+// Middlewares returns the middlewares of the chain in the applied order.
+func (c *Chain) Middlewares() []datastore.Middleware {
+	return append([]datastore.Middleware(nil), c.mws...)
+}
+
+// String describes the chain, a middleware per line.
+// The nested chains and the conditions of When are indented.
+func (c *Chain) String() string {
+	buf := &bytes.Buffer{}
+	describe(buf, 0, c)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+func describe(buf *bytes.Buffer, depth int, mw datastore.Middleware) {
+	indent := strings.Repeat("  ", depth)
+	switch mw := mw.(type) {
+	case *Chain:
+		fmt.Fprintf(buf, "%sChain\n", indent)
+		for _, child := range mw.mws {
+			describe(buf, depth+1, child)
+		}
+	case *Conditional:
+		fmt.Fprintf(buf, "%sWhen %s\n", indent, mw.p.String())
+		describe(buf, depth+1, mw.mw)
+	default:
+		fmt.Fprintf(buf, "%s%T\n", indent, mw)
+	}
+}
+
+// start returns the link to the first middleware, it passes the calls to next at last.
+func (c *Chain) start(info *datastore.MiddlewareInfo) *link {
+	return &link{mws: c.mws, next: info.Next}
+}
+
+func (c *Chain) AllocateIDs(info *datastore.MiddlewareInfo, keys []datastore.Key) ([]datastore.Key, error) {
+	return c.start(info).AllocateIDs(info, keys)
+}
+
+func (c *Chain) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.Key, error) {
+	return c.start(info).PutMultiWithoutTx(info, keys, psList)
+}
+
+func (c *Chain) PutMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.PendingKey, error) {
+	return c.start(info).PutMultiWithTx(info, keys, psList)
+}
+
+func (c *Chain) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	return c.start(info).GetMultiWithoutTx(info, keys, psList)
+}
+
+func (c *Chain) GetMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	return c.start(info).GetMultiWithTx(info, keys, psList)
+}
+
+func (c *Chain) DeleteMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	return c.start(info).DeleteMultiWithoutTx(info, keys)
+}
+
+func (c *Chain) DeleteMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	return c.start(info).DeleteMultiWithTx(info, keys)
+}
+
+func (c *Chain) PostCommit(info *datastore.MiddlewareInfo, tx datastore.Transaction, commit datastore.Commit) error {
+	return c.start(info).PostCommit(info, tx, commit)
+}
+
+func (c *Chain) PostRollback(info *datastore.MiddlewareInfo, tx datastore.Transaction) error {
+	return c.start(info).PostRollback(info, tx)
+}
+
+func (c *Chain) Run(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) datastore.Iterator {
+	return c.start(info).Run(info, q, qDump)
+}
+
+func (c *Chain) GetAll(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, psList *[]datastore.PropertyList) ([]datastore.Key, error) {
+	return c.start(info).GetAll(info, q, qDump, psList)
+}
+
+func (c *Chain) Next(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, iter datastore.Iterator, ps *datastore.PropertyList) (datastore.Key, error) {
+	return c.start(info).Next(info, q, qDump, iter, ps)
+}
+
+func (c *Chain) Count(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) (int, error) {
+	return c.start(info).Count(info, q, qDump)
+}
+
+// link is info.Next of the middleware in the chain, it calls the rest of the middlewares.
+type link struct {
+	mws  []datastore.Middleware
+	next datastore.Middleware
+}
+
+// hop returns the middleware to call and the copy of info, Next of the copy is the rest of the chain.
+// info.Next of the caller isn't changed, so the caller can call it again.
+func (l *link) hop(info *datastore.MiddlewareInfo) (datastore.Middleware, *datastore.MiddlewareInfo) {
+	hopInfo := *info
+	if len(l.mws) == 0 {
+		hopInfo.Next = l.next
+		return l.next, &hopInfo
+	}
+
+	hopInfo.Next = &link{mws: l.mws[1:], next: l.next}
+	return l.mws[0], &hopInfo
+}
+
+// back writes the Context set by the middlewares back to info.
+// In the transaction, MiddlewareInfo is shared until PostCommit or PostRollback, and the values in Context must reach them.
+func back(info, hopInfo *datastore.MiddlewareInfo) {
+	info.Context = hopInfo.Context
+}
+
+func (l *link) AllocateIDs(info *datastore.MiddlewareInfo, keys []datastore.Key) ([]datastore.Key, error) {
+	mw, hopInfo := l.hop(info)
+	defer back(info, hopInfo)
+
+	return mw.AllocateIDs(hopInfo, keys)
+}
+
+func (l *link) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.Key, error) {
+	mw, hopInfo := l.hop(info)
+	defer back(info, hopInfo)
+
+	return mw.PutMultiWithoutTx(hopInfo, keys, psList)
+}
+
+func (l *link) PutMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.PendingKey, error) {
+	mw, hopInfo := l.hop(info)
+	defer back(info, hopInfo)
+
+	return mw.PutMultiWithTx(hopInfo, keys, psList)
+}
+
+func (l *link) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	mw, hopInfo := l.hop(info)
+	defer back(info, hopInfo)
+
+	return mw.GetMultiWithoutTx(hopInfo, keys, psList)
+}
+
+func (l *link) GetMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	mw, hopInfo := l.hop(info)
+	defer back(info, hopInfo)
+
+	return mw.GetMultiWithTx(hopInfo, keys, psList)
+}
+
+func (l *link) DeleteMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	mw, hopInfo := l.hop(info)
+	defer back(info, hopInfo)
+
+	return mw.DeleteMultiWithoutTx(hopInfo, keys)
+}
+
+func (l *link) DeleteMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	mw, hopInfo := l.hop(info)
+	defer back(info, hopInfo)
+
+	return mw.DeleteMultiWithTx(hopInfo, keys)
+}
+
+func (l *link) PostCommit(info *datastore.MiddlewareInfo, tx datastore.Transaction, commit datastore.Commit) error {
+	mw, hopInfo := l.hop(info)
+	defer back(info, hopInfo)
+
+	return mw.PostCommit(hopInfo, tx, commit)
+}
+
+func (l *link) PostRollback(info *datastore.MiddlewareInfo, tx datastore.Transaction) error {
+	mw, hopInfo := l.hop(info)
+	defer back(info, hopInfo)
+
+	return mw.PostRollback(hopInfo, tx)
+}
+
+func (l *link) Run(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) datastore.Iterator {
+	mw, hopInfo := l.hop(info)
+	defer back(info, hopInfo)
+
+	return mw.Run(hopInfo, q, qDump)
+}
+
+func (l *link) GetAll(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, psList *[]datastore.PropertyList) ([]datastore.Key, error) {
+	mw, hopInfo := l.hop(info)
+	defer back(info, hopInfo)
+
+	return mw.GetAll(hopInfo, q, qDump, psList)
+}
+
+func (l *link) Next(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, iter datastore.Iterator, ps *datastore.PropertyList) (datastore.Key, error) {
+	mw, hopInfo := l.hop(info)
+	defer back(info, hopInfo)
+
+	return mw.Next(hopInfo, q, qDump, iter, ps)
+}
+
+func (l *link) Count(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) (int, error) {
+	mw, hopInfo := l.hop(info)
+	defer back(info, hopInfo)
+
+	return mw.Count(hopInfo, q, qDump)
+}
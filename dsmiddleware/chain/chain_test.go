@@ -0,0 +1,306 @@
+package chain
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/MakeNowJust/heredoc/v2"
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/dsmiddleware/noop"
+	"go.mercari.io/datastore/internal/testutils"
+)
+
+// recorder records the operations and the keys it receives.
+type recorder struct {
+	datastore.Middleware
+	name string
+	logs *[]string
+}
+
+func newRecorder(name string, logs *[]string) *recorder {
+	return &recorder{Middleware: noop.New(), name: name, logs: logs}
+}
+
+func (r *recorder) log(op string, keys []datastore.Key) {
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		names = append(names, key.Kind())
+	}
+	*r.logs = append(*r.logs, fmt.Sprintf("%s.%s %s", r.name, op, strings.Join(names, ",")))
+}
+
+func (r *recorder) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.Key, error) {
+	r.log("PutMultiWithoutTx", keys)
+	return info.Next.PutMultiWithoutTx(info, keys, psList)
+}
+
+func (r *recorder) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	r.log("GetMultiWithoutTx", keys)
+	return info.Next.GetMultiWithoutTx(info, keys, psList)
+}
+
+func (r *recorder) GetAll(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, psList *[]datastore.PropertyList) ([]datastore.Key, error) {
+	*r.logs = append(*r.logs, fmt.Sprintf("%s.GetAll %s", r.name, qDump.Kind))
+	return info.Next.GetAll(info, q, qDump, psList)
+}
+
+// twice calls info.Next twice, as the retry does.
+type twice struct {
+	datastore.Middleware
+}
+
+func (m *twice) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	err := info.Next.GetMultiWithoutTx(info, keys, psList)
+	if err != nil {
+		return err
+	}
+	return info.Next.GetMultiWithoutTx(info, keys, psList)
+}
+
+type txContextKey struct{}
+
+// txValue sets the Context value in PutMultiWithTx, and records it in PostCommit.
+type txValue struct {
+	datastore.Middleware
+	value interface{}
+}
+
+func (m *txValue) PutMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.PendingKey, error) {
+	info.Context = context.WithValue(info.Context, txContextKey{}, "tx")
+	return info.Next.PutMultiWithTx(info, keys, psList)
+}
+
+func (m *txValue) PostCommit(info *datastore.MiddlewareInfo, tx datastore.Transaction, commit datastore.Commit) error {
+	m.value = info.Context.Value(txContextKey{})
+	return info.Next.PostCommit(info, tx, commit)
+}
+
+type Data struct {
+	Name string
+}
+
+func TestChain_Order(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	var logs []string
+	client.AppendMiddleware(New(
+		newRecorder("a", &logs),
+		New(newRecorder("b", &logs), newRecorder("c", &logs)),
+	))
+	client.AppendMiddleware(newRecorder("d", &logs))
+	client.AppendMiddleware(ms)
+
+	_, err := client.Put(ctx, client.NameKey("A", "a", nil), &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := heredoc.Doc(`
+		a.PutMultiWithoutTx A
+		b.PutMultiWithoutTx A
+		c.PutMultiWithoutTx A
+		d.PutMultiWithoutTx A
+	`)
+	if v := strings.Join(logs, "\n") + "\n"; v != expected {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := ms.Calls("PutMultiWithoutTx"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestChain_NextTwice(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	var logs []string
+	client.AppendMiddleware(New(&twice{Middleware: noop.New()}, newRecorder("a", &logs)))
+	client.AppendMiddleware(newRecorder("b", &logs))
+	client.AppendMiddleware(ms)
+
+	key := client.NameKey("A", "a", nil)
+	_, err := client.Put(ctx, key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs = nil
+
+	err = client.Get(ctx, key, &Data{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second call passes all middlewares after twice.
+	expected := heredoc.Doc(`
+		a.GetMultiWithoutTx A
+		b.GetMultiWithoutTx A
+		a.GetMultiWithoutTx A
+		b.GetMultiWithoutTx A
+	`)
+	if v := strings.Join(logs, "\n") + "\n"; v != expected {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := ms.Calls("GetMultiWithoutTx"); v != 2 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestChain_TransactionContext(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	mw := &txValue{Middleware: noop.New()}
+	tx := ms.NewTransaction(ctx, client, New(noop.New(), New(mw)), ms)
+
+	_, err := tx.PutMultiWithTx([]datastore.Key{client.NameKey("A", "a", nil)}, []datastore.PropertyList{{{Name: "Name", Value: "a"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the Context set in the chain reaches PostCommit.
+	if v := mw.value; v != "tx" {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestChain_WhenKinds(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	var logs []string
+	client.AppendMiddleware(New(
+		When(Kinds("A", "B"), newRecorder("ab", &logs)),
+		newRecorder("all", &logs),
+	))
+	client.AppendMiddleware(ms)
+
+	keys := []datastore.Key{
+		client.NameKey("A", "a", nil),
+		client.NameKey("C", "c", nil),
+		client.NameKey("B", "b", nil),
+	}
+	list := []*Data{{Name: "a"}, {Name: "c"}, {Name: "b"}}
+	retKeys, err := client.PutMulti(ctx, keys, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx, key := range retKeys {
+		if !key.Equal(keys[idx]) {
+			t.Errorf("unexpected: %v", key)
+		}
+	}
+
+	// the missing key is reported at its index.
+	keys = append(keys, client.NameKey("C", "missing", nil))
+	list = make([]*Data, len(keys))
+	err = client.GetMulti(ctx, keys, list)
+	mErr, ok := err.(datastore.MultiError)
+	if !ok {
+		t.Fatalf("unexpected: %v", err)
+	}
+	for idx, err := range mErr {
+		if idx == 3 && err != datastore.ErrNoSuchEntity {
+			t.Errorf("unexpected: %v", err)
+		} else if idx != 3 && err != nil {
+			t.Errorf("unexpected: %v", err)
+		}
+	}
+	if v := fmt.Sprintf("%s,%s,%s", list[0].Name, list[1].Name, list[2].Name); v != "a,c,b" {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	_, err = client.GetAll(ctx, client.NewQuery("C"), &[]*Data{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.GetAll(ctx, client.NewQuery("A"), &[]*Data{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := heredoc.Doc(`
+		ab.PutMultiWithoutTx A,B
+		all.PutMultiWithoutTx A,B
+		all.PutMultiWithoutTx C
+		ab.GetMultiWithoutTx A,B
+		all.GetMultiWithoutTx A,B
+		all.GetMultiWithoutTx C,C
+		all.GetAll C
+		ab.GetAll A
+		all.GetAll A
+	`)
+	if v := strings.Join(logs, "\n") + "\n"; v != expected {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := ms.Calls("PutMultiWithoutTx"); v != 2 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestChain_WhenPredicates(t *testing.T) {
+	type contextKey struct{}
+
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	var logs []string
+	client.AppendMiddleware(New(
+		When(And(Namespaces("x"), Not(Ops(OpGetMultiWithoutTx))), newRecorder("x", &logs)),
+		When(ContextValue(contextKey{}, "debug"), newRecorder("debug", &logs)),
+	))
+	client.AppendMiddleware(ms)
+
+	keyX := client.NameKey("A", "a", nil)
+	keyX.SetNamespace("x")
+	_, err := client.Put(ctx, keyX, &Data{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Put(ctx, client.NameKey("A", "a", nil), &Data{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Get(ctx, keyX, &Data{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Get(context.WithValue(ctx, contextKey{}, "debug"), keyX, &Data{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := heredoc.Doc(`
+		x.PutMultiWithoutTx A
+		debug.GetMultiWithoutTx A
+	`)
+	if v := strings.Join(logs, "\n") + "\n"; v != expected {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestChain_String(t *testing.T) {
+	var logs []string
+	c := New(
+		newRecorder("a", &logs),
+		When(Or(Kinds("A", "B"), Namespaces("x")), New(newRecorder("b", &logs), noop.New())),
+	).Append(When(Not(Ops(OpRun, OpNext)), noop.New()))
+
+	expected := heredoc.Doc(`
+		Chain
+		  *chain.recorder
+		  When Or(Kinds(A, B), Namespaces(x))
+		    Chain
+		      *chain.recorder
+		      *noop.noop
+		  When Not(Ops(Run, Next))
+		    *noop.noop
+	`)
+	if v := c.String() + "\n"; v != expected {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := len(c.Middlewares()); v != 3 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
@@ -0,0 +1,28 @@
+/*
+Package chain composes the middlewares into one middleware, and applies them conditionally.
+
+New makes the chain that applies the middlewares First-In First-Apply, the same as Client.AppendMiddleware.
+The chain is a middleware, so it can be appended to the client or nested in the other chain.
+Each middleware in the chain receives the copy of MiddlewareInfo, its Next can be called again, e.g. by the retry.
+The Context set by the middlewares is written back, so the values set in the transaction reach PostCommit.
+
+When applies the middleware only to the calls that Predicate matches, the other calls are passed to info.Next straight.
+Kinds, Namespaces, Ops and ContextValue are combined by And, Or and Not.
+
+	client.AppendMiddleware(chain.New(
+		chain.When(chain.Namespaces("x"), dslog.NewLogger("x: ", logf)),
+		chain.When(chain.Kinds("A", "B"), rediscache.NewWithPool(pool)),
+	))
+
+The key-based operations are evaluated for each Key, the batch of the mixed kinds is split and merged.
+PostCommit and PostRollback are always passed to the middleware.
+
+String of Chain describes the middlewares and the conditions for debugging.
+
+	Chain
+	  When Namespaces(x)
+	    *dslog.logger
+	  When Kinds(A, B)
+	    *rediscache.cacheHandler
+*/
+package chain // import "go.mercari.io/datastore/dsmiddleware/chain"
@@ -0,0 +1,170 @@
+package chain
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mercari.io/datastore"
+)
+
+// Op is the operation of Middleware, the name of the method.
+type Op string
+
+// The operations matched by Ops.
+const (
+	OpAllocateIDs          Op = "AllocateIDs"
+	OpPutMultiWithoutTx    Op = "PutMultiWithoutTx"
+	OpPutMultiWithTx       Op = "PutMultiWithTx"
+	OpGetMultiWithoutTx    Op = "GetMultiWithoutTx"
+	OpGetMultiWithTx       Op = "GetMultiWithTx"
+	OpDeleteMultiWithoutTx Op = "DeleteMultiWithoutTx"
+	OpDeleteMultiWithTx    Op = "DeleteMultiWithTx"
+	OpRun                  Op = "Run"
+	OpGetAll               Op = "GetAll"
+	OpNext                 Op = "Next"
+	OpCount                Op = "Count"
+)
+
+// Target is the call evaluated by Predicate.
+// The key-based operations are evaluated for each Key, and Query is nil.
+// The query operations are evaluated once, and Key is nil.
+type Target struct {
+	Op          Op
+	Key         datastore.Key
+	Query       *datastore.QueryDump
+	Transaction datastore.Transaction
+}
+
+// kind returns the kind of the key or the query.
+func (t *Target) kind() string {
+	if t.Key != nil {
+		return t.Key.Kind()
+	} else if t.Query != nil {
+		return t.Query.Kind
+	}
+	return ""
+}
+
+// namespace returns the namespace of the key or the query.
+func (t *Target) namespace() string {
+	if t.Key != nil {
+		return t.Key.Namespace()
+	} else if t.Query != nil {
+		return t.Query.Namespace
+	}
+	return ""
+}
+
+// Predicate decides whether the middleware is applied to the target.
+// String describes the condition for the introspection.
+type Predicate interface {
+	Match(ctx context.Context, t *Target) bool
+	String() string
+}
+
+// PredicateFunc creates a Predicate that is named by name.
+func PredicateFunc(name string, f func(ctx context.Context, t *Target) bool) Predicate {
+	return &predicateFunc{name: name, f: f}
+}
+
+type predicateFunc struct {
+	name string
+	f    func(ctx context.Context, t *Target) bool
+}
+
+func (p *predicateFunc) Match(ctx context.Context, t *Target) bool {
+	return p.f(ctx, t)
+}
+
+func (p *predicateFunc) String() string {
+	return p.name
+}
+
+// Kinds creates a Predicate that matches the keys or the queries of the specified kinds.
+func Kinds(kinds ...string) Predicate {
+	return PredicateFunc(fmt.Sprintf("Kinds(%s)", strings.Join(kinds, ", ")), func(ctx context.Context, t *Target) bool {
+		kind := t.kind()
+		for _, k := range kinds {
+			if kind == k {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Namespaces creates a Predicate that matches the keys or the queries in the specified namespaces.
+func Namespaces(namespaces ...string) Predicate {
+	return PredicateFunc(fmt.Sprintf("Namespaces(%s)", strings.Join(namespaces, ", ")), func(ctx context.Context, t *Target) bool {
+		namespace := t.namespace()
+		for _, ns := range namespaces {
+			if namespace == ns {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Ops creates a Predicate that matches the specified operations.
+func Ops(ops ...Op) Predicate {
+	names := make([]string, 0, len(ops))
+	for _, op := range ops {
+		names = append(names, string(op))
+	}
+	return PredicateFunc(fmt.Sprintf("Ops(%s)", strings.Join(names, ", ")), func(ctx context.Context, t *Target) bool {
+		for _, op := range ops {
+			if t.Op == op {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// ContextValue creates a Predicate that matches the call whose context has the specified value by key.
+func ContextValue(key, value interface{}) Predicate {
+	return PredicateFunc(fmt.Sprintf("ContextValue(%v=%v)", key, value), func(ctx context.Context, t *Target) bool {
+		return ctx.Value(key) == value
+	})
+}
+
+// And creates a Predicate that matches if all predicates match.
+func And(ps ...Predicate) Predicate {
+	return PredicateFunc(joinPredicates("And", ps), func(ctx context.Context, t *Target) bool {
+		for _, p := range ps {
+			if !p.Match(ctx, t) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Or creates a Predicate that matches if any predicate matches.
+func Or(ps ...Predicate) Predicate {
+	return PredicateFunc(joinPredicates("Or", ps), func(ctx context.Context, t *Target) bool {
+		for _, p := range ps {
+			if p.Match(ctx, t) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Not creates a Predicate that matches if p doesn't match.
+func Not(p Predicate) Predicate {
+	return PredicateFunc(fmt.Sprintf("Not(%s)", p.String()), func(ctx context.Context, t *Target) bool {
+		return !p.Match(ctx, t)
+	})
+}
+
+func joinPredicates(name string, ps []Predicate) string {
+	names := make([]string, 0, len(ps))
+	for _, p := range ps {
+		names = append(names, p.String())
+	}
+	return fmt.Sprintf("%s(%s)", name, strings.Join(names, ", "))
+}
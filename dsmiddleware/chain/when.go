@@ -0,0 +1,324 @@
+package chain
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	"go.mercari.io/datastore"
+)
+
+var _ datastore.Middleware = &Conditional{}
+
+// When creates & returns the middleware that applies mw only to the calls that p matches.
+// The other calls are passed to info.Next straight.
+//
+// The key-based operations are evaluated for each Key.
+// If p matches a part of the keys, mw receives the matched keys and info.Next receives the others,
+// and their results are merged in the order of the keys.
+// PostCommit and PostRollback are always passed to mw, it may have seen the operations in the transaction.
+func When(p Predicate, mw datastore.Middleware) *Conditional {
+	return &Conditional{p: p, mw: mw}
+}
+
+// Conditional is the middleware created by When.
+type Conditional struct {
+	p  Predicate
+	mw datastore.Middleware
+}
+
+// Predicate returns the condition.
+func (c *Conditional) Predicate() Predicate {
+	return c.p
+}
+
+// Middleware returns the middleware applied conditionally.
+func (c *Conditional) Middleware() datastore.Middleware {
+	return c.mw
+}
+
+// String describes the condition and the middleware.
+func (c *Conditional) String() string {
+	buf := &bytes.Buffer{}
+	describe(buf, 0, c)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// split returns the indexes of the keys that p matches and the others.
+func (c *Conditional) split(ctx context.Context, op Op, tx datastore.Transaction, keys []datastore.Key) ([]int, []int) {
+	var matched, unmatched []int
+	for idx, key := range keys {
+		if c.p.Match(ctx, &Target{Op: op, Key: key, Transaction: tx}) {
+			matched = append(matched, idx)
+		} else {
+			unmatched = append(unmatched, idx)
+		}
+	}
+
+	return matched, unmatched
+}
+
+func (c *Conditional) matchQuery(info *datastore.MiddlewareInfo, op Op, qDump *datastore.QueryDump) bool {
+	return c.p.Match(info.Context, &Target{Op: op, Query: qDump, Transaction: qDump.Transaction})
+}
+
+func subKeys(keys []datastore.Key, idxs []int) []datastore.Key {
+	sub := make([]datastore.Key, 0, len(idxs))
+	for _, idx := range idxs {
+		sub = append(sub, keys[idx])
+	}
+	return sub
+}
+
+func subPsList(psList []datastore.PropertyList, idxs []int) []datastore.PropertyList {
+	sub := make([]datastore.PropertyList, 0, len(idxs))
+	for _, idx := range idxs {
+		var ps datastore.PropertyList
+		if idx < len(psList) {
+			ps = psList[idx]
+		}
+		sub = append(sub, ps)
+	}
+	return sub
+}
+
+// mergeErrors merges the errors of the split calls into the error of all keys.
+// The error that isn't MultiError is returned as is.
+func mergeErrors(size int, idxsList [2][]int, errs [2]error) error {
+	var mErr datastore.MultiError
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		mErr2, ok := err.(datastore.MultiError)
+		if !ok {
+			return err
+		}
+		if mErr == nil {
+			mErr = make(datastore.MultiError, size)
+		}
+		for idx, err := range mErr2 {
+			mErr[idxsList[i][idx]] = err
+		}
+	}
+	if mErr == nil {
+		return nil
+	}
+
+	return mErr
+}
+
+func (c *Conditional) AllocateIDs(info *datastore.MiddlewareInfo, keys []datastore.Key) ([]datastore.Key, error) {
+	matched, unmatched := c.split(info.Context, OpAllocateIDs, nil, keys)
+	if len(unmatched) == 0 {
+		return c.mw.AllocateIDs(info, keys)
+	} else if len(matched) == 0 {
+		return info.Next.AllocateIDs(info, keys)
+	}
+
+	next := info.Next
+	idxsList := [2][]int{matched, unmatched}
+	retKeys := make([]datastore.Key, len(keys))
+	var errs [2]error
+	for i, idxs := range idxsList {
+		info.Next = next
+		var partialRetKeys []datastore.Key
+		if i == 0 {
+			partialRetKeys, errs[i] = c.mw.AllocateIDs(info, subKeys(keys, idxs))
+		} else {
+			partialRetKeys, errs[i] = next.AllocateIDs(info, subKeys(keys, idxs))
+		}
+		for idx, key := range partialRetKeys {
+			retKeys[idxs[idx]] = key
+		}
+	}
+	if err := mergeErrors(len(keys), idxsList, errs); err != nil {
+		return nil, err
+	}
+
+	return retKeys, nil
+}
+
+func (c *Conditional) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.Key, error) {
+	matched, unmatched := c.split(info.Context, OpPutMultiWithoutTx, nil, keys)
+	if len(unmatched) == 0 {
+		return c.mw.PutMultiWithoutTx(info, keys, psList)
+	} else if len(matched) == 0 {
+		return info.Next.PutMultiWithoutTx(info, keys, psList)
+	}
+
+	next := info.Next
+	idxsList := [2][]int{matched, unmatched}
+	retKeys := make([]datastore.Key, len(keys))
+	var errs [2]error
+	for i, idxs := range idxsList {
+		info.Next = next
+		var partialRetKeys []datastore.Key
+		if i == 0 {
+			partialRetKeys, errs[i] = c.mw.PutMultiWithoutTx(info, subKeys(keys, idxs), subPsList(psList, idxs))
+		} else {
+			partialRetKeys, errs[i] = next.PutMultiWithoutTx(info, subKeys(keys, idxs), subPsList(psList, idxs))
+		}
+		for idx, key := range partialRetKeys {
+			retKeys[idxs[idx]] = key
+		}
+	}
+	err := mergeErrors(len(keys), idxsList, errs)
+	if _, ok := err.(datastore.MultiError); err != nil && !ok {
+		return nil, err
+	}
+
+	return retKeys, err
+}
+
+func (c *Conditional) PutMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.PendingKey, error) {
+	matched, unmatched := c.split(info.Context, OpPutMultiWithTx, info.Transaction, keys)
+	if len(unmatched) == 0 {
+		return c.mw.PutMultiWithTx(info, keys, psList)
+	} else if len(matched) == 0 {
+		return info.Next.PutMultiWithTx(info, keys, psList)
+	}
+
+	next := info.Next
+	idxsList := [2][]int{matched, unmatched}
+	pKeys := make([]datastore.PendingKey, len(keys))
+	var errs [2]error
+	for i, idxs := range idxsList {
+		info.Next = next
+		var partialPKeys []datastore.PendingKey
+		if i == 0 {
+			partialPKeys, errs[i] = c.mw.PutMultiWithTx(info, subKeys(keys, idxs), subPsList(psList, idxs))
+		} else {
+			partialPKeys, errs[i] = next.PutMultiWithTx(info, subKeys(keys, idxs), subPsList(psList, idxs))
+		}
+		for idx, pKey := range partialPKeys {
+			pKeys[idxs[idx]] = pKey
+		}
+	}
+	err := mergeErrors(len(keys), idxsList, errs)
+	if _, ok := err.(datastore.MultiError); err != nil && !ok {
+		return nil, err
+	}
+
+	return pKeys, err
+}
+
+func (c *Conditional) getMulti(info *datastore.MiddlewareInfo, op Op, keys []datastore.Key, psList []datastore.PropertyList, get func(mw datastore.Middleware, keys []datastore.Key, psList []datastore.PropertyList) error) error {
+	var tx datastore.Transaction
+	if op == OpGetMultiWithTx {
+		tx = info.Transaction
+	}
+	matched, unmatched := c.split(info.Context, op, tx, keys)
+	if len(unmatched) == 0 {
+		return get(c.mw, keys, psList)
+	} else if len(matched) == 0 {
+		return get(info.Next, keys, psList)
+	}
+
+	next := info.Next
+	idxsList := [2][]int{matched, unmatched}
+	var errs [2]error
+	for i, idxs := range idxsList {
+		info.Next = next
+		mw := next
+		if i == 0 {
+			mw = c.mw
+		}
+		partialPsList := make([]datastore.PropertyList, len(idxs))
+		errs[i] = get(mw, subKeys(keys, idxs), partialPsList)
+		for idx, ps := range partialPsList {
+			if idxs[idx] < len(psList) {
+				psList[idxs[idx]] = ps
+			}
+		}
+	}
+
+	return mergeErrors(len(keys), idxsList, errs)
+}
+
+func (c *Conditional) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	return c.getMulti(info, OpGetMultiWithoutTx, keys, psList, func(mw datastore.Middleware, keys []datastore.Key, psList []datastore.PropertyList) error {
+		return mw.GetMultiWithoutTx(info, keys, psList)
+	})
+}
+
+func (c *Conditional) GetMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	return c.getMulti(info, OpGetMultiWithTx, keys, psList, func(mw datastore.Middleware, keys []datastore.Key, psList []datastore.PropertyList) error {
+		return mw.GetMultiWithTx(info, keys, psList)
+	})
+}
+
+func (c *Conditional) deleteMulti(info *datastore.MiddlewareInfo, op Op, keys []datastore.Key, del func(mw datastore.Middleware, keys []datastore.Key) error) error {
+	var tx datastore.Transaction
+	if op == OpDeleteMultiWithTx {
+		tx = info.Transaction
+	}
+	matched, unmatched := c.split(info.Context, op, tx, keys)
+	if len(unmatched) == 0 {
+		return del(c.mw, keys)
+	} else if len(matched) == 0 {
+		return del(info.Next, keys)
+	}
+
+	next := info.Next
+	idxsList := [2][]int{matched, unmatched}
+	var errs [2]error
+	for i, idxs := range idxsList {
+		info.Next = next
+		mw := next
+		if i == 0 {
+			mw = c.mw
+		}
+		errs[i] = del(mw, subKeys(keys, idxs))
+	}
+
+	return mergeErrors(len(keys), idxsList, errs)
+}
+
+func (c *Conditional) DeleteMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	return c.deleteMulti(info, OpDeleteMultiWithoutTx, keys, func(mw datastore.Middleware, keys []datastore.Key) error {
+		return mw.DeleteMultiWithoutTx(info, keys)
+	})
+}
+
+func (c *Conditional) DeleteMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	return c.deleteMulti(info, OpDeleteMultiWithTx, keys, func(mw datastore.Middleware, keys []datastore.Key) error {
+		return mw.DeleteMultiWithTx(info, keys)
+	})
+}
+
+func (c *Conditional) PostCommit(info *datastore.MiddlewareInfo, tx datastore.Transaction, commit datastore.Commit) error {
+	return c.mw.PostCommit(info, tx, commit)
+}
+
+func (c *Conditional) PostRollback(info *datastore.MiddlewareInfo, tx datastore.Transaction) error {
+	return c.mw.PostRollback(info, tx)
+}
+
+func (c *Conditional) Run(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) datastore.Iterator {
+	if !c.matchQuery(info, OpRun, qDump) {
+		return info.Next.Run(info, q, qDump)
+	}
+	return c.mw.Run(info, q, qDump)
+}
+
+func (c *Conditional) GetAll(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, psList *[]datastore.PropertyList) ([]datastore.Key, error) {
+	if !c.matchQuery(info, OpGetAll, qDump) {
+		return info.Next.GetAll(info, q, qDump, psList)
+	}
+	return c.mw.GetAll(info, q, qDump, psList)
+}
+
+func (c *Conditional) Next(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, iter datastore.Iterator, ps *datastore.PropertyList) (datastore.Key, error) {
+	if !c.matchQuery(info, OpNext, qDump) {
+		return info.Next.Next(info, q, qDump, iter, ps)
+	}
+	return c.mw.Next(info, q, qDump, iter, ps)
+}
+
+func (c *Conditional) Count(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) (int, error) {
+	if !c.matchQuery(info, OpCount, qDump) {
+		return info.Next.Count(info, q, qDump)
+	}
+	return c.mw.Count(info, q, qDump)
+}
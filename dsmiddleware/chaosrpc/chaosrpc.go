@@ -1,95 +1,381 @@
 package chaosrpc
 
 import (
+	"context"
 	"errors"
 	"math/rand"
+	"sync"
+	"time"
 
 	"go.mercari.io/datastore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // NOTE Please give me a pull request if You can make more chaos (within the specification).
 
 var _ datastore.Middleware = &chaosHandler{}
 
+// defaultMethods are the methods that raise errors with the default rate.
+var defaultMethods = map[string]bool{
+	"AllocateIDs":          true,
+	"PutMultiWithoutTx":    true,
+	"PutMultiWithTx":       true,
+	"GetMultiWithoutTx":    true,
+	"GetMultiWithTx":       true,
+	"DeleteMultiWithoutTx": true,
+	"DeleteMultiWithTx":    true,
+	"GetAll":               true,
+	"Count":                true,
+}
+
+// optionalMethods are the methods that raise errors only with WithMethodRate.
+var optionalMethods = map[string]bool{
+	"PostCommit": true,
+	"Next":       true,
+}
+
 // New ChaosRPC middleware returns.
-func New(s rand.Source) datastore.Middleware {
-	return &chaosHandler{
-		r: rand.New(s),
+// The results are deterministic for the given rand.Source, if the operations are called in the same order.
+func New(s rand.Source, opts ...Option) datastore.Middleware {
+	ch := &chaosHandler{
+		r:           rand.New(s),
+		rate:        0.2,
+		methodRates: make(map[string]float64),
+	}
+
+	for _, opt := range opts {
+		opt.Apply(ch)
+	}
+
+	return ch
+}
+
+// A Option is an option for chaosrpc.
+type Option interface {
+	Apply(*chaosHandler)
+}
+
+// Latency returns the duration of the injected latency.
+type Latency func(r *rand.Rand) time.Duration
+
+// UniformLatency returns the Latency that is distributed uniformly in [min, max).
+func UniformLatency(min, max time.Duration) Latency {
+	return func(r *rand.Rand) time.Duration {
+		if max <= min {
+			return min
+		}
+		return min + time.Duration(r.Int63n(int64(max-min)))
+	}
+}
+
+// ExponentialLatency returns the Latency that is distributed exponentially with the mean.
+// It makes the long tail.
+func ExponentialLatency(mean time.Duration) Latency {
+	return func(r *rand.Rand) time.Duration {
+		return time.Duration(r.ExpFloat64() * float64(mean))
+	}
+}
+
+// NormalLatency returns the Latency that is distributed normally, negative values become zero.
+func NormalLatency(mean, stddev time.Duration) Latency {
+	return func(r *rand.Rand) time.Duration {
+		d := time.Duration(r.NormFloat64()*float64(stddev)) + mean
+		if d < 0 {
+			return 0
+		}
+		return d
 	}
 }
 
 type chaosHandler struct {
+	m sync.Mutex
 	r *rand.Rand
+
+	rate         float64
+	methodRates  map[string]float64
+	codes        []codes.Code
+	latencyRate  float64
+	latency      Latency
+	partialRate  float64
+	afterRPCRate float64
+	kinds        map[string]bool
+}
+
+// fault is the chaos for a call.
+type fault struct {
+	latency time.Duration
+	err     error
+	// afterRPC means err is returned after the RPC succeeded.
+	afterRPC bool
+	// failed holds the errors of each key for the partial MultiError.
+	failed []error
+}
+
+func (ch *chaosHandler) methodRate(method string) float64 {
+	if rate, ok := ch.methodRates[method]; ok {
+		return rate
+	}
+	if defaultMethods[method] {
+		return ch.rate
+	}
+
+	return 0
+}
+
+func (ch *chaosHandler) targetKind(kind string) bool {
+	return len(ch.kinds) == 0 || ch.kinds[kind]
 }
 
-func (ch *chaosHandler) raiseError() error {
-	// Make an error with a 20% rate
-	if ch.r.Intn(5) == 0 {
+func (ch *chaosHandler) targetKeys(keys []datastore.Key) bool {
+	if len(ch.kinds) == 0 {
+		return true
+	}
+	for _, key := range keys {
+		if key != nil && ch.kinds[key.Kind()] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (ch *chaosHandler) newError() error {
+	if len(ch.codes) == 0 {
 		return errors.New("error from chaosrpc")
 	}
 
-	return nil
+	return status.Error(ch.codes[ch.r.Intn(len(ch.codes))], "error from chaosrpc")
+}
+
+// fault decides the chaos of the call. keyCount is the number of keys that can fail partially.
+func (ch *chaosHandler) fault(method string, target bool, keyCount int) *fault {
+	ft := &fault{}
+	if !target {
+		return ft
+	}
+
+	ch.m.Lock()
+	defer ch.m.Unlock()
+
+	if ch.latency != nil && ch.r.Float64() < ch.latencyRate {
+		ft.latency = ch.latency(ch.r)
+	}
+	if ch.r.Float64() >= ch.methodRate(method) {
+		return ft
+	}
+
+	if 2 <= keyCount && ch.r.Float64() < ch.partialRate {
+		ft.failed = make([]error, keyCount)
+		failedCount := 0
+		for idx := range ft.failed {
+			if ch.r.Intn(2) == 0 {
+				ft.failed[idx] = ch.newError()
+				failedCount++
+			}
+		}
+		// at least one key fails, and at least one key succeeds.
+		if failedCount == 0 {
+			ft.failed[ch.r.Intn(keyCount)] = ch.newError()
+		} else if failedCount == keyCount {
+			ft.failed[ch.r.Intn(keyCount)] = nil
+		}
+		return ft
+	}
+
+	ft.err = ch.newError()
+	ft.afterRPC = ch.r.Float64() < ch.afterRPCRate
+
+	return ft
+}
+
+func (ch *chaosHandler) sleep(ctx context.Context, ft *fault) error {
+	if ft.latency <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(ft.latency)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// inject calls rpc with the chaos.
+func (ch *chaosHandler) inject(ctx context.Context, ft *fault, rpc func() error) error {
+	if err := ch.sleep(ctx, ft); err != nil {
+		return err
+	}
+	if ft.err != nil && !ft.afterRPC {
+		return ft.err
+	}
+
+	err := rpc()
+	if err != nil {
+		return err
+	}
+
+	// the RPC succeeded, but the caller can't know it.
+	return ft.err
+}
+
+// partial calls rpc with the keys that don't fail, and returns MultiError that contains the injected errors.
+func (ch *chaosHandler) partial(ctx context.Context, ft *fault, keys []datastore.Key, rpc func(idxs []int, keys []datastore.Key) error) error {
+	if err := ch.sleep(ctx, ft); err != nil {
+		return err
+	}
+
+	idxs := make([]int, 0, len(keys))
+	okKeys := make([]datastore.Key, 0, len(keys))
+	for idx, key := range keys {
+		if ft.failed[idx] == nil {
+			idxs = append(idxs, idx)
+			okKeys = append(okKeys, key)
+		}
+	}
+
+	errs := make([]error, len(keys))
+	copy(errs, ft.failed)
+
+	err := rpc(idxs, okKeys)
+	if merr, ok := err.(datastore.MultiError); ok {
+		for i, idx := range idxs {
+			errs[idx] = merr[i]
+		}
+	} else if err != nil {
+		return err
+	}
+
+	return datastore.MultiError(errs)
 }
 
 func (ch *chaosHandler) AllocateIDs(info *datastore.MiddlewareInfo, keys []datastore.Key) ([]datastore.Key, error) {
-	if err := ch.raiseError(); err != nil {
+	ft := ch.fault("AllocateIDs", ch.targetKeys(keys), 0)
+
+	var retKeys []datastore.Key
+	err := ch.inject(info.Context, ft, func() error {
+		var err error
+		retKeys, err = info.Next.AllocateIDs(info, keys)
+		return err
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	return info.Next.AllocateIDs(info, keys)
+	return retKeys, nil
 }
 
 func (ch *chaosHandler) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.Key, error) {
-	if err := ch.raiseError(); err != nil {
+	ft := ch.fault("PutMultiWithoutTx", ch.targetKeys(keys), len(keys))
+
+	if ft.failed != nil {
+		retKeys := make([]datastore.Key, len(keys))
+		err := ch.partial(info.Context, ft, keys, func(idxs []int, okKeys []datastore.Key) error {
+			okPsList := make([]datastore.PropertyList, 0, len(idxs))
+			for _, idx := range idxs {
+				okPsList = append(okPsList, psList[idx])
+			}
+			okRetKeys, err := info.Next.PutMultiWithoutTx(info, okKeys, okPsList)
+			for i, key := range okRetKeys {
+				retKeys[idxs[i]] = key
+			}
+			return err
+		})
+		return retKeys, err
+	}
+
+	var retKeys []datastore.Key
+	err := ch.inject(info.Context, ft, func() error {
+		var err error
+		retKeys, err = info.Next.PutMultiWithoutTx(info, keys, psList)
+		return err
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	return info.Next.PutMultiWithoutTx(info, keys, psList)
+	return retKeys, nil
 }
 
 func (ch *chaosHandler) PutMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.PendingKey, error) {
-	if err := ch.raiseError(); err != nil {
+	ft := ch.fault("PutMultiWithTx", ch.targetKeys(keys), 0)
+
+	var pKeys []datastore.PendingKey
+	err := ch.inject(info.Context, ft, func() error {
+		var err error
+		pKeys, err = info.Next.PutMultiWithTx(info, keys, psList)
+		return err
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	return info.Next.PutMultiWithTx(info, keys, psList)
+	return pKeys, nil
 }
 
 func (ch *chaosHandler) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
-	if err := ch.raiseError(); err != nil {
-		return err
+	ft := ch.fault("GetMultiWithoutTx", ch.targetKeys(keys), len(keys))
+
+	if ft.failed != nil {
+		return ch.partial(info.Context, ft, keys, func(idxs []int, okKeys []datastore.Key) error {
+			okPsList := make([]datastore.PropertyList, len(okKeys))
+			err := info.Next.GetMultiWithoutTx(info, okKeys, okPsList)
+			for i, idx := range idxs {
+				psList[idx] = okPsList[i]
+			}
+			return err
+		})
 	}
 
-	return info.Next.GetMultiWithoutTx(info, keys, psList)
+	return ch.inject(info.Context, ft, func() error {
+		return info.Next.GetMultiWithoutTx(info, keys, psList)
+	})
 }
 
 func (ch *chaosHandler) GetMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
-	if err := ch.raiseError(); err != nil {
-		return err
-	}
+	ft := ch.fault("GetMultiWithTx", ch.targetKeys(keys), 0)
 
-	return info.Next.GetMultiWithTx(info, keys, psList)
+	return ch.inject(info.Context, ft, func() error {
+		return info.Next.GetMultiWithTx(info, keys, psList)
+	})
 }
 
 func (ch *chaosHandler) DeleteMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
-	if err := ch.raiseError(); err != nil {
-		return err
+	ft := ch.fault("DeleteMultiWithoutTx", ch.targetKeys(keys), len(keys))
+
+	if ft.failed != nil {
+		return ch.partial(info.Context, ft, keys, func(idxs []int, okKeys []datastore.Key) error {
+			return info.Next.DeleteMultiWithoutTx(info, okKeys)
+		})
 	}
 
-	return info.Next.DeleteMultiWithoutTx(info, keys)
+	return ch.inject(info.Context, ft, func() error {
+		return info.Next.DeleteMultiWithoutTx(info, keys)
+	})
 }
 
 func (ch *chaosHandler) DeleteMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
-	if err := ch.raiseError(); err != nil {
-		return err
-	}
+	ft := ch.fault("DeleteMultiWithTx", ch.targetKeys(keys), 0)
 
-	return info.Next.DeleteMultiWithTx(info, keys)
+	return ch.inject(info.Context, ft, func() error {
+		return info.Next.DeleteMultiWithTx(info, keys)
+	})
 }
 
 func (ch *chaosHandler) PostCommit(info *datastore.MiddlewareInfo, tx datastore.Transaction, commit datastore.Commit) error {
-	// PostCommit don't do RPC
-	return info.Next.PostCommit(info, tx, commit)
+	// PostCommit don't do RPC, the error after the commit makes the ambiguous commit.
+	// The kinds are not known here.
+	ft := ch.fault("PostCommit", true, 0)
+
+	err := info.Next.PostCommit(info, tx, commit)
+	if err != nil {
+		return err
+	}
+
+	return ft.err
 }
 
 func (ch *chaosHandler) PostRollback(info *datastore.MiddlewareInfo, tx datastore.Transaction) error {
@@ -103,22 +389,51 @@ func (ch *chaosHandler) Run(info *datastore.MiddlewareInfo, q datastore.Query, q
 }
 
 func (ch *chaosHandler) GetAll(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, psList *[]datastore.PropertyList) ([]datastore.Key, error) {
-	if err := ch.raiseError(); err != nil {
+	ft := ch.fault("GetAll", ch.targetKind(qDump.Kind), 0)
+
+	var keys []datastore.Key
+	err := ch.inject(info.Context, ft, func() error {
+		var err error
+		keys, err = info.Next.GetAll(info, q, qDump, psList)
+		return err
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	return info.Next.GetAll(info, q, qDump, psList)
+	return keys, nil
 }
 
 func (ch *chaosHandler) Next(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, iter datastore.Iterator, ps *datastore.PropertyList) (datastore.Key, error) {
 	// Next is not idempotent, don't retry in dsmiddleware/rpcretry.
-	return info.Next.Next(info, q, qDump, iter, ps)
+	// It raises errors only if the rate is specified by WithMethodRate.
+	ft := ch.fault("Next", ch.targetKind(qDump.Kind), 0)
+
+	var key datastore.Key
+	err := ch.inject(info.Context, ft, func() error {
+		var err error
+		key, err = info.Next.Next(info, q, qDump, iter, ps)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
 }
 
 func (ch *chaosHandler) Count(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) (int, error) {
-	if err := ch.raiseError(); err != nil {
+	ft := ch.fault("Count", ch.targetKind(qDump.Kind), 0)
+
+	var count int
+	err := ch.inject(info.Context, ft, func() error {
+		var err error
+		count, err = info.Next.Count(info, q, qDump)
+		return err
+	})
+	if err != nil {
 		return 0, err
 	}
 
-	return info.Next.Count(info, q, qDump)
+	return count, nil
 }
@@ -1,10 +1,16 @@
 package chaosrpc
 
 import (
+	"context"
 	"math/rand"
+	"strings"
 	"testing"
+	"time"
 
+	"go.mercari.io/datastore"
 	"go.mercari.io/datastore/internal/testutils"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestChaosRPC_CheckRaiseError(t *testing.T) {
@@ -44,3 +50,151 @@ func TestChaosRPC_CheckRaiseError(t *testing.T) {
 		t.Errorf("unexpected: %v", catchErr)
 	}
 }
+
+func TestChaosRPC_Deterministic(t *testing.T) {
+	type Data struct {
+		Name string
+	}
+
+	run := func() string {
+		ctx, client, ms := testutils.SetupOnMemory()
+		client.AppendMiddleware(New(rand.NewSource(100), WithCodes(codes.Unavailable, codes.Aborted)))
+		client.AppendMiddleware(ms)
+
+		var results []string
+		for i := 0; i < 50; i++ {
+			err := client.Get(ctx, client.NameKey("Data", "a", nil), &Data{})
+			results = append(results, status.Code(err).String())
+		}
+		return strings.Join(results, ",")
+	}
+
+	result := run()
+	if v := run(); v != result {
+		t.Errorf("unexpected: %v", v)
+	}
+	if !strings.Contains(result, "Unavailable") || !strings.Contains(result, "Aborted") {
+		t.Errorf("unexpected: %v", result)
+	}
+}
+
+func TestChaosRPC_MethodRateAndKinds(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+	client.AppendMiddleware(New(rand.NewSource(1),
+		WithRate(0),
+		WithMethodRate("PutMultiWithoutTx", 1),
+		WithKinds("Chaos"),
+		WithCodes(codes.Unavailable),
+	))
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	_, err := client.Put(ctx, client.NameKey("Data", "a", nil), &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Put(ctx, client.NameKey("Chaos", "a", nil), &Data{Name: "a"})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("unexpected: %v", err)
+	}
+	err = client.Get(ctx, client.NameKey("Chaos", "a", nil), &Data{})
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("unexpected: %v", err)
+	}
+
+	// the misspelled method isn't ignored silently.
+	for _, method := range []string{"PutMultiWithoutTX", "Run", "PostRollback"} {
+		func() {
+			defer func() {
+				if err := recover(); err == nil {
+					t.Errorf("unexpected: nil, method=%s", method)
+				}
+			}()
+			WithMethodRate(method, 1)
+		}()
+	}
+}
+
+func TestChaosRPC_Partial(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+	client.AppendMiddleware(New(rand.NewSource(1), WithRate(1), WithPartialRate(1)))
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	keys := make([]datastore.Key, 4)
+	list := make([]*Data, 4)
+	for i := range keys {
+		keys[i] = client.IDKey("Data", int64(i+1), nil)
+		list[i] = &Data{Name: "a"}
+	}
+	_, err := client.PutMulti(ctx, keys, list)
+	merr, ok := err.(datastore.MultiError)
+	if !ok {
+		t.Fatalf("unexpected: %T, %v", err, err)
+	}
+	succeeded := 0
+	for idx, err := range merr {
+		if err == nil {
+			succeeded++
+			if _, ok := ms.Raw(keys[idx]); !ok {
+				t.Errorf("unexpected: #%d is not stored", idx)
+			}
+		} else if _, ok := ms.Raw(keys[idx]); ok {
+			t.Errorf("unexpected: #%d is stored", idx)
+		}
+	}
+	if succeeded == 0 || succeeded == len(keys) {
+		t.Errorf("unexpected: %v", succeeded)
+	}
+}
+
+func TestChaosRPC_AfterRPC(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+	client.AppendMiddleware(New(rand.NewSource(1), WithRate(1), WithAfterRPCRate(1)))
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	_, err := client.Put(ctx, client.NameKey("Data", "a", nil), &Data{Name: "a"})
+	if err == nil {
+		t.Fatal("unexpected: nil")
+	}
+	// the entity is stored.
+	if v := ms.Len(); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestChaosRPC_Latency(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+	client.AppendMiddleware(New(rand.NewSource(1), WithRate(0), WithLatency(1, UniformLatency(50*time.Millisecond, 60*time.Millisecond))))
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	start := time.Now()
+	_, err := client.Put(ctx, client.NameKey("Data", "a", nil), &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := time.Since(start); v < 50*time.Millisecond {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	err = client.Get(ctx, client.NameKey("Data", "a", nil), &Data{})
+	if err != context.DeadlineExceeded {
+		t.Errorf("unexpected: %v", err)
+	}
+}
@@ -1,6 +1,21 @@
 /*
 Package chaosrpc generates chaos very efficiently!
-This package will randomly error all RPCs with a probability of 20%.
+By default, this package will randomly error all RPCs with a probability of 20%.
 Please use only for testing.
+
+The chaos is configurable by options.
+
+	mw := chaosrpc.New(rand.NewSource(1),
+		chaosrpc.WithRate(0.1),
+		chaosrpc.WithMethodRate("GetMultiWithoutTx", 0.3),
+		chaosrpc.WithMethodRate("PostCommit", 0.05),
+		chaosrpc.WithCodes(codes.Unavailable, codes.Aborted, codes.DeadlineExceeded),
+		chaosrpc.WithLatency(0.5, chaosrpc.ExponentialLatency(20*time.Millisecond)),
+		chaosrpc.WithPartialRate(0.5),
+		chaosrpc.WithAfterRPCRate(0.2),
+		chaosrpc.WithKinds("User", "Order"),
+	)
+
+The results are deterministic for the given rand.Source, if the operations are called in the same order.
 */
 package chaosrpc // import "go.mercari.io/datastore/dsmiddleware/chaosrpc"
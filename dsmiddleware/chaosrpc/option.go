@@ -0,0 +1,106 @@
+package chaosrpc
+
+import (
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+)
+
+// WithRate specifies the rate of errors of RPCs. The default is 0.2.
+// PostCommit and Next don't raise errors unless WithMethodRate is specified.
+func WithRate(rate float64) Option {
+	return &withRate{rate}
+}
+
+type withRate struct{ rate float64 }
+
+func (w *withRate) Apply(ch *chaosHandler) {
+	ch.rate = w.rate
+}
+
+// WithMethodRate specifies the rate of errors of the Middleware method, e.g. "GetMultiWithoutTx".
+// The error of PostCommit is raised after the commit succeeded, it makes the ambiguous commit.
+// It panics if method isn't the Middleware method that raises errors.
+func WithMethodRate(method string, rate float64) Option {
+	if !defaultMethods[method] && !optionalMethods[method] {
+		panic(fmt.Sprintf("dsmiddleware/chaosrpc: unknown method '%s'", method))
+	}
+	return &withMethodRate{method, rate}
+}
+
+type withMethodRate struct {
+	method string
+	rate   float64
+}
+
+func (w *withMethodRate) Apply(ch *chaosHandler) {
+	ch.methodRates[w.method] = w.rate
+}
+
+// WithCodes specifies the gRPC codes of errors, e.g. codes.Unavailable, codes.Aborted and codes.DeadlineExceeded.
+// A code is chosen randomly for each error. By default, the error is not from gRPC.
+func WithCodes(cs ...codes.Code) Option {
+	return &withCodes{cs}
+}
+
+type withCodes struct{ cs []codes.Code }
+
+func (w *withCodes) Apply(ch *chaosHandler) {
+	ch.codes = w.cs
+}
+
+// WithLatency creates a Option that injects the latency before RPCs at the rate.
+func WithLatency(rate float64, latency Latency) Option {
+	return &withLatency{rate, latency}
+}
+
+type withLatency struct {
+	rate    float64
+	latency Latency
+}
+
+func (w *withLatency) Apply(ch *chaosHandler) {
+	ch.latencyRate = w.rate
+	ch.latency = w.latency
+}
+
+// WithPartialRate specifies the rate of partial MultiError in the errors of
+// GetMultiWithoutTx, PutMultiWithoutTx and DeleteMultiWithoutTx with multiple keys.
+// Some of keys fail, and the others are processed by the RPC.
+func WithPartialRate(rate float64) Option {
+	return &withPartialRate{rate}
+}
+
+type withPartialRate struct{ rate float64 }
+
+func (w *withPartialRate) Apply(ch *chaosHandler) {
+	ch.partialRate = w.rate
+}
+
+// WithAfterRPCRate specifies the rate of errors that are returned after the RPC succeeded.
+// e.g. the entity is stored by Put, but the caller receives the error.
+func WithAfterRPCRate(rate float64) Option {
+	return &withAfterRPCRate{rate}
+}
+
+type withAfterRPCRate struct{ rate float64 }
+
+func (w *withAfterRPCRate) Apply(ch *chaosHandler) {
+	ch.afterRPCRate = w.rate
+}
+
+// WithKinds limits the chaos to the operations on the kinds.
+// The operations with keys are selected if one of keys has the kind, queries are selected by the kind of the query.
+// PostCommit is selected regardless of the kinds.
+func WithKinds(kinds ...string) Option {
+	return &withKinds{kinds}
+}
+
+type withKinds struct{ kinds []string }
+
+func (w *withKinds) Apply(ch *chaosHandler) {
+	ch.kinds = make(map[string]bool)
+	for _, kind := range w.kinds {
+		ch.kinds[kind] = true
+	}
+}
@@ -0,0 +1,616 @@
+package chunk
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"time"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/internal/estimate"
+)
+
+var _ datastore.Middleware = &chunkHandler{}
+
+const (
+	// about 1 MB, the maximum size of an entity is 1,048,572 bytes.
+	defaultThreshold = 1000 * 1000
+	defaultChunkSize = 1000 * 1000
+	defaultChunkKind = "_Chunk"
+
+	propChunkCount = "_chunkCount"
+	propChunkGen   = "_chunkGen"
+	propGen        = "Gen"
+	propData       = "Data"
+)
+
+// ErrBrokenChunks is returned when some chunks are missing or written by another operation.
+// It may happen when the entity is loaded outside of the transaction while it is updated.
+var ErrBrokenChunks = errors.New("dsmiddleware/chunk: chunks are broken")
+
+// New chunk middleware creates & returns.
+func New(opts ...Option) datastore.Middleware {
+	ch := &chunkHandler{
+		threshold: defaultThreshold,
+		chunkSize: defaultChunkSize,
+		chunkKind: defaultChunkKind,
+	}
+
+	for _, opt := range opts {
+		opt.Apply(ch)
+	}
+
+	if ch.logf == nil {
+		ch.logf = func(ctx context.Context, format string, args ...interface{}) {}
+	}
+
+	return ch
+}
+
+// A Option is an option for chunk.
+type Option interface {
+	Apply(*chunkHandler)
+}
+
+type chunkHandler struct {
+	threshold int
+	chunkSize int
+	chunkKind string
+	filters   []func(key datastore.Key) bool
+	logf      func(ctx context.Context, format string, args ...interface{})
+}
+
+func (ch *chunkHandler) target(key datastore.Key) bool {
+	if key.Kind() == ch.chunkKind {
+		return false
+	}
+	for _, f := range ch.filters {
+		if !f(key) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (ch *chunkHandler) oversize(key datastore.Key, ps datastore.PropertyList) bool {
+	if !ch.target(key) {
+		return false
+	}
+
+	return ch.threshold < estimate.EntitySize(key, ps)
+}
+
+func (ch *chunkHandler) chunkKey(client datastore.Client, key datastore.Key, idx int) datastore.Key {
+	chunkKey := client.IDKey(ch.chunkKind, int64(idx+1), key)
+	chunkKey.SetNamespace(key.Namespace())
+	return chunkKey
+}
+
+// split returns the head entity that has indexed properties and chunks that have the rest.
+func (ch *chunkHandler) split(ctx context.Context, ps datastore.PropertyList) (datastore.PropertyList, []datastore.PropertyList, error) {
+	var head, rest datastore.PropertyList
+	for _, p := range ps {
+		if p.NoIndex {
+			rest = append(rest, p)
+		} else {
+			head = append(head, p)
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	err := enc.Encode(rest)
+	if err != nil {
+		ch.logf(ctx, "dsmiddleware/chunk.split: gob.Encode error err=%s", err.Error())
+		return nil, nil, err
+	}
+	b := buf.Bytes()
+
+	gen := time.Now().UnixNano()
+	var chunks []datastore.PropertyList
+	for i := 0; i < len(b); i += ch.chunkSize {
+		end := i + ch.chunkSize
+		if len(b) < end {
+			end = len(b)
+		}
+		chunks = append(chunks, datastore.PropertyList{
+			{Name: propGen, Value: gen, NoIndex: true},
+			{Name: propData, Value: b[i:end], NoIndex: true},
+		})
+	}
+
+	head = append(head,
+		datastore.Property{Name: propChunkCount, Value: int64(len(chunks)), NoIndex: true},
+		datastore.Property{Name: propChunkGen, Value: gen, NoIndex: true},
+	)
+
+	return head, chunks, nil
+}
+
+// chunkInfo returns the chunk count and generation recorded in the head entity.
+func chunkInfo(ps datastore.PropertyList) (int, int64, bool) {
+	var cnt, gen int64
+	var found bool
+	for _, p := range ps {
+		switch p.Name {
+		case propChunkCount:
+			cnt, found = p.Value.(int64)
+		case propChunkGen:
+			gen, _ = p.Value.(int64)
+		}
+	}
+
+	return int(cnt), gen, found
+}
+
+// join restores the entity from the head entity and its chunks.
+func (ch *chunkHandler) join(ctx context.Context, head datastore.PropertyList, gen int64, chunks []datastore.PropertyList) (datastore.PropertyList, error) {
+	var buf bytes.Buffer
+	for _, chunk := range chunks {
+		var chunkGen int64
+		var data []byte
+		for _, p := range chunk {
+			switch p.Name {
+			case propGen:
+				chunkGen, _ = p.Value.(int64)
+			case propData:
+				data, _ = p.Value.([]byte)
+			}
+		}
+		if chunkGen != gen {
+			return nil, ErrBrokenChunks
+		}
+		buf.Write(data)
+	}
+
+	var rest datastore.PropertyList
+	dec := gob.NewDecoder(&buf)
+	err := dec.Decode(&rest)
+	if err != nil {
+		ch.logf(ctx, "dsmiddleware/chunk.join: gob.Decode error err=%s", err.Error())
+		return nil, ErrBrokenChunks
+	}
+
+	ps := make(datastore.PropertyList, 0, len(head)+len(rest))
+	for _, p := range head {
+		if p.Name == propChunkCount || p.Name == propChunkGen {
+			continue
+		}
+		ps = append(ps, p)
+	}
+	ps = append(ps, rest...)
+
+	return ps, nil
+}
+
+// chunkKeys returns keys of all chunks that belong to the key, including orphans.
+func (ch *chunkHandler) chunkKeys(info *datastore.MiddlewareInfo, key datastore.Key) ([]datastore.Key, error) {
+	q := info.Client.NewQuery(ch.chunkKind).Namespace(key.Namespace()).Ancestor(key).KeysOnly()
+	if info.Transaction != nil {
+		q = q.Transaction(info.Transaction)
+	}
+
+	keys, err := info.Client.GetAll(info.Context, q, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// the ancestor query also matches the chunks of the descendant entities.
+	chunkKeys := make([]datastore.Key, 0, len(keys))
+	for _, k := range keys {
+		if k.ParentKey() != nil && k.ParentKey().Equal(key) {
+			chunkKeys = append(chunkKeys, k)
+		}
+	}
+
+	return chunkKeys, nil
+}
+
+// headChunkKeys returns keys of the chunks recorded in the head entities.
+// The head entities are loaded by get at once, instead of a query for each key.
+func (ch *chunkHandler) headChunkKeys(info *datastore.MiddlewareInfo, keys []datastore.Key, get func(keys []datastore.Key, psList []datastore.PropertyList) error) ([]datastore.Key, error) {
+	headKeys := make([]datastore.Key, 0, len(keys))
+	for _, key := range keys {
+		if ch.target(key) && !key.Incomplete() {
+			headKeys = append(headKeys, key)
+		}
+	}
+	if len(headKeys) == 0 {
+		return nil, nil
+	}
+
+	psList := make([]datastore.PropertyList, len(headKeys))
+	err := get(headKeys, psList)
+	merr, ok := err.(datastore.MultiError)
+	if ok {
+		for _, err := range merr {
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return nil, err
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	var chunkKeys []datastore.Key
+	for idx, ps := range psList {
+		if merr != nil && merr[idx] != nil {
+			continue
+		}
+		cnt, _, ok := chunkInfo(ps)
+		if !ok {
+			continue
+		}
+		for i := 0; i < cnt; i++ {
+			chunkKeys = append(chunkKeys, ch.chunkKey(info.Client, headKeys[idx], i))
+		}
+	}
+
+	return chunkKeys, nil
+}
+
+// restore replaces the head entities in psList with the entities joined with their chunks.
+// getChunks must load the chunks in the same way as the head entities.
+func (ch *chunkHandler) restore(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList, merr datastore.MultiError, getChunks func(chunkKeys []datastore.Key, chunkPsList []datastore.PropertyList) error) error {
+	type headInfo struct {
+		idx   int
+		gen   int64
+		begin int
+		end   int
+	}
+	var heads []headInfo
+	var chunkKeys []datastore.Key
+	for idx, ps := range psList {
+		if merr != nil && merr[idx] != nil {
+			continue
+		}
+		cnt, gen, ok := chunkInfo(ps)
+		if !ok {
+			continue
+		}
+		h := headInfo{idx: idx, gen: gen, begin: len(chunkKeys)}
+		for i := 0; i < cnt; i++ {
+			chunkKeys = append(chunkKeys, ch.chunkKey(info.Client, keys[idx], i))
+		}
+		h.end = len(chunkKeys)
+		heads = append(heads, h)
+	}
+	if len(heads) == 0 {
+		if merr != nil {
+			return merr
+		}
+		return nil
+	}
+
+	ch.logf(info.Context, "dsmiddleware/chunk: restore len(heads)=%d len(chunks)=%d", len(heads), len(chunkKeys))
+
+	chunkPsList := make([]datastore.PropertyList, len(chunkKeys))
+	var chunkMerr datastore.MultiError
+	err := getChunks(chunkKeys, chunkPsList)
+	if m, ok := err.(datastore.MultiError); ok {
+		chunkMerr = m
+	} else if err != nil {
+		return err
+	}
+
+	if merr == nil {
+		merr = make(datastore.MultiError, len(keys))
+	}
+	for _, h := range heads {
+		broken := false
+		for i := h.begin; i < h.end; i++ {
+			if chunkMerr != nil && chunkMerr[i] != nil {
+				broken = true
+				break
+			}
+		}
+		if broken {
+			ch.logf(info.Context, "dsmiddleware/chunk: chunks are missing key=%s", keys[h.idx].String())
+			merr[h.idx] = ErrBrokenChunks
+			continue
+		}
+		ps, err := ch.join(info.Context, psList[h.idx], h.gen, chunkPsList[h.begin:h.end])
+		if err != nil {
+			ch.logf(info.Context, "dsmiddleware/chunk: chunks are broken key=%s", keys[h.idx].String())
+			merr[h.idx] = err
+			continue
+		}
+		psList[h.idx] = ps
+	}
+
+	for _, err := range merr {
+		if err != nil {
+			return merr
+		}
+	}
+
+	return nil
+}
+
+func (ch *chunkHandler) AllocateIDs(info *datastore.MiddlewareInfo, keys []datastore.Key) ([]datastore.Key, error) {
+	return info.Next.AllocateIDs(info, keys)
+}
+
+func (ch *chunkHandler) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.Key, error) {
+	next := info.Next
+
+	found := false
+	for idx, key := range keys {
+		if ch.oversize(key, psList[idx]) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		// the small entity that overwrites the chunked one must remove its chunks.
+		chunkKeys, err := ch.headChunkKeys(info, keys, func(keys []datastore.Key, psList []datastore.PropertyList) error {
+			return next.GetMultiWithoutTx(info, keys, psList)
+		})
+		if err != nil {
+			return nil, err
+		}
+		found = len(chunkKeys) != 0
+	}
+	if !found {
+		return next.PutMultiWithoutTx(info, keys, psList)
+	}
+
+	// the head entity and chunks must be saved at once.
+	// the transaction goes through all middlewares again, from the first middleware of the client,
+	// then PutMultiWithTx splits the entities and removes the stale chunks.
+	ch.logf(info.Context, "dsmiddleware/chunk.PutMultiWithoutTx: start transaction len=%d", len(keys))
+
+	var pKeys []datastore.PendingKey
+	commit, err := info.Client.RunInTransaction(info.Context, func(tx datastore.Transaction) error {
+		var err error
+		pKeys, err = tx.PutMulti(keys, psList)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	retKeys := make([]datastore.Key, len(pKeys))
+	for idx, pKey := range pKeys {
+		retKeys[idx] = commit.Key(pKey)
+	}
+
+	return retKeys, nil
+}
+
+func (ch *chunkHandler) PutMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.PendingKey, error) {
+	next := info.Next
+
+	var newKeys []datastore.Key
+	var newPsList []datastore.PropertyList
+	var staleKeys []datastore.Key
+	var smallKeys []datastore.Key
+	headIdxs := make([]int, 0, len(keys))
+	for idx, key := range keys {
+		ps := psList[idx]
+		headIdxs = append(headIdxs, len(newKeys))
+		if !ch.oversize(key, ps) {
+			newKeys = append(newKeys, key)
+			newPsList = append(newPsList, ps)
+			smallKeys = append(smallKeys, key)
+			continue
+		}
+
+		if key.Incomplete() {
+			// chunks require the complete key of the head entity.
+			allocated, err := info.Client.AllocateIDs(info.Context, []datastore.Key{key})
+			if err != nil {
+				return nil, err
+			}
+			key = allocated[0]
+		} else {
+			oldChunkKeys, err := ch.chunkKeys(info, key)
+			if err != nil {
+				return nil, err
+			}
+			staleKeys = append(staleKeys, oldChunkKeys...)
+		}
+
+		head, chunks, err := ch.split(info.Context, ps)
+		if err != nil {
+			return nil, err
+		}
+		ch.logf(info.Context, "dsmiddleware/chunk.PutMultiWithTx: split key=%s len(chunks)=%d", key.String(), len(chunks))
+
+		newKeys = append(newKeys, key)
+		newPsList = append(newPsList, head)
+		for i, chunk := range chunks {
+			newKeys = append(newKeys, ch.chunkKey(info.Client, key, i))
+			newPsList = append(newPsList, chunk)
+		}
+	}
+
+	// the chunks recorded in the head entities that are overwritten without chunks are stale.
+	oldChunkKeys, err := ch.headChunkKeys(info, smallKeys, func(keys []datastore.Key, psList []datastore.PropertyList) error {
+		return next.GetMultiWithTx(info, keys, psList)
+	})
+	if err != nil {
+		return nil, err
+	}
+	staleKeys = append(staleKeys, oldChunkKeys...)
+
+	// chunks that are overwritten must not be deleted.
+	overwritten := make(map[string]bool)
+	for _, key := range newKeys {
+		if key.Kind() == ch.chunkKind {
+			overwritten[key.Encode()] = true
+		}
+	}
+	var deleteKeys []datastore.Key
+	for _, key := range staleKeys {
+		if !overwritten[key.Encode()] {
+			deleteKeys = append(deleteKeys, key)
+		}
+	}
+
+	if len(newKeys) == len(keys) && len(deleteKeys) == 0 {
+		return next.PutMultiWithTx(info, newKeys, newPsList)
+	}
+
+	pKeys, err := next.PutMultiWithTx(info, newKeys, newPsList)
+	if err != nil {
+		return nil, err
+	}
+	if len(deleteKeys) != 0 {
+		err = next.DeleteMultiWithTx(info, deleteKeys)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// pick up the head entities.
+	retPKeys := make([]datastore.PendingKey, 0, len(keys))
+	for _, idx := range headIdxs {
+		retPKeys = append(retPKeys, pKeys[idx])
+	}
+
+	return retPKeys, nil
+}
+
+func (ch *chunkHandler) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	next := info.Next
+
+	err := next.GetMultiWithoutTx(info, keys, psList)
+	merr, ok := err.(datastore.MultiError)
+	if !ok && err != nil {
+		return err
+	}
+
+	return ch.restore(info, keys, psList, merr, func(chunkKeys []datastore.Key, chunkPsList []datastore.PropertyList) error {
+		return next.GetMultiWithoutTx(info, chunkKeys, chunkPsList)
+	})
+}
+
+func (ch *chunkHandler) GetMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	next := info.Next
+
+	err := next.GetMultiWithTx(info, keys, psList)
+	merr, ok := err.(datastore.MultiError)
+	if !ok && err != nil {
+		return err
+	}
+
+	return ch.restore(info, keys, psList, merr, func(chunkKeys []datastore.Key, chunkPsList []datastore.PropertyList) error {
+		return next.GetMultiWithTx(info, chunkKeys, chunkPsList)
+	})
+}
+
+func (ch *chunkHandler) DeleteMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	next := info.Next
+
+	chunkKeys, err := ch.headChunkKeys(info, keys, func(keys []datastore.Key, psList []datastore.PropertyList) error {
+		return next.GetMultiWithoutTx(info, keys, psList)
+	})
+	if err != nil {
+		return err
+	}
+	if len(chunkKeys) == 0 {
+		return next.DeleteMultiWithoutTx(info, keys)
+	}
+
+	// the head entity and chunks must be deleted at once.
+	// the transaction goes through all middlewares again, from the first middleware of the client,
+	// then DeleteMultiWithTx collects the chunks.
+	ch.logf(info.Context, "dsmiddleware/chunk.DeleteMultiWithoutTx: start transaction len=%d", len(keys))
+
+	_, err = info.Client.RunInTransaction(info.Context, func(tx datastore.Transaction) error {
+		return tx.DeleteMulti(keys)
+	})
+
+	return err
+}
+
+func (ch *chunkHandler) DeleteMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	next := info.Next
+
+	chunkKeys, err := ch.headChunkKeys(info, keys, func(keys []datastore.Key, psList []datastore.PropertyList) error {
+		return next.GetMultiWithTx(info, keys, psList)
+	})
+	if err != nil {
+		return err
+	}
+	newKeys := keys
+	if len(chunkKeys) != 0 {
+		newKeys = make([]datastore.Key, 0, len(keys)+len(chunkKeys))
+		newKeys = append(newKeys, keys...)
+		newKeys = append(newKeys, chunkKeys...)
+	}
+
+	err = next.DeleteMultiWithTx(info, newKeys)
+	if merr, ok := err.(datastore.MultiError); ok && len(merr) != len(keys) {
+		return datastore.MultiError(merr[:len(keys)])
+	}
+
+	return err
+}
+
+func (ch *chunkHandler) PostCommit(info *datastore.MiddlewareInfo, tx datastore.Transaction, commit datastore.Commit) error {
+	return info.Next.PostCommit(info, tx, commit)
+}
+
+func (ch *chunkHandler) PostRollback(info *datastore.MiddlewareInfo, tx datastore.Transaction) error {
+	return info.Next.PostRollback(info, tx)
+}
+
+func (ch *chunkHandler) Run(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) datastore.Iterator {
+	return info.Next.Run(info, q, qDump)
+}
+
+// getChunksByClient loads chunks through all middlewares, because query operations can't call GetMulti of the next middleware.
+func (ch *chunkHandler) getChunksByClient(info *datastore.MiddlewareInfo, qDump *datastore.QueryDump) func(chunkKeys []datastore.Key, chunkPsList []datastore.PropertyList) error {
+	return func(chunkKeys []datastore.Key, chunkPsList []datastore.PropertyList) error {
+		if qDump.Transaction != nil {
+			return qDump.Transaction.GetMulti(chunkKeys, chunkPsList)
+		}
+		return info.Client.GetMulti(info.Context, chunkKeys, chunkPsList)
+	}
+}
+
+func (ch *chunkHandler) GetAll(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, psList *[]datastore.PropertyList) ([]datastore.Key, error) {
+	keys, err := info.Next.GetAll(info, q, qDump, psList)
+	if err != nil || qDump.KeysOnly || len(qDump.Project) != 0 || psList == nil {
+		return keys, err
+	}
+
+	err = ch.restore(info, keys, *psList, nil, ch.getChunksByClient(info, qDump))
+	if merr, ok := err.(datastore.MultiError); ok {
+		for _, err := range merr {
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (ch *chunkHandler) Next(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, iter datastore.Iterator, ps *datastore.PropertyList) (datastore.Key, error) {
+	key, err := info.Next.Next(info, q, qDump, iter, ps)
+	if err != nil || qDump.KeysOnly || len(qDump.Project) != 0 || ps == nil {
+		return key, err
+	}
+
+	psList := []datastore.PropertyList{*ps}
+	err = ch.restore(info, []datastore.Key{key}, psList, nil, ch.getChunksByClient(info, qDump))
+	if merr, ok := err.(datastore.MultiError); ok {
+		return nil, merr[0]
+	} else if err != nil {
+		return nil, err
+	}
+	*ps = psList[0]
+
+	return key, nil
+}
+
+func (ch *chunkHandler) Count(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) (int, error) {
+	return info.Next.Count(info, q, qDump)
+}
@@ -0,0 +1,337 @@
+package chunk
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/internal/testutils"
+)
+
+type Data struct {
+	Name string
+	Body string `datastore:",noindex"`
+}
+
+func TestChunk_SplitAndJoin(t *testing.T) {
+	ctx := context.Background()
+	ch := New(WithChunkSize(100)).(*chunkHandler)
+
+	body := strings.Repeat("a", 1000)
+	ps := datastore.PropertyList{
+		{Name: "Name", Value: "foo"},
+		{Name: "Body", Value: body, NoIndex: true},
+		{Name: "Tags", Value: []interface{}{"a", "b"}, NoIndex: true},
+	}
+
+	head, chunks, err := ch.split(ctx, ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := len(chunks); v < 10 {
+		t.Errorf("unexpected: %v", v)
+	}
+	cnt, gen, ok := chunkInfo(head)
+	if !ok || cnt != len(chunks) || gen == 0 {
+		t.Fatalf("unexpected: %v, %v, %v", cnt, gen, ok)
+	}
+	for _, p := range head {
+		if p.Name == "Body" {
+			t.Errorf("NoIndex property remains in head")
+		}
+	}
+
+	joined, err := ch.join(ctx, head, gen, chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(datastore.PropertyList(joined), ps) {
+		t.Errorf("unexpected: %v", joined)
+	}
+
+	// chunk written by another operation
+	chunks[1][0].Value = gen + 1
+	_, err = ch.join(ctx, head, gen, chunks)
+	if err != ErrBrokenChunks {
+		t.Errorf("unexpected: %v", err)
+	}
+}
+
+func TestChunk_Basic(t *testing.T) {
+	ctx, client, cleanUp := testutils.SetupCloudDatastore(t)
+	defer cleanUp()
+
+	var logs []string
+	logf := func(ctx context.Context, format string, args ...interface{}) {
+		t.Logf(format, args...)
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+
+	mw := New(WithThreshold(1000), WithChunkSize(300), WithLogger(logf))
+	client.AppendMiddleware(mw)
+	defer func() {
+		// stop logging before cleanUp func called.
+		client.RemoveMiddleware(mw)
+	}()
+
+	countChunks := func(key datastore.Key) int {
+		q := client.NewQuery(defaultChunkKind).Ancestor(key).KeysOnly()
+		keys, err := client.GetAll(ctx, q, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(keys)
+	}
+
+	body := strings.Repeat("Hello, world! ", 100)
+
+	// Put. split into chunks.
+	key, err := client.Put(ctx, client.IncompleteKey("Data", nil), &Data{Name: "foo", Body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Incomplete() {
+		t.Fatalf("unexpected: %v", key.Incomplete())
+	}
+	if v := countChunks(key); v != 6 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// Get. reassemble chunks.
+	obj := &Data{}
+	err = client.Get(ctx, key, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Name != "foo" || obj.Body != body {
+		t.Errorf("unexpected: %v", obj)
+	}
+
+	// Query. only head entities are matched.
+	var list []*Data
+	keys, err := client.GetAll(ctx, client.NewQuery("Data").Filter("Name =", "foo"), &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || !keys[0].Equal(key) {
+		t.Fatalf("unexpected: %v", keys)
+	}
+	if list[0].Body != body {
+		t.Errorf("unexpected: %v", list[0].Body)
+	}
+
+	iter := client.Run(ctx, client.NewQuery("Data"))
+	obj = &Data{}
+	_, err = iter.Next(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Body != body {
+		t.Errorf("unexpected: %v", obj.Body)
+	}
+
+	// Put. fewer chunks, the rest is removed.
+	_, err = client.Put(ctx, key, &Data{Name: "foo", Body: body[:700]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := countChunks(key); v != 3 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// Put. small entity doesn't use chunks.
+	_, err = client.Put(ctx, key, &Data{Name: "foo", Body: "small"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj = &Data{}
+	err = client.Get(ctx, key, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Body != "small" {
+		t.Errorf("unexpected: %v", obj.Body)
+	}
+	// the old chunks are removed with it.
+	if v := countChunks(key); v != 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+	_, err = client.Put(ctx, key, &Data{Name: "foo", Body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := countChunks(key); v != 6 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// Delete. remove head and chunks.
+	err = client.Delete(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := countChunks(key); v != 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+	err = client.Get(ctx, key, &Data{})
+	if err != datastore.ErrNoSuchEntity {
+		t.Errorf("unexpected: %v", err)
+	}
+}
+
+func TestChunk_Transaction(t *testing.T) {
+	ctx, client, cleanUp := testutils.SetupCloudDatastore(t)
+	defer cleanUp()
+
+	mw := New(WithThreshold(1000), WithChunkSize(300))
+	client.AppendMiddleware(mw)
+	defer func() {
+		client.RemoveMiddleware(mw)
+	}()
+
+	body := strings.Repeat("Hello, world! ", 100)
+	key := client.NameKey("Data", "a", nil)
+
+	_, err := client.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		_, err := tx.Put(key, &Data{Name: "foo", Body: body})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		obj := &Data{}
+		err := tx.Get(key, obj)
+		if err != nil {
+			return err
+		}
+		if obj.Body != body {
+			t.Errorf("unexpected: %v", obj.Body)
+		}
+
+		return tx.Delete(key)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Get(ctx, key, &Data{})
+	if err != datastore.ErrNoSuchEntity {
+		t.Errorf("unexpected: %v", err)
+	}
+}
+
+func TestChunk_OverwriteOnMemory(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	ch := New(WithThreshold(1000), WithChunkSize(300)).(*chunkHandler)
+	client.AppendMiddleware(ms)
+
+	// the chunked entity is written as is.
+	key := client.NameKey("Data", "a", nil)
+	head, chunks, err := ch.split(ctx, datastore.PropertyList{
+		{Name: "Name", Value: "foo"},
+		{Name: "Body", Value: strings.Repeat("Hello, world! ", 100), NoIndex: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []datastore.Key{key}
+	psList := []datastore.PropertyList{head}
+	for i, chunk := range chunks {
+		keys = append(keys, ch.chunkKey(client, key, i))
+		psList = append(psList, chunk)
+	}
+	_, err = client.PutMulti(ctx, keys, psList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := ms.NewTransaction(ctx, client, ch, ms)
+	_, err = tx.PutMultiWithTx([]datastore.Key{key}, []datastore.PropertyList{{{Name: "Name", Value: "foo"}, {Name: "Body", Value: "small", NoIndex: true}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the small entity overwrites the head, and its chunks are removed.
+	ps := make([]datastore.PropertyList, len(keys))
+	err = client.GetMulti(ctx, keys, ps)
+	merr, ok := err.(datastore.MultiError)
+	if !ok {
+		t.Fatalf("unexpected: %v", err)
+	}
+	for idx, err := range merr {
+		if idx == 0 && err != nil {
+			t.Errorf("unexpected: %v", err)
+		} else if idx != 0 && err != datastore.ErrNoSuchEntity {
+			t.Errorf("unexpected: %v", err)
+		}
+	}
+	if _, _, ok := chunkInfo(ps[0]); ok {
+		t.Errorf("unexpected: %v", ps[0])
+	}
+}
+
+func TestChunk_Descendant(t *testing.T) {
+	ctx, client, cleanUp := testutils.SetupCloudDatastore(t)
+	defer cleanUp()
+
+	mw := New(WithThreshold(1000), WithChunkSize(300))
+	client.AppendMiddleware(mw)
+	defer func() {
+		client.RemoveMiddleware(mw)
+	}()
+
+	countChunks := func(key datastore.Key) int {
+		q := client.NewQuery(defaultChunkKind).Ancestor(key).KeysOnly()
+		keys, err := client.GetAll(ctx, q, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(keys)
+	}
+
+	body := strings.Repeat("Hello, world! ", 100)
+
+	parentKey := client.NameKey("Data", "parent", nil)
+	childKey := client.NameKey("Data", "child", parentKey)
+	_, err := client.PutMulti(ctx, []datastore.Key{parentKey, childKey}, []*Data{{Body: body}, {Body: body}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := countChunks(childKey); v != 6 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// the chunks of the child entity aren't stale chunks of the parent entity.
+	_, err = client.Put(ctx, parentKey, &Data{Body: body[:700]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := countChunks(childKey); v != 6 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	err = client.Delete(ctx, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := countChunks(childKey); v != 6 {
+		t.Errorf("unexpected: %v", v)
+	}
+	obj := &Data{}
+	err = client.Get(ctx, childKey, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Body != body {
+		t.Errorf("unexpected: %v", obj.Body)
+	}
+}
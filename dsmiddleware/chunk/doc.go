@@ -0,0 +1,21 @@
+/*
+Package chunk saves entities larger than the 1 MiB limit by splitting them across child chunk entities.
+
+When the estimated size of the entity exceeds the threshold,
+the indexed properties are kept in the head entity under the original key,
+and the NoIndex properties are serialized and split into chunk entities whose parent is the head entity.
+The chunks are reassembled transparently by Get, GetMulti, GetAll and Iterator.Next.
+Queries match only the head entity, because the chunks have no indexed properties.
+
+The head entity and chunks are saved and deleted in a transaction.
+When Put or Delete without a transaction writes the chunks, this middleware starts a new transaction by the Client,
+the transaction passes through all middlewares of the Client again, from the first one.
+The middlewares placed before this middleware see the operation twice, without and with the transaction,
+and the middlewares placed after it see only the transaction.
+Place this middleware after compress and before the cache middlewares.
+
+Put and Delete load the head entities at once and remove the chunks recorded in them,
+so overwriting a chunked entity with a small one removes the old chunks too.
+The oversize Put finds the chunks by an ancestor query, including the orphans that no head records.
+*/
+package chunk // import "go.mercari.io/datastore/dsmiddleware/chunk"
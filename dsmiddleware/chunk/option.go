@@ -0,0 +1,91 @@
+package chunk
+
+import (
+	"context"
+
+	"go.mercari.io/datastore"
+)
+
+// WithThreshold specifies the estimated entity size in bytes that the entity is split over.
+func WithThreshold(threshold int) Option {
+	return &withThreshold{threshold}
+}
+
+type withThreshold struct{ threshold int }
+
+func (w *withThreshold) Apply(o *chunkHandler) {
+	o.threshold = w.threshold
+}
+
+// WithChunkSize specifies the maximum byte size of data in each chunk entity.
+func WithChunkSize(size int) Option {
+	return &withChunkSize{size}
+}
+
+type withChunkSize struct{ size int }
+
+func (w *withChunkSize) Apply(o *chunkHandler) {
+	o.chunkSize = w.size
+}
+
+// WithChunkKind specifies the Kind of chunk entities. default is "_Chunk".
+func WithChunkKind(kind string) Option {
+	return &withChunkKind{kind}
+}
+
+type withChunkKind struct{ kind string }
+
+func (w *withChunkKind) Apply(o *chunkHandler) {
+	o.chunkKind = w.kind
+}
+
+// WithIncludeKinds creates a Option that selects the Kind specified as the target.
+func WithIncludeKinds(kinds ...string) Option {
+	return &withIncludeKinds{kinds}
+}
+
+type withIncludeKinds struct{ kinds []string }
+
+func (w *withIncludeKinds) Apply(o *chunkHandler) {
+	o.filters = append(o.filters, func(key datastore.Key) bool {
+		for _, incKind := range w.kinds {
+			if key.Kind() == incKind {
+				return true
+			}
+		}
+
+		return false
+	})
+}
+
+// WithExcludeKinds creates a Option that selects the Kind unspecified as the target.
+func WithExcludeKinds(kinds ...string) Option {
+	return &withExcludeKinds{kinds}
+}
+
+type withExcludeKinds struct{ kinds []string }
+
+func (w *withExcludeKinds) Apply(o *chunkHandler) {
+	o.filters = append(o.filters, func(key datastore.Key) bool {
+		for _, excKind := range w.kinds {
+			if key.Kind() == excKind {
+				return false
+			}
+		}
+
+		return true
+	})
+}
+
+// WithLogger creates a Option that uses the specified logger.
+func WithLogger(logf func(ctx context.Context, format string, args ...interface{})) Option {
+	return &withLogger{logf}
+}
+
+type withLogger struct {
+	logf func(ctx context.Context, format string, args ...interface{})
+}
+
+func (w *withLogger) Apply(o *chunkHandler) {
+	o.logf = w.logf
+}
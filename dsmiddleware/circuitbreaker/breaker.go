@@ -0,0 +1,132 @@
+package circuitbreaker
+
+import (
+	"sync"
+	"time"
+)
+
+// slotCount is the number of slots in the rolling window.
+const slotCount = 10
+
+type slot struct {
+	start    time.Time
+	requests int
+	failures int
+}
+
+// transition is the change of the state.
+type transition struct {
+	from State
+	to   State
+}
+
+// breaker holds the state of an operation type.
+type breaker struct {
+	bh *breakerHandler
+	op Op
+
+	m        sync.Mutex
+	state    State
+	openedAt time.Time
+	slots    [slotCount]slot
+	// probes is the number of requests permitted in the half-open state.
+	probes int
+	// successes is the number of succeeded probes.
+	successes int
+}
+
+func (b *breaker) setState(now time.Time, state State, ts []transition) []transition {
+	ts = append(ts, transition{from: b.state, to: state})
+	b.state = state
+	b.probes = 0
+	b.successes = 0
+	b.slots = [slotCount]slot{}
+	if state == Open {
+		b.openedAt = now
+	}
+
+	return ts
+}
+
+// allow returns OpenError if the request isn't permitted.
+// If the request is permitted as the probe in the half-open state, probe is true.
+func (b *breaker) allow(now time.Time) (probe bool, ts []transition, err error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.state == Open {
+		elapsed := now.Sub(b.openedAt)
+		if elapsed < b.bh.openTimeout {
+			return false, nil, &OpenError{Op: b.op, State: Open, RetryAfter: b.bh.openTimeout - elapsed}
+		}
+		ts = b.setState(now, HalfOpen, ts)
+	}
+
+	if b.state == HalfOpen {
+		if b.bh.halfOpenProbes <= b.probes {
+			return false, ts, &OpenError{Op: b.op, State: HalfOpen}
+		}
+		b.probes++
+		return true, ts, nil
+	}
+
+	return false, ts, nil
+}
+
+// record records the result of the request permitted by allow.
+func (b *breaker) record(now time.Time, probe bool, failed bool) (ts []transition) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	switch b.state {
+	case HalfOpen:
+		if !probe {
+			return nil
+		}
+		if failed {
+			return b.setState(now, Open, ts)
+		}
+		b.successes++
+		if b.bh.halfOpenProbes <= b.successes {
+			return b.setState(now, Closed, ts)
+		}
+		return nil
+
+	case Closed:
+		width := b.bh.window / slotCount
+		if width <= 0 {
+			width = 1
+		}
+		start := now.Truncate(width)
+		s := &b.slots[int((start.UnixNano()/int64(width))%slotCount)]
+		if !s.start.Equal(start) {
+			*s = slot{start: start}
+		}
+		s.requests++
+		if failed {
+			s.failures++
+		}
+		if !failed {
+			return nil
+		}
+
+		var requests, failures int
+		for _, s := range b.slots {
+			if now.Sub(s.start) < b.bh.window {
+				requests += s.requests
+				failures += s.failures
+			}
+		}
+		if requests < b.bh.minRequests {
+			return nil
+		}
+		if b.bh.failureRatio <= float64(failures)/float64(requests) {
+			return b.setState(now, Open, ts)
+		}
+		return nil
+
+	default:
+		// the request started before the circuit opened.
+		return nil
+	}
+}
@@ -0,0 +1,306 @@
+package circuitbreaker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/dsmiddleware/storagecache"
+	"go.mercari.io/datastore/internal/errcode"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+)
+
+var _ datastore.Middleware = &breakerHandler{}
+
+// State is the state of the circuit.
+type State int
+
+const (
+	// Closed permits all requests, and tracks the failure rate.
+	Closed State = iota
+	// Open rejects all requests until the open timeout passes.
+	Open
+	// HalfOpen permits limited number of requests to probe the recovery.
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+// Op is the type of operations that share the circuit.
+type Op string
+
+const (
+	// OpGet represents GetMultiWithoutTx and GetMultiWithTx.
+	OpGet Op = "Get"
+	// OpPut represents PutMultiWithoutTx.
+	OpPut Op = "Put"
+	// OpDelete represents DeleteMultiWithoutTx.
+	OpDelete Op = "Delete"
+	// OpQuery represents GetAll, Count and Iterator.Next.
+	OpQuery Op = "Query"
+	// OpAllocateIDs represents AllocateIDs.
+	OpAllocateIDs Op = "AllocateIDs"
+)
+
+// OpenError is returned when the circuit of the operation rejects the request.
+type OpenError struct {
+	Op    Op
+	State State
+	// RetryAfter is the duration until the circuit becomes half-open. It is zero in the half-open state.
+	RetryAfter time.Duration
+}
+
+func (err *OpenError) Error() string {
+	return fmt.Sprintf("dsmiddleware/circuitbreaker: circuit of %s is %s, retry after %s", err.Op, err.State, err.RetryAfter)
+}
+
+// IsFailure reports whether err is the failure of Datastore.
+// It is the default of WithFailureFunc, Unavailable, DeadlineExceeded, Internal and ResourceExhausted are the failure.
+// ErrNoSuchEntity and the errors of the application aren't the failure.
+func IsFailure(err error) bool {
+	switch errcode.Code(err) {
+	case codes.Unavailable.String(), codes.DeadlineExceeded.String(), codes.Internal.String(), codes.ResourceExhausted.String():
+		return true
+	default:
+		return false
+	}
+}
+
+// New circuit breaker middleware creates & returns.
+func New(opts ...Option) datastore.Middleware {
+	bh := &breakerHandler{
+		window:         time.Minute,
+		failureRatio:   0.5,
+		minRequests:    20,
+		openTimeout:    30 * time.Second,
+		halfOpenProbes: 1,
+		isFailure:      IsFailure,
+		now:            time.Now,
+		breakers:       make(map[Op]*breaker),
+	}
+
+	for _, opt := range opts {
+		opt.Apply(bh)
+	}
+
+	if bh.logf == nil {
+		bh.logf = func(ctx context.Context, format string, args ...interface{}) {}
+	}
+
+	return bh
+}
+
+// A Option is an option for circuitbreaker.
+type Option interface {
+	Apply(*breakerHandler)
+}
+
+type breakerHandler struct {
+	window         time.Duration
+	failureRatio   float64
+	minRequests    int
+	openTimeout    time.Duration
+	halfOpenProbes int
+	isFailure      func(err error) bool
+	fallback       storagecache.Storage
+	onStateChange  func(ctx context.Context, op Op, from, to State)
+	now            func() time.Time
+	logf           func(ctx context.Context, format string, args ...interface{})
+
+	m        sync.Mutex
+	breakers map[Op]*breaker
+}
+
+func (bh *breakerHandler) breaker(op Op) *breaker {
+	bh.m.Lock()
+	defer bh.m.Unlock()
+
+	b, ok := bh.breakers[op]
+	if !ok {
+		b = &breaker{bh: bh, op: op}
+		bh.breakers[op] = b
+	}
+
+	return b
+}
+
+func (bh *breakerHandler) notify(ctx context.Context, op Op, ts []transition) {
+	for _, t := range ts {
+		bh.logf(ctx, "dsmiddleware/circuitbreaker: circuit of %s changed from %s to %s", op, t.from, t.to)
+		if bh.onStateChange != nil {
+			bh.onStateChange(ctx, op, t.from, t.to)
+		}
+	}
+}
+
+// do calls f if the circuit of op permits, and records the result.
+func (bh *breakerHandler) do(ctx context.Context, op Op, f func() error) error {
+	b := bh.breaker(op)
+
+	probe, ts, err := b.allow(bh.now())
+	bh.notify(ctx, op, ts)
+	if err != nil {
+		return err
+	}
+
+	err = f()
+
+	ts = b.record(bh.now(), probe, err != nil && bh.isFailure(err))
+	bh.notify(ctx, op, ts)
+
+	return err
+}
+
+func (bh *breakerHandler) AllocateIDs(info *datastore.MiddlewareInfo, keys []datastore.Key) ([]datastore.Key, error) {
+	var retKeys []datastore.Key
+	err := bh.do(info.Context, OpAllocateIDs, func() error {
+		var err error
+		retKeys, err = info.Next.AllocateIDs(info, keys)
+		return err
+	})
+
+	return retKeys, err
+}
+
+func (bh *breakerHandler) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.Key, error) {
+	var retKeys []datastore.Key
+	err := bh.do(info.Context, OpPut, func() error {
+		var err error
+		retKeys, err = info.Next.PutMultiWithoutTx(info, keys, psList)
+		return err
+	})
+
+	return retKeys, err
+}
+
+func (bh *breakerHandler) PutMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.PendingKey, error) {
+	// mutations in the transaction are sent on commit.
+	return info.Next.PutMultiWithTx(info, keys, psList)
+}
+
+func (bh *breakerHandler) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	err := bh.do(info.Context, OpGet, func() error {
+		return info.Next.GetMultiWithoutTx(info, keys, psList)
+	})
+	if openErr, ok := err.(*OpenError); ok && bh.fallback != nil {
+		return bh.getFromFallback(info.Context, openErr, keys, psList)
+	}
+
+	return err
+}
+
+// getFromFallback reads entities from the fallback storage while the circuit is open.
+func (bh *breakerHandler) getFromFallback(ctx context.Context, openErr *OpenError, keys []datastore.Key, psList []datastore.PropertyList) error {
+	cis, err := bh.fallback.GetMulti(ctx, keys)
+	if err != nil {
+		bh.logf(ctx, "dsmiddleware/circuitbreaker.GetMultiWithoutTx: error on storage.GetMulti err=%s", err.Error())
+		return openErr
+	}
+
+	errs := make([]error, len(keys))
+	var missing bool
+	for idx, ci := range cis {
+		if ci == nil {
+			errs[idx] = openErr
+			missing = true
+			continue
+		}
+		if ci.NoSuchEntity {
+			// the tombstone of the negative cache.
+			errs[idx] = datastore.ErrNoSuchEntity
+			missing = true
+			continue
+		}
+		psList[idx] = ci.PropertyList
+	}
+	if missing {
+		return datastore.MultiError(errs)
+	}
+
+	return nil
+}
+
+func (bh *breakerHandler) GetMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	return bh.do(info.Context, OpGet, func() error {
+		return info.Next.GetMultiWithTx(info, keys, psList)
+	})
+}
+
+func (bh *breakerHandler) DeleteMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	return bh.do(info.Context, OpDelete, func() error {
+		return info.Next.DeleteMultiWithoutTx(info, keys)
+	})
+}
+
+func (bh *breakerHandler) DeleteMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	// mutations in the transaction are sent on commit.
+	return info.Next.DeleteMultiWithTx(info, keys)
+}
+
+func (bh *breakerHandler) PostCommit(info *datastore.MiddlewareInfo, tx datastore.Transaction, commit datastore.Commit) error {
+	return info.Next.PostCommit(info, tx, commit)
+}
+
+func (bh *breakerHandler) PostRollback(info *datastore.MiddlewareInfo, tx datastore.Transaction) error {
+	return info.Next.PostRollback(info, tx)
+}
+
+func (bh *breakerHandler) Run(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) datastore.Iterator {
+	// the query is executed by Iterator.Next.
+	return info.Next.Run(info, q, qDump)
+}
+
+func (bh *breakerHandler) GetAll(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, psList *[]datastore.PropertyList) ([]datastore.Key, error) {
+	var keys []datastore.Key
+	err := bh.do(info.Context, OpQuery, func() error {
+		var err error
+		keys, err = info.Next.GetAll(info, q, qDump, psList)
+		return err
+	})
+
+	return keys, err
+}
+
+func (bh *breakerHandler) Next(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, iter datastore.Iterator, ps *datastore.PropertyList) (datastore.Key, error) {
+	var key datastore.Key
+	var done bool
+	err := bh.do(info.Context, OpQuery, func() error {
+		var err error
+		key, err = info.Next.Next(info, q, qDump, iter, ps)
+		if err == iterator.Done {
+			done = true
+			return nil
+		}
+		return err
+	})
+	if done {
+		return nil, iterator.Done
+	}
+
+	return key, err
+}
+
+func (bh *breakerHandler) Count(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) (int, error) {
+	var count int
+	err := bh.do(info.Context, OpQuery, func() error {
+		var err error
+		count, err = info.Next.Count(info, q, qDump)
+		return err
+	})
+
+	return count, err
+}
@@ -0,0 +1,238 @@
+package circuitbreaker
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/dsmiddleware/localcache"
+	"go.mercari.io/datastore/internal/testutils"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type Data struct {
+	Name string
+}
+
+// flakyGet fails GetMultiWithoutTx while unavailable is true.
+type flakyGet struct {
+	datastore.Middleware
+	unavailable bool
+}
+
+func (m *flakyGet) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	if m.unavailable {
+		return status.Error(codes.Unavailable, "unavailable")
+	}
+	return m.Middleware.GetMultiWithoutTx(info, keys, psList)
+}
+
+type recorder struct {
+	transitions []string
+}
+
+func (r *recorder) record(ctx context.Context, op Op, from, to State) {
+	r.transitions = append(r.transitions, fmt.Sprintf("%s:%s->%s", op, from, to))
+}
+
+func TestCircuitBreaker_Basic(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	now := time.Now()
+	r := &recorder{}
+	mw := New(
+		WithFailureThreshold(0.5, 4),
+		WithOpenTimeout(time.Minute),
+		WithStateChangeFunc(r.record),
+	)
+	mw.(*breakerHandler).now = func() time.Time { return now }
+	flaky := &flakyGet{Middleware: ms}
+	client.AppendMiddleware(mw)
+	client.AppendMiddleware(flaky)
+
+	key := client.NameKey("Data", "a", nil)
+	_, err := client.Put(ctx, key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ErrNoSuchEntity isn't the failure.
+	for i := 0; i < 4; i++ {
+		err = client.Get(ctx, client.NameKey("Data", "missing", nil), &Data{})
+		if err != datastore.ErrNoSuchEntity {
+			t.Fatalf("unexpected: %v", err)
+		}
+	}
+	if v := len(r.transitions); v != 0 {
+		t.Fatalf("unexpected: %v", r.transitions)
+	}
+
+	flaky.unavailable = true
+	for i := 0; i < 4; i++ {
+		err = client.Get(ctx, key, &Data{})
+		if status.Code(err) != codes.Unavailable {
+			t.Fatalf("unexpected: %v", err)
+		}
+	}
+	if v := fmt.Sprintf("%v", r.transitions); v != "[Get:closed->open]" {
+		t.Fatalf("unexpected: %v", v)
+	}
+
+	calls := ms.Calls("GetMultiWithoutTx")
+	err = client.Get(ctx, key, &Data{})
+	openErr, ok := err.(*OpenError)
+	if !ok {
+		t.Fatalf("unexpected: %T, %v", err, err)
+	}
+	if openErr.Op != OpGet || openErr.State != Open || openErr.RetryAfter != time.Minute {
+		t.Errorf("unexpected: %+v", openErr)
+	}
+	if v := ms.Calls("GetMultiWithoutTx"); v != calls {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// other operations have their own circuits.
+	_, err = client.Put(ctx, key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the probe fails, and the circuit opens again.
+	now = now.Add(time.Minute)
+	err = client.Get(ctx, key, &Data{})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("unexpected: %v", err)
+	}
+	err = client.Get(ctx, key, &Data{})
+	if _, ok := err.(*OpenError); !ok {
+		t.Fatalf("unexpected: %T, %v", err, err)
+	}
+
+	// the probe succeeds, and the circuit closes.
+	flaky.unavailable = false
+	now = now.Add(time.Minute)
+	obj := &Data{}
+	err = client.Get(ctx, key, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Name != "a" {
+		t.Errorf("unexpected: %v", obj.Name)
+	}
+
+	expected := "[Get:closed->open Get:open->half-open Get:half-open->open Get:open->half-open Get:half-open->closed]"
+	if v := fmt.Sprintf("%v", r.transitions); v != expected {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestCircuitBreaker_HalfOpenProbes(t *testing.T) {
+	now := time.Now()
+	bh := New(WithFailureThreshold(1, 1), WithOpenTimeout(time.Second), WithHalfOpenProbes(2)).(*breakerHandler)
+	b := bh.breaker(OpGet)
+
+	if ts := b.record(now, false, true); len(ts) != 1 || ts[0].to != Open {
+		t.Fatalf("unexpected: %+v", ts)
+	}
+
+	now = now.Add(time.Second)
+	probe1, ts, err := b.allow(now)
+	if err != nil || !probe1 || len(ts) != 1 || ts[0].to != HalfOpen {
+		t.Fatalf("unexpected: %v, %+v, %v", probe1, ts, err)
+	}
+	probe2, _, err := b.allow(now)
+	if err != nil || !probe2 {
+		t.Fatalf("unexpected: %v, %v", probe2, err)
+	}
+	// no more probes are permitted.
+	_, _, err = b.allow(now)
+	if openErr, ok := err.(*OpenError); !ok || openErr.State != HalfOpen {
+		t.Fatalf("unexpected: %v", err)
+	}
+
+	if ts := b.record(now, probe1, false); len(ts) != 0 {
+		t.Fatalf("unexpected: %+v", ts)
+	}
+	if ts := b.record(now, probe2, false); len(ts) != 1 || ts[0].to != Closed {
+		t.Fatalf("unexpected: %+v", ts)
+	}
+}
+
+func TestCircuitBreaker_Window(t *testing.T) {
+	now := time.Now()
+	bh := New(WithFailureThreshold(0.5, 4), WithWindow(10*time.Second)).(*breakerHandler)
+	b := bh.breaker(OpPut)
+
+	for i := 0; i < 3; i++ {
+		b.record(now, false, true)
+	}
+
+	// the failures out of the window are ignored.
+	now = now.Add(20 * time.Second)
+	for i := 0; i < 2; i++ {
+		if ts := b.record(now, false, false); len(ts) != 0 {
+			t.Fatalf("unexpected: %+v", ts)
+		}
+	}
+	if ts := b.record(now, false, true); len(ts) != 0 {
+		t.Fatalf("unexpected: %+v", ts)
+	}
+	if ts := b.record(now, false, true); len(ts) != 1 || ts[0].to != Open {
+		t.Fatalf("unexpected: %+v", ts)
+	}
+}
+
+func TestCircuitBreaker_CacheFallback(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	cache := localcache.New(localcache.WithNegativeExpireDuration(time.Minute))
+	mw := New(WithFailureThreshold(0.5, 1), WithCacheFallback(cache))
+	flaky := &flakyGet{Middleware: ms}
+	client.AppendMiddleware(mw)
+	client.AppendMiddleware(cache)
+	client.AppendMiddleware(flaky)
+
+	keys := []datastore.Key{client.NameKey("Data", "a", nil), client.NameKey("Data", "b", nil)}
+	_, err := client.PutMulti(ctx, keys, []*Data{{Name: "a"}, {Name: "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cache.DeleteMulti(ctx, keys[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the tombstone is cached.
+	keys = append(keys, client.NameKey("Data", "c", nil))
+	err = client.Get(ctx, keys[2], &Data{})
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("unexpected: %v", err)
+	}
+
+	flaky.unavailable = true
+	err = client.Get(ctx, keys[1], &Data{})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("unexpected: %v", err)
+	}
+
+	list := make([]*Data, 3)
+	err = client.GetMulti(ctx, keys, list)
+	merr, ok := err.(datastore.MultiError)
+	if !ok {
+		t.Fatalf("unexpected: %T, %v", err, err)
+	}
+	if merr[0] != nil {
+		t.Errorf("unexpected: %v", merr[0])
+	}
+	if _, ok := merr[1].(*OpenError); !ok {
+		t.Errorf("unexpected: %T, %v", merr[1], merr[1])
+	}
+	if merr[2] != datastore.ErrNoSuchEntity {
+		t.Errorf("unexpected: %v", merr[2])
+	}
+	if list[0] == nil || list[0].Name != "a" {
+		t.Errorf("unexpected: %+v", list[0])
+	}
+}
@@ -0,0 +1,24 @@
+/*
+Package circuitbreaker fails fast while Datastore is unavailable, instead of waiting through retries.
+
+The circuit is tracked for each operation type, Get, Put, Delete, Query and AllocateIDs.
+It opens when the failure rate in the rolling window reaches the threshold,
+and rejects the requests with OpenError until the open timeout passes.
+Then it becomes half-open, and permits limited number of probes.
+It closes when the probes succeed, otherwise it opens again.
+
+	client.AppendMiddleware(circuitbreaker.New(
+		circuitbreaker.WithFailureThreshold(0.5, 20),
+		circuitbreaker.WithOpenTimeout(30*time.Second),
+		circuitbreaker.WithStateChangeFunc(func(ctx context.Context, op circuitbreaker.Op, from, to circuitbreaker.State) {
+			log.Printf("circuit of %s: %s -> %s", op, from, to)
+		}),
+	))
+	client.AppendMiddleware(rpcretry.New())
+
+Put it before rpcretry, the failure after the retries is counted once, and the open circuit skips the retries.
+
+With WithCacheFallback, Get outside the transaction reads entities from the storage of storagecache while the circuit is open.
+Put and Delete in the transaction are sent on commit, they are not tracked.
+*/
+package circuitbreaker // import "go.mercari.io/datastore/dsmiddleware/circuitbreaker"
@@ -0,0 +1,114 @@
+package circuitbreaker
+
+import (
+	"context"
+	"time"
+
+	"go.mercari.io/datastore/dsmiddleware/storagecache"
+)
+
+// WithFailureThreshold specifies the failure rate that opens the circuit.
+// The circuit opens when the rate of failures in the window reaches ratio,
+// and the number of requests in the window is at least minRequests.
+// The default is 0.5 of 20 requests.
+func WithFailureThreshold(ratio float64, minRequests int) Option {
+	return &withFailureThreshold{ratio, minRequests}
+}
+
+type withFailureThreshold struct {
+	ratio       float64
+	minRequests int
+}
+
+func (w *withFailureThreshold) Apply(bh *breakerHandler) {
+	bh.failureRatio = w.ratio
+	bh.minRequests = w.minRequests
+}
+
+// WithWindow specifies the duration of the rolling window to track the failure rate.
+// The default is 1 minute.
+func WithWindow(d time.Duration) Option {
+	return &withWindow{d}
+}
+
+type withWindow struct{ d time.Duration }
+
+func (w *withWindow) Apply(bh *breakerHandler) {
+	bh.window = w.d
+}
+
+// WithOpenTimeout specifies the duration of the open state before it becomes half-open.
+// The default is 30 seconds.
+func WithOpenTimeout(d time.Duration) Option {
+	return &withOpenTimeout{d}
+}
+
+type withOpenTimeout struct{ d time.Duration }
+
+func (w *withOpenTimeout) Apply(bh *breakerHandler) {
+	bh.openTimeout = w.d
+}
+
+// WithHalfOpenProbes specifies the number of requests permitted in the half-open state.
+// The circuit closes when all of them succeed, and opens again when one of them fails.
+// The default is 1.
+func WithHalfOpenProbes(n int) Option {
+	return &withHalfOpenProbes{n}
+}
+
+type withHalfOpenProbes struct{ n int }
+
+func (w *withHalfOpenProbes) Apply(bh *breakerHandler) {
+	bh.halfOpenProbes = w.n
+}
+
+// WithFailureFunc specifies the function that determines whether err is the failure.
+// The default is IsFailure.
+func WithFailureFunc(f func(err error) bool) Option {
+	return &withFailureFunc{f}
+}
+
+type withFailureFunc struct{ f func(err error) bool }
+
+func (w *withFailureFunc) Apply(bh *breakerHandler) {
+	bh.isFailure = w.f
+}
+
+// WithCacheFallback creates a Option that reads entities from the storage while the circuit of Get is open.
+// The keys not in the storage fail with OpenError in MultiError.
+// The storage is usually shared with the storagecache based middleware, e.g. localcache or rediscache.
+func WithCacheFallback(s storagecache.Storage) Option {
+	return &withCacheFallback{s}
+}
+
+type withCacheFallback struct{ s storagecache.Storage }
+
+func (w *withCacheFallback) Apply(bh *breakerHandler) {
+	bh.fallback = w.s
+}
+
+// WithStateChangeFunc specifies the function that is called on every state transition.
+func WithStateChangeFunc(f func(ctx context.Context, op Op, from, to State)) Option {
+	return &withStateChangeFunc{f}
+}
+
+type withStateChangeFunc struct {
+	f func(ctx context.Context, op Op, from, to State)
+}
+
+func (w *withStateChangeFunc) Apply(bh *breakerHandler) {
+	bh.onStateChange = w.f
+}
+
+// WithLogger creates a Option that uses the specified logger.
+func WithLogger(logf func(ctx context.Context, format string, args ...interface{})) Option {
+	return &withLogger{logf}
+}
+
+type withLogger struct {
+	logf func(ctx context.Context, format string, args ...interface{})
+}
+
+func (w *withLogger) Apply(bh *breakerHandler) {
+	bh.logf = w.logf
+}
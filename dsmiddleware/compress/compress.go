@@ -0,0 +1,334 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+
+	"go.mercari.io/datastore"
+)
+
+var _ datastore.Middleware = &compressHandler{}
+
+const defaultThreshold = 1024
+
+// marker is the prefix of the compressed value.
+// 0xff never appears in UTF-8 text, so it hardly conflicts with the legacy data.
+var marker = []byte{0xff, 'd', 's', 'c'}
+
+const (
+	formatVersion byte = 1
+	headerLength       = 7 // marker + version + algorithm + original type
+
+	origBytes  byte = 'b'
+	origString byte = 's'
+)
+
+// New compress middleware creates & returns.
+func New(opts ...Option) datastore.Middleware {
+	ch := &compressHandler{
+		threshold: defaultThreshold,
+	}
+
+	for _, opt := range opts {
+		opt.Apply(ch)
+	}
+
+	if ch.compressor == nil {
+		ch.compressor = Gzip(gzip.DefaultCompression)
+	}
+	if ch.logf == nil {
+		ch.logf = func(ctx context.Context, format string, args ...interface{}) {}
+	}
+
+	ch.compressors = map[byte]Compressor{
+		GzipID: Gzip(gzip.DefaultCompression),
+		ZstdID: Zstd(),
+	}
+	ch.compressors[ch.compressor.ID()] = ch.compressor
+
+	return ch
+}
+
+// A Option is an option for compress.
+type Option interface {
+	Apply(*compressHandler)
+}
+
+type compressHandler struct {
+	threshold   int
+	compressor  Compressor
+	compressors map[byte]Compressor
+	logf        func(ctx context.Context, format string, args ...interface{})
+}
+
+func (ch *compressHandler) encode(ctx context.Context, origType byte, b []byte) ([]byte, bool) {
+	if len(b) < ch.threshold {
+		return nil, false
+	}
+
+	compressed, err := ch.compressor.Compress(b)
+	if err != nil {
+		ch.logf(ctx, "dsmiddleware/compress: compress error, store as it is. err=%s", err.Error())
+		return nil, false
+	}
+	if len(b) <= headerLength+len(compressed) {
+		// not effective
+		return nil, false
+	}
+
+	buf := make([]byte, 0, headerLength+len(compressed))
+	buf = append(buf, marker...)
+	buf = append(buf, formatVersion, ch.compressor.ID(), origType)
+	buf = append(buf, compressed...)
+
+	return buf, true
+}
+
+func (ch *compressHandler) decode(ctx context.Context, b []byte) (interface{}, bool) {
+	if len(b) < headerLength || !bytes.HasPrefix(b, marker) {
+		return nil, false
+	}
+
+	version, algorithm, origType := b[4], b[5], b[6]
+	if version != formatVersion {
+		ch.logf(ctx, "dsmiddleware/compress: unknown format version=%d, load as it is", version)
+		return nil, false
+	}
+	c, ok := ch.compressors[algorithm]
+	if !ok {
+		ch.logf(ctx, "dsmiddleware/compress: unknown algorithm=%d, load as it is", algorithm)
+		return nil, false
+	}
+
+	decompressed, err := c.Decompress(b[headerLength:])
+	if err != nil {
+		ch.logf(ctx, "dsmiddleware/compress: decompress error, load as it is. err=%s", err.Error())
+		return nil, false
+	}
+
+	switch origType {
+	case origBytes:
+		return decompressed, true
+	case origString:
+		return string(decompressed), true
+	default:
+		ch.logf(ctx, "dsmiddleware/compress: unknown original type=%s, load as it is", fmt.Sprintf("%q", origType))
+		return nil, false
+	}
+}
+
+func (ch *compressHandler) compressValue(ctx context.Context, v interface{}, noIndex bool) (interface{}, bool) {
+	switch v := v.(type) {
+	case []byte:
+		if !noIndex || bytes.HasPrefix(v, marker) {
+			// already compressed value comes when the later middleware starts the operation again, e.g. chunk.
+			return nil, false
+		}
+		return ch.encode(ctx, origBytes, v)
+	case string:
+		if !noIndex {
+			return nil, false
+		}
+		return ch.encode(ctx, origString, []byte(v))
+	case []interface{}:
+		var newList []interface{}
+		for idx, elem := range v {
+			newElem, ok := ch.compressValue(ctx, elem, noIndex)
+			if !ok {
+				continue
+			}
+			if newList == nil {
+				newList = make([]interface{}, len(v))
+				copy(newList, v)
+			}
+			newList[idx] = newElem
+		}
+		if newList == nil {
+			return nil, false
+		}
+		return newList, true
+	case *datastore.Entity:
+		if v == nil {
+			return nil, false
+		}
+		ps, ok := ch.compressProperties(ctx, v.Properties)
+		if !ok {
+			return nil, false
+		}
+		return &datastore.Entity{Key: v.Key, Properties: ps}, true
+	}
+
+	return nil, false
+}
+
+func (ch *compressHandler) decompressValue(ctx context.Context, v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case []byte:
+		return ch.decode(ctx, v)
+	case []interface{}:
+		var newList []interface{}
+		for idx, elem := range v {
+			newElem, ok := ch.decompressValue(ctx, elem)
+			if !ok {
+				continue
+			}
+			if newList == nil {
+				newList = make([]interface{}, len(v))
+				copy(newList, v)
+			}
+			newList[idx] = newElem
+		}
+		if newList == nil {
+			return nil, false
+		}
+		return newList, true
+	case *datastore.Entity:
+		if v == nil {
+			return nil, false
+		}
+		ps, ok := ch.decompressProperties(ctx, v.Properties)
+		if !ok {
+			return nil, false
+		}
+		return &datastore.Entity{Key: v.Key, Properties: ps}, true
+	}
+
+	return nil, false
+}
+
+// compressProperties returns a new slice if any value was compressed, ps is never modified.
+func (ch *compressHandler) compressProperties(ctx context.Context, ps []datastore.Property) ([]datastore.Property, bool) {
+	var newPs []datastore.Property
+	for idx, p := range ps {
+		v, ok := ch.compressValue(ctx, p.Value, p.NoIndex)
+		if !ok {
+			continue
+		}
+		if newPs == nil {
+			newPs = make([]datastore.Property, len(ps))
+			copy(newPs, ps)
+		}
+		newPs[idx].Value = v
+	}
+
+	return newPs, newPs != nil
+}
+
+// decompressProperties returns a new slice if any value was decompressed, ps is never modified.
+func (ch *compressHandler) decompressProperties(ctx context.Context, ps []datastore.Property) ([]datastore.Property, bool) {
+	var newPs []datastore.Property
+	for idx, p := range ps {
+		v, ok := ch.decompressValue(ctx, p.Value)
+		if !ok {
+			continue
+		}
+		if newPs == nil {
+			newPs = make([]datastore.Property, len(ps))
+			copy(newPs, ps)
+		}
+		newPs[idx].Value = v
+	}
+
+	return newPs, newPs != nil
+}
+
+func (ch *compressHandler) compressPropertyLists(ctx context.Context, psList []datastore.PropertyList) []datastore.PropertyList {
+	var newPsList []datastore.PropertyList
+	for idx, ps := range psList {
+		newPs, ok := ch.compressProperties(ctx, ps)
+		if !ok {
+			continue
+		}
+		if newPsList == nil {
+			newPsList = make([]datastore.PropertyList, len(psList))
+			copy(newPsList, psList)
+		}
+		newPsList[idx] = newPs
+	}
+	if newPsList == nil {
+		return psList
+	}
+
+	return newPsList
+}
+
+// decompressPropertyLists decompresses in place, because psList is the destination of Get operations.
+func (ch *compressHandler) decompressPropertyLists(ctx context.Context, psList []datastore.PropertyList) {
+	for idx, ps := range psList {
+		newPs, ok := ch.decompressProperties(ctx, ps)
+		if !ok {
+			continue
+		}
+		psList[idx] = newPs
+	}
+}
+
+func (ch *compressHandler) AllocateIDs(info *datastore.MiddlewareInfo, keys []datastore.Key) ([]datastore.Key, error) {
+	return info.Next.AllocateIDs(info, keys)
+}
+
+func (ch *compressHandler) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.Key, error) {
+	psList = ch.compressPropertyLists(info.Context, psList)
+	return info.Next.PutMultiWithoutTx(info, keys, psList)
+}
+
+func (ch *compressHandler) PutMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.PendingKey, error) {
+	psList = ch.compressPropertyLists(info.Context, psList)
+	return info.Next.PutMultiWithTx(info, keys, psList)
+}
+
+func (ch *compressHandler) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	err := info.Next.GetMultiWithoutTx(info, keys, psList)
+	ch.decompressPropertyLists(info.Context, psList)
+	return err
+}
+
+func (ch *compressHandler) GetMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	err := info.Next.GetMultiWithTx(info, keys, psList)
+	ch.decompressPropertyLists(info.Context, psList)
+	return err
+}
+
+func (ch *compressHandler) DeleteMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	return info.Next.DeleteMultiWithoutTx(info, keys)
+}
+
+func (ch *compressHandler) DeleteMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	return info.Next.DeleteMultiWithTx(info, keys)
+}
+
+func (ch *compressHandler) PostCommit(info *datastore.MiddlewareInfo, tx datastore.Transaction, commit datastore.Commit) error {
+	return info.Next.PostCommit(info, tx, commit)
+}
+
+func (ch *compressHandler) PostRollback(info *datastore.MiddlewareInfo, tx datastore.Transaction) error {
+	return info.Next.PostRollback(info, tx)
+}
+
+func (ch *compressHandler) Run(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) datastore.Iterator {
+	return info.Next.Run(info, q, qDump)
+}
+
+func (ch *compressHandler) GetAll(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, psList *[]datastore.PropertyList) ([]datastore.Key, error) {
+	keys, err := info.Next.GetAll(info, q, qDump, psList)
+	if psList != nil {
+		ch.decompressPropertyLists(info.Context, *psList)
+	}
+	return keys, err
+}
+
+func (ch *compressHandler) Next(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, iter datastore.Iterator, ps *datastore.PropertyList) (datastore.Key, error) {
+	key, err := info.Next.Next(info, q, qDump, iter, ps)
+	if err == nil && ps != nil {
+		if newPs, ok := ch.decompressProperties(info.Context, *ps); ok {
+			*ps = newPs
+		}
+	}
+	return key, err
+}
+
+func (ch *compressHandler) Count(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) (int, error) {
+	return info.Next.Count(info, q, qDump)
+}
@@ -0,0 +1,287 @@
+package compress
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/dsmiddleware/localcache"
+	"go.mercari.io/datastore/internal/testutils"
+)
+
+type Data struct {
+	Name  string
+	Text  string   `datastore:",noindex"`
+	Blob  []byte   `datastore:",noindex"`
+	Texts []string `datastore:",noindex"`
+}
+
+func hasMarker(v interface{}) bool {
+	b, ok := v.([]byte)
+	if !ok {
+		return false
+	}
+	return bytes.HasPrefix(b, marker)
+}
+
+func TestCompress_Basic(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	var logs []string
+	logf := func(ctx context.Context, format string, args ...interface{}) {
+		t.Logf(format, args...)
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+
+	client.AppendMiddleware(New(WithLogger(logf)))
+	client.AppendMiddleware(ms)
+
+	long := strings.Repeat("Hello, world! ", 200)
+	objBefore := &Data{
+		Name:  long,
+		Text:  long,
+		Blob:  []byte(long),
+		Texts: []string{"short", long},
+	}
+
+	key, err := client.Put(ctx, client.IncompleteKey("Data", nil), objBefore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if objBefore.Text != long || string(objBefore.Blob) != long || objBefore.Texts[1] != long {
+		t.Errorf("the source object is modified")
+	}
+
+	ps, ok := ms.Raw(key)
+	if !ok {
+		t.Fatalf("unexpected: %v", ok)
+	}
+	for _, p := range ps {
+		switch p.Name {
+		case "Name":
+			// indexed property is not compressed
+			if v, ok := p.Value.(string); !ok || v != long {
+				t.Errorf("unexpected: %T", p.Value)
+			}
+		case "Text", "Blob":
+			if !hasMarker(p.Value) {
+				t.Errorf("%s is not compressed", p.Name)
+			}
+			if len(p.Value.([]byte)) >= len(long) {
+				t.Errorf("unexpected: %v", len(p.Value.([]byte)))
+			}
+		case "Texts":
+			list := p.Value.([]interface{})
+			if v, ok := list[0].(string); !ok || v != "short" {
+				t.Errorf("unexpected: %T", list[0])
+			}
+			if !hasMarker(list[1]) {
+				t.Errorf("Texts[1] is not compressed")
+			}
+		}
+	}
+
+	objAfter := &Data{}
+	err = client.Get(ctx, key, objAfter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if objAfter.Name != long || objAfter.Text != long || string(objAfter.Blob) != long {
+		t.Errorf("unexpected: %v", objAfter)
+	}
+	if len(objAfter.Texts) != 2 || objAfter.Texts[0] != "short" || objAfter.Texts[1] != long {
+		t.Errorf("unexpected: %v", objAfter.Texts)
+	}
+
+	var list []*Data
+	_, err = client.GetAll(ctx, client.NewQuery("Data"), &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("unexpected: %v", len(list))
+	}
+	if list[0].Text != long || string(list[0].Blob) != long {
+		t.Errorf("unexpected: %v", list[0])
+	}
+
+	if len(logs) != 0 {
+		t.Errorf("unexpected: %v", logs)
+	}
+}
+
+func TestCompress_BelowThreshold(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	client.AppendMiddleware(New(WithThreshold(100)))
+	client.AppendMiddleware(ms)
+
+	objBefore := &Data{
+		Text: strings.Repeat("a", 99),
+		Blob: []byte(strings.Repeat("a", 100)),
+	}
+	key, err := client.Put(ctx, client.IncompleteKey("Data", nil), objBefore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps, _ := ms.Raw(key)
+	for _, p := range ps {
+		switch p.Name {
+		case "Text":
+			if _, ok := p.Value.(string); !ok {
+				t.Errorf("unexpected: %T", p.Value)
+			}
+		case "Blob":
+			if !hasMarker(p.Value) {
+				t.Errorf("Blob is not compressed")
+			}
+		}
+	}
+}
+
+func TestCompress_Incompressible(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	client.AppendMiddleware(New(WithThreshold(1)))
+	client.AppendMiddleware(ms)
+
+	// too short to get smaller
+	objBefore := &Data{Text: "abc"}
+	key, err := client.Put(ctx, client.IncompleteKey("Data", nil), objBefore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps, _ := ms.Raw(key)
+	for _, p := range ps {
+		if p.Name != "Text" {
+			continue
+		}
+		if v, ok := p.Value.(string); !ok || v != "abc" {
+			t.Errorf("unexpected: %v", p.Value)
+		}
+	}
+}
+
+func TestCompress_LegacyData(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	var logs []string
+	logf := func(ctx context.Context, format string, args ...interface{}) {
+		t.Logf(format, args...)
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+
+	client.AppendMiddleware(New(WithLogger(logf)))
+	client.AppendMiddleware(ms)
+
+	long := strings.Repeat("Hello, world! ", 200)
+	// broken data that looks like compressed
+	broken := append(append([]byte{}, marker...), formatVersion, GzipID, origBytes, 1, 2, 3)
+
+	key := client.IDKey("Data", 1, nil)
+	ms.SetRaw(key, datastore.PropertyList{
+		{Name: "Text", Value: long, NoIndex: true},
+		{Name: "Blob", Value: broken, NoIndex: true},
+	})
+
+	obj := &Data{}
+	err := client.Get(ctx, key, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Text != long {
+		t.Errorf("unexpected: %v", obj.Text)
+	}
+	if !bytes.Equal(obj.Blob, broken) {
+		t.Errorf("unexpected: %v", obj.Blob)
+	}
+
+	if len(logs) != 1 || !strings.HasPrefix(logs[0], "dsmiddleware/compress: decompress error") {
+		t.Errorf("unexpected: %v", logs)
+	}
+}
+
+func TestCompress_Zstd(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	client.AppendMiddleware(New(WithCompressor(Zstd())))
+	client.AppendMiddleware(ms)
+
+	long := strings.Repeat("Hello, world! ", 200)
+	key, err := client.Put(ctx, client.IncompleteKey("Data", nil), &Data{Blob: []byte(long)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps, _ := ms.Raw(key)
+	for _, p := range ps {
+		if p.Name != "Blob" {
+			continue
+		}
+		if !hasMarker(p.Value) {
+			t.Fatalf("Blob is not compressed")
+		}
+		if v := p.Value.([]byte)[5]; v != ZstdID {
+			t.Errorf("unexpected: %v", v)
+		}
+	}
+
+	// saved by zstd, loaded by default (gzip) middleware.
+	client.RemoveMiddleware(ms)
+	client.AppendMiddleware(New())
+	client.AppendMiddleware(ms)
+
+	obj := &Data{}
+	err = client.Get(ctx, key, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj.Blob) != long {
+		t.Errorf("unexpected: %v", len(obj.Blob))
+	}
+}
+
+func TestCompress_WithLocalCache(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	ch := localcache.New()
+	client.AppendMiddleware(New())
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	long := strings.Repeat("Hello, world! ", 200)
+	key, err := client.Put(ctx, client.IncompleteKey("Data", nil), &Data{Text: long})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cis, err := ch.GetMulti(ctx, []datastore.Key{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cis) != 1 || cis[0] == nil {
+		t.Fatalf("unexpected: %v", cis)
+	}
+	for _, p := range cis[0].PropertyList {
+		if p.Name == "Text" && !hasMarker(p.Value) {
+			t.Errorf("cache doesn't keep the compressed form")
+		}
+	}
+
+	obj := &Data{}
+	err = client.Get(ctx, key, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Text != long {
+		t.Errorf("unexpected: %v", obj.Text)
+	}
+	if v := ms.Calls("GetMultiWithoutTx"); v != 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
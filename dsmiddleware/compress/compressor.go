@@ -0,0 +1,108 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// GzipID is the algorithm ID of Gzip compressor.
+	GzipID byte = 1
+	// ZstdID is the algorithm ID of Zstd compressor.
+	ZstdID byte = 2
+)
+
+// Compressor compresses and decompresses property values.
+// ID is recorded into the marker of the compressed value, it must be unique and must not be changed.
+type Compressor interface {
+	ID() byte
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+// Gzip returns Compressor that uses gzip with specified compression level.
+func Gzip(level int) Compressor {
+	return &gzipCompressor{level: level}
+}
+
+type gzipCompressor struct {
+	level int
+}
+
+func (c *gzipCompressor) ID() byte {
+	return GzipID
+}
+
+func (c *gzipCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c *gzipCompressor) Decompress(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// Zstd returns Compressor that uses zstd with default compression level.
+func Zstd() Compressor {
+	return &zstdCompressor{}
+}
+
+type zstdCompressor struct {
+	once sync.Once
+	enc  *zstd.Encoder
+	dec  *zstd.Decoder
+	err  error
+}
+
+func (c *zstdCompressor) init() error {
+	c.once.Do(func() {
+		c.enc, c.err = zstd.NewWriter(nil)
+		if c.err != nil {
+			return
+		}
+		c.dec, c.err = zstd.NewReader(nil)
+	})
+
+	return c.err
+}
+
+func (c *zstdCompressor) ID() byte {
+	return ZstdID
+}
+
+func (c *zstdCompressor) Compress(src []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+
+	return c.enc.EncodeAll(src, nil), nil
+}
+
+func (c *zstdCompressor) Decompress(src []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+
+	return c.dec.DecodeAll(src, nil)
+}
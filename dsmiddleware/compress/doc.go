@@ -0,0 +1,15 @@
+/*
+Package compress shrinks large NoIndex properties transparently.
+
+[]byte and string values of NoIndex properties that are larger than the threshold are compressed before Put,
+and they are decompressed after Get, GetAll and Next.
+The compressed value is saved as []byte that starts with a marker,
+so values saved before this middleware was introduced are loaded as they are.
+
+Place this middleware before the cache middlewares (localcache, rediscache, dsmemcache, aememcache).
+Middleware will apply First-In First-Apply, so the cache storage keeps the compressed form as it is.
+
+The default algorithm is gzip. zstd is also available by WithCompressor(Zstd()).
+Every algorithm that this package provides can be loaded regardless of the algorithm used for saving.
+*/
+package compress // import "go.mercari.io/datastore/dsmiddleware/compress"
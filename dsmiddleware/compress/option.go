@@ -0,0 +1,39 @@
+package compress
+
+import "context"
+
+// WithThreshold specifies the minimum byte size of the value to be compressed.
+func WithThreshold(threshold int) Option {
+	return &withThreshold{threshold}
+}
+
+type withThreshold struct{ threshold int }
+
+func (w *withThreshold) Apply(o *compressHandler) {
+	o.threshold = w.threshold
+}
+
+// WithCompressor specifies the compression algorithm used for saving.
+// The Compressor is also used for loading the value marked with its ID.
+func WithCompressor(c Compressor) Option {
+	return &withCompressor{c}
+}
+
+type withCompressor struct{ c Compressor }
+
+func (w *withCompressor) Apply(o *compressHandler) {
+	o.compressor = w.c
+}
+
+// WithLogger creates a Option that uses the specified logger.
+func WithLogger(logf func(ctx context.Context, format string, args ...interface{})) Option {
+	return &withLogger{logf}
+}
+
+type withLogger struct {
+	logf func(ctx context.Context, format string, args ...interface{})
+}
+
+func (w *withLogger) Apply(o *compressHandler) {
+	o.logf = w.logf
+}
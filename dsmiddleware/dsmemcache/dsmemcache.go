@@ -1,9 +1,7 @@
 package dsmemcache
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
 	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
@@ -12,16 +10,20 @@ import (
 )
 
 var _ storagecache.Storage = &cacheHandler{}
+var _ storagecache.LockStorage = &cacheHandler{}
 var _ datastore.Middleware = &cacheHandler{}
 
+const defaultLockDuration = 32 * time.Second
+
 // New dsmemcache middleware creates & returns.
 func New(client *memcache.Client, opts ...CacheOption) interface {
 	datastore.Middleware
 	storagecache.Storage
 } {
 	ch := &cacheHandler{
-		client: client,
-		stOpts: &storagecache.Options{},
+		client:       client,
+		stOpts:       &storagecache.Options{},
+		lockDuration: defaultLockDuration,
 	}
 
 	for _, opt := range opts {
@@ -39,6 +41,9 @@ func New(client *memcache.Client, opts ...CacheOption) interface {
 			return "mercari:dsmemcache:" + key.Encode()
 		}
 	}
+	if ch.codec == nil {
+		ch.codec = storagecache.NewGobCodec()
+	}
 
 	return ch
 }
@@ -47,10 +52,13 @@ type cacheHandler struct {
 	datastore.Middleware
 	stOpts *storagecache.Options
 
-	client         *memcache.Client
-	expireDuration time.Duration
-	logf           func(ctx context.Context, format string, args ...interface{})
-	cacheKey       func(key datastore.Key) string
+	client                 *memcache.Client
+	expireDuration         time.Duration
+	negativeExpireDuration time.Duration
+	lockDuration           time.Duration
+	logf                   func(ctx context.Context, format string, args ...interface{})
+	cacheKey               func(key datastore.Key) string
+	codec                  storagecache.Codec
 }
 
 // A CacheOption is an cache option for a dsmemcache middleware.
@@ -66,16 +74,15 @@ func (ch *cacheHandler) SetMulti(ctx context.Context, cis []*storagecache.CacheI
 		if ci.Key.Incomplete() {
 			panic("incomplete key incoming")
 		}
-		var buf bytes.Buffer
-		enc := gob.NewEncoder(&buf)
-		if err := enc.Encode(ci.PropertyList); err != nil {
-			ch.logf(ctx, "dsmiddleware/dsmemcache.SetMulti: gob.Encode error key=%s err=%s", ci.Key.String(), err.Error())
+		b, err := ch.codec.Encode(ci)
+		if err != nil {
+			ch.logf(ctx, "dsmiddleware/dsmemcache.SetMulti: encode error key=%s err=%s", ci.Key.String(), err.Error())
 			continue
 		}
 		item := &memcache.Item{
 			Key:        ch.cacheKey(ci.Key),
-			Value:      buf.Bytes(),
-			Expiration: int32(ch.expireDuration.Seconds()),
+			Value:      b,
+			Expiration: ch.expiration(ci),
 		}
 		if err := ch.client.Set(item); err != nil {
 			return err
@@ -85,6 +92,20 @@ func (ch *cacheHandler) SetMulti(ctx context.Context, cis []*storagecache.CacheI
 	return nil
 }
 
+// expiration returns the expiration in seconds of the item.
+func (ch *cacheHandler) expiration(ci *storagecache.CacheItem) int32 {
+	if !ci.NoSuchEntity {
+		return int32(ch.expireDuration.Seconds())
+	}
+
+	// memcache treats 0 as no expiration, so the tombstone lives 1 second at least.
+	expiration := int32(ch.negativeExpireDuration.Seconds())
+	if expiration < 1 {
+		expiration = 1
+	}
+	return expiration
+}
+
 func (ch *cacheHandler) GetMulti(ctx context.Context, keys []datastore.Key) ([]*storagecache.CacheItem, error) {
 	ch.logf(ctx, "dsmiddleware/dsmemcache.GetMulti: incoming len=%d", len(keys))
 
@@ -103,26 +124,20 @@ func (ch *cacheHandler) GetMulti(ctx context.Context, keys []datastore.Key) ([]*
 	hit, miss := 0, 0
 	for idx, key := range keys {
 		item, ok := itemMap[ch.cacheKey(key)]
-		if !ok {
+		if !ok || storagecache.IsLockValue(item.Value) {
 			resultList[idx] = nil
 			miss++
 			continue
 		}
-		buf := bytes.NewBuffer(item.Value)
-		dec := gob.NewDecoder(buf)
-		var ps datastore.PropertyList
-		err = dec.Decode(&ps)
+		ci, err := ch.codec.Decode(key, item.Value)
 		if err != nil {
 			resultList[idx] = nil
-			ch.logf(ctx, "dsmiddleware/dsmemcache.GetMulti: gob.Decode error key=%s err=%s", key.String(), err.Error())
+			ch.logf(ctx, "dsmiddleware/dsmemcache.GetMulti: decode error key=%s err=%s", key.String(), err.Error())
 			miss++
 			continue
 		}
 
-		resultList[idx] = &storagecache.CacheItem{
-			Key:          key,
-			PropertyList: ps,
-		}
+		resultList[idx] = ci
 		hit++
 	}
 
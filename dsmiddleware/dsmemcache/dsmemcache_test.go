@@ -6,6 +6,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/MakeNowJust/heredoc/v2"
 	"github.com/bradfitz/gomemcache/memcache"
@@ -371,3 +372,59 @@ func TestMemcache_MultiError(t *testing.T) {
 		t.Errorf("unexpected: %v", v)
 	}
 }
+
+func TestMemcache_LockProtocol(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	memcacheClient := memcache.New(os.Getenv("MEMCACHE_ADDR"))
+	ch := New(memcacheClient, WithLockProtocol(time.Minute))
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	key := client.NameKey("Data", fmt.Sprintf("lock-%d", time.Now().UnixNano()), nil)
+	cacheKey := "mercari:dsmemcache:" + key.Encode()
+	_, err := client.Put(ctx, key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the writer releases the lock, and doesn't fill the cache.
+	if _, err := memcacheClient.Get(cacheKey); err != memcache.ErrCacheMiss {
+		t.Fatalf("unexpected: %v", err)
+	}
+
+	// the reader fills the cache by the compare-and-swap.
+	for i := 0; i < 2; i++ {
+		err = client.Get(ctx, key, &Data{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v := ms.Calls("GetMultiWithoutTx"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// the lock of the writer is the cache miss, and the reader doesn't fill over it.
+	err = ch.(storagecache.LockStorage).LockMulti(ctx, []datastore.Key{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Get(ctx, key, &Data{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := ms.Calls("GetMultiWithoutTx"); v != 2 {
+		t.Errorf("unexpected: %v", v)
+	}
+	item, err := memcacheClient.Get(cacheKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !storagecache.IsLockValue(item.Value) {
+		t.Errorf("unexpected: %v", item.Value)
+	}
+}
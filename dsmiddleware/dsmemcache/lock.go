@@ -0,0 +1,102 @@
+package dsmemcache
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/dsmiddleware/storagecache"
+)
+
+func (ch *cacheHandler) LockMulti(ctx context.Context, keys []datastore.Key) error {
+	ch.logf(ctx, "dsmiddleware/dsmemcache.LockMulti: incoming len=%d", len(keys))
+
+	lock := storagecache.NewLockValue()
+	for _, key := range keys {
+		item := &memcache.Item{
+			Key:        ch.cacheKey(key),
+			Value:      lock,
+			Expiration: int32(ch.lockDuration.Seconds()),
+		}
+		if err := ch.client.Set(item); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ch *cacheHandler) AddLockMulti(ctx context.Context, keys []datastore.Key) ([][]byte, error) {
+	ch.logf(ctx, "dsmiddleware/dsmemcache.AddLockMulti: incoming len=%d", len(keys))
+
+	locks := make([][]byte, len(keys))
+	lock := storagecache.NewLockValue()
+	locked := 0
+	for idx, key := range keys {
+		item := &memcache.Item{
+			Key:        ch.cacheKey(key),
+			Value:      lock,
+			Expiration: int32(ch.lockDuration.Seconds()),
+		}
+		err := ch.client.Add(item)
+		if err == memcache.ErrNotStored {
+			// the entity is cached, or the other locks it.
+			continue
+		} else if err != nil {
+			return locks, err
+		}
+		locks[idx] = lock
+		locked++
+	}
+
+	ch.logf(ctx, "dsmiddleware/dsmemcache.AddLockMulti: locked=%d", locked)
+
+	return locks, nil
+}
+
+func (ch *cacheHandler) CompareAndSwapMulti(ctx context.Context, cis []*storagecache.CacheItem, locks [][]byte) error {
+	ch.logf(ctx, "dsmiddleware/dsmemcache.CompareAndSwapMulti: incoming len=%d", len(cis))
+
+	cacheKeys := make([]string, 0, len(cis))
+	for _, ci := range cis {
+		if ci.Key.Incomplete() {
+			panic("incomplete key incoming")
+		}
+		cacheKeys = append(cacheKeys, ch.cacheKey(ci.Key))
+	}
+	// the items have the cas id to swap.
+	itemMap, err := ch.client.GetMulti(cacheKeys)
+	if err != nil {
+		return err
+	}
+
+	swapped, conflicted := 0, 0
+	for idx, ci := range cis {
+		item, ok := itemMap[cacheKeys[idx]]
+		if !ok || !bytes.Equal(item.Value, locks[idx]) {
+			conflicted++
+			continue
+		}
+		b, err := ch.codec.Encode(ci)
+		if err != nil {
+			ch.logf(ctx, "dsmiddleware/dsmemcache.CompareAndSwapMulti: encode error key=%s err=%s", ci.Key.String(), err.Error())
+			continue
+		}
+		item.Value = b
+		item.Expiration = ch.expiration(ci)
+		err = ch.client.CompareAndSwap(item)
+		if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+			// the other writer or reader wins, the cache isn't filled.
+			conflicted++
+			continue
+		} else if err != nil {
+			return err
+		}
+		swapped++
+	}
+
+	ch.logf(ctx, "dsmiddleware/dsmemcache.CompareAndSwapMulti: swapped=%d conflicted=%d", swapped, conflicted)
+
+	return nil
+}
@@ -0,0 +1,19 @@
+/*
+Package dsmetrics records the count, the latency, the entity count, the estimated bytes and the errors of each operation.
+
+The measurements are passed to Recorder with the operation name and the Kind.
+The errors are classified by the gRPC code name, and the elements of MultiError are counted separately,
+so the rate of ErrNoSuchEntity is derived from ElementCodes["NotFound"] and Entities.
+
+	rec := prommetrics.New()
+	prometheus.MustRegister(rec)
+	client.AppendMiddleware(dsmetrics.New(rec))
+
+The cache middlewares built on storagecache report the hits and the misses to the same Recorder by CacheStats.
+
+	client.AppendMiddleware(localcache.New(localcache.WithStatsRecorder(dsmetrics.CacheStats(rec, "localcache"))))
+
+Place this middleware after the cache middlewares to measure only RPCs.
+Subpackage prommetrics provides the Recorder for Prometheus, and otelmetrics provides it for OpenTelemetry.
+*/
+package dsmetrics // import "go.mercari.io/datastore/dsmiddleware/dsmetrics"
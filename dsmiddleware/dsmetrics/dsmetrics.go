@@ -0,0 +1,288 @@
+package dsmetrics
+
+import (
+	"time"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/internal/errcode"
+	"go.mercari.io/datastore/internal/estimate"
+	"google.golang.org/api/iterator"
+)
+
+var _ datastore.Middleware = &metricsHandler{}
+
+// New metrics middleware creates & returns.
+func New(r Recorder, opts ...Option) datastore.Middleware {
+	mh := &metricsHandler{
+		r:   r,
+		now: time.Now,
+	}
+
+	for _, opt := range opts {
+		opt.Apply(mh)
+	}
+
+	return mh
+}
+
+// A Option is an option for dsmetrics.
+type Option interface {
+	Apply(*metricsHandler)
+}
+
+type metricsHandler struct {
+	r         Recorder
+	skipBytes bool
+	now       func() time.Time
+}
+
+func keysKind(keys []datastore.Key) string {
+	var kind string
+	for _, key := range keys {
+		if key == nil {
+			continue
+		}
+		if kind == "" {
+			kind = key.Kind()
+		} else if kind != key.Kind() {
+			return MixedKind
+		}
+	}
+
+	return kind
+}
+
+func (mh *metricsHandler) keysBytes(keys []datastore.Key) int {
+	if mh.skipBytes {
+		return 0
+	}
+	size := 0
+	for _, key := range keys {
+		if key == nil {
+			continue
+		}
+		size += estimate.KeySize(key)
+	}
+
+	return size
+}
+
+func (mh *metricsHandler) entitiesBytes(keys []datastore.Key, psList []datastore.PropertyList, errs []error) int {
+	if mh.skipBytes {
+		return 0
+	}
+	size := 0
+	for idx, key := range keys {
+		if idx >= len(psList) || (errs != nil && errs[idx] != nil) {
+			continue
+		}
+		size += estimate.EntitySize(key, psList[idx])
+	}
+
+	return size
+}
+
+func (mh *metricsHandler) record(info *datastore.MiddlewareInfo, m *Measurement, start time.Time, err error) {
+	m.Duration = mh.now().Sub(start)
+	m.Code = errcode.Code(err)
+	if merr, ok := err.(datastore.MultiError); ok {
+		m.Code = errcode.Code(nil)
+		m.ElementCodes = make(map[string]int)
+		for _, err := range merr {
+			if err != nil {
+				m.ElementCodes[errcode.Code(err)]++
+			}
+		}
+	}
+
+	mh.r.RecordOperation(info.Context, m)
+}
+
+// elementErrors returns the errors of each element, or nil if err isn't MultiError.
+func elementErrors(err error) []error {
+	merr, ok := err.(datastore.MultiError)
+	if !ok {
+		return nil
+	}
+	return merr
+}
+
+// succeeded returns the count of elements that have no error.
+func succeeded(n int, err error) int {
+	if err == nil {
+		return n
+	}
+	merr, ok := err.(datastore.MultiError)
+	if !ok {
+		return 0
+	}
+	cnt := 0
+	for _, err := range merr {
+		if err == nil {
+			cnt++
+		}
+	}
+
+	return cnt
+}
+
+func (mh *metricsHandler) AllocateIDs(info *datastore.MiddlewareInfo, keys []datastore.Key) ([]datastore.Key, error) {
+	start := mh.now()
+	m := &Measurement{Op: "AllocateIDs", Kind: keysKind(keys), Transaction: info.Transaction != nil}
+
+	keys, err := info.Next.AllocateIDs(info, keys)
+	m.Entities = len(keys)
+	mh.record(info, m, start, err)
+
+	return keys, err
+}
+
+func (mh *metricsHandler) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.Key, error) {
+	start := mh.now()
+	m := &Measurement{Op: "PutMultiWithoutTx", Kind: keysKind(keys)}
+	m.Bytes = mh.entitiesBytes(keys, psList, nil)
+
+	retKeys, err := info.Next.PutMultiWithoutTx(info, keys, psList)
+	m.Entities = succeeded(len(keys), err)
+	mh.record(info, m, start, err)
+
+	return retKeys, err
+}
+
+func (mh *metricsHandler) PutMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.PendingKey, error) {
+	start := mh.now()
+	m := &Measurement{Op: "PutMultiWithTx", Kind: keysKind(keys), Transaction: true}
+	m.Bytes = mh.entitiesBytes(keys, psList, nil)
+
+	pKeys, err := info.Next.PutMultiWithTx(info, keys, psList)
+	m.Entities = succeeded(len(keys), err)
+	mh.record(info, m, start, err)
+
+	return pKeys, err
+}
+
+func (mh *metricsHandler) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	start := mh.now()
+	m := &Measurement{Op: "GetMultiWithoutTx", Kind: keysKind(keys)}
+
+	err := info.Next.GetMultiWithoutTx(info, keys, psList)
+	m.Entities = succeeded(len(keys), err)
+	if m.Entities != 0 {
+		m.Bytes = mh.entitiesBytes(keys, psList, elementErrors(err))
+	}
+	mh.record(info, m, start, err)
+
+	return err
+}
+
+func (mh *metricsHandler) GetMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	start := mh.now()
+	m := &Measurement{Op: "GetMultiWithTx", Kind: keysKind(keys), Transaction: true}
+
+	err := info.Next.GetMultiWithTx(info, keys, psList)
+	m.Entities = succeeded(len(keys), err)
+	if m.Entities != 0 {
+		m.Bytes = mh.entitiesBytes(keys, psList, elementErrors(err))
+	}
+	mh.record(info, m, start, err)
+
+	return err
+}
+
+func (mh *metricsHandler) DeleteMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	start := mh.now()
+	m := &Measurement{Op: "DeleteMultiWithoutTx", Kind: keysKind(keys)}
+	m.Bytes = mh.keysBytes(keys)
+
+	err := info.Next.DeleteMultiWithoutTx(info, keys)
+	m.Entities = succeeded(len(keys), err)
+	mh.record(info, m, start, err)
+
+	return err
+}
+
+func (mh *metricsHandler) DeleteMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	start := mh.now()
+	m := &Measurement{Op: "DeleteMultiWithTx", Kind: keysKind(keys), Transaction: true}
+	m.Bytes = mh.keysBytes(keys)
+
+	err := info.Next.DeleteMultiWithTx(info, keys)
+	m.Entities = succeeded(len(keys), err)
+	mh.record(info, m, start, err)
+
+	return err
+}
+
+func (mh *metricsHandler) PostCommit(info *datastore.MiddlewareInfo, tx datastore.Transaction, commit datastore.Commit) error {
+	start := mh.now()
+	m := &Measurement{Op: "PostCommit", Transaction: true}
+
+	err := info.Next.PostCommit(info, tx, commit)
+	mh.record(info, m, start, err)
+
+	return err
+}
+
+func (mh *metricsHandler) PostRollback(info *datastore.MiddlewareInfo, tx datastore.Transaction) error {
+	start := mh.now()
+	m := &Measurement{Op: "PostRollback", Transaction: true}
+
+	err := info.Next.PostRollback(info, tx)
+	mh.record(info, m, start, err)
+
+	return err
+}
+
+func (mh *metricsHandler) Run(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) datastore.Iterator {
+	// Run doesn't call RPC, it is measured by Next.
+	return info.Next.Run(info, q, qDump)
+}
+
+func (mh *metricsHandler) GetAll(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, psList *[]datastore.PropertyList) ([]datastore.Key, error) {
+	start := mh.now()
+	m := &Measurement{Op: "GetAll", Kind: qDump.Kind, Transaction: qDump.Transaction != nil}
+
+	keys, err := info.Next.GetAll(info, q, qDump, psList)
+	m.Entities = len(keys)
+	if err == nil && psList != nil {
+		m.Bytes = mh.entitiesBytes(keys, *psList, nil)
+	} else if err == nil {
+		m.Bytes = mh.keysBytes(keys)
+	}
+	mh.record(info, m, start, err)
+
+	return keys, err
+}
+
+func (mh *metricsHandler) Next(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, iter datastore.Iterator, ps *datastore.PropertyList) (datastore.Key, error) {
+	start := mh.now()
+	m := &Measurement{Op: "Next", Kind: qDump.Kind, Transaction: qDump.Transaction != nil}
+
+	key, err := info.Next.Next(info, q, qDump, iter, ps)
+	if err == nil {
+		m.Entities = 1
+		if ps != nil {
+			m.Bytes = mh.entitiesBytes([]datastore.Key{key}, []datastore.PropertyList{*ps}, nil)
+		} else {
+			m.Bytes = mh.keysBytes([]datastore.Key{key})
+		}
+	}
+	if err == iterator.Done {
+		mh.record(info, m, start, nil)
+	} else {
+		mh.record(info, m, start, err)
+	}
+
+	return key, err
+}
+
+func (mh *metricsHandler) Count(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) (int, error) {
+	start := mh.now()
+	m := &Measurement{Op: "Count", Kind: qDump.Kind, Transaction: qDump.Transaction != nil}
+
+	cnt, err := info.Next.Count(info, q, qDump)
+	m.Entities = cnt
+	mh.record(info, m, start, err)
+
+	return cnt, err
+}
@@ -0,0 +1,140 @@
+package dsmetrics
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/dsmiddleware/localcache"
+	"go.mercari.io/datastore/internal/testutils"
+)
+
+type Data struct {
+	Name string
+}
+
+type captureRecorder struct {
+	m      sync.Mutex
+	ops    []*Measurement
+	caches []*CacheMeasurement
+}
+
+func (r *captureRecorder) RecordOperation(ctx context.Context, m *Measurement) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.ops = append(r.ops, m)
+}
+
+func (r *captureRecorder) RecordCache(ctx context.Context, m *CacheMeasurement) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.caches = append(r.caches, m)
+}
+
+func TestMetrics_Basic(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	rec := &captureRecorder{}
+	client.AppendMiddleware(New(rec))
+	client.AppendMiddleware(ms)
+
+	keys, err := client.PutMulti(ctx, []datastore.Key{
+		client.NameKey("Data", "a", nil),
+		client.NameKey("Data", "b", nil),
+	}, []*Data{{Name: "foo"}, {Name: "bar"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := make([]*Data, 3)
+	err = client.GetMulti(ctx, append(keys, client.NameKey("Data", "missing", nil)), list)
+	if _, ok := err.(datastore.MultiError); !ok {
+		t.Fatalf("unexpected: %v", err)
+	}
+
+	_, err = client.GetAll(ctx, client.NewQuery("Data"), &[]*Data{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.DeleteMulti(ctx, []datastore.Key{keys[0], client.NameKey("Other", "a", nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rec.ops) != 4 {
+		t.Fatalf("unexpected: %v", len(rec.ops))
+	}
+
+	if v := rec.ops[0]; v.Op != "PutMultiWithoutTx" || v.Kind != "Data" || v.Entities != 2 || v.Bytes == 0 || v.Code != "OK" || v.Transaction {
+		t.Errorf("unexpected: %+v", v)
+	}
+	if v := rec.ops[1]; v.Op != "GetMultiWithoutTx" || v.Entities != 2 || v.Bytes != rec.ops[0].Bytes || v.Code != "OK" || v.ElementCodes["NotFound"] != 1 {
+		t.Errorf("unexpected: %+v", v)
+	}
+	if v := rec.ops[2]; v.Op != "GetAll" || v.Kind != "Data" || v.Entities != 2 || v.Bytes != rec.ops[0].Bytes {
+		t.Errorf("unexpected: %+v", v)
+	}
+	if v := rec.ops[3]; v.Op != "DeleteMultiWithoutTx" || v.Kind != MixedKind || v.Entities != 2 {
+		t.Errorf("unexpected: %+v", v)
+	}
+}
+
+func TestMetrics_SkipBytes(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	rec := &captureRecorder{}
+	client.AppendMiddleware(New(rec, WithSkipBytes()))
+	client.AppendMiddleware(ms)
+
+	_, err := client.Put(ctx, client.NameKey("Data", "a", nil), &Data{Name: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rec.ops) != 1 {
+		t.Fatalf("unexpected: %v", len(rec.ops))
+	}
+	if v := rec.ops[0]; v.Bytes != 0 || v.Entities != 1 {
+		t.Errorf("unexpected: %+v", v)
+	}
+}
+
+func TestMetrics_CacheStats(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	rec := &captureRecorder{}
+	client.AppendMiddleware(localcache.New(localcache.WithStatsRecorder(CacheStats(rec, "localcache"))))
+	client.AppendMiddleware(New(rec))
+	client.AppendMiddleware(ms)
+
+	key := client.NameKey("Data", "a", nil)
+	err := client.Get(ctx, key, &Data{})
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("unexpected: %v", err)
+	}
+	_, err = client.Put(ctx, key, &Data{Name: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Get(ctx, key, &Data{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rec.caches) != 2 {
+		t.Fatalf("unexpected: %v", len(rec.caches))
+	}
+	if v := rec.caches[0]; v.Cache != "localcache" || v.Kind != "Data" || v.Hits != 0 || v.Misses != 1 {
+		t.Errorf("unexpected: %+v", v)
+	}
+	if v := rec.caches[1]; v.Hits != 1 || v.Misses != 0 {
+		t.Errorf("unexpected: %+v", v)
+	}
+
+	// the second Get is served by the cache.
+	if len(rec.ops) != 2 {
+		t.Errorf("unexpected: %v", len(rec.ops))
+	}
+}
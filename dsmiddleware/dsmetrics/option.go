@@ -0,0 +1,13 @@
+package dsmetrics
+
+// WithSkipBytes creates a Option that doesn't estimate the size of entities.
+// The estimation walks all properties of PropertyList.
+func WithSkipBytes() Option {
+	return &withSkipBytes{}
+}
+
+type withSkipBytes struct{}
+
+func (w *withSkipBytes) Apply(mh *metricsHandler) {
+	mh.skipBytes = true
+}
@@ -0,0 +1,12 @@
+/*
+Package otelmetrics provides dsmetrics.Recorder that records the measurements by OpenTelemetry instruments.
+It is the separate module that requires Go 1.19 or later, as go.opentelemetry.io/otel/sdk/metric does.
+
+	rec, err := otelmetrics.New(otelmetrics.WithMeterProvider(mp))
+	...
+	client.AppendMiddleware(dsmetrics.New(rec))
+
+The instruments are datastore.operations, datastore.operation.duration, datastore.operation.entities,
+datastore.operation.bytes, datastore.element_errors and datastore.cache.lookups.
+*/
+package otelmetrics // import "go.mercari.io/datastore/dsmiddleware/dsmetrics/otelmetrics"
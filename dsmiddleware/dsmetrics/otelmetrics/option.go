@@ -0,0 +1,27 @@
+package otelmetrics
+
+import (
+	"go.opentelemetry.io/otel/metric"
+)
+
+// WithMeterProvider specifies the MeterProvider. default is the global MeterProvider.
+func WithMeterProvider(mp metric.MeterProvider) Option {
+	return &withMeterProvider{mp}
+}
+
+type withMeterProvider struct{ mp metric.MeterProvider }
+
+func (w *withMeterProvider) Apply(r *Recorder) {
+	r.meterProvider = w.mp
+}
+
+// WithPrefix specifies the prefix of instrument names. default is "datastore.".
+func WithPrefix(prefix string) Option {
+	return &withPrefix{prefix}
+}
+
+type withPrefix struct{ prefix string }
+
+func (w *withPrefix) Apply(r *Recorder) {
+	r.prefix = w.prefix
+}
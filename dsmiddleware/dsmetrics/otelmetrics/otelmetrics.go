@@ -0,0 +1,108 @@
+package otelmetrics
+
+import (
+	"context"
+
+	"go.mercari.io/datastore/dsmiddleware/dsmetrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const instrumentationName = "go.mercari.io/datastore/dsmiddleware/dsmetrics/otelmetrics"
+
+var _ dsmetrics.Recorder = &Recorder{}
+
+// New returns the Recorder that records the measurements by OpenTelemetry instruments.
+func New(opts ...Option) (*Recorder, error) {
+	r := &Recorder{
+		prefix: "datastore.",
+	}
+
+	for _, opt := range opts {
+		opt.Apply(r)
+	}
+
+	if r.meterProvider == nil {
+		r.meterProvider = otel.GetMeterProvider()
+	}
+	meter := r.meterProvider.Meter(instrumentationName)
+
+	var err error
+	r.operations, err = meter.Int64Counter(r.prefix+"operations", metric.WithDescription("Count of Datastore operations."))
+	if err != nil {
+		return nil, err
+	}
+	r.duration, err = meter.Float64Histogram(r.prefix+"operation.duration", metric.WithDescription("Latency of Datastore operations."), metric.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+	r.entities, err = meter.Int64Histogram(r.prefix+"operation.entities", metric.WithDescription("Count of entities per Datastore operation."))
+	if err != nil {
+		return nil, err
+	}
+	r.bytes, err = meter.Int64Histogram(r.prefix+"operation.bytes", metric.WithDescription("Estimated size of entities per Datastore operation."), metric.WithUnit("By"))
+	if err != nil {
+		return nil, err
+	}
+	r.elementErrors, err = meter.Int64Counter(r.prefix+"element_errors", metric.WithDescription("Count of errors in MultiError."))
+	if err != nil {
+		return nil, err
+	}
+	r.cache, err = meter.Int64Counter(r.prefix+"cache.lookups", metric.WithDescription("Count of cache lookups."))
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// A Option is an option for Recorder.
+type Option interface {
+	Apply(*Recorder)
+}
+
+// Recorder records the measurements by OpenTelemetry instruments.
+type Recorder struct {
+	meterProvider metric.MeterProvider
+	prefix        string
+
+	operations    metric.Int64Counter
+	duration      metric.Float64Histogram
+	entities      metric.Int64Histogram
+	bytes         metric.Int64Histogram
+	elementErrors metric.Int64Counter
+	cache         metric.Int64Counter
+}
+
+// RecordOperation implements dsmetrics.Recorder.
+func (r *Recorder) RecordOperation(ctx context.Context, m *dsmetrics.Measurement) {
+	attrs := []attribute.KeyValue{
+		attribute.String("datastore.op", m.Op),
+		attribute.String("datastore.kind", m.Kind),
+		attribute.Bool("datastore.transaction", m.Transaction),
+	}
+	opt := metric.WithAttributes(attrs...)
+
+	r.operations.Add(ctx, 1, metric.WithAttributes(append(attrs, attribute.String("datastore.code", m.Code))...))
+	r.duration.Record(ctx, m.Duration.Seconds(), opt)
+	r.entities.Record(ctx, int64(m.Entities), opt)
+	r.bytes.Record(ctx, int64(m.Bytes), opt)
+	for code, cnt := range m.ElementCodes {
+		r.elementErrors.Add(ctx, int64(cnt), metric.WithAttributes(append(attrs, attribute.String("datastore.code", code))...))
+	}
+}
+
+// RecordCache implements dsmetrics.Recorder.
+func (r *Recorder) RecordCache(ctx context.Context, m *dsmetrics.CacheMeasurement) {
+	attrs := []attribute.KeyValue{
+		attribute.String("datastore.cache", m.Cache),
+		attribute.String("datastore.kind", m.Kind),
+	}
+	if m.Hits != 0 {
+		r.cache.Add(ctx, int64(m.Hits), metric.WithAttributes(append(attrs, attribute.String("datastore.result", "hit"))...))
+	}
+	if m.Misses != 0 {
+		r.cache.Add(ctx, int64(m.Misses), metric.WithAttributes(append(attrs, attribute.String("datastore.result", "miss"))...))
+	}
+}
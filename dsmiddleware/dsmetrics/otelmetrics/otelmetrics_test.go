@@ -0,0 +1,67 @@
+package otelmetrics
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mercari.io/datastore/dsmiddleware/dsmetrics"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestRecorder(t *testing.T) {
+	ctx := context.Background()
+
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	rec, err := New(WithMeterProvider(mp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec.RecordOperation(ctx, &dsmetrics.Measurement{
+		Op:           "GetMultiWithoutTx",
+		Kind:         "Data",
+		Duration:     10 * time.Millisecond,
+		Entities:     2,
+		Bytes:        100,
+		Code:         "OK",
+		ElementCodes: map[string]int{"NotFound": 1},
+	})
+	rec.RecordCache(ctx, &dsmetrics.CacheMeasurement{Cache: "localcache", Kind: "Data", Hits: 2, Misses: 1})
+
+	var rm metricdata.ResourceMetrics
+	err = reader.Collect(ctx, &rm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rm.ScopeMetrics) != 1 {
+		t.Fatalf("unexpected: %v", len(rm.ScopeMetrics))
+	}
+
+	metrics := make(map[string]metricdata.Metrics)
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		metrics[m.Name] = m
+	}
+	if len(metrics) != 6 {
+		t.Errorf("unexpected: %v", len(metrics))
+	}
+
+	// metricdata.Sum and metricdata.Histogram are generic types, they are inspected by reflect.
+	dataPoints := func(name string) reflect.Value {
+		return reflect.ValueOf(metrics[name].Data).FieldByName("DataPoints")
+	}
+
+	if v := dataPoints("datastore.operations"); v.Len() != 1 || v.Index(0).FieldByName("Value").Int() != 1 {
+		t.Errorf("unexpected: %+v", metrics["datastore.operations"].Data)
+	}
+	if v := dataPoints("datastore.cache.lookups"); v.Len() != 2 {
+		t.Errorf("unexpected: %+v", metrics["datastore.cache.lookups"].Data)
+	}
+	if v := dataPoints("datastore.operation.duration"); v.Len() != 1 || v.Index(0).FieldByName("Count").Uint() != 1 {
+		t.Errorf("unexpected: %+v", metrics["datastore.operation.duration"].Data)
+	}
+}
@@ -0,0 +1,12 @@
+/*
+Package prommetrics provides dsmetrics.Recorder that exports the measurements as Prometheus metrics.
+It is the separate module that requires Go 1.13 or later, as github.com/prometheus/client_golang does.
+
+	rec := prommetrics.New()
+	prometheus.MustRegister(rec)
+	client.AppendMiddleware(dsmetrics.New(rec))
+
+The metrics are datastore_operations_total, datastore_operation_duration_seconds, datastore_operation_entities,
+datastore_operation_bytes, datastore_element_errors_total and datastore_cache_lookups_total.
+*/
+package prommetrics // import "go.mercari.io/datastore/dsmiddleware/dsmetrics/prommetrics"
@@ -0,0 +1,10 @@
+module go.mercari.io/datastore/dsmiddleware/dsmetrics/prommetrics
+
+go 1.13
+
+require (
+	github.com/prometheus/client_golang v1.12.0
+	go.mercari.io/datastore v0.0.0-00010101000000-000000000000
+)
+
+replace go.mercari.io/datastore => ../../..
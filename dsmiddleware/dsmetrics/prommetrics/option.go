@@ -0,0 +1,45 @@
+package prommetrics
+
+// WithNamespace specifies the namespace of metric names. default is "datastore".
+func WithNamespace(namespace string) Option {
+	return &withNamespace{namespace}
+}
+
+type withNamespace struct{ namespace string }
+
+func (w *withNamespace) Apply(r *Recorder) {
+	r.namespace = w.namespace
+}
+
+// WithDurationBuckets specifies the buckets of the latency histogram in seconds.
+func WithDurationBuckets(buckets ...float64) Option {
+	return &withDurationBuckets{buckets}
+}
+
+type withDurationBuckets struct{ buckets []float64 }
+
+func (w *withDurationBuckets) Apply(r *Recorder) {
+	r.durationBuckets = w.buckets
+}
+
+// WithEntitiesBuckets specifies the buckets of the entity count histogram.
+func WithEntitiesBuckets(buckets ...float64) Option {
+	return &withEntitiesBuckets{buckets}
+}
+
+type withEntitiesBuckets struct{ buckets []float64 }
+
+func (w *withEntitiesBuckets) Apply(r *Recorder) {
+	r.entitiesBuckets = w.buckets
+}
+
+// WithBytesBuckets specifies the buckets of the bytes histogram.
+func WithBytesBuckets(buckets ...float64) Option {
+	return &withBytesBuckets{buckets}
+}
+
+type withBytesBuckets struct{ buckets []float64 }
+
+func (w *withBytesBuckets) Apply(r *Recorder) {
+	r.bytesBuckets = w.buckets
+}
@@ -0,0 +1,130 @@
+package prommetrics
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mercari.io/datastore/dsmiddleware/dsmetrics"
+)
+
+var _ dsmetrics.Recorder = &Recorder{}
+var _ prometheus.Collector = &Recorder{}
+
+var (
+	defaultDurationBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	defaultEntitiesBuckets = []float64{0, 1, 5, 10, 25, 50, 100, 250, 500, 1000}
+	defaultBytesBuckets    = prometheus.ExponentialBuckets(64, 4, 10)
+)
+
+// New returns the Recorder that exports the measurements as Prometheus metrics.
+// Register it to prometheus.Registerer, it is a prometheus.Collector.
+func New(opts ...Option) *Recorder {
+	r := &Recorder{
+		namespace:       "datastore",
+		durationBuckets: defaultDurationBuckets,
+		entitiesBuckets: defaultEntitiesBuckets,
+		bytesBuckets:    defaultBytesBuckets,
+	}
+
+	for _, opt := range opts {
+		opt.Apply(r)
+	}
+
+	opLabels := []string{"op", "kind", "tx"}
+	r.operations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: r.namespace,
+		Name:      "operations_total",
+		Help:      "Count of Datastore operations.",
+	}, append(opLabels, "code"))
+	r.duration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: r.namespace,
+		Name:      "operation_duration_seconds",
+		Help:      "Latency of Datastore operations.",
+		Buckets:   r.durationBuckets,
+	}, opLabels)
+	r.entities = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: r.namespace,
+		Name:      "operation_entities",
+		Help:      "Count of entities per Datastore operation.",
+		Buckets:   r.entitiesBuckets,
+	}, opLabels)
+	r.bytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: r.namespace,
+		Name:      "operation_bytes",
+		Help:      "Estimated size of entities per Datastore operation.",
+		Buckets:   r.bytesBuckets,
+	}, opLabels)
+	r.elementErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: r.namespace,
+		Name:      "element_errors_total",
+		Help:      "Count of errors in MultiError.",
+	}, append(opLabels, "code"))
+	r.cache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: r.namespace,
+		Name:      "cache_lookups_total",
+		Help:      "Count of cache lookups.",
+	}, []string{"cache", "kind", "result"})
+
+	return r
+}
+
+// A Option is an option for Recorder.
+type Option interface {
+	Apply(*Recorder)
+}
+
+// Recorder records the measurements into Prometheus metrics.
+type Recorder struct {
+	namespace       string
+	durationBuckets []float64
+	entitiesBuckets []float64
+	bytesBuckets    []float64
+
+	operations    *prometheus.CounterVec
+	duration      *prometheus.HistogramVec
+	entities      *prometheus.HistogramVec
+	bytes         *prometheus.HistogramVec
+	elementErrors *prometheus.CounterVec
+	cache         *prometheus.CounterVec
+}
+
+func (r *Recorder) collectors() []prometheus.Collector {
+	return []prometheus.Collector{r.operations, r.duration, r.entities, r.bytes, r.elementErrors, r.cache}
+}
+
+// Describe implements prometheus.Collector.
+func (r *Recorder) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range r.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (r *Recorder) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range r.collectors() {
+		c.Collect(ch)
+	}
+}
+
+// RecordOperation implements dsmetrics.Recorder.
+func (r *Recorder) RecordOperation(ctx context.Context, m *dsmetrics.Measurement) {
+	tx := strconv.FormatBool(m.Transaction)
+	r.operations.WithLabelValues(m.Op, m.Kind, tx, m.Code).Inc()
+	r.duration.WithLabelValues(m.Op, m.Kind, tx).Observe(m.Duration.Seconds())
+	r.entities.WithLabelValues(m.Op, m.Kind, tx).Observe(float64(m.Entities))
+	r.bytes.WithLabelValues(m.Op, m.Kind, tx).Observe(float64(m.Bytes))
+	for code, cnt := range m.ElementCodes {
+		r.elementErrors.WithLabelValues(m.Op, m.Kind, tx, code).Add(float64(cnt))
+	}
+}
+
+// RecordCache implements dsmetrics.Recorder.
+func (r *Recorder) RecordCache(ctx context.Context, m *dsmetrics.CacheMeasurement) {
+	if m.Hits != 0 {
+		r.cache.WithLabelValues(m.Cache, m.Kind, "hit").Add(float64(m.Hits))
+	}
+	if m.Misses != 0 {
+		r.cache.WithLabelValues(m.Cache, m.Kind, "miss").Add(float64(m.Misses))
+	}
+}
@@ -0,0 +1,61 @@
+package prommetrics
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.mercari.io/datastore/dsmiddleware/dsmetrics"
+)
+
+func TestRecorder(t *testing.T) {
+	ctx := context.Background()
+
+	rec := New(WithNamespace("test"))
+	reg := prometheus.NewPedanticRegistry()
+	err := reg.Register(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec.RecordOperation(ctx, &dsmetrics.Measurement{
+		Op:           "GetMultiWithoutTx",
+		Kind:         "Data",
+		Duration:     10 * time.Millisecond,
+		Entities:     2,
+		Bytes:        100,
+		Code:         "OK",
+		ElementCodes: map[string]int{"NotFound": 1},
+	})
+	rec.RecordCache(ctx, &dsmetrics.CacheMeasurement{Cache: "localcache", Kind: "Data", Hits: 2, Misses: 1})
+
+	if v := testutil.ToFloat64(rec.operations.WithLabelValues("GetMultiWithoutTx", "Data", "false", "OK")); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := testutil.ToFloat64(rec.elementErrors.WithLabelValues("GetMultiWithoutTx", "Data", "false", "NotFound")); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := testutil.ToFloat64(rec.cache.WithLabelValues("localcache", "Data", "hit")); v != 2 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := testutil.ToFloat64(rec.cache.WithLabelValues("localcache", "Data", "miss")); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mfs) != 6 {
+		t.Errorf("unexpected: %v", len(mfs))
+	}
+	for _, mf := range mfs {
+		if mf.GetName() == "test_operation_duration_seconds" {
+			if v := mf.GetMetric()[0].GetHistogram().GetSampleCount(); v != 1 {
+				t.Errorf("unexpected: %v", v)
+			}
+		}
+	}
+}
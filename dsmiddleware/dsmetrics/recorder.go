@@ -0,0 +1,86 @@
+package dsmetrics
+
+import (
+	"context"
+	"time"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/dsmiddleware/storagecache"
+)
+
+// MixedKind is the Kind of the operation that has keys of several Kinds.
+const MixedKind = "(mixed)"
+
+// Recorder receives the measurements.
+// The adapters for Prometheus and OpenTelemetry are in subpackages.
+type Recorder interface {
+	RecordOperation(ctx context.Context, m *Measurement)
+	RecordCache(ctx context.Context, m *CacheMeasurement)
+}
+
+// Measurement represents the result of an operation.
+type Measurement struct {
+	// Op is the method name of datastore.Middleware, e.g. "GetMultiWithoutTx".
+	Op string
+	// Kind is the Kind of keys or the query. MixedKind if keys have several Kinds.
+	Kind        string
+	Transaction bool
+	Duration    time.Duration
+	// Entities is the count of entities that are saved, loaded, deleted or counted.
+	Entities int
+	// Bytes is the size estimated from keys and PropertyList by the storage size rule.
+	Bytes int
+	// Code is the gRPC code name of the error. It is "OK" when the operation returns MultiError.
+	Code string
+	// ElementCodes is the count of errors in MultiError by the gRPC code name.
+	// ErrNoSuchEntity is counted as "NotFound".
+	ElementCodes map[string]int
+}
+
+// CacheMeasurement represents the result of the cache lookup.
+type CacheMeasurement struct {
+	Cache  string
+	Kind   string
+	Hits   int
+	Misses int
+}
+
+// CacheStats returns storagecache.StatsRecorder that reports to r as the specified cache name.
+// Pass it to WithStatsRecorder option of localcache, dsmemcache, rediscache or aememcache.
+func CacheStats(r Recorder, cache string) storagecache.StatsRecorder {
+	return &cacheStats{r: r, cache: cache}
+}
+
+type cacheStats struct {
+	r     Recorder
+	cache string
+}
+
+func (cs *cacheStats) record(ctx context.Context, keys []datastore.Key, hit bool) {
+	counts := make(map[string]int)
+	var kinds []string
+	for _, key := range keys {
+		if _, ok := counts[key.Kind()]; !ok {
+			kinds = append(kinds, key.Kind())
+		}
+		counts[key.Kind()]++
+	}
+
+	for _, kind := range kinds {
+		m := &CacheMeasurement{Cache: cs.cache, Kind: kind}
+		if hit {
+			m.Hits = counts[kind]
+		} else {
+			m.Misses = counts[kind]
+		}
+		cs.r.RecordCache(ctx, m)
+	}
+}
+
+func (cs *cacheStats) RecordHits(ctx context.Context, keys []datastore.Key) {
+	cs.record(ctx, keys, true)
+}
+
+func (cs *cacheStats) RecordMisses(ctx context.Context, keys []datastore.Key) {
+	cs.record(ctx, keys, false)
+}
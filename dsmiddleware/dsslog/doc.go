@@ -0,0 +1,21 @@
+/*
+Package dsslog emits one structured log record per operation by log/slog.
+It requires Go 1.21 or later.
+
+Each record has the operation name, Kinds, keys (truncated by WithMaxKeys), the duration,
+the sequential transaction ID, the query fields from QueryDump, and the error details.
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	client.AppendMiddleware(dsslog.New(
+		dsslog.WithLogger(logger),
+		dsslog.WithLevel(slog.LevelInfo),
+		dsslog.WithSampling(0.1),
+		dsslog.WithSlowThreshold(500*time.Millisecond, slog.LevelWarn),
+	))
+
+The records of succeeded operations are emitted at the level of WithLevel and sampled by WithSampling.
+The records of slow operations are raised to the level of WithSlowThreshold,
+and the records of failed operations are emitted at the level of WithErrorLevel.
+The transaction ID is assigned by this middleware, it is unique only in the process.
+*/
+package dsslog // import "go.mercari.io/datastore/dsmiddleware/dsslog"
@@ -0,0 +1,396 @@
+//go:build go1.21
+// +build go1.21
+
+package dsslog
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/internal/errcode"
+	"google.golang.org/api/iterator"
+)
+
+const defaultMaxKeys = 10
+
+var _ datastore.Middleware = &slogHandler{}
+
+// New slog middleware creates & returns.
+func New(opts ...Option) datastore.Middleware {
+	sh := &slogHandler{
+		level:      slog.LevelDebug,
+		errorLevel: slog.LevelError,
+		slowLevel:  slog.LevelWarn,
+		sampleRate: 1,
+		maxKeys:    defaultMaxKeys,
+		now:        time.Now,
+		random:     rand.Float64,
+		txIDs:      make(map[datastore.Transaction]uint64),
+	}
+
+	for _, opt := range opts {
+		opt.Apply(sh)
+	}
+
+	if sh.logger == nil {
+		sh.logger = slog.Default()
+	}
+
+	return sh
+}
+
+// A Option is an option for dsslog.
+type Option interface {
+	Apply(*slogHandler)
+}
+
+type slogHandler struct {
+	logger        *slog.Logger
+	level         slog.Level
+	errorLevel    slog.Level
+	slowLevel     slog.Level
+	slowThreshold time.Duration
+	sampleRate    float64
+	maxKeys       int
+	now           func() time.Time
+	random        func() float64
+
+	m           sync.Mutex
+	txIDs       map[datastore.Transaction]uint64
+	lastTxIDSeq uint64
+}
+
+// record is a log record of an operation.
+type record struct {
+	op    string
+	start time.Time
+	keys  []datastore.Key
+	qDump *datastore.QueryDump
+	tx    datastore.Transaction
+	attrs []slog.Attr
+}
+
+func (sh *slogHandler) newRecord(op string, tx datastore.Transaction) *record {
+	return &record{op: op, start: sh.now(), tx: tx}
+}
+
+// txID returns the sequential ID of the transaction, it is assigned on the first operation in the transaction.
+func (sh *slogHandler) txID(tx datastore.Transaction) uint64 {
+	sh.m.Lock()
+	defer sh.m.Unlock()
+
+	id, ok := sh.txIDs[tx]
+	if !ok {
+		sh.lastTxIDSeq++
+		id = sh.lastTxIDSeq
+		sh.txIDs[tx] = id
+	}
+
+	return id
+}
+
+func (sh *slogHandler) releaseTxID(tx datastore.Transaction) {
+	sh.m.Lock()
+	defer sh.m.Unlock()
+
+	delete(sh.txIDs, tx)
+}
+
+func (sh *slogHandler) keysAttrs(keys []datastore.Key) []slog.Attr {
+	var kinds []string
+	for _, key := range keys {
+		if key == nil {
+			continue
+		}
+		found := false
+		for _, kind := range kinds {
+			if kind == key.Kind() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			kinds = append(kinds, key.Kind())
+		}
+	}
+
+	n := len(keys)
+	if 0 <= sh.maxKeys && sh.maxKeys < n {
+		n = sh.maxKeys
+	}
+	keyStrings := make([]string, 0, n)
+	for _, key := range keys[:n] {
+		if key == nil {
+			keyStrings = append(keyStrings, "<nil>")
+			continue
+		}
+		keyStrings = append(keyStrings, key.String())
+	}
+
+	return []slog.Attr{
+		slog.Any("kinds", kinds),
+		slog.Any("keys", keyStrings),
+		slog.Int("key_count", len(keys)),
+		slog.Bool("keys_truncated", n < len(keys)),
+	}
+}
+
+func queryAttr(qDump *datastore.QueryDump) slog.Attr {
+	attrs := []interface{}{
+		slog.String("kind", qDump.Kind),
+	}
+	if qDump.Ancestor != nil {
+		attrs = append(attrs, slog.String("ancestor", qDump.Ancestor.String()))
+	}
+	if qDump.Namespace != "" {
+		attrs = append(attrs, slog.String("namespace", qDump.Namespace))
+	}
+	if qDump.EventualConsistency {
+		attrs = append(attrs, slog.Bool("eventual_consistency", true))
+	}
+	if len(qDump.Filter) != 0 {
+		filters := make([]string, 0, len(qDump.Filter))
+		for _, f := range qDump.Filter {
+			filters = append(filters, fmt.Sprintf("%s %v", f.Filter, f.Value))
+		}
+		attrs = append(attrs, slog.Any("filters", filters))
+	}
+	if len(qDump.Order) != 0 {
+		attrs = append(attrs, slog.Any("orders", qDump.Order))
+	}
+	if len(qDump.Project) != 0 {
+		attrs = append(attrs, slog.Any("projections", qDump.Project))
+	}
+	if len(qDump.DistinctOn) != 0 {
+		attrs = append(attrs, slog.Any("distinct_on", qDump.DistinctOn))
+	}
+	if qDump.Distinct {
+		attrs = append(attrs, slog.Bool("distinct", true))
+	}
+	if qDump.KeysOnly {
+		attrs = append(attrs, slog.Bool("keys_only", true))
+	}
+	if qDump.Limit != 0 {
+		attrs = append(attrs, slog.Int("limit", qDump.Limit))
+	}
+	if qDump.Offset != 0 {
+		attrs = append(attrs, slog.Int("offset", qDump.Offset))
+	}
+	if qDump.Start != nil {
+		attrs = append(attrs, slog.String("start", qDump.Start.String()))
+	}
+	if qDump.End != nil {
+		attrs = append(attrs, slog.String("end", qDump.End.String()))
+	}
+
+	return slog.Group("query", attrs...)
+}
+
+func errorAttr(err error) slog.Attr {
+	attrs := []interface{}{
+		slog.String("message", err.Error()),
+		slog.String("code", errcode.Code(err)),
+	}
+	if merr, ok := err.(datastore.MultiError); ok {
+		cnt := 0
+		for _, err := range merr {
+			if err != nil {
+				cnt++
+			}
+		}
+		attrs = append(attrs, slog.Int("element_errors", cnt))
+	}
+
+	return slog.Group("error", attrs...)
+}
+
+func (sh *slogHandler) log(ctx context.Context, r *record, err error) {
+	duration := sh.now().Sub(r.start)
+	slow := 0 < sh.slowThreshold && sh.slowThreshold <= duration
+	failed := err != nil && !errcode.IsNoSuchEntity(err)
+
+	level := sh.level
+	if failed {
+		level = sh.errorLevel
+	} else if slow {
+		level = sh.slowLevel
+	} else if sh.sampleRate < 1 && sh.random() >= sh.sampleRate {
+		// sampling is applied to the ordinary records only.
+		return
+	}
+	if !sh.logger.Enabled(ctx, level) {
+		return
+	}
+
+	attrs := make([]slog.Attr, 0, 8+len(r.attrs))
+	attrs = append(attrs, slog.String("op", r.op))
+	if r.keys != nil {
+		attrs = append(attrs, sh.keysAttrs(r.keys)...)
+	}
+	if r.qDump != nil {
+		attrs = append(attrs, queryAttr(r.qDump))
+	}
+	attrs = append(attrs, slog.Duration("duration", duration))
+	if r.tx != nil {
+		attrs = append(attrs, slog.Uint64("tx_id", sh.txID(r.tx)))
+	}
+	if slow {
+		attrs = append(attrs, slog.Bool("slow", true))
+	}
+	attrs = append(attrs, r.attrs...)
+	if err != nil {
+		attrs = append(attrs, errorAttr(err))
+	}
+
+	sh.logger.LogAttrs(ctx, level, "datastore."+r.op, attrs...)
+}
+
+func (sh *slogHandler) AllocateIDs(info *datastore.MiddlewareInfo, keys []datastore.Key) ([]datastore.Key, error) {
+	r := sh.newRecord("AllocateIDs", nil)
+	r.keys = keys
+
+	retKeys, err := info.Next.AllocateIDs(info, keys)
+	sh.log(info.Context, r, err)
+
+	return retKeys, err
+}
+
+func (sh *slogHandler) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.Key, error) {
+	r := sh.newRecord("PutMultiWithoutTx", nil)
+
+	retKeys, err := info.Next.PutMultiWithoutTx(info, keys, psList)
+	if err == nil {
+		// complete keys are more useful.
+		r.keys = retKeys
+	} else {
+		r.keys = keys
+	}
+	sh.log(info.Context, r, err)
+
+	return retKeys, err
+}
+
+func (sh *slogHandler) PutMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.PendingKey, error) {
+	r := sh.newRecord("PutMultiWithTx", info.Transaction)
+	r.keys = keys
+
+	pKeys, err := info.Next.PutMultiWithTx(info, keys, psList)
+	sh.log(info.Context, r, err)
+
+	return pKeys, err
+}
+
+func (sh *slogHandler) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	r := sh.newRecord("GetMultiWithoutTx", nil)
+	r.keys = keys
+
+	err := info.Next.GetMultiWithoutTx(info, keys, psList)
+	sh.log(info.Context, r, err)
+
+	return err
+}
+
+func (sh *slogHandler) GetMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	r := sh.newRecord("GetMultiWithTx", info.Transaction)
+	r.keys = keys
+
+	err := info.Next.GetMultiWithTx(info, keys, psList)
+	sh.log(info.Context, r, err)
+
+	return err
+}
+
+func (sh *slogHandler) DeleteMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	r := sh.newRecord("DeleteMultiWithoutTx", nil)
+	r.keys = keys
+
+	err := info.Next.DeleteMultiWithoutTx(info, keys)
+	sh.log(info.Context, r, err)
+
+	return err
+}
+
+func (sh *slogHandler) DeleteMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	r := sh.newRecord("DeleteMultiWithTx", info.Transaction)
+	r.keys = keys
+
+	err := info.Next.DeleteMultiWithTx(info, keys)
+	sh.log(info.Context, r, err)
+
+	return err
+}
+
+func (sh *slogHandler) PostCommit(info *datastore.MiddlewareInfo, tx datastore.Transaction, commit datastore.Commit) error {
+	r := sh.newRecord("PostCommit", tx)
+
+	err := info.Next.PostCommit(info, tx, commit)
+	sh.log(info.Context, r, err)
+	sh.releaseTxID(tx)
+
+	return err
+}
+
+func (sh *slogHandler) PostRollback(info *datastore.MiddlewareInfo, tx datastore.Transaction) error {
+	r := sh.newRecord("PostRollback", tx)
+
+	err := info.Next.PostRollback(info, tx)
+	sh.log(info.Context, r, err)
+	sh.releaseTxID(tx)
+
+	return err
+}
+
+func (sh *slogHandler) Run(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) datastore.Iterator {
+	r := sh.newRecord("Run", qDump.Transaction)
+	r.qDump = qDump
+
+	iter := info.Next.Run(info, q, qDump)
+	sh.log(info.Context, r, nil)
+
+	return iter
+}
+
+func (sh *slogHandler) GetAll(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, psList *[]datastore.PropertyList) ([]datastore.Key, error) {
+	r := sh.newRecord("GetAll", qDump.Transaction)
+	r.qDump = qDump
+
+	keys, err := info.Next.GetAll(info, q, qDump, psList)
+	r.attrs = append(r.attrs, slog.Int("entities", len(keys)))
+	sh.log(info.Context, r, err)
+
+	return keys, err
+}
+
+func (sh *slogHandler) Next(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, iter datastore.Iterator, ps *datastore.PropertyList) (datastore.Key, error) {
+	r := sh.newRecord("Next", qDump.Transaction)
+	r.qDump = qDump
+
+	key, err := info.Next.Next(info, q, qDump, iter, ps)
+	if err == iterator.Done {
+		r.attrs = append(r.attrs, slog.Bool("done", true))
+		sh.log(info.Context, r, nil)
+	} else {
+		if key != nil {
+			r.attrs = append(r.attrs, slog.String("key", key.String()))
+		}
+		sh.log(info.Context, r, err)
+	}
+
+	return key, err
+}
+
+func (sh *slogHandler) Count(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) (int, error) {
+	r := sh.newRecord("Count", qDump.Transaction)
+	r.qDump = qDump
+
+	cnt, err := info.Next.Count(info, q, qDump)
+	r.attrs = append(r.attrs, slog.Int("count", cnt))
+	sh.log(info.Context, r, err)
+
+	return cnt, err
+}
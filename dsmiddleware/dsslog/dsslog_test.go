@@ -0,0 +1,201 @@
+//go:build go1.21
+// +build go1.21
+
+package dsslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/internal/testutils"
+)
+
+type Data struct {
+	Name string
+}
+
+func newLogger() (*slog.Logger, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	return slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})), buf
+}
+
+func parseRecords(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		r := make(map[string]interface{})
+		err := json.Unmarshal([]byte(line), &r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestSlog_Basic(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	logger, buf := newLogger()
+	client.AppendMiddleware(New(WithLogger(logger), WithMaxKeys(2)))
+	client.AppendMiddleware(ms)
+
+	keys := []datastore.Key{
+		client.NameKey("Data", "a", nil),
+		client.NameKey("Data", "b", nil),
+		client.NameKey("Other", "c", nil),
+	}
+	_, err := client.PutMulti(ctx, keys, []*Data{{Name: "a"}, {Name: "b"}, {Name: "c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Get(ctx, client.NameKey("Data", "missing", nil), &Data{})
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("unexpected: %v", err)
+	}
+
+	// OnMemoryDatastore doesn't support filters, it is logged as the failure.
+	q := client.NewQuery("Data").Filter("Name =", "a").Order("-Name")
+	_, err = client.GetAll(ctx, q, &[]*Data{})
+	if err == nil {
+		t.Fatal("unexpected: nil")
+	}
+
+	_, err = client.GetAll(ctx, client.NewQuery("Data").Limit(10), &[]*Data{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := parseRecords(t, buf)
+	if len(records) != 4 {
+		t.Fatalf("unexpected: %v", len(records))
+	}
+
+	if v := records[0]; v["msg"] != "datastore.PutMultiWithoutTx" || v["level"] != "DEBUG" || v["key_count"] != float64(3) || v["keys_truncated"] != true {
+		t.Errorf("unexpected: %+v", v)
+	}
+	if v, ok := records[0]["keys"].([]interface{}); !ok || len(v) != 2 {
+		t.Errorf("unexpected: %+v", records[0]["keys"])
+	}
+	if v, ok := records[0]["kinds"].([]interface{}); !ok || len(v) != 2 || v[0] != "Data" || v[1] != "Other" {
+		t.Errorf("unexpected: %+v", records[0]["kinds"])
+	}
+	if _, ok := records[0]["duration"]; !ok {
+		t.Errorf("unexpected: %+v", records[0])
+	}
+
+	// ErrNoSuchEntity isn't the failure.
+	if v := records[1]; v["level"] != "DEBUG" {
+		t.Errorf("unexpected: %+v", v)
+	}
+	if v, ok := records[1]["error"].(map[string]interface{}); !ok || v["code"] != "NotFound" {
+		t.Errorf("unexpected: %+v", records[1]["error"])
+	}
+
+	if v := records[2]; v["msg"] != "datastore.GetAll" || v["level"] != "ERROR" {
+		t.Errorf("unexpected: %+v", v)
+	}
+	query, ok := records[2]["query"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("unexpected: %+v", records[2])
+	}
+	if v, ok := query["filters"].([]interface{}); !ok || len(v) != 1 || v[0] != "Name = a" {
+		t.Errorf("unexpected: %+v", query["filters"])
+	}
+	if v, ok := query["orders"].([]interface{}); !ok || len(v) != 1 || v[0] != "-Name" {
+		t.Errorf("unexpected: %+v", query["orders"])
+	}
+	if v, ok := records[2]["error"].(map[string]interface{}); !ok || v["message"] == "" {
+		t.Errorf("unexpected: %+v", records[2]["error"])
+	}
+
+	query, ok = records[3]["query"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("unexpected: %+v", records[3])
+	}
+	if query["kind"] != "Data" || query["limit"] != float64(10) {
+		t.Errorf("unexpected: %+v", query)
+	}
+	if v := records[3]["entities"]; v != float64(2) {
+		t.Errorf("unexpected: %+v", v)
+	}
+}
+
+func TestSlog_SlowAndSampling(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	logger, buf := newLogger()
+	mw := New(WithLogger(logger), WithSampling(0), WithSlowThreshold(100*time.Millisecond, slog.LevelWarn))
+	client.AppendMiddleware(mw)
+	client.AppendMiddleware(ms)
+
+	// sampled out.
+	_, err := client.Put(ctx, client.NameKey("Data", "a", nil), &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := buf.Len(); v != 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// slow operation is always emitted.
+	now := time.Now()
+	sh := mw.(*slogHandler)
+	sh.now = func() time.Time {
+		now = now.Add(150 * time.Millisecond)
+		return now
+	}
+	_, err = client.Put(ctx, client.NameKey("Data", "a", nil), &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := parseRecords(t, buf)
+	if len(records) != 1 {
+		t.Fatalf("unexpected: %v", len(records))
+	}
+	if v := records[0]; v["level"] != "WARN" || v["slow"] != true {
+		t.Errorf("unexpected: %+v", v)
+	}
+}
+
+func TestSlog_Transaction(t *testing.T) {
+	ctx, client, cleanUp := testutils.SetupCloudDatastore(t)
+	defer cleanUp()
+
+	logger, buf := newLogger()
+	mw := New(WithLogger(logger))
+	client.AppendMiddleware(mw)
+	defer func() {
+		client.RemoveMiddleware(mw)
+	}()
+
+	for i := 0; i < 2; i++ {
+		_, err := client.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+			_, err := tx.Put(client.NameKey("Data", "a", nil), &Data{Name: "a"})
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records := parseRecords(t, buf)
+	if len(records) != 4 {
+		t.Fatalf("unexpected: %v", len(records))
+	}
+	if records[0]["tx_id"] != records[1]["tx_id"] || records[1]["tx_id"] == records[2]["tx_id"] || records[2]["tx_id"] != records[3]["tx_id"] {
+		t.Errorf("unexpected: %+v", records)
+	}
+	if v := records[1]["msg"]; v != "datastore.PostCommit" {
+		t.Errorf("unexpected: %v", v)
+	}
+}
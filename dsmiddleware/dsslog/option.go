@@ -0,0 +1,83 @@
+//go:build go1.21
+// +build go1.21
+
+package dsslog
+
+import (
+	"log/slog"
+	"time"
+)
+
+// WithLogger specifies the logger. default is slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return &withLogger{logger}
+}
+
+type withLogger struct{ logger *slog.Logger }
+
+func (w *withLogger) Apply(sh *slogHandler) {
+	sh.logger = w.logger
+}
+
+// WithLevel specifies the level of records of the succeeded operations. default is slog.LevelDebug.
+func WithLevel(level slog.Level) Option {
+	return &withLevel{level}
+}
+
+type withLevel struct{ level slog.Level }
+
+func (w *withLevel) Apply(sh *slogHandler) {
+	sh.level = w.level
+}
+
+// WithErrorLevel specifies the level of records of the failed operations. default is slog.LevelError.
+// ErrNoSuchEntity is not treated as the failure.
+func WithErrorLevel(level slog.Level) Option {
+	return &withErrorLevel{level}
+}
+
+type withErrorLevel struct{ level slog.Level }
+
+func (w *withErrorLevel) Apply(sh *slogHandler) {
+	sh.errorLevel = w.level
+}
+
+// WithSlowThreshold specifies the duration that the operation is regarded as slow,
+// and the level of records of the slow operations. Slow operations are never sampled out.
+func WithSlowThreshold(d time.Duration, level slog.Level) Option {
+	return &withSlowThreshold{d, level}
+}
+
+type withSlowThreshold struct {
+	d     time.Duration
+	level slog.Level
+}
+
+func (w *withSlowThreshold) Apply(sh *slogHandler) {
+	sh.slowThreshold = w.d
+	sh.slowLevel = w.level
+}
+
+// WithSampling specifies the rate of records of the succeeded operations in [0, 1]. default is 1.
+// Records of the failed or slow operations are always emitted.
+func WithSampling(rate float64) Option {
+	return &withSampling{rate}
+}
+
+type withSampling struct{ rate float64 }
+
+func (w *withSampling) Apply(sh *slogHandler) {
+	sh.sampleRate = w.rate
+}
+
+// WithMaxKeys specifies the maximum count of keys in a record. default is 10.
+// Negative value means no limit.
+func WithMaxKeys(n int) Option {
+	return &withMaxKeys{n}
+}
+
+type withMaxKeys struct{ n int }
+
+func (w *withMaxKeys) Apply(sh *slogHandler) {
+	sh.maxKeys = w.n
+}
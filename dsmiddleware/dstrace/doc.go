@@ -0,0 +1,18 @@
+/*
+Package dstrace creates OpenTelemetry spans for each operation that passes through the middleware.
+It is the separate module that requires Go 1.19 or later, as go.opentelemetry.io/otel does.
+
+A span is created for every method of datastore.Middleware, named like "datastore.GetMultiWithoutTx".
+Spans have the kind, the count of keys, the namespace, whether in the transaction or not,
+and the gRPC code name of the error as attributes.
+ErrNoSuchEntity from Get is recorded as the code, but the span isn't marked as error.
+
+	client.AppendMiddleware(dstrace.New(dstrace.WithTracerProvider(tp)))
+
+The downstream middlewares receive the context of the span, except in the transaction.
+The operations in the transaction share MiddlewareInfo until the commit, so their spans aren't the parents.
+
+Iterator.Next is traced per call, the RPC is actually issued only when the iterator fetches the next batch.
+Place this middleware after the cache middlewares to trace only RPCs, or before them to trace all operations.
+*/
+package dstrace // import "go.mercari.io/datastore/dsmiddleware/dstrace"
@@ -0,0 +1,233 @@
+package dstrace
+
+import (
+	"strings"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/internal/errcode"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/iterator"
+)
+
+const instrumentationName = "go.mercari.io/datastore/dsmiddleware/dstrace"
+
+// Attribute keys of spans.
+const (
+	AttrKind        = attribute.Key("datastore.kind")
+	AttrKeys        = attribute.Key("datastore.keys")
+	AttrNamespace   = attribute.Key("datastore.namespace")
+	AttrTransaction = attribute.Key("datastore.transaction")
+	AttrEntities    = attribute.Key("datastore.entities")
+	AttrDone        = attribute.Key("datastore.done")
+	AttrErrorCode   = attribute.Key("datastore.error_code")
+)
+
+var _ datastore.Middleware = &tracer{}
+
+// New tracing middleware creates & returns.
+func New(opts ...Option) datastore.Middleware {
+	t := &tracer{
+		spanNamePrefix: "datastore.",
+	}
+
+	for _, opt := range opts {
+		opt.Apply(t)
+	}
+
+	if t.tracerProvider == nil {
+		t.tracerProvider = otel.GetTracerProvider()
+	}
+	t.tracer = t.tracerProvider.Tracer(instrumentationName)
+
+	return t
+}
+
+// A Option is an option for dstrace.
+type Option interface {
+	Apply(*tracer)
+}
+
+type tracer struct {
+	tracerProvider trace.TracerProvider
+	tracer         trace.Tracer
+	spanNamePrefix string
+	attrs          []attribute.KeyValue
+}
+
+// start starts the span, and returns the copy of info that has the context of the span.
+// The downstream middlewares and RPCs receive the copy, their spans become the children of the span.
+// In the transaction, info is returned as is. The middlewares share it until PostCommit or PostRollback,
+// and the values they put in info.Context must not be lost by the copy.
+func (t *tracer) start(info *datastore.MiddlewareInfo, opName string, attrs ...attribute.KeyValue) (*datastore.MiddlewareInfo, trace.Span) {
+	attrs = append(attrs, t.attrs...)
+	ctx, span := t.tracer.Start(info.Context, t.spanNamePrefix+opName, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	if info.Transaction != nil {
+		return info, span
+	}
+	newInfo := *info
+	newInfo.Context = ctx
+
+	return &newInfo, span
+}
+
+func (t *tracer) end(span trace.Span, err error) {
+	if err != nil {
+		span.SetAttributes(AttrErrorCode.String(errcode.Code(err)))
+		if !errcode.IsNoSuchEntity(err) {
+			span.RecordError(err)
+			span.SetStatus(otelcodes.Error, err.Error())
+		}
+	}
+	span.End()
+}
+
+func keysAttrs(info *datastore.MiddlewareInfo, keys []datastore.Key) []attribute.KeyValue {
+	var kinds []string
+	var namespace string
+	for _, key := range keys {
+		if key == nil {
+			continue
+		}
+		namespace = key.Namespace()
+		found := false
+		for _, kind := range kinds {
+			if kind == key.Kind() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			kinds = append(kinds, key.Kind())
+		}
+	}
+
+	return []attribute.KeyValue{
+		AttrKind.String(strings.Join(kinds, ",")),
+		AttrKeys.Int(len(keys)),
+		AttrNamespace.String(namespace),
+		AttrTransaction.Bool(info.Transaction != nil),
+	}
+}
+
+func queryAttrs(qDump *datastore.QueryDump) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		AttrKind.String(qDump.Kind),
+		AttrNamespace.String(qDump.Namespace),
+		AttrTransaction.Bool(qDump.Transaction != nil),
+	}
+}
+
+func (t *tracer) AllocateIDs(info *datastore.MiddlewareInfo, keys []datastore.Key) ([]datastore.Key, error) {
+	info, span := t.start(info, "AllocateIDs", keysAttrs(info, keys)...)
+	keys, err := info.Next.AllocateIDs(info, keys)
+	t.end(span, err)
+
+	return keys, err
+}
+
+func (t *tracer) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.Key, error) {
+	info, span := t.start(info, "PutMultiWithoutTx", keysAttrs(info, keys)...)
+	keys, err := info.Next.PutMultiWithoutTx(info, keys, psList)
+	t.end(span, err)
+
+	return keys, err
+}
+
+func (t *tracer) PutMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.PendingKey, error) {
+	info, span := t.start(info, "PutMultiWithTx", keysAttrs(info, keys)...)
+	pKeys, err := info.Next.PutMultiWithTx(info, keys, psList)
+	t.end(span, err)
+
+	return pKeys, err
+}
+
+func (t *tracer) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	info, span := t.start(info, "GetMultiWithoutTx", keysAttrs(info, keys)...)
+	err := info.Next.GetMultiWithoutTx(info, keys, psList)
+	t.end(span, err)
+
+	return err
+}
+
+func (t *tracer) GetMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	info, span := t.start(info, "GetMultiWithTx", keysAttrs(info, keys)...)
+	err := info.Next.GetMultiWithTx(info, keys, psList)
+	t.end(span, err)
+
+	return err
+}
+
+func (t *tracer) DeleteMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	info, span := t.start(info, "DeleteMultiWithoutTx", keysAttrs(info, keys)...)
+	err := info.Next.DeleteMultiWithoutTx(info, keys)
+	t.end(span, err)
+
+	return err
+}
+
+func (t *tracer) DeleteMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	info, span := t.start(info, "DeleteMultiWithTx", keysAttrs(info, keys)...)
+	err := info.Next.DeleteMultiWithTx(info, keys)
+	t.end(span, err)
+
+	return err
+}
+
+func (t *tracer) PostCommit(info *datastore.MiddlewareInfo, tx datastore.Transaction, commit datastore.Commit) error {
+	info, span := t.start(info, "PostCommit", AttrTransaction.Bool(true))
+	err := info.Next.PostCommit(info, tx, commit)
+	t.end(span, err)
+
+	return err
+}
+
+func (t *tracer) PostRollback(info *datastore.MiddlewareInfo, tx datastore.Transaction) error {
+	info, span := t.start(info, "PostRollback", AttrTransaction.Bool(true))
+	err := info.Next.PostRollback(info, tx)
+	t.end(span, err)
+
+	return err
+}
+
+func (t *tracer) Run(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) datastore.Iterator {
+	// Run doesn't call RPC, the query is executed by Next.
+	info, span := t.start(info, "Run", queryAttrs(qDump)...)
+	iter := info.Next.Run(info, q, qDump)
+	t.end(span, nil)
+
+	return iter
+}
+
+func (t *tracer) GetAll(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, psList *[]datastore.PropertyList) ([]datastore.Key, error) {
+	info, span := t.start(info, "GetAll", queryAttrs(qDump)...)
+	keys, err := info.Next.GetAll(info, q, qDump, psList)
+	span.SetAttributes(AttrEntities.Int(len(keys)))
+	t.end(span, err)
+
+	return keys, err
+}
+
+func (t *tracer) Next(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, iter datastore.Iterator, ps *datastore.PropertyList) (datastore.Key, error) {
+	info, span := t.start(info, "Next", queryAttrs(qDump)...)
+	key, err := info.Next.Next(info, q, qDump, iter, ps)
+	if err == iterator.Done {
+		span.SetAttributes(AttrDone.Bool(true))
+		t.end(span, nil)
+	} else {
+		t.end(span, err)
+	}
+
+	return key, err
+}
+
+func (t *tracer) Count(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) (int, error) {
+	info, span := t.start(info, "Count", queryAttrs(qDump)...)
+	cnt, err := info.Next.Count(info, q, qDump)
+	span.SetAttributes(AttrEntities.Int(cnt))
+	t.end(span, err)
+
+	return cnt, err
+}
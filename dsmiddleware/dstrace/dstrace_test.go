@@ -0,0 +1,320 @@
+package dstrace
+
+import (
+	"context"
+	"testing"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/dsmiddleware/noop"
+	"go.mercari.io/datastore/internal/testutils"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type Data struct {
+	Name string
+}
+
+// spanRecorder records the span in the context that the next middleware receives.
+type spanRecorder struct {
+	datastore.Middleware
+	spanCtx trace.SpanContext
+}
+
+func (m *spanRecorder) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	m.spanCtx = trace.SpanContextFromContext(info.Context)
+	return info.Next.GetMultiWithoutTx(info, keys, psList)
+}
+
+type contextKey struct{}
+
+// txValue sets the Context value in PutMultiWithTx, and records it in PostCommit.
+type txValue struct {
+	datastore.Middleware
+	value interface{}
+}
+
+func (m *txValue) PutMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.PendingKey, error) {
+	info.Context = context.WithValue(info.Context, contextKey{}, "tx")
+	return info.Next.PutMultiWithTx(info, keys, psList)
+}
+
+func (m *txValue) PostCommit(info *datastore.MiddlewareInfo, tx datastore.Transaction, commit datastore.Commit) error {
+	m.value = info.Context.Value(contextKey{})
+	return info.Next.PostCommit(info, tx, commit)
+}
+
+type unavailablePut struct {
+	datastore.Middleware
+}
+
+func (m *unavailablePut) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.Key, error) {
+	return nil, status.Error(codes.Unavailable, "unavailable")
+}
+
+func setupTracer() (datastore.Middleware, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	return New(WithTracerProvider(tp), WithAttributes(attribute.String("service", "test"))), exporter
+}
+
+func attrMap(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	m := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes {
+		m[kv.Key] = kv.Value
+	}
+	return m
+}
+
+func TestTrace_Basic(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	mw, exporter := setupTracer()
+	client.AppendMiddleware(mw)
+	client.AppendMiddleware(ms)
+
+	keys, err := client.PutMulti(ctx, []datastore.Key{
+		client.IncompleteKey("Data", nil),
+		client.NameKey("Data", "a", nil),
+	}, []*Data{{Name: "foo"}, {Name: "bar"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := make([]*Data, 2)
+	err = client.GetMulti(ctx, keys, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := client.NewQuery("Data")
+	cnt, err := client.Count(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cnt != 2 {
+		t.Fatalf("unexpected: %v", cnt)
+	}
+
+	// OnMemoryDatastore iterates without the middleware, Next is traced on the emulator.
+	iter := client.Run(ctx, q)
+	for {
+		_, err := iter.Next(&Data{})
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = client.DeleteMulti(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exporter.GetSpans()
+	var names []string
+	for _, span := range spans {
+		names = append(names, span.Name)
+	}
+	expected := []string{
+		"datastore.PutMultiWithoutTx",
+		"datastore.GetMultiWithoutTx",
+		"datastore.Count",
+		"datastore.Run",
+		"datastore.DeleteMultiWithoutTx",
+	}
+	if len(names) != len(expected) {
+		t.Fatalf("unexpected: %v", names)
+	}
+	for idx := range expected {
+		if names[idx] != expected[idx] {
+			t.Errorf("unexpected: %v", names)
+			break
+		}
+	}
+
+	m := attrMap(spans[0])
+	if v := m[AttrKind]; v.AsString() != "Data" {
+		t.Errorf("unexpected: %v", v.AsString())
+	}
+	if v := m[AttrKeys]; v.AsInt64() != 2 {
+		t.Errorf("unexpected: %v", v.AsInt64())
+	}
+	if v := m[AttrTransaction]; v.AsBool() {
+		t.Errorf("unexpected: %v", v.AsBool())
+	}
+	if v := m["service"]; v.AsString() != "test" {
+		t.Errorf("unexpected: %v", v.AsString())
+	}
+	if _, ok := m[AttrErrorCode]; ok {
+		t.Errorf("unexpected: %v", m)
+	}
+
+	if v := attrMap(spans[2])[AttrEntities]; v.AsInt64() != 2 {
+		t.Errorf("unexpected: %v", v.AsInt64())
+	}
+}
+
+func TestTrace_Error(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	mw, exporter := setupTracer()
+	client.AppendMiddleware(mw)
+	client.AppendMiddleware(&unavailablePut{ms})
+
+	// ErrNoSuchEntity isn't the error of the span.
+	err := client.Get(ctx, client.NameKey("Data", "missing", nil), &Data{})
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("unexpected: %v", err)
+	}
+
+	_, err = client.Put(ctx, client.NameKey("Data", "a", nil), &Data{Name: "foo"})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("unexpected: %v", err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("unexpected: %v", len(spans))
+	}
+	if v := attrMap(spans[0])[AttrErrorCode]; v.AsString() != "NotFound" {
+		t.Errorf("unexpected: %v", v.AsString())
+	}
+	if v := spans[0].Status.Code; v != otelcodes.Unset {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := attrMap(spans[1])[AttrErrorCode]; v.AsString() != "Unavailable" {
+		t.Errorf("unexpected: %v", v.AsString())
+	}
+	if v := spans[1].Status.Code; v != otelcodes.Error {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestTrace_Transaction(t *testing.T) {
+	ctx, client, cleanUp := testutils.SetupCloudDatastore(t)
+	defer cleanUp()
+
+	mw, exporter := setupTracer()
+	client.AppendMiddleware(mw)
+	defer func() {
+		client.RemoveMiddleware(mw)
+	}()
+
+	key := client.NameKey("Data", "a", nil)
+	_, err := client.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		_, err := tx.Put(key, &Data{Name: "foo"})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("unexpected: %v", len(spans))
+	}
+	if v := spans[0]; v.Name != "datastore.PutMultiWithTx" || !attrMap(v)[AttrTransaction].AsBool() {
+		t.Errorf("unexpected: %+v", v)
+	}
+	if v := spans[1]; v.Name != "datastore.PostCommit" {
+		t.Errorf("unexpected: %+v", v)
+	}
+}
+
+func TestTrace_Next(t *testing.T) {
+	ctx, client, cleanUp := testutils.SetupCloudDatastore(t)
+	defer cleanUp()
+
+	_, err := client.PutMulti(ctx, []datastore.Key{
+		client.NameKey("Data", "a", nil),
+		client.NameKey("Data", "b", nil),
+	}, []*Data{{Name: "foo"}, {Name: "bar"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mw, exporter := setupTracer()
+	client.AppendMiddleware(mw)
+	defer func() {
+		client.RemoveMiddleware(mw)
+	}()
+
+	iter := client.Run(ctx, client.NewQuery("Data"))
+	for {
+		_, err := iter.Next(&Data{})
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 4 {
+		t.Fatalf("unexpected: %v", len(spans))
+	}
+	if v := spans[3]; v.Name != "datastore.Next" || !attrMap(v)[AttrDone].AsBool() || v.Status.Code != otelcodes.Unset {
+		t.Errorf("unexpected: %+v", v)
+	}
+}
+
+func TestTrace_ChildSpan(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	mw, exporter := setupTracer()
+	rec := &spanRecorder{Middleware: noop.New()}
+	client.AppendMiddleware(mw)
+	client.AppendMiddleware(rec)
+	client.AppendMiddleware(ms)
+
+	err := client.Get(ctx, client.NameKey("Data", "a", nil), &Data{})
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatal(err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("unexpected: %v", len(spans))
+	}
+	if v := rec.spanCtx.SpanID(); v != spans[0].SpanContext.SpanID() {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// the context of the caller isn't changed.
+	if v := trace.SpanContextFromContext(ctx); v.IsValid() {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestTrace_TransactionContext(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	mw, exporter := setupTracer()
+	rec := &txValue{Middleware: noop.New()}
+	tx := ms.NewTransaction(ctx, client, mw, rec, ms)
+
+	_, err := tx.PutMultiWithTx([]datastore.Key{client.NameKey("Data", "a", nil)}, []datastore.PropertyList{{{Name: "Name", Value: "a"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the Context set by the downstream middleware in the transaction reaches PostCommit.
+	if v := rec.value; v != "tx" {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := len(exporter.GetSpans()); v != 2 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
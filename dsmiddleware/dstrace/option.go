@@ -0,0 +1,39 @@
+package dstrace
+
+import (
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WithTracerProvider specifies the TracerProvider. default is the global TracerProvider.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return &withTracerProvider{tp}
+}
+
+type withTracerProvider struct{ tp trace.TracerProvider }
+
+func (w *withTracerProvider) Apply(t *tracer) {
+	t.tracerProvider = w.tp
+}
+
+// WithSpanNamePrefix specifies the prefix of span names. default is "datastore.".
+func WithSpanNamePrefix(prefix string) Option {
+	return &withSpanNamePrefix{prefix}
+}
+
+type withSpanNamePrefix struct{ prefix string }
+
+func (w *withSpanNamePrefix) Apply(t *tracer) {
+	t.spanNamePrefix = w.prefix
+}
+
+// WithAttributes specifies the attributes that are added to all spans.
+func WithAttributes(attrs ...attribute.KeyValue) Option {
+	return &withAttributes{attrs}
+}
+
+type withAttributes struct{ attrs []attribute.KeyValue }
+
+func (w *withAttributes) Apply(t *tracer) {
+	t.attrs = append(t.attrs, w.attrs...)
+}
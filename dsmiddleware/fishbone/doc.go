@@ -2,6 +2,7 @@
 Package fishbone automatically rewrites the behavior based on KeysOnly + Get by Key when Run or GetAll Query, contributing to reducing the amount of charge.
 If you use Run or GetAll with Query, you will be charged for Small Operations + Entity Reads as you retrieve all Entities from Datastore.
 We decompose this automatically, set it to KeysOnly and get Entity from cache in Run or GetAll method.
+The query with SkipCache of CallOption isn't rewritten.
 
 Why fishbone?
 
@@ -56,7 +56,8 @@ func (m *modifier) PostRollback(info *datastore.MiddlewareInfo, tx datastore.Tra
 }
 
 func (m *modifier) Run(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) datastore.Iterator {
-	if qDump.KeysOnly {
+	// the rewrite is for the cache, it is useless when the cache is skipped.
+	if qDump.KeysOnly || info.CallOptions().SkipCache {
 		return info.Next.Run(info, q, qDump)
 	}
 
@@ -81,7 +82,8 @@ func (m *modifier) Run(info *datastore.MiddlewareInfo, q datastore.Query, qDump
 }
 
 func (m *modifier) GetAll(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, psList *[]datastore.PropertyList) ([]datastore.Key, error) {
-	if qDump.KeysOnly {
+	// the rewrite is for the cache, it is useless when the cache is skipped.
+	if qDump.KeysOnly || info.CallOptions().SkipCache {
 		return info.Next.GetAll(info, q, qDump, psList)
 	}
 
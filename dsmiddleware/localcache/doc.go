@@ -5,5 +5,23 @@ How the cache is used is explained in the storagecache package's document.
 The local cache can not be deleted from other machines.
 Therefore, if the cache holding period becomes long, there is a possibility that the data is old.
 As a countermeasure, we recommend keeping the lifetime of the cache as long as processing one request.
+
+By default, the cache grows without limit until the entities expire.
+WithMaxEntries and WithMaxBytes limit the cache, the least recently used entities are evicted.
+The bytes are estimated by the storage size rules of Datastore, it isn't the exact memory usage.
+The cache is split into shards to reduce the lock contention, and the limits are divided into the shards.
+
+The expired entities are removed when they are read.
+WithSweepInterval removes them periodically in the background, call Close to stop it.
+
+	ch := localcache.New(
+		localcache.WithMaxEntries(10000),
+		localcache.WithMaxBytes(64<<20),
+		localcache.WithSweepInterval(time.Minute),
+	)
+	defer ch.Close()
+	client.AppendMiddleware(ch)
+
+	stats := ch.Stats()
 */
 package localcache // import "go.mercari.io/datastore/dsmiddleware/localcache"
@@ -7,18 +7,20 @@ import (
 
 	"go.mercari.io/datastore"
 	"go.mercari.io/datastore/dsmiddleware/storagecache"
+	"go.mercari.io/datastore/internal/estimate"
 )
 
 var _ storagecache.Storage = &cacheHandler{}
 var _ datastore.Middleware = &cacheHandler{}
 
 const defaultExpiration = 3 * time.Minute
+const defaultShards = 16
 
 // New in-memory localcache middleware creates and returns.
 func New(opts ...CacheOption) CacheHandler {
 	ch := &cacheHandler{
-		cache:  make(map[string]cacheItem),
-		stOpts: &storagecache.Options{},
+		stOpts:     &storagecache.Options{},
+		shardCount: defaultShards,
 	}
 
 	for _, opt := range opts {
@@ -35,6 +37,29 @@ func New(opts ...CacheOption) CacheHandler {
 		ch.logf = func(ctx context.Context, format string, args ...interface{}) {}
 	}
 
+	if ch.shardCount <= 0 {
+		ch.shardCount = 1
+	}
+	// every shard should be able to hold at least one item, the limit 0 of the shard means no limit.
+	if 0 < ch.maxEntries && ch.maxEntries < ch.shardCount {
+		ch.shardCount = ch.maxEntries
+	}
+	if 0 < ch.maxBytes && ch.maxBytes < int64(ch.shardCount) {
+		ch.shardCount = int(ch.maxBytes)
+	}
+	ch.shards = make([]*shard, ch.shardCount)
+	for idx := range ch.shards {
+		ch.shards[idx] = newShard(
+			int(splitLimit(int64(ch.maxEntries), ch.shardCount, idx)),
+			splitLimit(ch.maxBytes, ch.shardCount, idx),
+		)
+	}
+
+	ch.done = make(chan struct{})
+	if 0 < ch.sweepInterval {
+		go ch.sweeper()
+	}
+
 	return ch
 }
 
@@ -48,16 +73,36 @@ type CacheHandler interface {
 	CacheKeys() []string
 	CacheLen() int
 	FlushLocalCache()
+	// Stats returns the statistics of the cache.
+	Stats() Stats
+	// Close stops the background sweeper.
+	Close()
+}
+
+// Stats is the statistics of the cache.
+type Stats struct {
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64
+	Expirations uint64
+	Entries     int
+	Bytes       int64
 }
 
 type cacheHandler struct {
 	datastore.Middleware
 	stOpts *storagecache.Options
 
-	cache          map[string]cacheItem
-	m              sync.Mutex
-	expireDuration time.Duration
-	logf           func(ctx context.Context, format string, args ...interface{})
+	shards                 []*shard
+	shardCount             int
+	maxEntries             int
+	maxBytes               int64
+	expireDuration         time.Duration
+	negativeExpireDuration time.Duration
+	sweepInterval          time.Duration
+	done                   chan struct{}
+	closeOnce              sync.Once
+	logf                   func(ctx context.Context, format string, args ...interface{})
 }
 
 // A CacheOption is an option for cache.
@@ -68,45 +113,108 @@ type CacheOption interface {
 type cacheItem struct {
 	Key          datastore.Key
 	PropertyList datastore.PropertyList
+	noSuchEntity bool
+	keyStr       string
+	size         int64
 	setAt        time.Time
 	expiration   time.Duration
 }
 
+func (item *cacheItem) expired(now time.Time) bool {
+	return !item.setAt.Add(item.expiration).After(now)
+}
+
 func (ch *cacheHandler) HasCache(key datastore.Key) bool {
-	_, ok := ch.cache[key.Encode()]
+	keyStr := key.Encode()
+	s := ch.shardFor(keyStr)
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	_, ok := s.items[keyStr]
 	return ok
 }
 
 func (ch *cacheHandler) DeleteCache(ctx context.Context, key datastore.Key) {
-	ch.m.Lock()
-	defer ch.m.Unlock()
+	keyStr := key.Encode()
+	s := ch.shardFor(keyStr)
+	s.m.Lock()
+	defer s.m.Unlock()
+
 	ch.logf(ctx, "dsmiddleware/localcache.DeleteCache: key=%s", key.String())
-	delete(ch.cache, key.Encode())
+	if e, ok := s.items[keyStr]; ok {
+		s.remove(e)
+	}
 }
 
 func (ch *cacheHandler) CacheKeys() []string {
-	list := make([]string, 0, len(ch.cache))
-	for keyStr := range ch.cache {
-		list = append(list, keyStr)
+	var list []string
+	for _, s := range ch.shards {
+		s.m.Lock()
+		for keyStr := range s.items {
+			list = append(list, keyStr)
+		}
+		s.m.Unlock()
 	}
 
 	return list
 }
 
 func (ch *cacheHandler) CacheLen() int {
-	return len(ch.cache)
+	cnt := 0
+	for _, s := range ch.shards {
+		s.m.Lock()
+		cnt += len(s.items)
+		s.m.Unlock()
+	}
+
+	return cnt
 }
 
 func (ch *cacheHandler) FlushLocalCache() {
-	ch.m.Lock()
-	defer ch.m.Unlock()
-	ch.cache = make(map[string]cacheItem)
+	for _, s := range ch.shards {
+		s.flush()
+	}
 }
 
-func (ch *cacheHandler) SetMulti(ctx context.Context, cis []*storagecache.CacheItem) error {
-	ch.m.Lock()
-	defer ch.m.Unlock()
+func (ch *cacheHandler) Stats() Stats {
+	var stats Stats
+	for _, s := range ch.shards {
+		s.m.Lock()
+		stats.Hits += s.hits
+		stats.Misses += s.misses
+		stats.Evictions += s.evictions
+		stats.Expirations += s.expirations
+		stats.Entries += len(s.items)
+		stats.Bytes += s.bytes
+		s.m.Unlock()
+	}
+
+	return stats
+}
+
+func (ch *cacheHandler) Close() {
+	ch.closeOnce.Do(func() {
+		close(ch.done)
+	})
+}
 
+func (ch *cacheHandler) sweeper() {
+	t := time.NewTicker(ch.sweepInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ch.done:
+			return
+		case now := <-t.C:
+			for _, s := range ch.shards {
+				s.sweep(now)
+			}
+		}
+	}
+}
+
+func (ch *cacheHandler) SetMulti(ctx context.Context, cis []*storagecache.CacheItem) error {
 	ch.logf(ctx, "dsmiddleware/localcache.SetMulti: len=%d", len(cis))
 	for idx, ci := range cis {
 		ch.logf(ctx, "dsmiddleware/localcache.SetMulti: idx=%d key=%s len(ps)=%d", idx, ci.Key.String(), len(ci.PropertyList))
@@ -117,21 +225,31 @@ func (ch *cacheHandler) SetMulti(ctx context.Context, cis []*storagecache.CacheI
 		if ci.Key.Incomplete() {
 			continue
 		}
-		ch.cache[ci.Key.Encode()] = cacheItem{
+		expiration := ch.expireDuration
+		if ci.NoSuchEntity {
+			expiration = ch.negativeExpireDuration
+		}
+		keyStr := ci.Key.Encode()
+		item := &cacheItem{
 			Key:          ci.Key,
 			PropertyList: ci.PropertyList,
+			noSuchEntity: ci.NoSuchEntity,
+			keyStr:       keyStr,
+			size:         int64(estimate.EntitySize(ci.Key, ci.PropertyList)),
 			setAt:        now,
-			expiration:   ch.expireDuration,
+			expiration:   expiration,
 		}
+
+		s := ch.shardFor(keyStr)
+		s.m.Lock()
+		s.set(item)
+		s.m.Unlock()
 	}
 
 	return nil
 }
 
 func (ch *cacheHandler) GetMulti(ctx context.Context, keys []datastore.Key) ([]*storagecache.CacheItem, error) {
-	ch.m.Lock()
-	defer ch.m.Unlock()
-
 	now := time.Now()
 
 	ch.logf(ctx, "dsmiddleware/localcache.GetMulti: len=%d", len(keys))
@@ -145,38 +263,60 @@ func (ch *cacheHandler) GetMulti(ctx context.Context, keys []datastore.Key) ([]*
 			ch.logf(ctx, "dsmiddleware/localcache.GetMulti: idx=%d, incomplete key=%s", idx, key.String())
 			continue
 		}
-		cItem, ok := ch.cache[key.Encode()]
-		if !ok {
-			ch.logf(ctx, "dsmiddleware/localcache.GetMulti: idx=%d, missed key=%s", idx, key.String())
-			continue
-		}
-
-		if cItem.setAt.Add(cItem.expiration).After(now) {
-			ch.logf(ctx, "dsmiddleware/localcache.GetMulti: idx=%d, hit key=%s len(ps)=%d", idx, key.String(), len(cItem.PropertyList))
-			resultList[idx] = &storagecache.CacheItem{
-				Key:          key,
-				PropertyList: cItem.PropertyList,
-			}
-		} else {
-			ch.logf(ctx, "dsmiddleware/localcache.GetMulti: idx=%d, expired key=%s", idx, key.String())
-			delete(ch.cache, key.Encode())
-		}
+		resultList[idx] = ch.get(ctx, idx, key, now)
 	}
 
 	return resultList, nil
 }
 
-func (ch *cacheHandler) DeleteMulti(ctx context.Context, keys []datastore.Key) error {
-	ch.m.Lock()
-	defer ch.m.Unlock()
+func (ch *cacheHandler) get(ctx context.Context, idx int, key datastore.Key, now time.Time) *storagecache.CacheItem {
+	keyStr := key.Encode()
+	s := ch.shardFor(keyStr)
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	e, ok := s.items[keyStr]
+	if !ok {
+		ch.logf(ctx, "dsmiddleware/localcache.GetMulti: idx=%d, missed key=%s", idx, key.String())
+		s.misses++
+		return nil
+	}
+
+	cItem := e.Value.(*cacheItem)
+	if cItem.expired(now) {
+		ch.logf(ctx, "dsmiddleware/localcache.GetMulti: idx=%d, expired key=%s", idx, key.String())
+		s.remove(e)
+		s.expirations++
+		s.misses++
+		return nil
+	}
 
+	ch.logf(ctx, "dsmiddleware/localcache.GetMulti: idx=%d, hit key=%s len(ps)=%d", idx, key.String(), len(cItem.PropertyList))
+	s.lru.MoveToFront(e)
+	s.hits++
+
+	return &storagecache.CacheItem{
+		Key:          key,
+		PropertyList: cItem.PropertyList,
+		NoSuchEntity: cItem.noSuchEntity,
+		ExpiresAt:    cItem.setAt.Add(cItem.expiration),
+	}
+}
+
+func (ch *cacheHandler) DeleteMulti(ctx context.Context, keys []datastore.Key) error {
 	ch.logf(ctx, "dsmiddleware/localcache.DeleteMulti: len=%d", len(keys))
 	for idx, key := range keys {
 		ch.logf(ctx, "dsmiddleware/localcache.DeleteMulti: idx=%d key=%s", idx, key.String())
 	}
 
 	for _, key := range keys {
-		delete(ch.cache, key.Encode())
+		keyStr := key.Encode()
+		s := ch.shardFor(keyStr)
+		s.m.Lock()
+		if e, ok := s.items[keyStr]; ok {
+			s.remove(e)
+		}
+		s.m.Unlock()
 	}
 
 	return nil
@@ -3,14 +3,18 @@ package localcache
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"regexp"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/MakeNowJust/heredoc/v2"
 	"go.mercari.io/datastore"
 	"go.mercari.io/datastore/dsmiddleware/dslog"
+	"go.mercari.io/datastore/dsmiddleware/noop"
 	"go.mercari.io/datastore/internal/testutils"
 	"google.golang.org/api/iterator"
 )
@@ -1283,3 +1287,728 @@ func TestLocalCache_MultiError(t *testing.T) {
 		t.Errorf("unexpected: %v", v)
 	}
 }
+
+func TestLocalCache_NegativeCache(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	ch := New(WithNegativeExpireDuration(30 * time.Second))
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	key := client.NameKey("Data", "a", nil)
+
+	// the tombstone is stored by ErrNoSuchEntity.
+	err := client.Get(ctx, key, &Data{})
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("unexpected: %v", err)
+	}
+	if v := ch.HasCache(key); !v {
+		t.Fatalf("unexpected: %v", v)
+	}
+	if v := ch.(*cacheHandler).shardFor(key.Encode()).items[key.Encode()].Value.(*cacheItem).expiration; v != 30*time.Second {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// the tombstone hits.
+	err = client.Get(ctx, key, &Data{})
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("unexpected: %v", err)
+	}
+	if v := ms.Calls("GetMultiWithoutTx"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// the tombstone is overwritten by Put.
+	_, err = client.Put(ctx, key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := &Data{}
+	err = client.Get(ctx, key, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := obj.Name; v != "a" {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := ms.Calls("GetMultiWithoutTx"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// the tombstone and the entity are mixed.
+	key2 := client.NameKey("Data", "b", nil)
+	keys := []datastore.Key{key, key2}
+	for i := 0; i < 2; i++ {
+		list := make([]*Data, 2)
+		err = client.GetMulti(ctx, keys, list)
+		merr, ok := err.(datastore.MultiError)
+		if !ok {
+			t.Fatalf("unexpected: %v", err)
+		}
+		if merr[0] != nil || merr[1] != datastore.ErrNoSuchEntity {
+			t.Errorf("unexpected: %v", merr)
+		}
+		if v := list[0].Name; v != "a" {
+			t.Errorf("unexpected: %v", v)
+		}
+	}
+	if v := ms.Calls("GetMultiWithoutTx"); v != 2 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestLocalCache_NegativeCacheWithoutOption(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	ch := New()
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	key := client.NameKey("Data", "a", nil)
+
+	for i := 0; i < 2; i++ {
+		err := client.Get(ctx, key, &Data{})
+		if err != datastore.ErrNoSuchEntity {
+			t.Fatalf("unexpected: %v", err)
+		}
+	}
+	if v := ch.HasCache(key); v {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := ms.Calls("GetMultiWithoutTx"); v != 2 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestLocalCache_NegativeCacheTransaction(t *testing.T) {
+	ctx, client, cleanUp := testutils.SetupCloudDatastore(t)
+	defer cleanUp()
+
+	ch := New(WithNegativeExpireDuration(30 * time.Second))
+	client.AppendMiddleware(ch)
+	defer func() {
+		// stop caching before cleanUp func called.
+		client.RemoveMiddleware(ch)
+	}()
+
+	type Data struct {
+		Name string
+	}
+
+	key := client.NameKey("Data", "a", nil)
+
+	err := client.Get(ctx, key, &Data{})
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("unexpected: %v", err)
+	}
+	if v := ch.HasCache(key); !v {
+		t.Fatalf("unexpected: %v", v)
+	}
+
+	tx, err := client.NewTransaction(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tx.Put(key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the tombstone is alive until commit.
+	if v := ch.HasCache(key); !v {
+		t.Fatalf("unexpected: %v", v)
+	}
+	_, err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the tombstone is deleted by commit.
+	if v := ch.HasCache(key); v {
+		t.Fatalf("unexpected: %v", v)
+	}
+	obj := &Data{}
+	err = client.Get(ctx, key, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := obj.Name; v != "a" {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestLocalCache_MaxEntries(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	ch := New(WithMaxEntries(2), WithShards(1))
+	defer ch.Close()
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	keyA := client.NameKey("Data", "a", nil)
+	keyB := client.NameKey("Data", "b", nil)
+	keyC := client.NameKey("Data", "c", nil)
+
+	_, err := client.PutMulti(ctx, []datastore.Key{keyA, keyB}, []*Data{{Name: "a"}, {Name: "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a is used recently, b is evicted.
+	err = client.Get(ctx, keyA, &Data{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Put(ctx, keyC, &Data{Name: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := ch.HasCache(keyA); !v {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := ch.HasCache(keyB); v {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := ch.HasCache(keyC); !v {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	stats := ch.Stats()
+	if v := stats.Entries; v != 2 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := stats.Evictions; v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := stats.Hits; v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// b is loaded from datastore again.
+	err = client.Get(ctx, keyB, &Data{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := ms.Calls("GetMultiWithoutTx"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := ch.Stats().Misses; v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestLocalCache_MaxBytes(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	ch := New(WithMaxBytes(1024), WithShards(1))
+	defer ch.Close()
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	for i := 0; i < 10; i++ {
+		key := client.IDKey("Data", int64(i+1), nil)
+		_, err := client.Put(ctx, key, &Data{Name: strings.Repeat("a", 200)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := ch.Stats()
+	if v := stats.Bytes; 1024 < v || v <= 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := stats.Entries; 5 <= v || v <= 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := uint64(10 - stats.Entries); stats.Evictions != v {
+		t.Errorf("unexpected: %v", stats.Evictions)
+	}
+	if v := ch.HasCache(client.IDKey("Data", 10, nil)); !v {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	ch.FlushLocalCache()
+	if v := ch.Stats(); v.Entries != 0 || v.Bytes != 0 {
+		t.Errorf("unexpected: %+v", v)
+	}
+}
+
+func TestLocalCache_MaxBytesShards(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	// maxBytes is less than the default number of shards.
+	ch := New(WithMaxBytes(8))
+	defer ch.Close()
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	for _, s := range ch.(*cacheHandler).shards {
+		if s.maxBytes <= 0 {
+			t.Fatalf("unexpected: %v", s.maxBytes)
+		}
+	}
+
+	// no shard can hold the entity.
+	for i := 0; i < 16; i++ {
+		key := client.IDKey("Data", int64(i+1), nil)
+		_, err := client.Put(ctx, key, &Data{Name: "a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.Get(ctx, key, &Data{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v := ch.Stats(); v.Entries != 0 || v.Evictions == 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestLocalCache_SweepInterval(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	ch := New(WithExpireDuration(10*time.Millisecond), WithSweepInterval(5*time.Millisecond))
+	defer ch.Close()
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	key := client.NameKey("Data", "a", nil)
+	_, err := client.Put(ctx, key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for ch.HasCache(key) {
+		if time.Now().After(deadline) {
+			t.Fatal("the expired entity is not swept")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if v := ch.Stats().Expirations; v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// Close can be called twice.
+	ch.Close()
+	ch.Close()
+}
+
+func TestLocalCache_Concurrent(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	ch := New(WithMaxEntries(50))
+	defer ch.Close()
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := client.IDKey("Data", int64(i*100+j+1), nil)
+				_, err := client.Put(ctx, key, &Data{Name: "a"})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				err = client.Get(ctx, key, &Data{})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if v := ch.CacheLen(); 50 < v {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := len(ch.CacheKeys()); v != ch.CacheLen() {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+// slowGet delays GetMultiWithoutTx, so the concurrent cache misses overlap.
+type slowGet struct {
+	datastore.Middleware
+	d time.Duration
+}
+
+func (m *slowGet) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	time.Sleep(m.d)
+	return info.Next.GetMultiWithoutTx(info, keys, psList)
+}
+
+// lateGet delays the return of GetMultiWithoutTx, so the result read before the write lands after it.
+type lateGet struct {
+	datastore.Middleware
+	d time.Duration
+}
+
+func (m *lateGet) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	err := info.Next.GetMultiWithoutTx(info, keys, psList)
+	time.Sleep(m.d)
+	return err
+}
+
+// failingGet delays GetMultiWithoutTx, and fails entirely by the done context or err.
+type failingGet struct {
+	datastore.Middleware
+	d   time.Duration
+	err error
+}
+
+func (m *failingGet) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	time.Sleep(m.d)
+	if err := info.Context.Err(); err != nil {
+		return err
+	} else if m.err != nil {
+		return m.err
+	}
+	return info.Next.GetMultiWithoutTx(info, keys, psList)
+}
+
+func TestLocalCache_Coalescing(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	ch := New(WithCoalescing())
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(&slowGet{Middleware: noop.New(), d: 100 * time.Millisecond})
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	key := client.NameKey("Data", "a", nil)
+	_, err := client.Put(ctx, key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch.FlushLocalCache()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			obj := &Data{}
+			err := client.Get(ctx, key, obj)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if v := obj.Name; v != "a" {
+				t.Errorf("unexpected: %v", v)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if v := ms.Calls("GetMultiWithoutTx"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// ErrNoSuchEntity is shared too.
+	key2 := client.NameKey("Data", "b", nil)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := client.Get(ctx, key2, &Data{})
+			if err != datastore.ErrNoSuchEntity {
+				t.Errorf("unexpected: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if v := ms.Calls("GetMultiWithoutTx"); v != 2 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestLocalCache_CoalescingWrite(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	ch := New(WithCoalescing())
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(&lateGet{Middleware: noop.New(), d: 100 * time.Millisecond})
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	key := client.NameKey("Data", "a", nil)
+	_, err := client.Put(ctx, key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch.FlushLocalCache()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// the flight started before the delete returns the old entity.
+		err := client.Get(ctx, key, &Data{})
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	time.Sleep(30 * time.Millisecond)
+
+	err = client.Delete(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the reader after the delete doesn't join the flight.
+	err = client.Get(ctx, key, &Data{})
+	if err != datastore.ErrNoSuchEntity {
+		t.Errorf("unexpected: %v", err)
+	}
+	wg.Wait()
+
+	if v := ms.Calls("GetMultiWithoutTx"); v != 2 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestLocalCache_CoalescingError(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	ch := New(WithCoalescing())
+	fg := &failingGet{Middleware: noop.New(), d: 100 * time.Millisecond}
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(fg)
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	key := client.NameKey("Data", "a", nil)
+	_, err := client.Put(ctx, key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch.FlushLocalCache()
+
+	// the request that fetches is canceled, the waiter fetches by itself.
+	cancelCtx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := client.Get(cancelCtx, key, &Data{})
+		if err != context.Canceled {
+			t.Errorf("unexpected: %v", err)
+		}
+	}()
+	time.Sleep(30 * time.Millisecond)
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		cancel()
+	}()
+
+	obj := &Data{}
+	err = client.Get(ctx, key, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := obj.Name; v != "a" {
+		t.Errorf("unexpected: %v", v)
+	}
+	wg.Wait()
+
+	if v := ms.Calls("GetMultiWithoutTx"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// the other error of the whole fetch is shared as is.
+	ch.FlushLocalCache()
+	fg.err = errors.New("unavailable")
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := client.Get(ctx, key, &Data{})
+			if err != fg.err {
+				t.Errorf("unexpected: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestLocalCache_EarlyRefresh(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	// the large beta refreshes every hit.
+	ch := New(WithExpireDuration(time.Minute), WithEarlyRefresh(1e12))
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	key := client.NameKey("Data", "a", nil)
+	_, err := client.Put(ctx, key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch.FlushLocalCache()
+
+	// the miss measures the time to fetch.
+	err = client.Get(ctx, key, &Data{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := ms.Calls("GetMultiWithoutTx"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// the entity is changed without the cache.
+	ms.SetRaw(key, datastore.PropertyList{{Name: "Name", Value: "b"}})
+
+	// the hit returns the cached entity, and refreshes it in background.
+	obj := &Data{}
+	err = client.Get(ctx, key, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := obj.Name; v != "a" {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	for i := 0; i < 100 && ms.Calls("GetMultiWithoutTx") < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v := ms.Calls("GetMultiWithoutTx"); v != 2 {
+		t.Fatalf("unexpected: %v", v)
+	}
+
+	var name string
+	for i := 0; i < 100; i++ {
+		cis, err := ch.GetMulti(ctx, []datastore.Key{key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		name = cis[0].PropertyList[0].Value.(string)
+		if name == "b" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if name != "b" {
+		t.Errorf("unexpected: %v", name)
+	}
+}
+
+func TestLocalCache_CallOptions(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	ch := New()
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	key := client.NameKey("Data", "a", nil)
+	_, err := client.Put(ctx, key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := ch.HasCache(key); !v {
+		t.Fatalf("unexpected: %v", v)
+	}
+
+	// Datastore is updated behind the cache.
+	ms.SetRaw(key, datastore.PropertyList{{Name: "Name", Value: "b"}})
+
+	// SkipCache reads Datastore, and doesn't fill the cache.
+	obj := &Data{}
+	err = client.Get(datastore.WithCallOptions(ctx, datastore.SkipCache()), key, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := obj.Name; v != "b" {
+		t.Errorf("unexpected: %v", v)
+	}
+	obj = &Data{}
+	err = client.Get(ctx, key, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := obj.Name; v != "a" {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// StrongRead reads Datastore, and refreshes the cache.
+	obj = &Data{}
+	err = client.Get(datastore.WithCallOptions(ctx, datastore.StrongRead()), key, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := obj.Name; v != "b" {
+		t.Errorf("unexpected: %v", v)
+	}
+	obj = &Data{}
+	err = client.Get(ctx, key, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := obj.Name; v != "b" {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := ms.Calls("GetMultiWithoutTx"); v != 2 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// SkipCache invalidates the cache by Put.
+	_, err = client.Put(datastore.WithCallOptions(ctx, datastore.SkipCache()), key, &Data{Name: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := ch.HasCache(key); v {
+		t.Errorf("unexpected: %v", v)
+	}
+}
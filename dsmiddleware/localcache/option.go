@@ -82,3 +82,98 @@ type withExpireDuration struct{ d time.Duration }
 func (w *withExpireDuration) Apply(o *cacheHandler) {
 	o.expireDuration = w.d
 }
+
+// WithStatsRecorder creates a ClientOption that reports cache hits and misses to the specified recorder.
+func WithStatsRecorder(r storagecache.StatsRecorder) CacheOption {
+	return &withStatsRecorder{r}
+}
+
+type withStatsRecorder struct{ r storagecache.StatsRecorder }
+
+func (w *withStatsRecorder) Apply(o *cacheHandler) {
+	o.stOpts.StatsRecorder = w.r
+}
+
+// WithNegativeExpireDuration creates a ClientOption that caches ErrNoSuchEntity as the tombstone,
+// and expires it at a specified time.
+func WithNegativeExpireDuration(d time.Duration) CacheOption {
+	return &withNegativeExpireDuration{d}
+}
+
+type withNegativeExpireDuration struct{ d time.Duration }
+
+func (w *withNegativeExpireDuration) Apply(o *cacheHandler) {
+	o.negativeExpireDuration = w.d
+	o.stOpts.NegativeCache = 0 < w.d
+}
+
+// WithMaxEntries creates a ClientOption that limits the number of cached entities.
+// The least recently used entity is evicted when the limit is exceeded.
+func WithMaxEntries(n int) CacheOption {
+	return &withMaxEntries{n}
+}
+
+type withMaxEntries struct{ n int }
+
+func (w *withMaxEntries) Apply(o *cacheHandler) {
+	o.maxEntries = w.n
+}
+
+// WithMaxBytes creates a ClientOption that limits the estimated bytes of cached entities.
+// The least recently used entity is evicted when the limit is exceeded.
+func WithMaxBytes(n int64) CacheOption {
+	return &withMaxBytes{n}
+}
+
+type withMaxBytes struct{ n int64 }
+
+func (w *withMaxBytes) Apply(o *cacheHandler) {
+	o.maxBytes = w.n
+}
+
+// WithShards creates a ClientOption that specifies the number of shards. The default is 16.
+// Each shard has its own lock, and the limits are divided into the shards.
+func WithShards(n int) CacheOption {
+	return &withShards{n}
+}
+
+type withShards struct{ n int }
+
+func (w *withShards) Apply(o *cacheHandler) {
+	o.shardCount = w.n
+}
+
+// WithSweepInterval creates a ClientOption that removes expired entities periodically in the background.
+// CacheHandler.Close stops the sweeper.
+func WithSweepInterval(d time.Duration) CacheOption {
+	return &withSweepInterval{d}
+}
+
+type withSweepInterval struct{ d time.Duration }
+
+func (w *withSweepInterval) Apply(o *cacheHandler) {
+	o.sweepInterval = w.d
+}
+
+// WithCoalescing creates a ClientOption that makes the concurrent cache misses of the same key share one fetch from Datastore.
+func WithCoalescing() CacheOption {
+	return &withCoalescing{}
+}
+
+type withCoalescing struct{}
+
+func (w *withCoalescing) Apply(o *cacheHandler) {
+	o.stOpts.Coalesce = true
+}
+
+// WithEarlyRefresh creates a ClientOption that refreshes the entities near the expiration in the background.
+// The probability of the refresh rises as the expiration approaches, beta scales it and 1 is the standard.
+func WithEarlyRefresh(beta float64) CacheOption {
+	return &withEarlyRefresh{beta}
+}
+
+type withEarlyRefresh struct{ beta float64 }
+
+func (w *withEarlyRefresh) Apply(o *cacheHandler) {
+	o.stOpts.EarlyRefreshBeta = w.beta
+}
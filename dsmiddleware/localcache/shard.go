@@ -0,0 +1,107 @@
+package localcache
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// shard holds a part of the cache with its own lock and LRU list.
+type shard struct {
+	m          sync.Mutex
+	items      map[string]*list.Element
+	lru        *list.List // front is the most recently used cacheItem
+	bytes      int64
+	maxEntries int
+	maxBytes   int64
+
+	hits        uint64
+	misses      uint64
+	evictions   uint64
+	expirations uint64
+}
+
+func newShard(maxEntries int, maxBytes int64) *shard {
+	return &shard{
+		items:      make(map[string]*list.Element),
+		lru:        list.New(),
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+	}
+}
+
+// shardFor returns the shard that holds the encoded key.
+func (ch *cacheHandler) shardFor(keyStr string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(keyStr))
+	return ch.shards[h.Sum32()%uint32(len(ch.shards))]
+}
+
+// splitLimit divides the limit into n shards, the sum of them equals to the limit.
+func splitLimit(limit int64, n, idx int) int64 {
+	if limit <= 0 {
+		return 0
+	}
+	l := limit / int64(n)
+	if int64(idx) < limit%int64(n) {
+		l++
+	}
+	return l
+}
+
+// set stores the item as the most recently used, and evicts the least recently used items over the limits.
+// The caller must hold the lock.
+func (s *shard) set(item *cacheItem) {
+	if e, ok := s.items[item.keyStr]; ok {
+		s.remove(e)
+	}
+	s.items[item.keyStr] = s.lru.PushFront(item)
+	s.bytes += item.size
+
+	for 0 < s.lru.Len() && s.overLimit() {
+		s.remove(s.lru.Back())
+		s.evictions++
+	}
+}
+
+func (s *shard) overLimit() bool {
+	if 0 < s.maxEntries && s.maxEntries < s.lru.Len() {
+		return true
+	}
+	if 0 < s.maxBytes && s.maxBytes < s.bytes {
+		return true
+	}
+	return false
+}
+
+// remove removes the element. The caller must hold the lock.
+func (s *shard) remove(e *list.Element) {
+	item := s.lru.Remove(e).(*cacheItem)
+	delete(s.items, item.keyStr)
+	s.bytes -= item.size
+}
+
+// sweep removes the expired items.
+func (s *shard) sweep(now time.Time) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for e := s.lru.Back(); e != nil; {
+		prev := e.Prev()
+		if item := e.Value.(*cacheItem); item.expired(now) {
+			s.remove(e)
+			s.expirations++
+		}
+		e = prev
+	}
+}
+
+func (s *shard) flush() {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.items = make(map[string]*list.Element)
+	s.lru.Init()
+	s.bytes = 0
+}
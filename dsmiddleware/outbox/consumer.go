@@ -0,0 +1,292 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mercari.io/datastore"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	defaultBatchSize  = 100
+	defaultStaleAfter = 1 * time.Minute
+	defaultOverlap    = 1 * time.Minute
+)
+
+// Record represents a change of the entity.
+type Record struct {
+	// Key is the key of the record itself.
+	Key datastore.Key
+	// EntityKey is the key of the changed entity.
+	EntityKey   datastore.Key
+	Op          Op
+	Before      datastore.PropertyList
+	After       datastore.PropertyList
+	CreatedAt   time.Time
+	CommittedAt time.Time
+}
+
+type checkpoint struct {
+	CommittedAt time.Time `datastore:",noindex"`
+	// Seen has the encoded keys of the records delivered in the overlap window.
+	Seen      []string `datastore:",noindex"`
+	UpdatedAt time.Time
+}
+
+// NewConsumer returns the Consumer that reads the change records.
+// name identifies the checkpoint, each Consumer that has the different name reads all records independently.
+func NewConsumer(client datastore.Client, name string, opts ...ConsumerOption) *Consumer {
+	c := &Consumer{
+		client:         client,
+		name:           name,
+		outboxKind:     defaultOutboxKind,
+		checkpointKind: defaultCheckpointKind,
+		batchSize:      defaultBatchSize,
+		staleAfter:     defaultStaleAfter,
+		overlap:        defaultOverlap,
+	}
+
+	for _, opt := range opts {
+		opt.Apply(c)
+	}
+
+	if c.logf == nil {
+		c.logf = func(ctx context.Context, format string, args ...interface{}) {}
+	}
+
+	return c
+}
+
+// A ConsumerOption is an option for Consumer.
+type ConsumerOption interface {
+	Apply(*Consumer)
+}
+
+// Consumer reads the committed change records in order of the commit time.
+// The position is kept by the latest commit time and the records delivered in the overlap window before it,
+// and it is saved as a checkpoint entity by Checkpoint.
+type Consumer struct {
+	client         datastore.Client
+	name           string
+	outboxKind     string
+	checkpointKind string
+	batchSize      int
+	staleAfter     time.Duration
+	overlap        time.Duration
+	logf           func(ctx context.Context, format string, args ...interface{})
+
+	m           sync.Mutex
+	loaded      bool
+	committedAt time.Time
+	seen        map[string]time.Time
+	polled      bool
+}
+
+func (c *Consumer) checkpointKey() datastore.Key {
+	return c.client.NameKey(c.checkpointKind, c.name, nil)
+}
+
+// loadPosition returns the latest commit time and the records delivered in the overlap window.
+func (c *Consumer) loadPosition(ctx context.Context) (time.Time, map[string]time.Time, error) {
+	c.m.Lock()
+	if c.loaded {
+		committedAt, seen := c.committedAt, c.seen
+		c.m.Unlock()
+		return committedAt, seen, nil
+	}
+	c.m.Unlock()
+
+	cp := &checkpoint{}
+	err := c.client.Get(ctx, c.checkpointKey(), cp)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return time.Time{}, nil, err
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.committedAt = cp.CommittedAt
+	c.seen = make(map[string]time.Time, len(cp.Seen))
+	for _, keyStr := range cp.Seen {
+		// the commit time of each record isn't saved, it is removed after the overlap from the position.
+		c.seen[keyStr] = cp.CommittedAt
+	}
+	c.loaded = true
+
+	return c.committedAt, c.seen, nil
+}
+
+// Poll returns the records committed after the last position.
+// The records committed in the overlap window before the position are read again,
+// and the records that are not delivered yet are returned, so the records that have the earlier commit time are not lost.
+// The position advances in memory, call Checkpoint after the records are processed to save it.
+func (c *Consumer) Poll(ctx context.Context) ([]*Record, error) {
+	committedAt, seen, err := c.loadPosition(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// the records in the overlap window are skipped at most len(seen).
+	q := c.client.NewQuery(c.outboxKind).Order(propCommittedAt).Limit(c.batchSize + len(seen))
+	if !committedAt.IsZero() {
+		q = q.Filter(propCommittedAt+" >=", committedAt.Add(-c.overlap))
+	}
+
+	var records []*Record
+	iter := c.client.Run(ctx, q)
+	for len(records) < c.batchSize {
+		var ps datastore.PropertyList
+		key, err := iter.Next(&ps)
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if _, ok := seen[key.Encode()]; ok {
+			continue
+		}
+
+		record, err := toRecord(key, ps)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	if len(records) != 0 {
+		c.m.Lock()
+		newSeen := make(map[string]time.Time, len(c.seen)+len(records))
+		for keyStr, t := range c.seen {
+			newSeen[keyStr] = t
+		}
+		for _, record := range records {
+			newSeen[record.Key.Encode()] = record.CommittedAt
+			if record.CommittedAt.After(c.committedAt) {
+				c.committedAt = record.CommittedAt
+			}
+		}
+		from := c.committedAt.Add(-c.overlap)
+		for keyStr, t := range newSeen {
+			if t.Before(from) {
+				delete(newSeen, keyStr)
+			}
+		}
+		c.seen = newSeen
+		c.polled = true
+		c.m.Unlock()
+	}
+
+	c.logf(ctx, "dsmiddleware/outbox.Poll: name=%s len=%d", c.name, len(records))
+
+	return records, nil
+}
+
+// Checkpoint saves the position after the records returned by Poll.
+func (c *Consumer) Checkpoint(ctx context.Context) error {
+	c.m.Lock()
+	if !c.polled {
+		c.m.Unlock()
+		return nil
+	}
+	cp := &checkpoint{CommittedAt: c.committedAt, UpdatedAt: time.Now()}
+	for keyStr := range c.seen {
+		cp.Seen = append(cp.Seen, keyStr)
+	}
+	c.m.Unlock()
+
+	_, err := c.client.Put(ctx, c.checkpointKey(), cp)
+	if err != nil {
+		return err
+	}
+
+	c.logf(ctx, "dsmiddleware/outbox.Checkpoint: name=%s len(seen)=%d", c.name, len(cp.Seen))
+
+	return nil
+}
+
+// Reset discards the position in memory, the next Poll starts from the saved checkpoint.
+func (c *Consumer) Reset() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.loaded = false
+	c.committedAt = time.Time{}
+	c.seen = nil
+	c.polled = false
+}
+
+// Recover makes the records visible that stay pending longer than WithStaleAfter.
+// A record is left pending when the process stops between the commit and PostCommit.
+// The pending record exists only if the transaction was committed, so it is safe to make it visible.
+func (c *Consumer) Recover(ctx context.Context) (int, error) {
+	q := c.client.NewQuery(c.outboxKind).Filter(propPendingSince+" <", time.Now().Add(-c.staleAfter)).Limit(c.batchSize)
+
+	var psList []datastore.PropertyList
+	keys, err := c.client.GetAll(ctx, q, &psList)
+	if err != nil {
+		return 0, err
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	now := time.Now()
+	for idx := range psList {
+		psList[idx] = committedRecord(psList[idx], now)
+	}
+	_, err = c.client.PutMulti(ctx, keys, psList)
+	if err != nil {
+		return 0, err
+	}
+
+	c.logf(ctx, "dsmiddleware/outbox.Recover: len=%d", len(keys))
+
+	return len(keys), nil
+}
+
+func toRecord(key datastore.Key, ps datastore.PropertyList) (*Record, error) {
+	record := &Record{Key: key}
+	for _, p := range ps {
+		var ok bool
+		switch p.Name {
+		case propEntityKey:
+			record.EntityKey, ok = p.Value.(datastore.Key)
+		case propOp:
+			var op string
+			op, ok = p.Value.(string)
+			record.Op = Op(op)
+		case propBefore, propAfter:
+			var b []byte
+			b, ok = p.Value.([]byte)
+			if !ok {
+				break
+			}
+			decoded, err := decodePropertyList(b)
+			if err != nil {
+				return nil, fmt.Errorf("dsmiddleware/outbox: %s of %s can't be decoded: %s", p.Name, key.String(), err.Error())
+			}
+			if p.Name == propBefore {
+				record.Before = decoded
+			} else {
+				record.After = decoded
+			}
+		case propCreatedAt:
+			record.CreatedAt, ok = p.Value.(time.Time)
+		case propCommittedAt:
+			record.CommittedAt, ok = p.Value.(time.Time)
+		default:
+			ok = true
+		}
+		if !ok {
+			return nil, fmt.Errorf("dsmiddleware/outbox: %s of %s has unexpected type %T", p.Name, key.String(), p.Value)
+		}
+	}
+	if record.EntityKey == nil {
+		return nil, errors.New("dsmiddleware/outbox: EntityKey is missing in " + key.String())
+	}
+
+	return record, nil
+}
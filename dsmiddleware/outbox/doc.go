@@ -0,0 +1,30 @@
+/*
+Package outbox writes change records of entities in the same transaction, so the domain events are published reliably.
+
+When entities are saved or deleted in a transaction, this middleware writes a change record
+(kind, key, operation and optionally the entity before and after the change) into the outbox Kind in the same transaction.
+The record is pending until PostCommit, and it becomes visible to Consumer after the commit.
+Put and Delete outside of a transaction are executed in a new transaction started by the Client,
+the transaction passes through all middlewares of the Client again, from the first one.
+The middlewares placed before this middleware see the operation twice, without and with the transaction,
+and the middlewares placed after it see only the transaction.
+
+Consumer polls the committed records in order of the commit time, and keeps the position by the latest commit time.
+The commit time is decided by the clock of each instance, a record may be committed with the time earlier than the position.
+So Poll reads the records in the overlap window (WithOverlap) before the position again, and skips the records already delivered.
+Checkpoint saves the position and the records delivered in the overlap window into the checkpoint entity,
+so the next process resumes from there.
+If the process stops between the commit and PostCommit, the record stays pending.
+Call Consumer.Recover periodically to make such records visible.
+
+	client.AppendMiddleware(outbox.New(outbox.WithIncludeKinds("Order"), outbox.WithAfter()))
+	...
+	c := outbox.NewConsumer(client, "search-index")
+	records, err := c.Poll(ctx)
+	...
+	err = c.Checkpoint(ctx)
+
+The order is approximate across instances.
+Consumer must handle the records idempotently, the records after the last checkpoint are delivered again after the restart.
+*/
+package outbox // import "go.mercari.io/datastore/dsmiddleware/outbox"
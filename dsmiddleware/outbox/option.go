@@ -0,0 +1,174 @@
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"go.mercari.io/datastore"
+)
+
+// WithOutboxKind specifies the Kind of change records. default is "Outbox".
+func WithOutboxKind(kind string) Option {
+	return &withOutboxKind{kind}
+}
+
+type withOutboxKind struct{ kind string }
+
+func (w *withOutboxKind) Apply(o *outboxHandler) {
+	o.outboxKind = w.kind
+}
+
+// WithCheckpointKind specifies the Kind of checkpoints that is excluded from the target. default is "OutboxCheckpoint".
+func WithCheckpointKind(kind string) Option {
+	return &withCheckpointKind{kind}
+}
+
+type withCheckpointKind struct{ kind string }
+
+func (w *withCheckpointKind) Apply(o *outboxHandler) {
+	o.checkpointKind = w.kind
+}
+
+// WithBefore creates a Option that records the entity before the change.
+// It costs an additional Get in the transaction.
+func WithBefore() Option {
+	return &withBefore{}
+}
+
+type withBefore struct{}
+
+func (w *withBefore) Apply(o *outboxHandler) {
+	o.withBefore = true
+}
+
+// WithAfter creates a Option that records the entity after the change.
+func WithAfter() Option {
+	return &withAfter{}
+}
+
+type withAfter struct{}
+
+func (w *withAfter) Apply(o *outboxHandler) {
+	o.withAfter = true
+}
+
+// WithIncludeKinds creates a Option that selects the Kind specified as the target.
+func WithIncludeKinds(kinds ...string) Option {
+	return &withIncludeKinds{kinds}
+}
+
+type withIncludeKinds struct{ kinds []string }
+
+func (w *withIncludeKinds) Apply(o *outboxHandler) {
+	o.filters = append(o.filters, func(key datastore.Key) bool {
+		for _, incKind := range w.kinds {
+			if key.Kind() == incKind {
+				return true
+			}
+		}
+
+		return false
+	})
+}
+
+// WithExcludeKinds creates a Option that selects the Kind unspecified as the target.
+func WithExcludeKinds(kinds ...string) Option {
+	return &withExcludeKinds{kinds}
+}
+
+type withExcludeKinds struct{ kinds []string }
+
+func (w *withExcludeKinds) Apply(o *outboxHandler) {
+	o.filters = append(o.filters, func(key datastore.Key) bool {
+		for _, excKind := range w.kinds {
+			if key.Kind() == excKind {
+				return false
+			}
+		}
+
+		return true
+	})
+}
+
+// WithLogger creates a Option that uses the specified logger.
+func WithLogger(logf func(ctx context.Context, format string, args ...interface{})) Option {
+	return &withLogger{logf}
+}
+
+type withLogger struct {
+	logf func(ctx context.Context, format string, args ...interface{})
+}
+
+func (w *withLogger) Apply(o *outboxHandler) {
+	o.logf = w.logf
+}
+
+// WithConsumerOutboxKind specifies the Kind of change records that Consumer reads. default is "Outbox".
+func WithConsumerOutboxKind(kind string) ConsumerOption {
+	return &withConsumerOutboxKind{kind}
+}
+
+type withConsumerOutboxKind struct{ kind string }
+
+func (w *withConsumerOutboxKind) Apply(o *Consumer) {
+	o.outboxKind = w.kind
+}
+
+// WithConsumerCheckpointKind specifies the Kind of checkpoints. default is "OutboxCheckpoint".
+func WithConsumerCheckpointKind(kind string) ConsumerOption {
+	return &withConsumerCheckpointKind{kind}
+}
+
+type withConsumerCheckpointKind struct{ kind string }
+
+func (w *withConsumerCheckpointKind) Apply(o *Consumer) {
+	o.checkpointKind = w.kind
+}
+
+// WithBatchSize specifies the maximum count of records returned by Poll and Recover. default is 100.
+func WithBatchSize(size int) ConsumerOption {
+	return &withBatchSize{size}
+}
+
+type withBatchSize struct{ size int }
+
+func (w *withBatchSize) Apply(o *Consumer) {
+	o.batchSize = w.size
+}
+
+// WithStaleAfter specifies how long the record can stay pending before Recover makes it visible. default is 1 minute.
+func WithStaleAfter(d time.Duration) ConsumerOption {
+	return &withStaleAfter{d}
+}
+
+type withStaleAfter struct{ d time.Duration }
+
+func (w *withStaleAfter) Apply(o *Consumer) {
+	o.staleAfter = w.d
+}
+
+// WithOverlap specifies how long before the position Poll reads the records again. default is 1 minute.
+// The record whose commit time is earlier than the position by the overlap or more is not delivered,
+// it should be longer than the clock skew of the instances and the delay of PostCommit and Recover.
+func WithOverlap(d time.Duration) ConsumerOption {
+	return &withOverlap{d}
+}
+
+type withOverlap struct{ d time.Duration }
+
+func (w *withOverlap) Apply(o *Consumer) {
+	o.overlap = w.d
+}
+
+// WithConsumerLogger creates a ConsumerOption that uses the specified logger.
+func WithConsumerLogger(logf func(ctx context.Context, format string, args ...interface{})) ConsumerOption {
+	return &withConsumerLogger{logf}
+}
+
+type withConsumerLogger struct {
+	logf func(ctx context.Context, format string, args ...interface{})
+}
+
+func (w *withConsumerLogger) Apply(o *Consumer) {
+	o.logf = w.logf
+}
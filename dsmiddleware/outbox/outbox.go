@@ -0,0 +1,450 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"sync"
+	"time"
+
+	"go.mercari.io/datastore"
+)
+
+var _ datastore.Middleware = &outboxHandler{}
+
+const (
+	defaultOutboxKind     = "Outbox"
+	defaultCheckpointKind = "OutboxCheckpoint"
+
+	propKind         = "Kind"
+	propEntityKey    = "EntityKey"
+	propOp           = "Op"
+	propBefore       = "Before"
+	propAfter        = "After"
+	propCreatedAt    = "CreatedAt"
+	propPendingSince = "PendingSince"
+	propCommittedAt  = "CommittedAt"
+)
+
+// Op represents the type of the operation that changed the entity.
+type Op string
+
+const (
+	// OpPut represents the put operation.
+	OpPut Op = "put"
+	// OpDelete represents the delete operation.
+	OpDelete Op = "delete"
+)
+
+type contextTx struct{}
+
+// txRecord is a change record written in the transaction, it is committed in PostCommit.
+type txRecord struct {
+	PendingKey   datastore.PendingKey
+	PropertyList datastore.PropertyList
+}
+
+// New outbox middleware creates & returns.
+func New(opts ...Option) datastore.Middleware {
+	oh := &outboxHandler{
+		outboxKind:     defaultOutboxKind,
+		checkpointKind: defaultCheckpointKind,
+	}
+
+	for _, opt := range opts {
+		opt.Apply(oh)
+	}
+
+	if oh.logf == nil {
+		oh.logf = func(ctx context.Context, format string, args ...interface{}) {}
+	}
+
+	return oh
+}
+
+// A Option is an option for outbox middleware.
+type Option interface {
+	Apply(*outboxHandler)
+}
+
+type outboxHandler struct {
+	outboxKind     string
+	checkpointKind string
+	withBefore     bool
+	withAfter      bool
+	filters        []func(key datastore.Key) bool
+	logf           func(ctx context.Context, format string, args ...interface{})
+
+	m sync.Mutex
+}
+
+func (oh *outboxHandler) target(key datastore.Key) bool {
+	if key.Kind() == oh.outboxKind || key.Kind() == oh.checkpointKind {
+		return false
+	}
+	for _, f := range oh.filters {
+		if !f(key) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (oh *outboxHandler) anyTarget(keys []datastore.Key) bool {
+	for _, key := range keys {
+		if oh.target(key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func encodePropertyList(ps datastore.PropertyList) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	err := enc.Encode(ps)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decodePropertyList(b []byte) (datastore.PropertyList, error) {
+	var ps datastore.PropertyList
+	dec := gob.NewDecoder(bytes.NewBuffer(b))
+	err := dec.Decode(&ps)
+	if err != nil {
+		return nil, err
+	}
+
+	return ps, nil
+}
+
+func (oh *outboxHandler) newRecord(ctx context.Context, key datastore.Key, op Op, before, after datastore.PropertyList) (datastore.PropertyList, error) {
+	ps := datastore.PropertyList{
+		{Name: propKind, Value: key.Kind()},
+		{Name: propEntityKey, Value: key, NoIndex: true},
+		{Name: propOp, Value: string(op), NoIndex: true},
+		{Name: propCreatedAt, Value: time.Now(), NoIndex: true},
+		{Name: propPendingSince, Value: time.Now()},
+	}
+	if oh.withBefore && before != nil {
+		b, err := encodePropertyList(before)
+		if err != nil {
+			oh.logf(ctx, "dsmiddleware/outbox: gob.Encode error key=%s err=%s", key.String(), err.Error())
+			return nil, err
+		}
+		ps = append(ps, datastore.Property{Name: propBefore, Value: b, NoIndex: true})
+	}
+	if oh.withAfter && after != nil {
+		b, err := encodePropertyList(after)
+		if err != nil {
+			oh.logf(ctx, "dsmiddleware/outbox: gob.Encode error key=%s err=%s", key.String(), err.Error())
+			return nil, err
+		}
+		ps = append(ps, datastore.Property{Name: propAfter, Value: b, NoIndex: true})
+	}
+
+	return ps, nil
+}
+
+// committedRecord returns the copy of the record that is visible from Consumer.
+func committedRecord(ps datastore.PropertyList, committedAt time.Time) datastore.PropertyList {
+	newPs := make(datastore.PropertyList, 0, len(ps))
+	for _, p := range ps {
+		if p.Name == propPendingSince || p.Name == propCommittedAt {
+			continue
+		}
+		newPs = append(newPs, p)
+	}
+	newPs = append(newPs, datastore.Property{Name: propCommittedAt, Value: committedAt})
+
+	return newPs
+}
+
+// getBefore loads the current entities in the transaction. Missing entity is represented as nil.
+func (oh *outboxHandler) getBefore(info *datastore.MiddlewareInfo, next datastore.Middleware, keys []datastore.Key) ([]datastore.PropertyList, error) {
+	psList := make([]datastore.PropertyList, len(keys))
+	if !oh.withBefore {
+		return psList, nil
+	}
+
+	var targetIdxs []int
+	var targetKeys []datastore.Key
+	for idx, key := range keys {
+		if !oh.target(key) || key.Incomplete() {
+			continue
+		}
+		targetIdxs = append(targetIdxs, idx)
+		targetKeys = append(targetKeys, key)
+	}
+	if len(targetKeys) == 0 {
+		return psList, nil
+	}
+
+	targetPsList := make([]datastore.PropertyList, len(targetKeys))
+	err := next.GetMultiWithTx(info, targetKeys, targetPsList)
+	merr, ok := err.(datastore.MultiError)
+	if ok {
+		for _, err := range merr {
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return nil, merr
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	for i, idx := range targetIdxs {
+		if merr != nil && merr[i] != nil {
+			continue
+		}
+		psList[idx] = targetPsList[i]
+	}
+
+	return psList, nil
+}
+
+// putRecords writes the change records in the transaction and keeps them until PostCommit.
+func (oh *outboxHandler) putRecords(info *datastore.MiddlewareInfo, next datastore.Middleware, recordPsList []datastore.PropertyList) error {
+	if len(recordPsList) == 0 {
+		return nil
+	}
+
+	recordKeys := make([]datastore.Key, 0, len(recordPsList))
+	for range recordPsList {
+		recordKeys = append(recordKeys, info.Client.IncompleteKey(oh.outboxKind, nil))
+	}
+	pKeys, err := next.PutMultiWithTx(info, recordKeys, recordPsList)
+	if err != nil {
+		return err
+	}
+
+	oh.m.Lock()
+	defer oh.m.Unlock()
+
+	txRecordMap, ok := info.Context.Value(contextTx{}).(map[datastore.Transaction][]*txRecord)
+	if !ok {
+		txRecordMap = make(map[datastore.Transaction][]*txRecord)
+		info.Context = context.WithValue(info.Context, contextTx{}, txRecordMap)
+	}
+	records := txRecordMap[info.Transaction]
+	for idx, pKey := range pKeys {
+		records = append(records, &txRecord{
+			PendingKey:   pKey,
+			PropertyList: recordPsList[idx],
+		})
+	}
+	txRecordMap[info.Transaction] = records
+
+	return nil
+}
+
+func (oh *outboxHandler) AllocateIDs(info *datastore.MiddlewareInfo, keys []datastore.Key) ([]datastore.Key, error) {
+	return info.Next.AllocateIDs(info, keys)
+}
+
+func (oh *outboxHandler) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.Key, error) {
+	if !oh.anyTarget(keys) {
+		return info.Next.PutMultiWithoutTx(info, keys, psList)
+	}
+
+	// the change records must be written with the entities at once.
+	// the transaction goes through all middlewares again, from the first middleware of the client,
+	// then PutMultiWithTx writes the records.
+	oh.logf(info.Context, "dsmiddleware/outbox.PutMultiWithoutTx: start transaction len=%d", len(keys))
+
+	var pKeys []datastore.PendingKey
+	commit, err := info.Client.RunInTransaction(info.Context, func(tx datastore.Transaction) error {
+		var err error
+		pKeys, err = tx.PutMulti(keys, psList)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	retKeys := make([]datastore.Key, len(pKeys))
+	for idx, pKey := range pKeys {
+		retKeys[idx] = commit.Key(pKey)
+	}
+
+	return retKeys, nil
+}
+
+func (oh *outboxHandler) PutMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.PendingKey, error) {
+	next := info.Next
+	if !oh.anyTarget(keys) {
+		return next.PutMultiWithTx(info, keys, psList)
+	}
+
+	// the change record requires the complete key of the entity.
+	var incompleteIdxs []int
+	var incompleteKeys []datastore.Key
+	for idx, key := range keys {
+		if oh.target(key) && key.Incomplete() {
+			incompleteIdxs = append(incompleteIdxs, idx)
+			incompleteKeys = append(incompleteKeys, key)
+		}
+	}
+	if len(incompleteKeys) != 0 {
+		allocated, err := info.Client.AllocateIDs(info.Context, incompleteKeys)
+		if err != nil {
+			return nil, err
+		}
+		keys = append([]datastore.Key{}, keys...)
+		for i, idx := range incompleteIdxs {
+			keys[idx] = allocated[i]
+		}
+	}
+
+	beforeList, err := oh.getBefore(info, next, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	pKeys, err := next.PutMultiWithTx(info, keys, psList)
+	if err != nil {
+		return nil, err
+	}
+
+	recordPsList := make([]datastore.PropertyList, 0, len(keys))
+	for idx, key := range keys {
+		if !oh.target(key) {
+			continue
+		}
+		ps, err := oh.newRecord(info.Context, key, OpPut, beforeList[idx], psList[idx])
+		if err != nil {
+			return nil, err
+		}
+		recordPsList = append(recordPsList, ps)
+	}
+
+	err = oh.putRecords(info, next, recordPsList)
+	if err != nil {
+		return nil, err
+	}
+
+	return pKeys, nil
+}
+
+func (oh *outboxHandler) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	return info.Next.GetMultiWithoutTx(info, keys, psList)
+}
+
+func (oh *outboxHandler) GetMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	return info.Next.GetMultiWithTx(info, keys, psList)
+}
+
+func (oh *outboxHandler) DeleteMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	if !oh.anyTarget(keys) {
+		return info.Next.DeleteMultiWithoutTx(info, keys)
+	}
+
+	// the change records must be written with the deletion at once.
+	// the transaction goes through all middlewares again, from the first middleware of the client,
+	// then DeleteMultiWithTx writes the records.
+	oh.logf(info.Context, "dsmiddleware/outbox.DeleteMultiWithoutTx: start transaction len=%d", len(keys))
+
+	_, err := info.Client.RunInTransaction(info.Context, func(tx datastore.Transaction) error {
+		return tx.DeleteMulti(keys)
+	})
+
+	return err
+}
+
+func (oh *outboxHandler) DeleteMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	next := info.Next
+	if !oh.anyTarget(keys) {
+		return next.DeleteMultiWithTx(info, keys)
+	}
+
+	beforeList, err := oh.getBefore(info, next, keys)
+	if err != nil {
+		return err
+	}
+
+	err = next.DeleteMultiWithTx(info, keys)
+	if err != nil {
+		return err
+	}
+
+	recordPsList := make([]datastore.PropertyList, 0, len(keys))
+	for idx, key := range keys {
+		if !oh.target(key) {
+			continue
+		}
+		ps, err := oh.newRecord(info.Context, key, OpDelete, beforeList[idx], nil)
+		if err != nil {
+			return err
+		}
+		recordPsList = append(recordPsList, ps)
+	}
+
+	return oh.putRecords(info, next, recordPsList)
+}
+
+func (oh *outboxHandler) PostCommit(info *datastore.MiddlewareInfo, tx datastore.Transaction, commit datastore.Commit) error {
+	oh.m.Lock()
+	txRecordMap, ok := info.Context.Value(contextTx{}).(map[datastore.Transaction][]*txRecord)
+	var records []*txRecord
+	if ok {
+		records = txRecordMap[tx]
+		delete(txRecordMap, tx)
+	}
+	oh.m.Unlock()
+
+	if len(records) == 0 {
+		return info.Next.PostCommit(info, tx, commit)
+	}
+
+	now := time.Now()
+	keys := make([]datastore.Key, 0, len(records))
+	psList := make([]datastore.PropertyList, 0, len(records))
+	for _, record := range records {
+		keys = append(keys, commit.Key(record.PendingKey))
+		psList = append(psList, committedRecord(record.PropertyList, now))
+	}
+
+	// don't pass txCtx to appengine.APICall
+	// otherwise, `transaction context has expired` will be occur
+	baseCtx := info.Client.Context()
+	_, pErr := info.Client.PutMulti(baseCtx, keys, psList)
+	nErr := info.Next.PostCommit(info, tx, commit)
+	if pErr != nil {
+		// the records are still pending, Consumer.Recover makes them visible later.
+		oh.logf(info.Context, "dsmiddleware/outbox.PostCommit: error on PutMulti err=%s", pErr.Error())
+	}
+
+	return nErr
+}
+
+func (oh *outboxHandler) PostRollback(info *datastore.MiddlewareInfo, tx datastore.Transaction) error {
+	oh.m.Lock()
+	txRecordMap, ok := info.Context.Value(contextTx{}).(map[datastore.Transaction][]*txRecord)
+	if ok {
+		delete(txRecordMap, tx)
+	}
+	oh.m.Unlock()
+
+	return info.Next.PostRollback(info, tx)
+}
+
+func (oh *outboxHandler) Run(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) datastore.Iterator {
+	return info.Next.Run(info, q, qDump)
+}
+
+func (oh *outboxHandler) GetAll(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, psList *[]datastore.PropertyList) ([]datastore.Key, error) {
+	return info.Next.GetAll(info, q, qDump, psList)
+}
+
+func (oh *outboxHandler) Next(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, iter datastore.Iterator, ps *datastore.PropertyList) (datastore.Key, error) {
+	return info.Next.Next(info, q, qDump, iter, ps)
+}
+
+func (oh *outboxHandler) Count(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) (int, error) {
+	return info.Next.Count(info, q, qDump)
+}
@@ -0,0 +1,366 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/internal/testutils"
+)
+
+type Data struct {
+	Name string
+}
+
+func TestOutbox_Basic(t *testing.T) {
+	ctx, client, cleanUp := testutils.SetupCloudDatastore(t)
+	defer cleanUp()
+
+	mw := New(WithIncludeKinds("Data"), WithBefore(), WithAfter())
+	client.AppendMiddleware(mw)
+	defer func() {
+		client.RemoveMiddleware(mw)
+	}()
+
+	c := NewConsumer(client, "test")
+
+	key := client.NameKey("Data", "a", nil)
+	_, err := client.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		_, err := tx.Put(key, &Data{Name: "foo"})
+		if err != nil {
+			return err
+		}
+
+		// not visible until commit.
+		records, err := c.Poll(ctx)
+		if err != nil {
+			return err
+		}
+		if len(records) != 0 {
+			t.Errorf("unexpected: %v", len(records))
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := c.Poll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("unexpected: %v", len(records))
+	}
+	if v := records[0]; !v.EntityKey.Equal(key) || v.Op != OpPut || v.Before != nil || v.CommittedAt.IsZero() {
+		t.Errorf("unexpected: %+v", v)
+	}
+	if v := records[0].After; len(v) != 1 || v[0].Value != "foo" {
+		t.Errorf("unexpected: %+v", v)
+	}
+
+	// without transaction.
+	_, err = client.Put(ctx, key, &Data{Name: "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Delete(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// other kind is not recorded.
+	_, err = client.Put(ctx, client.NameKey("Other", "a", nil), &Data{Name: "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err = c.Poll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("unexpected: %v", len(records))
+	}
+	if v := records[0]; v.Op != OpPut || len(v.Before) != 1 || v.Before[0].Value != "foo" {
+		t.Errorf("unexpected: %+v", v)
+	}
+	if v := records[1]; v.Op != OpDelete || len(v.Before) != 1 || v.Before[0].Value != "bar" || v.After != nil {
+		t.Errorf("unexpected: %+v", v)
+	}
+
+	records, err = c.Poll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Errorf("unexpected: %v", len(records))
+	}
+}
+
+func TestOutbox_TransactionOnMemory(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+	client.AppendMiddleware(ms)
+
+	mw := New(WithIncludeKinds("Data"), WithAfter())
+
+	// committedRecords returns the records visible from Consumer.
+	committedRecords := func() int {
+		var psList []datastore.PropertyList
+		_, err := client.GetAll(ctx, client.NewQuery(defaultOutboxKind), &psList)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cnt := 0
+		for _, ps := range psList {
+			for _, p := range ps {
+				if p.Name == propCommittedAt {
+					cnt++
+				} else if p.Name == propPendingSince {
+					t.Errorf("unexpected: %v", ps)
+				}
+			}
+		}
+		return cnt
+	}
+
+	key := client.NameKey("Data", "a", nil)
+	tx := ms.NewTransaction(ctx, client, mw, ms)
+	_, err := tx.PutMultiWithTx([]datastore.Key{key}, []datastore.PropertyList{{{Name: "Name", Value: "foo"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := committedRecords(); v != 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+	_, err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the record written in the transaction is committed by PostCommit.
+	if v := committedRecords(); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// the record of the rollback is discarded.
+	tx = ms.NewTransaction(ctx, client, mw, ms)
+	_, err = tx.PutMultiWithTx([]datastore.Key{key}, []datastore.PropertyList{{{Name: "Name", Value: "bar"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := committedRecords(); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestOutbox_Rollback(t *testing.T) {
+	ctx, client, cleanUp := testutils.SetupCloudDatastore(t)
+	defer cleanUp()
+
+	mw := New()
+	client.AppendMiddleware(mw)
+	defer func() {
+		client.RemoveMiddleware(mw)
+	}()
+
+	errRollback := errors.New("rollback")
+	_, err := client.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		_, err := tx.Put(client.NameKey("Data", "a", nil), &Data{Name: "foo"})
+		if err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatalf("unexpected: %v", err)
+	}
+
+	cnt, err := client.Count(ctx, client.NewQuery(defaultOutboxKind))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cnt != 0 {
+		t.Errorf("unexpected: %v", cnt)
+	}
+}
+
+func TestOutbox_Checkpoint(t *testing.T) {
+	ctx, client, cleanUp := testutils.SetupCloudDatastore(t)
+	defer cleanUp()
+
+	mw := New()
+	client.AppendMiddleware(mw)
+	defer func() {
+		client.RemoveMiddleware(mw)
+	}()
+
+	put := func(name string) {
+		_, err := client.Put(ctx, client.NameKey("Data", name, nil), &Data{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	put("a")
+	put("b")
+
+	c := NewConsumer(client, "test")
+	records, err := c.Poll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("unexpected: %v", len(records))
+	}
+	err = c.Checkpoint(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put("c")
+
+	// resume from the checkpoint.
+	c = NewConsumer(client, "test")
+	records, err = c.Poll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].EntityKey.Name() != "c" {
+		t.Fatalf("unexpected: %v", records)
+	}
+
+	// not saved, the record is delivered again.
+	c.Reset()
+	records, err = c.Poll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("unexpected: %v", len(records))
+	}
+
+	// another consumer reads all records.
+	records, err = NewConsumer(client, "other").Poll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("unexpected: %v", len(records))
+	}
+}
+
+func TestOutbox_Recover(t *testing.T) {
+	ctx, client, cleanUp := testutils.SetupCloudDatastore(t)
+	defer cleanUp()
+
+	// the record that was left by the process stopped before PostCommit.
+	entityKey := client.NameKey("Data", "a", nil)
+	_, err := client.Put(ctx, client.IncompleteKey(defaultOutboxKind, nil), &datastore.PropertyList{
+		{Name: propKind, Value: "Data"},
+		{Name: propEntityKey, Value: entityKey, NoIndex: true},
+		{Name: propOp, Value: string(OpPut), NoIndex: true},
+		{Name: propCreatedAt, Value: time.Now().Add(-1 * time.Hour), NoIndex: true},
+		{Name: propPendingSince, Value: time.Now().Add(-1 * time.Hour)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewConsumer(client, "test", WithStaleAfter(10*time.Minute))
+	records, err := c.Poll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("unexpected: %v", len(records))
+	}
+
+	cnt, err := c.Recover(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cnt != 1 {
+		t.Errorf("unexpected: %v", cnt)
+	}
+
+	records, err = c.Poll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || !records[0].EntityKey.Equal(entityKey) {
+		t.Fatalf("unexpected: %v", records)
+	}
+}
+
+func TestOutbox_LateCommit(t *testing.T) {
+	ctx, client, cleanUp := testutils.SetupCloudDatastore(t)
+	defer cleanUp()
+
+	mw := New()
+	client.AppendMiddleware(mw)
+	defer func() {
+		client.RemoveMiddleware(mw)
+	}()
+
+	_, err := client.Put(ctx, client.NameKey("Data", "a", nil), &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewConsumer(client, "test", WithOverlap(time.Minute))
+	records, err := c.Poll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("unexpected: %v", len(records))
+	}
+
+	// the record committed by the instance whose clock is behind.
+	entityKey := client.NameKey("Data", "b", nil)
+	_, err = client.Put(ctx, client.IncompleteKey(defaultOutboxKind, nil), &datastore.PropertyList{
+		{Name: propKind, Value: "Data"},
+		{Name: propEntityKey, Value: entityKey, NoIndex: true},
+		{Name: propOp, Value: string(OpPut), NoIndex: true},
+		{Name: propCreatedAt, Value: records[0].CommittedAt.Add(-10 * time.Second), NoIndex: true},
+		{Name: propCommittedAt, Value: records[0].CommittedAt.Add(-10 * time.Second)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err = c.Poll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || !records[0].EntityKey.Equal(entityKey) {
+		t.Fatalf("unexpected: %v", records)
+	}
+	err = c.Checkpoint(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the records in the overlap window are not delivered twice.
+	records, err = c.Poll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("unexpected: %v", len(records))
+	}
+	records, err = NewConsumer(client, "test", WithOverlap(time.Minute)).Poll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("unexpected: %v", len(records))
+	}
+}
@@ -0,0 +1,27 @@
+/*
+Package querycache handles Run and GetAll to Datastore and provides caching of the query results on memory.
+
+The result keys are cached by QueryDump.String(), and the entities are loaded by GetMulti from the client.
+Append the entity cache like localcache or rediscache to the client, then the entities are served from it.
+
+	client.AppendMiddleware(querycache.New(querycache.WithExpireDuration(30 * time.Second)))
+	client.AppendMiddleware(localcache.New())
+
+Put and Delete increment the generation of the kind, and the cached queries of the kind become misses.
+The writes in the transaction are applied by the commit.
+The generations are held by each middleware, the writes by the other instances are reflected after the expiration.
+
+On a miss, Run fetches all keys of the query as KeysOnly before the first Next.
+The keys are fetched up to the limit of WithMaxKeys (the default is 1000) and one more.
+If the query returns more keys than the limit, the result isn't cached and the rest of the keys are streamed from the same query.
+With WithCursors, the cursors are also cached and Cursor of the iterator returns them.
+If the entity is deleted after the query is cached, the iterator skips it.
+
+With SkipCache of CallOption, the query is passed to Datastore and the result isn't cached.
+With StrongRead, the query is passed to Datastore and the result replaces the cache.
+
+The following queries are not cached.
+The queries in the transaction, the ancestor queries without EventualConsistency (unless WithStrongConsistentQueries),
+the kindless queries and the projection or distinct queries.
+*/
+package querycache // import "go.mercari.io/datastore/dsmiddleware/querycache"
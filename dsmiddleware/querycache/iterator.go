@@ -0,0 +1,156 @@
+package querycache
+
+import (
+	"errors"
+
+	"go.mercari.io/datastore"
+	"google.golang.org/api/iterator"
+)
+
+var _ datastore.Iterator = &cachedIterator{}
+var _ datastore.Iterator = &errorIterator{}
+
+// ErrCursorNotCached is returned by Iterator.Cursor when the cursors are not cached.
+var ErrCursorNotCached = errors.New("dsmiddleware/querycache: cursor is not cached, use WithCursors")
+
+func newIterator(info *datastore.MiddlewareInfo, qDump *datastore.QueryDump, item *cacheItem) datastore.Iterator {
+	return &cachedIterator{
+		info:     info,
+		keysOnly: qDump.KeysOnly,
+		item:     item,
+	}
+}
+
+// newStreamIterator returns the iterator that serves the keys of item, and then the rest of the keys from rest.
+// item is not cached, the consumed keys are dropped.
+func newStreamIterator(info *datastore.MiddlewareInfo, qDump *datastore.QueryDump, item *cacheItem, rest datastore.Iterator) datastore.Iterator {
+	return &cachedIterator{
+		info:     info,
+		keysOnly: qDump.KeysOnly,
+		item:     item,
+		rest:     rest,
+	}
+}
+
+// cachedIterator iterates the cached keys, and loads the entities by GetMulti.
+type cachedIterator struct {
+	info     *datastore.MiddlewareInfo
+	keysOnly bool
+	item     *cacheItem
+	pos      int                // index of the next key
+	rest     datastore.Iterator // KeysOnly iterator of the keys after item.keys, nil if there are no more keys
+
+	// pss and found are the entities of keys from bufPos.
+	bufPos int
+	pss    []datastore.PropertyList
+	found  []bool
+	err    error
+}
+
+func (it *cachedIterator) Next(dst interface{}) (datastore.Key, error) {
+	for {
+		if it.err != nil {
+			return nil, it.err
+		}
+		if it.rest != nil && len(it.item.keys) <= it.pos {
+			it.drop()
+		}
+		if err := it.fill(it.pos + 1); err != nil {
+			it.err = err
+			continue
+		}
+		if len(it.item.keys) <= it.pos {
+			return nil, iterator.Done
+		}
+
+		key := it.item.keys[it.pos]
+		if it.keysOnly {
+			it.pos++
+			return key, nil
+		}
+
+		if it.pos < it.bufPos || it.bufPos+len(it.pss) <= it.pos {
+			end := it.pos + hydrateBatchSize
+			if err := it.fill(end); err != nil {
+				it.err = err
+				continue
+			}
+			if len(it.item.keys) < end {
+				end = len(it.item.keys)
+			}
+			pss, found, err := hydrate(it.info, it.item.keys[it.pos:end])
+			if err != nil {
+				it.err = err
+				continue
+			}
+			it.bufPos, it.pss, it.found = it.pos, pss, found
+		}
+
+		bufIdx := it.pos - it.bufPos
+		it.pos++
+		if !it.found[bufIdx] {
+			// the entity is deleted after the query is cached.
+			continue
+		}
+
+		if dst != nil {
+			err := datastore.LoadEntity(it.info.Context, dst, &datastore.Entity{Key: key, Properties: it.pss[bufIdx]})
+			if err != nil {
+				return key, err
+			}
+		}
+
+		return key, nil
+	}
+}
+
+// fill reads the keys from rest until the count of the keys becomes n.
+func (it *cachedIterator) fill(n int) error {
+	for it.rest != nil && len(it.item.keys) < n {
+		key, err := it.rest.Next(nil)
+		if err == iterator.Done {
+			it.rest = nil
+			break
+		} else if err != nil {
+			return err
+		}
+		it.item.keys = append(it.item.keys, key)
+		if it.item.cursors != nil {
+			if err := it.item.appendCursor(it.rest); err != nil {
+				it.item.cursors = nil
+			}
+		}
+	}
+
+	return nil
+}
+
+// drop drops the consumed keys and entities, it is called when all keys are consumed.
+func (it *cachedIterator) drop() {
+	it.item.keys = it.item.keys[:0]
+	if it.item.cursors != nil {
+		it.item.cursors = it.item.cursors[len(it.item.cursors)-1:]
+	}
+	it.pos, it.bufPos, it.pss, it.found = 0, 0, nil, nil
+}
+
+func (it *cachedIterator) Cursor() (datastore.Cursor, error) {
+	if it.item.cursors == nil {
+		return nil, ErrCursorNotCached
+	}
+
+	return it.item.cursors[it.pos], nil
+}
+
+// errorIterator returns the error of the query.
+type errorIterator struct {
+	err error
+}
+
+func (it *errorIterator) Next(dst interface{}) (datastore.Key, error) {
+	return nil, it.err
+}
+
+func (it *errorIterator) Cursor() (datastore.Cursor, error) {
+	return nil, it.err
+}
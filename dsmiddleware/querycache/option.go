@@ -0,0 +1,123 @@
+package querycache
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// WithIncludeKinds creates a ClientOption that selects the Kind specified as the cache target.
+func WithIncludeKinds(kinds ...string) CacheOption {
+	return &withIncludeKinds{kinds}
+}
+
+type withIncludeKinds struct{ kinds []string }
+
+func (w *withIncludeKinds) Apply(o *cacheHandler) {
+	o.filters = append(o.filters, func(ctx context.Context, kind string) bool {
+		for _, incKind := range w.kinds {
+			if kind == incKind {
+				return true
+			}
+		}
+
+		return false
+	})
+}
+
+// WithExcludeKinds creates a ClientOption that selects the Kind unspecified as the cache target.
+func WithExcludeKinds(kinds ...string) CacheOption {
+	return &withExcludeKinds{kinds}
+}
+
+type withExcludeKinds struct{ kinds []string }
+
+func (w *withExcludeKinds) Apply(o *cacheHandler) {
+	o.filters = append(o.filters, func(ctx context.Context, kind string) bool {
+		for _, excKind := range w.kinds {
+			if kind == excKind {
+				return false
+			}
+		}
+
+		return true
+	})
+}
+
+// WithLogger creates a ClientOption that uses the specified logger.
+func WithLogger(logf func(ctx context.Context, format string, args ...interface{})) CacheOption {
+	return &withLogger{logf}
+}
+
+type withLogger struct {
+	logf func(ctx context.Context, format string, args ...interface{})
+}
+
+func (w *withLogger) Apply(o *cacheHandler) {
+	o.logf = w.logf
+}
+
+// WithExpireDuration creates a ClientOption to expire at a specified time.
+// The default is 1 minute.
+func WithExpireDuration(d time.Duration) CacheOption {
+	return &withExpireDuration{d}
+}
+
+type withExpireDuration struct{ d time.Duration }
+
+func (w *withExpireDuration) Apply(o *cacheHandler) {
+	o.expireDuration = w.d
+}
+
+// WithMaxKeys creates a ClientOption that limits count of the keys of the cached query.
+// The query that returns more keys isn't cached. The default is 1000.
+// It panics if n isn't positive, Run reads the keys up to the limit before the first Next.
+func WithMaxKeys(n int) CacheOption {
+	if n <= 0 {
+		panic(fmt.Sprintf("dsmiddleware/querycache: max keys must be positive, got %d", n))
+	}
+	return &withMaxKeys{n}
+}
+
+type withMaxKeys struct{ n int }
+
+func (w *withMaxKeys) Apply(o *cacheHandler) {
+	o.maxKeys = w.n
+}
+
+// WithMaxEntries creates a ClientOption that limits count of the cached queries.
+// The least recently used query is evicted over the limit, 0 means unlimited. The default is 1000.
+func WithMaxEntries(n int) CacheOption {
+	return &withMaxEntries{n}
+}
+
+type withMaxEntries struct{ n int }
+
+func (w *withMaxEntries) Apply(o *cacheHandler) {
+	o.maxEntries = w.n
+}
+
+// WithCursors creates a ClientOption that caches the cursors of Run with the keys.
+// Without it, Cursor of the cached iterator returns ErrCursorNotCached.
+func WithCursors() CacheOption {
+	return &withCursors{}
+}
+
+type withCursors struct{}
+
+func (w *withCursors) Apply(o *cacheHandler) {
+	o.cursors = true
+}
+
+// WithStrongConsistentQueries creates a ClientOption that serves the ancestor queries from the cache.
+// The ancestor queries are strongly consistent, they are not cached by default.
+// The queries in the transaction are never cached.
+func WithStrongConsistentQueries() CacheOption {
+	return &withStrongConsistentQueries{}
+}
+
+type withStrongConsistentQueries struct{}
+
+func (w *withStrongConsistentQueries) Apply(o *cacheHandler) {
+	o.strongQueries = true
+}
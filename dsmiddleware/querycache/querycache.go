@@ -0,0 +1,484 @@
+package querycache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"go.mercari.io/datastore"
+	"google.golang.org/api/iterator"
+)
+
+var _ datastore.Middleware = &cacheHandler{}
+
+const defaultExpiration = 1 * time.Minute
+const defaultMaxEntries = 1000
+const defaultMaxKeys = 1000
+
+// hydrateBatchSize is the count of entities loaded by a GetMulti from the iterator.
+const hydrateBatchSize = 100
+
+// New query cache middleware creates & returns.
+func New(opts ...CacheOption) CacheHandler {
+	ch := &cacheHandler{
+		expireDuration: defaultExpiration,
+		maxEntries:     defaultMaxEntries,
+		maxKeys:        defaultMaxKeys,
+		items:          make(map[string]*list.Element),
+		lru:            list.New(),
+		generations:    make(map[string]uint64),
+	}
+
+	for _, opt := range opts {
+		opt.Apply(ch)
+	}
+
+	if ch.logf == nil {
+		ch.logf = func(ctx context.Context, format string, args ...interface{}) {}
+	}
+
+	return ch
+}
+
+// CacheHandler is the query cache middleware.
+type CacheHandler interface {
+	datastore.Middleware
+
+	// Stats returns the current statistics of the cache.
+	Stats() Stats
+	// Flush removes all cached queries.
+	Flush()
+}
+
+// Stats is the statistics of the query cache.
+type Stats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+}
+
+type contextTx struct{}
+
+type cacheHandler struct {
+	expireDuration time.Duration
+	maxEntries     int
+	maxKeys        int
+	cursors        bool
+	strongQueries  bool
+	filters        []func(ctx context.Context, kind string) bool
+	logf           func(ctx context.Context, format string, args ...interface{})
+
+	m           sync.Mutex
+	items       map[string]*list.Element
+	lru         *list.List // front is the most recently used cacheItem
+	generations map[string]uint64
+	hits        uint64
+	misses      uint64
+}
+
+// A CacheOption is an cache option for a query cache middleware.
+type CacheOption interface {
+	Apply(*cacheHandler)
+}
+
+// cacheItem is the result of a query.
+// If cursors is not nil, cursors[i] is the position before keys[i], and the last one is the end.
+type cacheItem struct {
+	queryStr   string
+	genKey     string
+	generation uint64
+	keys       []datastore.Key
+	cursors    []datastore.Cursor
+	expiration time.Time
+}
+
+// generationKey returns the key of the generation counter of the kind.
+func generationKey(namespace, kind string) string {
+	return namespace + "\x00" + kind
+}
+
+func (ch *cacheHandler) target(info *datastore.MiddlewareInfo, qDump *datastore.QueryDump) bool {
+	if qDump.Transaction != nil || info.Transaction != nil {
+		// the cache doesn't know the isolation of the transaction.
+		return false
+	}
+	if info.CallOptions().SkipCache {
+		return false
+	}
+	if qDump.Kind == "" {
+		// kindless query depends on all kinds.
+		return false
+	}
+	if len(qDump.Project) != 0 || len(qDump.DistinctOn) != 0 || qDump.Distinct {
+		// the entities can't be loaded from keys.
+		return false
+	}
+	if qDump.Ancestor != nil && !qDump.EventualConsistency && !ch.strongQueries {
+		return false
+	}
+	for _, f := range ch.filters {
+		if !f(info.Context, qDump.Kind) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// generation returns the current generation of the kind of the query.
+func (ch *cacheHandler) generation(qDump *datastore.QueryDump) (string, uint64) {
+	genKey := generationKey(qDump.Namespace, qDump.Kind)
+
+	ch.m.Lock()
+	defer ch.m.Unlock()
+
+	return genKey, ch.generations[genKey]
+}
+
+// invalidate increments the generations of the kinds of keys, the cached queries of them become stale.
+func (ch *cacheHandler) invalidate(ctx context.Context, keys []datastore.Key) {
+	if len(keys) == 0 {
+		return
+	}
+
+	ch.m.Lock()
+	defer ch.m.Unlock()
+
+	done := make(map[string]bool)
+	for _, key := range keys {
+		if key == nil {
+			continue
+		}
+		genKey := generationKey(key.Namespace(), key.Kind())
+		if done[genKey] {
+			continue
+		}
+		done[genKey] = true
+		ch.generations[genKey]++
+		ch.logf(ctx, "dsmiddleware/querycache.invalidate: kind=%s generation=%d", key.Kind(), ch.generations[genKey])
+	}
+}
+
+func (ch *cacheHandler) get(ctx context.Context, queryStr string, needCursors bool) *cacheItem {
+	ch.m.Lock()
+	defer ch.m.Unlock()
+
+	e, ok := ch.items[queryStr]
+	if !ok {
+		ch.misses++
+		return nil
+	}
+	item := e.Value.(*cacheItem)
+	if item.generation != ch.generations[item.genKey] || !time.Now().Before(item.expiration) {
+		ch.lru.Remove(e)
+		delete(ch.items, queryStr)
+		ch.misses++
+		return nil
+	}
+	if needCursors && item.cursors == nil {
+		ch.misses++
+		return nil
+	}
+
+	ch.lru.MoveToFront(e)
+	ch.hits++
+	return item
+}
+
+func (ch *cacheHandler) set(ctx context.Context, item *cacheItem) {
+	ch.m.Lock()
+	defer ch.m.Unlock()
+
+	if item.generation != ch.generations[item.genKey] {
+		// the kind is written while the query is running.
+		ch.logf(ctx, "dsmiddleware/querycache.set: stale result query=%s", item.queryStr)
+		return
+	}
+
+	if e, ok := ch.items[item.queryStr]; ok {
+		ch.lru.Remove(e)
+	}
+	ch.items[item.queryStr] = ch.lru.PushFront(item)
+
+	for 0 < ch.maxEntries && ch.maxEntries < ch.lru.Len() {
+		e := ch.lru.Back()
+		ch.lru.Remove(e)
+		delete(ch.items, e.Value.(*cacheItem).queryStr)
+	}
+}
+
+func (ch *cacheHandler) Stats() Stats {
+	ch.m.Lock()
+	defer ch.m.Unlock()
+
+	return Stats{
+		Hits:    ch.hits,
+		Misses:  ch.misses,
+		Entries: ch.lru.Len(),
+	}
+}
+
+func (ch *cacheHandler) Flush() {
+	ch.m.Lock()
+	defer ch.m.Unlock()
+
+	ch.items = make(map[string]*list.Element)
+	ch.lru.Init()
+}
+
+func (ch *cacheHandler) AllocateIDs(info *datastore.MiddlewareInfo, keys []datastore.Key) ([]datastore.Key, error) {
+	return info.Next.AllocateIDs(info, keys)
+}
+
+func (ch *cacheHandler) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.Key, error) {
+	retKeys, err := info.Next.PutMultiWithoutTx(info, keys, psList)
+	// invalidate even if err is returned, some entities may be written.
+	ch.invalidate(info.Context, keys)
+	return retKeys, err
+}
+
+func (ch *cacheHandler) PutMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.PendingKey, error) {
+	pKeys, err := info.Next.PutMultiWithTx(info, keys, psList)
+	ch.recordTx(info, keys)
+	return pKeys, err
+}
+
+func (ch *cacheHandler) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	return info.Next.GetMultiWithoutTx(info, keys, psList)
+}
+
+func (ch *cacheHandler) GetMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	return info.Next.GetMultiWithTx(info, keys, psList)
+}
+
+func (ch *cacheHandler) DeleteMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	err := info.Next.DeleteMultiWithoutTx(info, keys)
+	ch.invalidate(info.Context, keys)
+	return err
+}
+
+func (ch *cacheHandler) DeleteMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	err := info.Next.DeleteMultiWithTx(info, keys)
+	ch.recordTx(info, keys)
+	return err
+}
+
+// recordTx records the written keys in the transaction, they are invalidated by the commit.
+func (ch *cacheHandler) recordTx(info *datastore.MiddlewareInfo, keys []datastore.Key) {
+	ch.m.Lock()
+	defer ch.m.Unlock()
+
+	txKeyMap, ok := info.Context.Value(contextTx{}).(map[datastore.Transaction][]datastore.Key)
+	if !ok {
+		txKeyMap = make(map[datastore.Transaction][]datastore.Key)
+		info.Context = context.WithValue(info.Context, contextTx{}, txKeyMap)
+	}
+	txKeyMap[info.Transaction] = append(txKeyMap[info.Transaction], keys...)
+}
+
+func (ch *cacheHandler) popTx(info *datastore.MiddlewareInfo, tx datastore.Transaction) []datastore.Key {
+	ch.m.Lock()
+	defer ch.m.Unlock()
+
+	txKeyMap, ok := info.Context.Value(contextTx{}).(map[datastore.Transaction][]datastore.Key)
+	if !ok {
+		return nil
+	}
+	keys := txKeyMap[tx]
+	delete(txKeyMap, tx)
+
+	return keys
+}
+
+func (ch *cacheHandler) PostCommit(info *datastore.MiddlewareInfo, tx datastore.Transaction, commit datastore.Commit) error {
+	ch.invalidate(info.Context, ch.popTx(info, tx))
+	return info.Next.PostCommit(info, tx, commit)
+}
+
+func (ch *cacheHandler) PostRollback(info *datastore.MiddlewareInfo, tx datastore.Transaction) error {
+	ch.popTx(info, tx)
+	return info.Next.PostRollback(info, tx)
+}
+
+func (ch *cacheHandler) Run(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) datastore.Iterator {
+	if !ch.target(info, qDump) {
+		return info.Next.Run(info, q, qDump)
+	}
+
+	queryStr := qDump.String()
+	var hit *cacheItem
+	if !info.CallOptions().StrongRead {
+		hit = ch.get(info.Context, queryStr, ch.cursors)
+	}
+	if hit != nil {
+		ch.logf(info.Context, "dsmiddleware/querycache.Run: hit query=%s len=%d", queryStr, len(hit.keys))
+		return newIterator(info, qDump, hit)
+	}
+	ch.logf(info.Context, "dsmiddleware/querycache.Run: miss query=%s", queryStr)
+
+	genKey, gen := ch.generation(qDump)
+	next := info.Next
+
+	// run as KeysOnly to the end, the entities are loaded by the iterator.
+	kq := q.KeysOnly()
+	kDump := *qDump
+	kDump.KeysOnly = true
+	iter := next.Run(info, kq, &kDump)
+
+	item := &cacheItem{
+		queryStr:   queryStr,
+		genKey:     genKey,
+		generation: gen,
+		keys:       make([]datastore.Key, 0),
+		expiration: time.Now().Add(ch.expireDuration),
+	}
+	// the cursors are recorded without WithCursors too, the stream over maxKeys serves them.
+	item.cursors = make([]datastore.Cursor, 0)
+	cursorErr := item.appendCursor(iter)
+	for {
+		key, err := iter.Next(nil)
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return &errorIterator{err: err}
+		}
+		item.keys = append(item.keys, key)
+		if cursorErr == nil {
+			cursorErr = item.appendCursor(iter)
+		}
+		if ch.maxKeys < len(item.keys) {
+			// the result is too large to cache, stream the rest of the keys through.
+			ch.logf(info.Context, "dsmiddleware/querycache.Run: over max keys query=%s", queryStr)
+			if cursorErr != nil {
+				item.cursors = nil
+			}
+			return newStreamIterator(info, qDump, item, iter)
+		}
+	}
+
+	switch {
+	case !ch.cursors:
+		item.cursors = nil
+		ch.set(info.Context, item)
+	case cursorErr != nil:
+		// serve the keys without caching, the cursors are required.
+		ch.logf(info.Context, "dsmiddleware/querycache.Run: error on iterator.Cursor err=%s", cursorErr.Error())
+		item.cursors = nil
+	default:
+		ch.set(info.Context, item)
+	}
+
+	return newIterator(info, qDump, item)
+}
+
+func (item *cacheItem) appendCursor(iter datastore.Iterator) error {
+	cur, err := iter.Cursor()
+	if err != nil {
+		return err
+	}
+	item.cursors = append(item.cursors, cur)
+	return nil
+}
+
+func (ch *cacheHandler) GetAll(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, psList *[]datastore.PropertyList) ([]datastore.Key, error) {
+	if !ch.target(info, qDump) {
+		return info.Next.GetAll(info, q, qDump, psList)
+	}
+
+	queryStr := qDump.String()
+	var hit *cacheItem
+	if !info.CallOptions().StrongRead {
+		hit = ch.get(info.Context, queryStr, false)
+	}
+	if hit != nil {
+		ch.logf(info.Context, "dsmiddleware/querycache.GetAll: hit query=%s len=%d", queryStr, len(hit.keys))
+		if qDump.KeysOnly {
+			// the caller may modify the returned slice.
+			return copyKeys(hit.keys), nil
+		}
+
+		pss, found, err := hydrate(info, hit.keys)
+		if err != nil {
+			return nil, err
+		}
+		keys := make([]datastore.Key, 0, len(hit.keys))
+		for idx, key := range hit.keys {
+			if !found[idx] {
+				continue
+			}
+			keys = append(keys, key)
+			*psList = append(*psList, pss[idx])
+		}
+
+		return keys, nil
+	}
+	ch.logf(info.Context, "dsmiddleware/querycache.GetAll: miss query=%s", queryStr)
+
+	genKey, gen := ch.generation(qDump)
+
+	keys, err := info.Next.GetAll(info, q, qDump, psList)
+	if err != nil {
+		return nil, err
+	}
+	if ch.maxKeys < len(keys) {
+		ch.logf(info.Context, "dsmiddleware/querycache.GetAll: over max keys query=%s len=%d", queryStr, len(keys))
+		return keys, nil
+	}
+
+	ch.set(info.Context, &cacheItem{
+		queryStr:   queryStr,
+		genKey:     genKey,
+		generation: gen,
+		keys:       copyKeys(keys),
+		expiration: time.Now().Add(ch.expireDuration),
+	})
+
+	return keys, nil
+}
+
+// copyKeys returns the copy of keys, the cached keys aren't shared with the callers.
+func copyKeys(keys []datastore.Key) []datastore.Key {
+	newKeys := make([]datastore.Key, len(keys))
+	copy(newKeys, keys)
+	return newKeys
+}
+
+func (ch *cacheHandler) Next(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, iter datastore.Iterator, ps *datastore.PropertyList) (datastore.Key, error) {
+	// the cached iterator doesn't call Next of middlewares.
+	return info.Next.Next(info, q, qDump, iter, ps)
+}
+
+func (ch *cacheHandler) Count(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) (int, error) {
+	return info.Next.Count(info, q, qDump)
+}
+
+// hydrate loads the entities of keys through the client, so the entity cache is used.
+// found[i] is false if the entity is deleted after the query is cached.
+func hydrate(info *datastore.MiddlewareInfo, keys []datastore.Key) ([]datastore.PropertyList, []bool, error) {
+	pss := make([]datastore.PropertyList, len(keys))
+	found := make([]bool, len(keys))
+	for idx := range found {
+		found[idx] = true
+	}
+	if len(keys) == 0 {
+		return pss, found, nil
+	}
+
+	err := info.Client.GetMulti(info.Context, keys, pss)
+	if merr, ok := err.(datastore.MultiError); ok {
+		for idx, err := range merr {
+			if err == nil {
+				continue
+			} else if err == datastore.ErrNoSuchEntity {
+				found[idx] = false
+				continue
+			}
+			return nil, nil, err
+		}
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	return pss, found, nil
+}
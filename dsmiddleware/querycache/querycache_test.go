@@ -0,0 +1,463 @@
+package querycache
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/internal/testutils"
+	"google.golang.org/api/iterator"
+)
+
+type Data struct {
+	Name string
+}
+
+func putData(ctx context.Context, t *testing.T, client datastore.Client, size int, parent datastore.Key) []datastore.Key {
+	keys := make([]datastore.Key, 0, size)
+	list := make([]*Data, 0, size)
+	for i := 0; i < size; i++ {
+		keys = append(keys, client.IDKey("Data", int64(i+1), parent))
+		list = append(list, &Data{Name: fmt.Sprintf("#%d", i+1)})
+	}
+	keys, err := client.PutMulti(ctx, keys, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keys
+}
+
+func TestQueryCache_GetAll(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	ch := New(WithLogger(func(ctx context.Context, format string, args ...interface{}) {
+		t.Logf(format, args...)
+	}))
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	putData(ctx, t, client, 3, nil)
+
+	q := client.NewQuery("Data")
+	for i := 0; i < 2; i++ {
+		var list []*Data
+		keys, err := client.GetAll(ctx, q, &list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := len(keys); v != 3 {
+			t.Fatalf("unexpected: %v", v)
+		}
+		if v := len(list); v != 3 {
+			t.Fatalf("unexpected: %v", v)
+		}
+		if v := list[0].Name; v != "#1" {
+			t.Errorf("unexpected: %v", v)
+		}
+	}
+	if v := ms.Calls("GetAll"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+	// the entities of the hit are loaded by GetMulti.
+	if v := ms.Calls("GetMultiWithoutTx"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// KeysOnly is the different query.
+	keys, err := client.GetAll(ctx, q.KeysOnly(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := len(keys); v != 3 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := ms.Calls("GetAll"); v != 2 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	stats := ch.Stats()
+	if v := stats.Hits; v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := stats.Misses; v != 2 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := stats.Entries; v != 2 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestQueryCache_Run(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	ch := New()
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	putData(ctx, t, client, 3, nil)
+
+	q := client.NewQuery("Data")
+	for i := 0; i < 2; i++ {
+		iter := client.Run(ctx, q)
+		var names []string
+		for {
+			obj := &Data{}
+			_, err := iter.Next(obj)
+			if err == iterator.Done {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, obj.Name)
+		}
+		if v := fmt.Sprintf("%v", names); v != "[#1 #2 #3]" {
+			t.Errorf("unexpected: %v", v)
+		}
+
+		if _, err := iter.Cursor(); err != ErrCursorNotCached {
+			t.Errorf("unexpected: %v", err)
+		}
+	}
+
+	if v := ms.Calls("Run"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := ms.Calls("GetMultiWithoutTx"); v != 2 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestQueryCache_Invalidation(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	ch := New()
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	keys := putData(ctx, t, client, 3, nil)
+
+	q := client.NewQuery("Data").KeysOnly()
+	getAll := func() int {
+		keys, err := client.GetAll(ctx, q, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(keys)
+	}
+
+	if v := getAll(); v != 3 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// the other kind doesn't invalidate.
+	_, err := client.Put(ctx, client.IDKey("Other", 1, nil), &Data{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := getAll(); v != 3 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := ms.Calls("GetAll"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	_, err = client.Put(ctx, client.IDKey("Data", 4, nil), &Data{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := getAll(); v != 4 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := ms.Calls("GetAll"); v != 2 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	err = client.Delete(ctx, keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := getAll(); v != 3 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := ms.Calls("GetAll"); v != 3 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestQueryCache_DeletedByOthers(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	client.AppendMiddleware(New())
+	client.AppendMiddleware(ms)
+
+	keys := putData(ctx, t, client, 3, nil)
+
+	q := client.NewQuery("Data")
+	var list []*Data
+	_, err := client.GetAll(ctx, q, &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the other instance deletes the entity without the invalidation.
+	_, other, _ := testutils.SetupOnMemory()
+	other.AppendMiddleware(ms)
+	err = other.Delete(ctx, keys[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list = nil
+	retKeys, err := client.GetAll(ctx, q, &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := len(retKeys); v != 2 {
+		t.Fatalf("unexpected: %v", v)
+	}
+	if v := len(list); v != 2 {
+		t.Fatalf("unexpected: %v", v)
+	}
+	if v := list[1].Name; v != "#3" {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	iter := client.Run(ctx, q)
+	cnt := 0
+	for {
+		_, err := iter.Next(&Data{})
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		cnt++
+	}
+	if cnt != 2 {
+		t.Errorf("unexpected: %v", cnt)
+	}
+}
+
+func TestQueryCache_StrongConsistentQueries(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	client.AppendMiddleware(New())
+	client.AppendMiddleware(ms)
+
+	parent := client.NameKey("Parent", "p", nil)
+	putData(ctx, t, client, 2, parent)
+
+	q := client.NewQuery("Data").Ancestor(parent).KeysOnly()
+	for i := 0; i < 2; i++ {
+		_, err := client.GetAll(ctx, q, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v := ms.Calls("GetAll"); v != 2 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// eventual consistent ancestor query is cached.
+	for i := 0; i < 2; i++ {
+		_, err := client.GetAll(ctx, q.EventualConsistency(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v := ms.Calls("GetAll"); v != 3 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	ctx, client, ms = testutils.SetupOnMemory()
+	client.AppendMiddleware(New(WithStrongConsistentQueries()))
+	client.AppendMiddleware(ms)
+	putData(ctx, t, client, 2, parent)
+
+	q = client.NewQuery("Data").Ancestor(client.NameKey("Parent", "p", nil)).KeysOnly()
+	for i := 0; i < 2; i++ {
+		keys, err := client.GetAll(ctx, q, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := len(keys); v != 2 {
+			t.Errorf("unexpected: %v", v)
+		}
+	}
+	if v := ms.Calls("GetAll"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestQueryCache_MaxEntries(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	ch := New(WithMaxEntries(2))
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	putData(ctx, t, client, 5, nil)
+
+	for limit := 1; limit <= 3; limit++ {
+		_, err := client.GetAll(ctx, client.NewQuery("Data").KeysOnly().Limit(limit), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v := ch.Stats().Entries; v != 2 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// Limit(1) is evicted.
+	_, err := client.GetAll(ctx, client.NewQuery("Data").KeysOnly().Limit(1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := ms.Calls("GetAll"); v != 4 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestQueryCache_MaxKeys(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	ch := New(WithMaxKeys(2))
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	putData(ctx, t, client, 5, nil)
+
+	// the result over the limit is streamed without caching, the query isn't run again.
+	iter := client.Run(ctx, client.NewQuery("Data"))
+	var names []string
+	for {
+		obj := &Data{}
+		_, err := iter.Next(obj)
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, obj.Name)
+	}
+	if v := fmt.Sprintf("%v", names); v != "[#1 #2 #3 #4 #5]" {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := ms.Calls("Run"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	iter = client.Run(ctx, client.NewQuery("Data").KeysOnly())
+	var ids []int64
+	for {
+		key, err := iter.Next(nil)
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, key.ID())
+	}
+	if v := fmt.Sprintf("%v", ids); v != "[1 2 3 4 5]" {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := ms.Calls("Run"); v != 2 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	keys, err := client.GetAll(ctx, client.NewQuery("Data").KeysOnly(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := len(keys); v != 5 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := ch.Stats().Entries; v != 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// the query with Limit is cached.
+	for i := 0; i < 2; i++ {
+		keys, err = client.GetAll(ctx, client.NewQuery("Data").KeysOnly().Limit(2), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := len(keys); v != 2 {
+			t.Errorf("unexpected: %v", v)
+		}
+	}
+	if v := ch.Stats().Entries; v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := ms.Calls("GetAll"); v != 2 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// the cached keys aren't shared with the caller.
+	keys[0] = nil
+	keys, err = client.GetAll(ctx, client.NewQuery("Data").KeysOnly().Limit(2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := keys[0]; v == nil {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// 0 doesn't mean unlimited.
+	func() {
+		defer func() {
+			if err := recover(); err == nil {
+				t.Error("unexpected: nil")
+			}
+		}()
+		WithMaxKeys(0)
+	}()
+}
+
+func TestQueryCache_CallOptions(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	ch := New()
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	putData(ctx, t, client, 3, nil)
+
+	q := client.NewQuery("Data").KeysOnly()
+	getAll := func(ctx context.Context) int {
+		keys, err := client.GetAll(ctx, q, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(keys)
+	}
+
+	if v := getAll(ctx); v != 3 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// Datastore is updated behind the cache.
+	ms.SetRaw(client.IDKey("Data", 4, nil), datastore.PropertyList{{Name: "Name", Value: "#4"}})
+
+	// SkipCache queries Datastore, and doesn't fill the cache.
+	if v := getAll(datastore.WithCallOptions(ctx, datastore.SkipCache())); v != 4 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := getAll(ctx); v != 3 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// StrongRead queries Datastore, and refreshes the cache.
+	if v := getAll(datastore.WithCallOptions(ctx, datastore.StrongRead())); v != 4 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := getAll(ctx); v != 4 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	if v := ms.Calls("GetAll"); v != 3 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
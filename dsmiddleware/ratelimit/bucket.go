@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket. It allows the reservation of more tokens than burst,
+// the tokens become negative and the next reservation waits for refilling.
+type bucket struct {
+	m      sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, burst int, now time.Time) *bucket {
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return &bucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+func (b *bucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// reserve takes n tokens and returns the duration to wait for them.
+// If the wait exceeds maxWait, no token is taken and ok is false.
+func (b *bucket) reserve(now time.Time, n int, maxWait time.Duration) (wait time.Duration, ok bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.refill(now)
+
+	tokens := b.tokens - float64(n)
+	if 0 <= tokens {
+		b.tokens = tokens
+		return 0, true
+	}
+
+	wait = time.Duration(-tokens / b.rate * float64(time.Second))
+	if 0 <= maxWait && maxWait < wait {
+		return wait, false
+	}
+	b.tokens = tokens
+
+	return wait, true
+}
+
+// cancel returns n tokens taken by reserve.
+func (b *bucket) cancel(n int) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.tokens = math.Min(b.burst, b.tokens+float64(n))
+}
+
+// setRate changes the rate and burst of the bucket.
+func (b *bucket) setRate(now time.Time, rate float64, burst int) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.rate == rate {
+		return
+	}
+	b.refill(now)
+	b.rate = rate
+	b.burst = float64(burst)
+}
@@ -0,0 +1,28 @@
+/*
+Package ratelimit limits the rate of operations on the client side by the token buckets per Kind and class of operations.
+
+https://cloud.google.com/datastore/docs/best-practices#ramping_up_traffic
+
+Operations are classified into Read (Get), Write (Put and Delete) and Query (GetAll, Count and Run).
+Each key costs a token for Read and Write, so a batch costs as many tokens as its keys.
+The batches split by splitop are counted in the same way, regardless of the order of middlewares.
+Each query costs a token, the batches fetched by Iterator.Next are not counted.
+
+	client.AppendMiddleware(ratelimit.New(
+		ratelimit.WithLimit(ratelimit.Write, 500, 500),
+		ratelimit.WithKindLimit("Log", ratelimit.Write, 100, 0),
+		ratelimit.WithRampUp(),
+	))
+
+WithRampUp follows the 500/50/5 rule, new Kinds receive 500 operations per second at first,
+and the rate increases by 50% every 5 minutes.
+The ramp up of a Kind ends when the rate reaches the highest limit of classes for the Kind.
+The schedule is held in the process, WithWarmKinds excludes the Kinds that already receive the traffic
+from the schedule after the restart of the process.
+
+By default, operations wait for the tokens until the deadline of the context.
+If the deadline comes before the tokens are available, RateLimitedError is returned without waiting.
+WithFailFast returns RateLimitedError immediately when no token is available.
+Run can't return the error, so the error is returned by Iterator.Next.
+*/
+package ratelimit // import "go.mercari.io/datastore/dsmiddleware/ratelimit"
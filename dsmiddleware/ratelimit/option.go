@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// WithLimit specifies the default limit of the class for each Kind.
+// Each Kind has its own token bucket.
+func WithLimit(class Class, rate float64, burst int) Option {
+	return &withLimit{"", class, Limit{Rate: rate, Burst: burst}}
+}
+
+// WithKindLimit specifies the limit of the class for the Kind, it overrides the default limit.
+// Non-positive rate disables the limit of the Kind.
+func WithKindLimit(kind string, class Class, rate float64, burst int) Option {
+	return &withLimit{kind, class, Limit{Rate: rate, Burst: burst}}
+}
+
+type withLimit struct {
+	kind  string
+	class Class
+	limit Limit
+}
+
+func (w *withLimit) Apply(l *limiter) {
+	l.limits[limitKey{Kind: w.kind, Class: w.class}] = w.limit
+}
+
+// WithRampUp creates a Option that follows the 500/50/5 rule.
+// Operations to each Kind start at 500 per second, and increase by 50% every 5 minutes.
+// https://cloud.google.com/datastore/docs/best-practices#ramping_up_traffic
+func WithRampUp() Option {
+	return WithRampUpSchedule(500, 1.5, 5*time.Minute)
+}
+
+// WithRampUpSchedule creates a Option that limits operations to each Kind by the ramp up schedule.
+// The rate starts at base per second, and it is multiplied by growth every interval.
+// The limit is shared by all classes, and it is applied in addition to the limits of classes.
+// The schedule of each Kind starts at the first operation in the process,
+// and it ends when the rate reaches the highest limit of classes for the Kind.
+func WithRampUpSchedule(base, growth float64, interval time.Duration) Option {
+	return &withRampUpSchedule{&rampUp{base: base, growth: growth, interval: interval}}
+}
+
+type withRampUpSchedule struct{ rampUp *rampUp }
+
+func (w *withRampUpSchedule) Apply(l *limiter) {
+	l.rampUp = w.rampUp
+}
+
+// WithWarmKinds creates a Option that excludes the Kinds from the ramp up schedule.
+// The schedule is held in the process, specify the Kinds that already receive the traffic
+// so that they aren't throttled again after the restart of the process.
+func WithWarmKinds(kinds ...string) Option {
+	return &withWarmKinds{kinds}
+}
+
+type withWarmKinds struct{ kinds []string }
+
+func (w *withWarmKinds) Apply(l *limiter) {
+	for _, kind := range w.kinds {
+		l.warmKinds[kind] = true
+	}
+}
+
+// WithFailFast creates a Option that returns RateLimitedError immediately instead of waiting for the tokens.
+func WithFailFast() Option {
+	return &withFailFast{}
+}
+
+type withFailFast struct{}
+
+func (w *withFailFast) Apply(l *limiter) {
+	l.failFast = true
+}
+
+// WithLogger creates a Option that uses the specified logger.
+func WithLogger(logf func(ctx context.Context, format string, args ...interface{})) Option {
+	return &withLogger{logf}
+}
+
+type withLogger struct {
+	logf func(ctx context.Context, format string, args ...interface{})
+}
+
+func (w *withLogger) Apply(l *limiter) {
+	l.logf = w.logf
+}
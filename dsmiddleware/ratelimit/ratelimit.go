@@ -0,0 +1,396 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"go.mercari.io/datastore"
+)
+
+var _ datastore.Middleware = &limiter{}
+
+// Class is the class of operations that share the token bucket.
+type Class int
+
+const (
+	// Read represents Get operations. A key costs a token.
+	Read Class = iota
+	// Write represents Put and Delete operations. A key costs a token.
+	Write
+	// Query represents query executions. A query costs a token.
+	Query
+)
+
+func (c Class) String() string {
+	switch c {
+	case Read:
+		return "read"
+	case Write:
+		return "write"
+	case Query:
+		return "query"
+	default:
+		return fmt.Sprintf("Class(%d)", int(c))
+	}
+}
+
+// Limit is the rate of operations per second and the size of the burst.
+// If Burst is not positive, the rate rounded up is used.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimitedError is returned when the operation isn't permitted by the rate limit.
+// It is returned immediately in the fail fast mode,
+// or when the deadline of the context comes before the tokens are available in the blocking mode.
+type RateLimitedError struct {
+	Kind       string
+	Class      Class
+	RetryAfter time.Duration
+}
+
+func (err *RateLimitedError) Error() string {
+	return fmt.Sprintf("dsmiddleware/ratelimit: %s of kind '%s' is rate limited, retry after %s", err.Class, err.Kind, err.RetryAfter)
+}
+
+// New rate limit middleware creates & returns.
+func New(opts ...Option) datastore.Middleware {
+	l := &limiter{
+		limits:     make(map[limitKey]Limit),
+		buckets:    make(map[limitKey]*bucket),
+		rampStarts: make(map[string]time.Time),
+		ramps:      make(map[string]*bucket),
+		warmKinds:  make(map[string]bool),
+		now:        time.Now,
+	}
+
+	for _, opt := range opts {
+		opt.Apply(l)
+	}
+
+	if l.logf == nil {
+		l.logf = func(ctx context.Context, format string, args ...interface{}) {}
+	}
+
+	return l
+}
+
+// A Option is an option for ratelimit.
+type Option interface {
+	Apply(*limiter)
+}
+
+// limitKey identifies the bucket. Empty kind means the default for all kinds.
+type limitKey struct {
+	Kind  string
+	Class Class
+}
+
+// maxRampRate is the rate that ends the ramp up of the Kinds without the limits of classes.
+// It keeps the burst in the range of int.
+const maxRampRate = math.MaxInt32
+
+type rampUp struct {
+	base     float64
+	growth   float64
+	interval time.Duration
+}
+
+type limiter struct {
+	limits    map[limitKey]Limit
+	rampUp    *rampUp
+	warmKinds map[string]bool
+	failFast  bool
+	now       func() time.Time
+	logf      func(ctx context.Context, format string, args ...interface{})
+
+	m          sync.Mutex
+	buckets    map[limitKey]*bucket
+	rampStarts map[string]time.Time
+	// ramps holds the buckets of the ramp up schedule. nil means the ramp up of the Kind has ended.
+	ramps map[string]*bucket
+}
+
+// reservation is the tokens taken from a bucket.
+type reservation struct {
+	b *bucket
+	n int
+}
+
+func (l *limiter) bucket(kind string, class Class, now time.Time) *bucket {
+	key := limitKey{Kind: kind, Class: class}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if b, ok := l.buckets[key]; ok {
+		return b
+	}
+
+	limit, ok := l.limits[key]
+	if !ok {
+		limit, ok = l.limits[limitKey{Class: class}]
+	}
+	if !ok || limit.Rate <= 0 {
+		l.buckets[key] = nil
+		return nil
+	}
+	b := newBucket(limit.Rate, limit.Burst, now)
+	l.buckets[key] = b
+
+	return b
+}
+
+// steadyRate returns the highest rate of the limits of classes for the Kind.
+// It is the goal of the ramp up schedule.
+func (l *limiter) steadyRate(kind string) float64 {
+	rate := 0.0
+	for _, class := range []Class{Read, Write, Query} {
+		limit, ok := l.limits[limitKey{Kind: kind, Class: class}]
+		if !ok {
+			limit, ok = l.limits[limitKey{Class: class}]
+		}
+		if ok && rate < limit.Rate {
+			rate = limit.Rate
+		}
+	}
+	if rate <= 0 || maxRampRate < rate {
+		return maxRampRate
+	}
+
+	return rate
+}
+
+// rampRate returns the rate of the ramp up schedule, and whether it has reached the steady rate.
+// the schedule of each Kind starts at the first operation.
+func (l *limiter) rampRate(kind string, now time.Time) (float64, bool) {
+	start, ok := l.rampStarts[kind]
+	if !ok {
+		start = now
+		l.rampStarts[kind] = start
+	}
+	steps := math.Floor(float64(now.Sub(start)) / float64(l.rampUp.interval))
+
+	rate := l.rampUp.base * math.Pow(l.rampUp.growth, steps)
+	steady := l.steadyRate(kind)
+	if steady <= rate || math.IsNaN(rate) {
+		return steady, true
+	}
+
+	return rate, false
+}
+
+func (l *limiter) rampBucket(kind string, now time.Time) *bucket {
+	if l.rampUp == nil || l.warmKinds[kind] {
+		return nil
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	b, ok := l.ramps[kind]
+	if ok && b == nil {
+		return nil
+	}
+
+	rate, reached := l.rampRate(kind, now)
+	if reached {
+		// the limits of classes take over the Kind.
+		l.ramps[kind] = nil
+		delete(l.rampStarts, kind)
+		return nil
+	}
+	burst := int(math.Ceil(rate))
+	if !ok {
+		b = newBucket(rate, burst, now)
+		l.ramps[kind] = b
+	} else {
+		b.setRate(now, rate, burst)
+	}
+
+	return b
+}
+
+// wait takes tokens of the buckets for each Kind, and waits for them.
+func (l *limiter) wait(ctx context.Context, class Class, costs map[string]int) error {
+	now := l.now()
+
+	maxWait := time.Duration(-1)
+	if l.failFast {
+		maxWait = 0
+	} else if deadline, ok := ctx.Deadline(); ok {
+		maxWait = deadline.Sub(now)
+		if maxWait < 0 {
+			maxWait = 0
+		}
+	}
+
+	var rs []*reservation
+	cancel := func() {
+		for _, r := range rs {
+			r.b.cancel(r.n)
+		}
+	}
+
+	var longest time.Duration
+	for kind, n := range costs {
+		for _, b := range []*bucket{l.bucket(kind, class, now), l.rampBucket(kind, now)} {
+			if b == nil {
+				continue
+			}
+			wait, ok := b.reserve(now, n, maxWait)
+			if !ok {
+				cancel()
+				l.logf(ctx, "dsmiddleware/ratelimit: %s of kind '%s' is rate limited, tokens=%d wait=%s", class, kind, n, wait)
+				return &RateLimitedError{Kind: kind, Class: class, RetryAfter: wait}
+			}
+			rs = append(rs, &reservation{b: b, n: n})
+			if longest < wait {
+				longest = wait
+			}
+		}
+	}
+
+	if longest == 0 {
+		return nil
+	}
+
+	t := time.NewTimer(longest)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		cancel()
+		return ctx.Err()
+	}
+}
+
+func keysCosts(keys []datastore.Key) map[string]int {
+	costs := make(map[string]int)
+	for _, key := range keys {
+		if key == nil {
+			continue
+		}
+		costs[key.Kind()]++
+	}
+
+	return costs
+}
+
+func (l *limiter) AllocateIDs(info *datastore.MiddlewareInfo, keys []datastore.Key) ([]datastore.Key, error) {
+	return info.Next.AllocateIDs(info, keys)
+}
+
+func (l *limiter) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.Key, error) {
+	err := l.wait(info.Context, Write, keysCosts(keys))
+	if err != nil {
+		return nil, err
+	}
+
+	return info.Next.PutMultiWithoutTx(info, keys, psList)
+}
+
+func (l *limiter) PutMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.PendingKey, error) {
+	err := l.wait(info.Context, Write, keysCosts(keys))
+	if err != nil {
+		return nil, err
+	}
+
+	return info.Next.PutMultiWithTx(info, keys, psList)
+}
+
+func (l *limiter) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	err := l.wait(info.Context, Read, keysCosts(keys))
+	if err != nil {
+		return err
+	}
+
+	return info.Next.GetMultiWithoutTx(info, keys, psList)
+}
+
+func (l *limiter) GetMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	err := l.wait(info.Context, Read, keysCosts(keys))
+	if err != nil {
+		return err
+	}
+
+	return info.Next.GetMultiWithTx(info, keys, psList)
+}
+
+func (l *limiter) DeleteMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	err := l.wait(info.Context, Write, keysCosts(keys))
+	if err != nil {
+		return err
+	}
+
+	return info.Next.DeleteMultiWithoutTx(info, keys)
+}
+
+func (l *limiter) DeleteMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	err := l.wait(info.Context, Write, keysCosts(keys))
+	if err != nil {
+		return err
+	}
+
+	return info.Next.DeleteMultiWithTx(info, keys)
+}
+
+func (l *limiter) PostCommit(info *datastore.MiddlewareInfo, tx datastore.Transaction, commit datastore.Commit) error {
+	return info.Next.PostCommit(info, tx, commit)
+}
+
+func (l *limiter) PostRollback(info *datastore.MiddlewareInfo, tx datastore.Transaction) error {
+	return info.Next.PostRollback(info, tx)
+}
+
+func (l *limiter) Run(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) datastore.Iterator {
+	// Run can't return the error, it is returned by Next of the iterator.
+	err := l.wait(info.Context, Query, map[string]int{qDump.Kind: 1})
+	if err != nil {
+		return &errorIterator{err: err}
+	}
+
+	return info.Next.Run(info, q, qDump)
+}
+
+func (l *limiter) GetAll(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, psList *[]datastore.PropertyList) ([]datastore.Key, error) {
+	err := l.wait(info.Context, Query, map[string]int{qDump.Kind: 1})
+	if err != nil {
+		return nil, err
+	}
+
+	return info.Next.GetAll(info, q, qDump, psList)
+}
+
+func (l *limiter) Next(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, iter datastore.Iterator, ps *datastore.PropertyList) (datastore.Key, error) {
+	return info.Next.Next(info, q, qDump, iter, ps)
+}
+
+func (l *limiter) Count(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) (int, error) {
+	err := l.wait(info.Context, Query, map[string]int{qDump.Kind: 1})
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Next.Count(info, q, qDump)
+}
+
+var _ datastore.Iterator = &errorIterator{}
+
+// errorIterator returns the error of Run.
+type errorIterator struct {
+	err error
+}
+
+func (it *errorIterator) Next(dst interface{}) (datastore.Key, error) {
+	return nil, it.err
+}
+
+func (it *errorIterator) Cursor() (datastore.Cursor, error) {
+	return nil, it.err
+}
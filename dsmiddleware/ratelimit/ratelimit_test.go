@@ -0,0 +1,287 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/internal/testutils"
+)
+
+type Data struct {
+	Name string
+}
+
+func TestBucket(t *testing.T) {
+	now := time.Now()
+	b := newBucket(10, 0, now)
+
+	if wait, ok := b.reserve(now, 10, 0); !ok || wait != 0 {
+		t.Fatalf("unexpected: %v, %v", wait, ok)
+	}
+	if wait, ok := b.reserve(now, 1, 0); ok || wait != 100*time.Millisecond {
+		t.Fatalf("unexpected: %v, %v", wait, ok)
+	}
+	// reserve more than burst, it makes the tokens negative.
+	if wait, ok := b.reserve(now, 20, -1); !ok || wait != 2*time.Second {
+		t.Fatalf("unexpected: %v, %v", wait, ok)
+	}
+	b.cancel(20)
+
+	now = now.Add(500 * time.Millisecond)
+	if wait, ok := b.reserve(now, 5, 0); !ok || wait != 0 {
+		t.Fatalf("unexpected: %v, %v", wait, ok)
+	}
+
+	// tokens aren't refilled more than burst.
+	now = now.Add(time.Hour)
+	if wait, ok := b.reserve(now, 11, 0); ok {
+		t.Fatalf("unexpected: %v, %v", wait, ok)
+	}
+}
+
+func TestRateLimit_FailFast(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	now := time.Now()
+	mw := New(WithLimit(Write, 1, 2), WithKindLimit("Log", Write, 0, 0), WithFailFast())
+	mw.(*limiter).now = func() time.Time { return now }
+	client.AppendMiddleware(mw)
+	client.AppendMiddleware(ms)
+
+	// a batch costs as many tokens as its keys.
+	keys := []datastore.Key{client.NameKey("Data", "a", nil), client.NameKey("Data", "b", nil)}
+	_, err := client.PutMulti(ctx, keys, []*Data{{Name: "a"}, {Name: "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Put(ctx, client.NameKey("Data", "c", nil), &Data{Name: "c"})
+	if err == nil {
+		t.Fatal("unexpected: nil")
+	}
+	rlErr, ok := err.(*RateLimitedError)
+	if !ok {
+		t.Fatalf("unexpected: %T, %v", err, err)
+	}
+	if rlErr.Kind != "Data" || rlErr.Class != Write || rlErr.RetryAfter != time.Second {
+		t.Errorf("unexpected: %+v", rlErr)
+	}
+
+	// other kinds and classes have their own buckets.
+	_, err = client.Put(ctx, client.NameKey("Other", "a", nil), &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Get(ctx, keys[0], &Data{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the limit of Log is disabled.
+	for i := 0; i < 5; i++ {
+		_, err = client.Put(ctx, client.IncompleteKey("Log", nil), &Data{Name: "log"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the failed operation doesn't take the token.
+	now = now.Add(time.Second)
+	_, err = client.Put(ctx, client.NameKey("Data", "c", nil), &Data{Name: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := ms.Calls("PutMultiWithoutTx"); v != 8 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestRateLimit_Blocking(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	client.AppendMiddleware(New(WithLimit(Read, 10, 1)))
+	client.AppendMiddleware(ms)
+
+	key := client.NameKey("Data", "a", nil)
+	_, err := client.Put(ctx, key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		err = client.Get(ctx, key, &Data{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v := time.Since(start); v < 150*time.Millisecond {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestRateLimit_Deadline(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	client.AppendMiddleware(New(WithLimit(Write, 1, 1)))
+	client.AppendMiddleware(ms)
+
+	_, err := client.Put(ctx, client.NameKey("Data", "a", nil), &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the deadline comes before the token is available.
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = client.Put(ctx, client.NameKey("Data", "b", nil), &Data{Name: "b"})
+	if _, ok := err.(*RateLimitedError); !ok {
+		t.Fatalf("unexpected: %T, %v", err, err)
+	}
+	if v := time.Since(start); 50*time.Millisecond < v {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestRateLimit_RampUp(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	now := time.Now()
+	mw := New(WithRampUpSchedule(2, 2, time.Minute), WithFailFast())
+	mw.(*limiter).now = func() time.Time { return now }
+	client.AppendMiddleware(mw)
+	client.AppendMiddleware(ms)
+
+	keys := []datastore.Key{client.NameKey("Data", "a", nil), client.NameKey("Data", "b", nil)}
+	_, err := client.PutMulti(ctx, keys, []*Data{{Name: "a"}, {Name: "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the ramp up limit is shared by all classes.
+	err = client.Get(ctx, keys[0], &Data{})
+	if _, ok := err.(*RateLimitedError); !ok {
+		t.Fatalf("unexpected: %T, %v", err, err)
+	}
+
+	// the schedule of each Kind starts at the first operation.
+	now = now.Add(time.Minute)
+	_, err = client.PutMulti(ctx, []datastore.Key{client.NameKey("Other", "a", nil), client.NameKey("Other", "b", nil)}, []*Data{{Name: "a"}, {Name: "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Put(ctx, client.NameKey("Other", "c", nil), &Data{Name: "c"})
+	if _, ok := err.(*RateLimitedError); !ok {
+		t.Fatalf("unexpected: %T, %v", err, err)
+	}
+
+	// the rate of Data is doubled after the interval.
+	_, err = client.PutMulti(ctx, keys, []*Data{{Name: "a"}, {Name: "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(250 * time.Millisecond)
+	err = client.Get(ctx, keys[0], &Data{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Put(ctx, client.NameKey("Other", "c", nil), &Data{Name: "c"})
+	if _, ok := err.(*RateLimitedError); !ok {
+		t.Fatalf("unexpected: %T, %v", err, err)
+	}
+}
+
+func TestRateLimit_RampUpEnd(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	now := time.Now()
+	mw := New(WithLimit(Write, 5, 5), WithRampUpSchedule(2, 2, time.Minute), WithWarmKinds("Warm"), WithFailFast())
+	l := mw.(*limiter)
+	l.now = func() time.Time { return now }
+	client.AppendMiddleware(mw)
+	client.AppendMiddleware(ms)
+
+	put := func(kind string, n int) error {
+		var keys []datastore.Key
+		var list []*Data
+		for i := 0; i < n; i++ {
+			keys = append(keys, client.IncompleteKey(kind, nil))
+			list = append(list, &Data{})
+		}
+		_, err := client.PutMulti(ctx, keys, list)
+		return err
+	}
+
+	// the warm kind isn't ramped up.
+	if err := put("Warm", 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := put("Data", 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := l.ramps["Warm"]; ok {
+		t.Errorf("unexpected: %v", ok)
+	}
+
+	// the rate reaches the limit of Write, the ramp up ends.
+	now = now.Add(10 * time.Minute)
+	if err := put("Data", 5); err != nil {
+		t.Fatal(err)
+	}
+	if b, ok := l.ramps["Data"]; !ok || b != nil {
+		t.Errorf("unexpected: %v, %v", b, ok)
+	}
+	if err := put("Data", 1); err == nil {
+		t.Fatal("unexpected: nil")
+	}
+}
+
+func TestRateLimit_RampUpOverflow(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	now := time.Now()
+	mw := New(WithRampUpSchedule(2, 2, time.Minute), WithFailFast())
+	l := mw.(*limiter)
+	l.now = func() time.Time { return now }
+	client.AppendMiddleware(mw)
+	client.AppendMiddleware(ms)
+
+	key := client.NameKey("Data", "a", nil)
+	_, err := client.Put(ctx, key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the kind without the limits of classes ends the ramp up before the burst overflows.
+	now = now.Add(24 * time.Hour)
+	_, err = client.Put(ctx, key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, ok := l.ramps["Data"]; !ok || b != nil {
+		t.Errorf("unexpected: %v, %v", b, ok)
+	}
+}
+
+func TestRateLimit_Run(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	client.AppendMiddleware(New(WithLimit(Query, 1, 1), WithFailFast()))
+	client.AppendMiddleware(ms)
+
+	_, err := client.Put(ctx, client.NameKey("Data", "a", nil), &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Run(ctx, client.NewQuery("Data")).Next(&Data{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the iterator created without the token returns the error.
+	_, err = client.Run(ctx, client.NewQuery("Data")).Next(&Data{})
+	if _, ok := err.(*RateLimitedError); !ok {
+		t.Fatalf("unexpected: %T, %v", err, err)
+	}
+}
@@ -0,0 +1,287 @@
+package rediscache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+	"go.mercari.io/datastore/internal/redisslot"
+)
+
+// batch is the keys sent to a node by a command.
+type batch struct {
+	node string
+	idxs []int
+}
+
+// connector provides the connections to Redis and decides the node of keys.
+type connector interface {
+	// route groups the indices of cacheKeys into batches.
+	route(ctx context.Context, cacheKeys []string, idxs []int) ([]*batch, error)
+	// conn returns the connection to the node, the caller must close it.
+	conn(ctx context.Context, node string) (redis.Conn, error)
+	// moved is called when the node doesn't serve the keys, and reports whether the keys should be routed again.
+	moved(ctx context.Context) bool
+	// asking reports whether the keys can be sent to the node of ASK redirection.
+	asking() bool
+	close() error
+}
+
+var _ connector = &singleConnector{}
+var _ connector = &funcConnector{}
+var _ connector = &clusterConnector{}
+
+// singleConnector shares one connection with the lock.
+type singleConnector struct {
+	m  sync.Mutex
+	rc redis.Conn
+}
+
+func (c *singleConnector) route(ctx context.Context, cacheKeys []string, idxs []int) ([]*batch, error) {
+	return []*batch{{idxs: idxs}}, nil
+}
+
+func (c *singleConnector) conn(ctx context.Context, node string) (redis.Conn, error) {
+	c.m.Lock()
+	return &lockedConn{Conn: c.rc, unlock: c.m.Unlock}, nil
+}
+
+func (c *singleConnector) moved(ctx context.Context) bool {
+	return false
+}
+
+func (c *singleConnector) asking() bool {
+	return false
+}
+
+func (c *singleConnector) close() error {
+	return nil
+}
+
+// lockedConn releases the lock instead of closing the shared connection.
+type lockedConn struct {
+	redis.Conn
+	once   sync.Once
+	unlock func()
+}
+
+func (c *lockedConn) Close() error {
+	c.once.Do(c.unlock)
+	return nil
+}
+
+// funcConnector gets the connection from the pool or the factory.
+type funcConnector struct {
+	get func(ctx context.Context) (redis.Conn, error)
+}
+
+func (c *funcConnector) route(ctx context.Context, cacheKeys []string, idxs []int) ([]*batch, error) {
+	return []*batch{{idxs: idxs}}, nil
+}
+
+func (c *funcConnector) conn(ctx context.Context, node string) (redis.Conn, error) {
+	return c.get(ctx)
+}
+
+func (c *funcConnector) moved(ctx context.Context) bool {
+	return false
+}
+
+func (c *funcConnector) asking() bool {
+	return false
+}
+
+func (c *funcConnector) close() error {
+	return nil
+}
+
+// clusterConnector routes keys by the hash slots of Redis Cluster, and pools connections per node.
+type clusterConnector struct {
+	seeds   []string
+	dial    func(ctx context.Context, addr string) (redis.Conn, error)
+	maxIdle int
+
+	m     sync.Mutex
+	slots []string // node address of each slot, nil if not loaded
+	pools map[string]*redis.Pool
+}
+
+func (c *clusterConnector) route(ctx context.Context, cacheKeys []string, idxs []int) ([]*batch, error) {
+	slots, err := c.loadSlots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// MGET and DEL require that all keys are in the same slot.
+	batchMap := make(map[int]*batch)
+	batches := make([]*batch, 0)
+	for _, idx := range idxs {
+		slot := redisslot.Slot(cacheKeys[idx])
+		b, ok := batchMap[slot]
+		if !ok {
+			b = &batch{node: slots[slot]}
+			batchMap[slot] = b
+			batches = append(batches, b)
+		}
+		b.idxs = append(b.idxs, idx)
+	}
+
+	return batches, nil
+}
+
+func (c *clusterConnector) loadSlots(ctx context.Context) ([]string, error) {
+	c.m.Lock()
+	slots := c.slots
+	nodes := make([]string, 0, len(c.pools)+len(c.seeds))
+	nodes = append(nodes, c.seeds...)
+	for node := range c.pools {
+		nodes = append(nodes, node)
+	}
+	c.m.Unlock()
+	if slots != nil {
+		return slots, nil
+	}
+
+	var lastErr error
+	for _, node := range nodes {
+		slots, err := c.clusterSlots(ctx, node)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		c.m.Lock()
+		c.slots = slots
+		c.m.Unlock()
+
+		return slots, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("dsmiddleware/rediscache: no cluster nodes")
+	}
+
+	return nil, lastErr
+}
+
+func (c *clusterConnector) clusterSlots(ctx context.Context, node string) ([]string, error) {
+	conn, err := c.conn(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ranges, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+
+	slots := make([]string, redisslot.Count)
+	for _, r := range ranges {
+		// [start, end, [host, port, id], replicas...]
+		vs, err := redis.Values(r, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(vs) < 3 {
+			return nil, fmt.Errorf("dsmiddleware/rediscache: unexpected CLUSTER SLOTS reply %v", vs)
+		}
+		start, err := redis.Int(vs[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		end, err := redis.Int(vs[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		master, err := redis.Values(vs[2], nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(master) < 2 {
+			return nil, fmt.Errorf("dsmiddleware/rediscache: unexpected CLUSTER SLOTS reply %v", vs)
+		}
+		host, err := redis.String(master[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		port, err := redis.Int(master[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		for slot := start; slot <= end && slot < redisslot.Count; slot++ {
+			slots[slot] = addr
+		}
+	}
+
+	return slots, nil
+}
+
+func (c *clusterConnector) conn(ctx context.Context, node string) (redis.Conn, error) {
+	if node == "" {
+		return nil, errors.New("dsmiddleware/rediscache: the slot is not served by any node")
+	}
+
+	c.m.Lock()
+	pool, ok := c.pools[node]
+	if !ok {
+		pool = &redis.Pool{
+			MaxIdle: c.maxIdle,
+			DialContext: func(ctx context.Context) (redis.Conn, error) {
+				return c.dial(ctx, node)
+			},
+		}
+		c.pools[node] = pool
+	}
+	c.m.Unlock()
+
+	return pool.GetContext(ctx)
+}
+
+func (c *clusterConnector) moved(ctx context.Context) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	// reload the slots by the next route.
+	c.slots = nil
+	return true
+}
+
+func (c *clusterConnector) asking() bool {
+	return true
+}
+
+func (c *clusterConnector) close() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	var lastErr error
+	for node, pool := range c.pools {
+		if err := pool.Close(); err != nil {
+			lastErr = err
+		}
+		delete(c.pools, node)
+	}
+
+	return lastErr
+}
+
+// redirection returns the type of the redirection of Redis Cluster, "MOVED" or "ASK", and the node to ask.
+// The empty type is returned if the error is not the redirection.
+func redirection(err error) (string, string) {
+	rErr, ok := err.(redis.Error)
+	if !ok {
+		return "", ""
+	}
+	// MOVED <slot> <host:port>, ASK <slot> <host:port>
+	fields := strings.Fields(string(rErr))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", ""
+	}
+	return fields[0], fields[2]
+}
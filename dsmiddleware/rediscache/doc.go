@@ -2,6 +2,40 @@
 Package rediscache handles Put, Get etc to Datastore and provides caching by Redis.
 How the cache is used is explained in the storagecache package's document.
 
+New shares the redis.Conn by the concurrent operations with the lock.
+NewWithPool or NewWithConnFunc gets the connection for each operation, it is recommended for the concurrent requests.
+
+	pool := &redis.Pool{
+		MaxIdle: 8,
+		DialContext: func(ctx context.Context) (redis.Conn, error) {
+			return redis.DialContext(ctx, "tcp", addr)
+		},
+	}
+	mw := rediscache.NewWithPool(pool)
+
+NewCluster supports Redis Cluster.
+The keys of an operation are split by the hash slot, and sent to each node in parallel.
+When the slots are moved, the slots are reloaded and the operation is retried once.
+When the slot is migrating, the keys replied by ASK are retried once on the importing node with ASKING.
+
+	mw := rediscache.NewCluster([]string{"10.0.0.1:6379", "10.0.0.2:6379"},
+		func(ctx context.Context, addr string) (redis.Conn, error) {
+			return redis.DialContext(ctx, "tcp", addr)
+		},
+	)
+	defer mw.Close()
+
+The commands are pipelined. The error of a node is logged, and Get treats its keys as the cache misses.
+
+Get reports the expiration of the entries by PTTL, so the early refresh works with tieredcache that has rediscache as the far storage.
+
+The cache is encoded by gob, WithCodec changes it.
+
+	mw := rediscache.NewWithPool(pool, rediscache.WithCodec(storagecache.NewProtoCodec()))
+
+WithLockProtocol prevents the stale entity from being cached by the reader that races with the writer.
+The reader fills the cache by WATCH, MULTI and EXEC only if the key still holds its lock.
+
 Related document.
 
 https://godoc.org/go.mercari.io/datastore/dsmiddleware/storagecache
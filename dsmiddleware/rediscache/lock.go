@@ -0,0 +1,213 @@
+package rediscache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/dsmiddleware/storagecache"
+)
+
+// errCASConflict is returned by compareAndSwapBatch when the watched keys are modified before EXEC.
+var errCASConflict = errors.New("dsmiddleware/rediscache: the watched keys are modified")
+
+func (ch *cacheHandler) LockMulti(ctx context.Context, keys []datastore.Key) error {
+	ch.logf(ctx, "dsmiddleware/rediscache.LockMulti: incoming len=%d", len(keys))
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	cacheKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		cacheKeys = append(cacheKeys, ch.cacheKey(key))
+	}
+	lock := storagecache.NewLockValue()
+
+	results := ch.pipeline(ctx, cacheKeys, func(b *batch) []*command {
+		cmds := make([]*command, 0, len(b.idxs))
+		for _, idx := range b.idxs {
+			cmds = append(cmds, &command{"SET", []interface{}{cacheKeys[idx], lock, "PX", int64(ch.lockDuration / time.Millisecond)}})
+		}
+		return cmds
+	})
+
+	return ch.logErrors(ctx, "dsmiddleware/rediscache.LockMulti", results)
+}
+
+func (ch *cacheHandler) AddLockMulti(ctx context.Context, keys []datastore.Key) ([][]byte, error) {
+	ch.logf(ctx, "dsmiddleware/rediscache.AddLockMulti: incoming len=%d", len(keys))
+
+	locks := make([][]byte, len(keys))
+	if len(keys) == 0 {
+		return locks, nil
+	}
+
+	cacheKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		cacheKeys = append(cacheKeys, ch.cacheKey(key))
+	}
+	lock := storagecache.NewLockValue()
+
+	results := ch.pipeline(ctx, cacheKeys, func(b *batch) []*command {
+		cmds := make([]*command, 0, len(b.idxs))
+		for _, idx := range b.idxs {
+			cmds = append(cmds, &command{"SET", []interface{}{cacheKeys[idx], lock, "NX", "PX", int64(ch.lockDuration / time.Millisecond)}})
+		}
+		return cmds
+	})
+	// the keys of the failed node are not locked, and not filled.
+	_ = ch.logErrors(ctx, "dsmiddleware/rediscache.AddLockMulti", results)
+
+	locked := 0
+	for _, r := range results {
+		if r.err != nil {
+			continue
+		}
+		for i, reply := range r.replies {
+			// SET NX replies nil if the key exists.
+			if reply == nil {
+				continue
+			}
+			locks[r.batch.idxs[i]] = lock
+			locked++
+		}
+	}
+
+	ch.logf(ctx, "dsmiddleware/rediscache.AddLockMulti: locked=%d", locked)
+
+	return locks, nil
+}
+
+func (ch *cacheHandler) CompareAndSwapMulti(ctx context.Context, cis []*storagecache.CacheItem, locks [][]byte) error {
+	ch.logf(ctx, "dsmiddleware/rediscache.CompareAndSwapMulti: incoming len=%d", len(cis))
+
+	cacheKeys := make([]string, 0, len(cis))
+	cacheValues := make([][]byte, 0, len(cis))
+	cacheLocks := make([][]byte, 0, len(cis))
+	expireDurations := make([]time.Duration, 0, len(cis))
+	for idx, ci := range cis {
+		if ci.Key.Incomplete() {
+			panic("incomplete key incoming")
+		}
+		cacheValue, err := ch.codec.Encode(ci)
+		if err != nil {
+			ch.logf(ctx, "dsmiddleware/rediscache.CompareAndSwapMulti: encode error key=%s err=%s", ci.Key.String(), err.Error())
+			continue
+		}
+		expireDuration := ch.expireDuration
+		if ci.NoSuchEntity {
+			expireDuration = ch.negativeExpireDuration
+		}
+		cacheKeys = append(cacheKeys, ch.cacheKey(ci.Key))
+		cacheValues = append(cacheValues, cacheValue)
+		cacheLocks = append(cacheLocks, locks[idx])
+		expireDurations = append(expireDurations, expireDuration)
+	}
+
+	if len(cacheKeys) == 0 {
+		return nil
+	}
+
+	idxs := make([]int, len(cacheKeys))
+	for idx := range idxs {
+		idxs[idx] = idx
+	}
+	batches, err := ch.connector.route(ctx, cacheKeys, idxs)
+	if err != nil {
+		ch.logf(ctx, "dsmiddleware/rediscache.CompareAndSwapMulti: err=%s", err.Error())
+		return err
+	}
+
+	// WATCH needs the round trip, the batches are processed one by one.
+	results := make([]*result, 0, len(batches))
+	swapped := 0
+	conflicted := 0
+	for _, b := range batches {
+		n, err := ch.compareAndSwapBatch(ctx, b, func(idx int) []interface{} {
+			args := []interface{}{cacheKeys[idx], cacheValues[idx]}
+			if 0 < expireDurations[idx] {
+				args = append(args, "PX", int64(expireDurations[idx]/time.Millisecond))
+			}
+			return args
+		}, cacheKeys, cacheLocks)
+		if err == errCASConflict {
+			// the other writer or reader wins, the cache isn't filled.
+			conflicted += len(b.idxs)
+			continue
+		} else if err == nil {
+			conflicted += len(b.idxs) - n
+		}
+		swapped += n
+		results = append(results, &result{batch: b, err: err})
+	}
+
+	ch.logf(ctx, "dsmiddleware/rediscache.CompareAndSwapMulti: swapped=%d conflicted=%d", swapped, conflicted)
+
+	return ch.logErrors(ctx, "dsmiddleware/rediscache.CompareAndSwapMulti", results)
+}
+
+// compareAndSwapBatch watches the keys of the batch, and sets the keys that still have the locks by MULTI and EXEC.
+// If any watched key is modified before EXEC, nothing is set and errCASConflict is returned.
+func (ch *cacheHandler) compareAndSwapBatch(ctx context.Context, b *batch, setArgs func(idx int) []interface{}, cacheKeys []string, locks [][]byte) (int, error) {
+	conn, err := ch.connector.conn(ctx, b.node)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	args := make([]interface{}, 0, len(b.idxs))
+	for _, idx := range b.idxs {
+		args = append(args, cacheKeys[idx])
+	}
+	err = conn.Send("WATCH", args...)
+	if err != nil {
+		return 0, err
+	}
+	current, err := redis.ByteSlices(conn.Do("MGET", args...))
+	if err != nil {
+		_, _ = conn.Do("UNWATCH")
+		return 0, err
+	}
+
+	swapIdxs := make([]int, 0, len(b.idxs))
+	for i, idx := range b.idxs {
+		if bytes.Equal(current[i], locks[idx]) {
+			swapIdxs = append(swapIdxs, idx)
+		}
+	}
+	if len(swapIdxs) == 0 {
+		_, err = conn.Do("UNWATCH")
+		return 0, err
+	}
+
+	// the connection of singleConnector is shared, it must not be left in MULTI.
+	discard := func(err error) (int, error) {
+		_, _ = conn.Do("DISCARD")
+		return 0, err
+	}
+	err = conn.Send("MULTI")
+	if err != nil {
+		return discard(err)
+	}
+	for _, idx := range swapIdxs {
+		err = conn.Send("SET", setArgs(idx)...)
+		if err != nil {
+			return discard(err)
+		}
+	}
+	reply, err := conn.Do("EXEC")
+	if _, ok := err.(redis.Error); ok {
+		// EXEC failed, the server discarded the transaction.
+		return 0, err
+	} else if err != nil {
+		return discard(err)
+	} else if reply == nil {
+		return 0, errCASConflict
+	}
+
+	return len(swapIdxs), nil
+}
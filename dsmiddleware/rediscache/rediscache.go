@@ -1,10 +1,8 @@
 package rediscache
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
-	"errors"
+	"sync"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
@@ -13,21 +11,63 @@ import (
 )
 
 var _ storagecache.Storage = &cacheHandler{}
+var _ storagecache.LockStorage = &cacheHandler{}
 var _ datastore.Middleware = &cacheHandler{}
 
 const defaultExpiration = 15 * time.Minute
+const defaultClusterMaxIdle = 8
+const defaultLockDuration = 32 * time.Second
 
 // New Redis cache middleware creates & returns.
+// The conn is shared by the concurrent operations with the lock, use NewWithPool to avoid the bottleneck.
 func New(conn redis.Conn, opts ...CacheOption) interface {
 	datastore.Middleware
 	storagecache.Storage
 } {
+	return newCacheHandler(&singleConnector{rc: conn}, opts)
+}
+
+// NewWithPool creates & returns the Redis cache middleware that gets a connection from the pool for each operation.
+func NewWithPool(pool *redis.Pool, opts ...CacheOption) interface {
+	datastore.Middleware
+	storagecache.Storage
+} {
+	return newCacheHandler(&funcConnector{get: pool.GetContext}, opts)
+}
+
+// NewWithConnFunc creates & returns the Redis cache middleware that gets a connection by f for each operation.
+// The connection is closed when the operation finished.
+func NewWithConnFunc(f func(ctx context.Context) (redis.Conn, error), opts ...CacheOption) interface {
+	datastore.Middleware
+	storagecache.Storage
+} {
+	return newCacheHandler(&funcConnector{get: f}, opts)
+}
+
+// NewCluster creates & returns the Redis cache middleware for Redis Cluster.
+// The hash slots are loaded from one of addrs by CLUSTER SLOTS, and dial connects to each node.
+// The keys of an operation are split by the slot, and sent to the nodes in parallel.
+// Close closes the connections.
+func NewCluster(addrs []string, dial func(ctx context.Context, addr string) (redis.Conn, error), opts ...CacheOption) interface {
+	datastore.Middleware
+	storagecache.Storage
+	Close() error
+} {
+	return newCacheHandler(&clusterConnector{
+		seeds:   addrs,
+		dial:    dial,
+		maxIdle: defaultClusterMaxIdle,
+		pools:   make(map[string]*redis.Pool),
+	}, opts)
+}
 
+func newCacheHandler(c connector, opts []CacheOption) *cacheHandler {
 	// I want to make ch.dsmiddleware accessible from the test
 	ch := &cacheHandler{
-		conn:           conn,
+		connector:      c,
 		stOpts:         &storagecache.Options{},
 		expireDuration: defaultExpiration,
+		lockDuration:   defaultLockDuration,
 	}
 
 	for _, opt := range opts {
@@ -45,6 +85,9 @@ func New(conn redis.Conn, opts ...CacheOption) interface {
 			return "mercari:rediscache:" + key.Encode()
 		}
 	}
+	if ch.codec == nil {
+		ch.codec = storagecache.NewGobCodec()
+	}
 
 	return ch
 }
@@ -53,10 +96,13 @@ type cacheHandler struct {
 	datastore.Middleware
 	stOpts *storagecache.Options
 
-	conn           redis.Conn
-	expireDuration time.Duration
-	logf           func(ctx context.Context, format string, args ...interface{})
-	cacheKey       func(key datastore.Key) string
+	connector              connector
+	expireDuration         time.Duration
+	negativeExpireDuration time.Duration
+	lockDuration           time.Duration
+	logf                   func(ctx context.Context, format string, args ...interface{})
+	cacheKey               func(key datastore.Key) string
+	codec                  storagecache.Codec
 }
 
 // A CacheOption is an cache option for a Redis cache middleware.
@@ -64,119 +110,283 @@ type CacheOption interface {
 	Apply(*cacheHandler)
 }
 
-func (ch *cacheHandler) SetMulti(ctx context.Context, cis []*storagecache.CacheItem) error {
+// command is a Redis command sent by pipelining.
+type command struct {
+	name string
+	args []interface{}
+}
 
-	ch.logf(ctx, "dsmiddleware/rediscache.SetMulti: incoming len=%d", len(cis))
+// result is the replies of the commands of a batch, or the error of it.
+type result struct {
+	batch   *batch
+	replies []interface{}
+	err     error
+}
+
+// pipeline sends the commands of each batch to the node by pipelining, the nodes are processed in parallel.
+// If the node doesn't serve the keys anymore, the keys are routed again and retried once.
+// If the slot of the keys is migrating, the keys are retried once on the node of ASK, without routing again.
+func (ch *cacheHandler) pipeline(ctx context.Context, cacheKeys []string, commands func(b *batch) []*command) []*result {
+	idxs := make([]int, len(cacheKeys))
+	for idx := range idxs {
+		idxs[idx] = idx
+	}
+
+	results := ch.pipelineOnce(ctx, cacheKeys, idxs, commands)
+
+	var movedIdxs []int
+	var moved []*result
+	askNodes := make([]string, 0)
+	asks := make(map[string][]*result)
+	done := make([]*result, 0, len(results))
+	for _, r := range results {
+		switch typ, node := redirection(r.err); {
+		case typ == "MOVED":
+			movedIdxs = append(movedIdxs, r.batch.idxs...)
+			moved = append(moved, r)
+			continue
+		case typ == "ASK" && ch.connector.asking():
+			if _, ok := asks[node]; !ok {
+				askNodes = append(askNodes, node)
+			}
+			asks[node] = append(asks[node], &result{batch: &batch{node: node, idxs: r.batch.idxs}})
+			continue
+		}
+		done = append(done, r)
+	}
+
+	for _, node := range askNodes {
+		ch.pipelineNode(ctx, node, asks[node], commands, true)
+		done = append(done, asks[node]...)
+	}
+
+	if len(movedIdxs) == 0 {
+		return done
+	}
+	if !ch.connector.moved(ctx) {
+		return append(done, moved...)
+	}
+
+	return append(done, ch.pipelineOnce(ctx, cacheKeys, movedIdxs, commands)...)
+}
+
+func (ch *cacheHandler) pipelineOnce(ctx context.Context, cacheKeys []string, idxs []int, commands func(b *batch) []*command) []*result {
+	batches, err := ch.connector.route(ctx, cacheKeys, idxs)
+	if err != nil {
+		return []*result{{batch: &batch{idxs: idxs}, err: err}}
+	}
+
+	nodeMap := make(map[string][]*result)
+	nodes := make([]string, 0)
+	results := make([]*result, 0, len(batches))
+	for _, b := range batches {
+		r := &result{batch: b}
+		if _, ok := nodeMap[b.node]; !ok {
+			nodes = append(nodes, b.node)
+		}
+		nodeMap[b.node] = append(nodeMap[b.node], r)
+		results = append(results, r)
+	}
 
-	err := ch.conn.Send("MULTI")
+	if len(nodes) == 1 {
+		ch.pipelineNode(ctx, nodes[0], nodeMap[nodes[0]], commands, false)
+		return results
+	}
+
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			ch.pipelineNode(ctx, node, nodeMap[node], commands, false)
+		}(node)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// pipelineNode sends the commands of the batches to the node.
+// If asking is true, each command follows ASKING, the node serves the keys of the importing slot only with it.
+func (ch *cacheHandler) pipelineNode(ctx context.Context, node string, results []*result, commands func(b *batch) []*command, asking bool) {
+	setErr := func(err error) {
+		for _, r := range results {
+			if r.err == nil {
+				r.err = err
+			}
+		}
+	}
+
+	conn, err := ch.connector.conn(ctx, node)
+	if err != nil {
+		setErr(err)
+		return
+	}
+	defer conn.Close()
+
+	cmdsList := make([][]*command, len(results))
+	for idx, r := range results {
+		cmdsList[idx] = commands(r.batch)
+		for _, cmd := range cmdsList[idx] {
+			if asking {
+				err := conn.Send("ASKING")
+				if err != nil {
+					setErr(err)
+					return
+				}
+			}
+			err := conn.Send(cmd.name, cmd.args...)
+			if err != nil {
+				setErr(err)
+				return
+			}
+		}
+	}
+	err = conn.Flush()
 	if err != nil {
-		ch.logf(ctx, `dsmiddleware/rediscache.SetMulti: conn.Send("MULTI") err=%s`, err.Error())
-		return err
+		setErr(err)
+		return
+	}
+
+	for idx, r := range results {
+		r.replies = make([]interface{}, 0, len(cmdsList[idx]))
+		for range cmdsList[idx] {
+			if asking {
+				_, err := conn.Receive()
+				if _, ok := err.(redis.Error); !ok && err != nil {
+					setErr(err)
+					return
+				}
+			}
+			reply, err := conn.Receive()
+			if rErr, ok := err.(redis.Error); ok {
+				// the error reply of the command, the connection is still available.
+				if r.err == nil {
+					r.err = rErr
+				}
+				r.replies = append(r.replies, nil)
+				continue
+			} else if err != nil {
+				setErr(err)
+				return
+			}
+			r.replies = append(r.replies, reply)
+		}
 	}
+}
+
+func (ch *cacheHandler) SetMulti(ctx context.Context, cis []*storagecache.CacheItem) error {
 
-	cnt := 0
+	ch.logf(ctx, "dsmiddleware/rediscache.SetMulti: incoming len=%d", len(cis))
+
+	cacheKeys := make([]string, 0, len(cis))
+	cacheValues := make([][]byte, 0, len(cis))
+	expireDurations := make([]time.Duration, 0, len(cis))
 	for _, ci := range cis {
 		if ci.Key.Incomplete() {
 			panic("incomplete key incoming")
 		}
-		var buf bytes.Buffer
-		enc := gob.NewEncoder(&buf)
-		err := enc.Encode(ci.PropertyList)
+		cacheValue, err := ch.codec.Encode(ci)
 		if err != nil {
-			ch.logf(ctx, "dsmiddleware/rediscache.SetMulti: gob.Encode error key=%s err=%s", ci.Key.String(), err.Error())
+			ch.logf(ctx, "dsmiddleware/rediscache.SetMulti: encode error key=%s err=%s", ci.Key.String(), err.Error())
 			continue
 		}
-		cacheKey := ch.cacheKey(ci.Key)
-		cacheValue := buf.Bytes()
-
-		if ch.expireDuration <= 0 {
-			err = ch.conn.Send("SET", cacheKey, cacheValue)
-			if err != nil {
-				ch.logf(ctx, `dsmiddleware/rediscache.SetMulti: conn.Send("SET", "%s", ...) err=%s`, cacheKey, err.Error())
-				return err
-			}
-		} else {
-			err = ch.conn.Send("SET", cacheKey, cacheValue, "PX", int64(ch.expireDuration/time.Millisecond))
-			if err != nil {
-				ch.logf(ctx, `dsmiddleware/rediscache.SetMulti: conn.Send("SET", "%s", ..., "PX", %d) err=%s`, cacheKey, ch.expireDuration/time.Millisecond, err.Error())
-				return err
-			}
+		expireDuration := ch.expireDuration
+		if ci.NoSuchEntity {
+			expireDuration = ch.negativeExpireDuration
 		}
-		cnt++
+		cacheKeys = append(cacheKeys, ch.cacheKey(ci.Key))
+		cacheValues = append(cacheValues, cacheValue)
+		expireDurations = append(expireDurations, expireDuration)
 	}
 
-	ch.logf(ctx, "dsmiddleware/rediscache.SetMulti: len=%d", cnt)
+	ch.logf(ctx, "dsmiddleware/rediscache.SetMulti: len=%d", len(cacheKeys))
 
-	_, err = ch.conn.Do("EXEC")
-	if err != nil {
-		ch.logf(ctx, `dsmiddleware/rediscache.SetMulti: conn.Send("EXEC") err=%s`, err.Error())
-		return err
+	if len(cacheKeys) == 0 {
+		return nil
 	}
 
-	return nil
+	results := ch.pipeline(ctx, cacheKeys, func(b *batch) []*command {
+		cmds := make([]*command, 0, len(b.idxs))
+		for _, idx := range b.idxs {
+			args := []interface{}{cacheKeys[idx], cacheValues[idx]}
+			if 0 < expireDurations[idx] {
+				args = append(args, "PX", int64(expireDurations[idx]/time.Millisecond))
+			}
+			cmds = append(cmds, &command{"SET", args})
+		}
+		return cmds
+	})
+
+	return ch.logErrors(ctx, "dsmiddleware/rediscache.SetMulti", results)
 }
 
 func (ch *cacheHandler) GetMulti(ctx context.Context, keys []datastore.Key) ([]*storagecache.CacheItem, error) {
 
 	ch.logf(ctx, "dsmiddleware/rediscache.GetMulti: incoming len=%d", len(keys))
 
-	err := ch.conn.Send("MULTI")
-	if err != nil {
-		ch.logf(ctx, `dsmiddleware/rediscache.GetMulti: conn.Send("MULTI") err=%s`, err.Error())
-		return nil, err
+	resultList := make([]*storagecache.CacheItem, len(keys))
+	if len(keys) == 0 {
+		return resultList, nil
 	}
 
-	resultList := make([]*storagecache.CacheItem, len(keys))
+	cacheKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		cacheKeys = append(cacheKeys, ch.cacheKey(key))
+	}
 
-	for idx, key := range keys {
-		cacheKey := ch.cacheKey(key)
-		resultList[idx] = &storagecache.CacheItem{
-			Key: key,
+	// the early refresh requires the expiration, even if the other middleware like tieredcache enables it.
+	now := time.Now()
+	results := ch.pipeline(ctx, cacheKeys, func(b *batch) []*command {
+		args := make([]interface{}, 0, len(b.idxs))
+		for _, idx := range b.idxs {
+			args = append(args, cacheKeys[idx])
 		}
-		err := ch.conn.Send("GET", cacheKey)
-		if err != nil {
-			ch.logf(ctx, `dsmiddleware/rediscache.GetMulti: conn.Send("GET", "%s") err=%s`, cacheKey, err.Error())
-			return nil, err
+		cmds := []*command{{"MGET", args}}
+		for _, idx := range b.idxs {
+			cmds = append(cmds, &command{"PTTL", []interface{}{cacheKeys[idx]}})
 		}
-	}
+		return cmds
+	})
 
-	resp, err := ch.conn.Do("EXEC")
-	if err != nil {
-		ch.logf(ctx, `dsmiddleware/rediscache.GetMulti: conn.Do("EXEC") err=%s`, err.Error())
-		return nil, err
-	}
-	bs, err := redis.ByteSlices(resp, nil)
-	if err != nil {
-		ch.logf(ctx, `dsmiddleware/rediscache.GetMulti: redis.ByteSlices err=%s`, err.Error())
-		return nil, err
+	bsList := make([][][]byte, len(results))
+	for idx, r := range results {
+		if r.err == nil {
+			bsList[idx], r.err = redis.ByteSlices(r.replies[0], nil)
+		}
 	}
+	// the error of the node degrades to the cache misses.
+	_ = ch.logErrors(ctx, "dsmiddleware/rediscache.GetMulti", results)
 
 	hit := 0
 	miss := 0
-	for idx, b := range bs {
-		if len(b) == 0 {
-			resultList[idx] = nil
-			miss++
-			continue
-		}
-		buf := bytes.NewBuffer(b)
-		dec := gob.NewDecoder(buf)
-		var ps datastore.PropertyList
-		err = dec.Decode(&ps)
-		if err != nil {
-			resultList[idx] = nil
-			ch.logf(ctx, "dsmiddleware/rediscache.GetMulti: gob.Decode error key=%s err=%s", keys[idx].String(), err.Error())
-			miss++
+	for resultIdx, r := range results {
+		if r.err != nil {
+			miss += len(r.batch.idxs)
 			continue
 		}
 
-		if !resultList[idx].Key.Equal(keys[idx]) {
-			ch.logf(ctx, "dsmiddleware/rediscache.GetMulti: key equality check failed")
-			return nil, errors.New("dsmiddleware/rediscache.GetMulti: key equality check failed")
-		}
+		for i, b := range bsList[resultIdx] {
+			idx := r.batch.idxs[i]
+			if len(b) == 0 || storagecache.IsLockValue(b) {
+				miss++
+				continue
+			}
+			ci, err := ch.codec.Decode(keys[idx], b)
+			if err != nil {
+				ch.logf(ctx, "dsmiddleware/rediscache.GetMulti: decode error key=%s err=%s", keys[idx].String(), err.Error())
+				miss++
+				continue
+			}
+
+			// PTTL returns -1 for the key without the expiration.
+			if pttl, err := redis.Int64(r.replies[1+i], nil); err == nil && 0 < pttl {
+				ci.ExpiresAt = now.Add(time.Duration(pttl) * time.Millisecond)
+			}
 
-		resultList[idx].PropertyList = ps
-		hit++
+			resultList[idx] = ci
+			hit++
+		}
 	}
 
 	ch.logf(ctx, "dsmiddleware/rediscache.GetMulti: hit=%d miss=%d", hit, miss)
@@ -187,27 +397,54 @@ func (ch *cacheHandler) GetMulti(ctx context.Context, keys []datastore.Key) ([]*
 func (ch *cacheHandler) DeleteMulti(ctx context.Context, keys []datastore.Key) error {
 	ch.logf(ctx, "dsmiddleware/rediscache.DeleteMulti: incoming len=%d", len(keys))
 
-	err := ch.conn.Send("MULTI")
-	if err != nil {
-		ch.logf(ctx, `dsmiddleware/rediscache.DeleteMulti: conn.Send("MULTI") err=%s`, err.Error())
-		return err
+	if len(keys) == 0 {
+		return nil
 	}
 
+	cacheKeys := make([]string, 0, len(keys))
 	for _, key := range keys {
-		cacheKey := ch.cacheKey(key)
+		cacheKeys = append(cacheKeys, ch.cacheKey(key))
+	}
 
-		err = ch.conn.Send("DEL", cacheKey)
-		if err != nil {
-			ch.logf(ctx, `dsmiddleware/rediscache.DeleteMulti: conn.Send("DEL", "%s") err=%s`, cacheKey, err.Error())
-			return err
+	results := ch.pipeline(ctx, cacheKeys, func(b *batch) []*command {
+		args := make([]interface{}, 0, len(b.idxs))
+		for _, idx := range b.idxs {
+			args = append(args, cacheKeys[idx])
+		}
+		return []*command{{"DEL", args}}
+	})
+
+	return ch.logErrors(ctx, "dsmiddleware/rediscache.DeleteMulti", results)
+}
+
+// logErrors logs the errors of the results once per node, and returns the first error.
+func (ch *cacheHandler) logErrors(ctx context.Context, logPrefix string, results []*result) error {
+	var nodes []string
+	lens := make(map[string]int)
+	errs := make(map[string]error)
+	for _, r := range results {
+		if r.err == nil {
+			continue
 		}
+		node := r.batch.node
+		if _, ok := errs[node]; !ok {
+			nodes = append(nodes, node)
+			errs[node] = r.err
+		}
+		lens[node] += len(r.batch.idxs)
 	}
 
-	_, err = ch.conn.Do("EXEC")
-	if err != nil {
-		ch.logf(ctx, `dsmiddleware/rediscache.DeleteMulti: conn.Send("EXEC") err=%s`, err.Error())
-		return err
+	for _, node := range nodes {
+		ch.logf(ctx, `%s: node="%s" len=%d err=%s`, logPrefix, node, lens[node], errs[node].Error())
 	}
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	return errs[nodes[0]]
+}
 
-	return nil
+// Close closes the connections of Redis Cluster.
+func (ch *cacheHandler) Close() error {
+	return ch.connector.close()
 }
@@ -8,6 +8,7 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -15,6 +16,7 @@ import (
 	"github.com/gomodule/redigo/redis"
 	"go.mercari.io/datastore"
 	"go.mercari.io/datastore/dsmiddleware/dslog"
+	"go.mercari.io/datastore/dsmiddleware/noop"
 	"go.mercari.io/datastore/dsmiddleware/storagecache"
 	"go.mercari.io/datastore/internal/testutils"
 	"google.golang.org/api/iterator"
@@ -752,3 +754,808 @@ func TestRedisCache_MultiError(t *testing.T) {
 		t.Errorf("unexpected: %v", v)
 	}
 }
+
+func TestRedisCache_NegativeCache(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	rs, err := testutils.StartRedisServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	conn, err := redis.Dial("tcp", rs.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ch := New(
+		conn,
+		WithNegativeExpireDuration(30*time.Second),
+	)
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	key := client.NameKey("Data", "a", nil)
+
+	for i := 0; i < 2; i++ {
+		err = client.Get(ctx, key, &Data{})
+		if err != datastore.ErrNoSuchEntity {
+			t.Fatalf("unexpected: %v", err)
+		}
+	}
+	if v := ms.Calls("GetMultiWithoutTx"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// the tombstone has its own TTL.
+	pttl, err := redis.Int64(conn.Do("PTTL", "mercari:rediscache:"+key.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pttl <= 0 || int64(30*time.Second/time.Millisecond) < pttl {
+		t.Errorf("unexpected: %v", pttl)
+	}
+
+	// the tombstone is overwritten by Put.
+	_, err = client.Put(ctx, key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := &Data{}
+	err = client.Get(ctx, key, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := obj.Name; v != "a" {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := ms.Calls("GetMultiWithoutTx"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestRedisCache_Pool(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	rs, err := testutils.StartRedisServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	pool := &redis.Pool{
+		MaxIdle: 4,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", rs.Addr)
+		},
+	}
+	defer pool.Close()
+
+	ch := NewWithPool(pool)
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	const size = 10
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			keys := make([]datastore.Key, 0, size)
+			list := make([]*Data, 0, size)
+			for j := 0; j < size; j++ {
+				keys = append(keys, client.IDKey("Data", int64(i*size+j+1), nil))
+				list = append(list, &Data{Name: fmt.Sprintf("#%d", i*size+j+1)})
+			}
+			_, err := client.PutMulti(ctx, keys, list)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			list = make([]*Data, size)
+			err = client.GetMulti(ctx, keys, list)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for j, obj := range list {
+				if v := obj.Name; v != fmt.Sprintf("#%d", i*size+j+1) {
+					t.Errorf("unexpected: %v", v)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if v := ms.Calls("GetMultiWithoutTx"); v != 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := rs.Len(); v != 8*size {
+		t.Errorf("unexpected: %v", v)
+	}
+	// one MGET per GetMulti.
+	if v := rs.Calls("MGET"); v != 8 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := rs.Calls("SET"); v != 8*size {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestRedisCache_ConnFunc(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	rs, err := testutils.StartRedisServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	dialed := 0
+	ch := NewWithConnFunc(func(ctx context.Context) (redis.Conn, error) {
+		dialed++
+		return redis.DialContext(ctx, "tcp", rs.Addr)
+	})
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	key := client.NameKey("Data", "a", nil)
+	_, err = client.Put(ctx, key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Get(ctx, key, &Data{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Delete(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := dialed; v != 3 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := ms.Calls("GetMultiWithoutTx"); v != 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := rs.Len(); v != 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func startRedisCluster(t *testing.T) (*testutils.RedisServer, *testutils.RedisServer) {
+	rsA, err := testutils.StartRedisServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsB, err := testutils.StartRedisServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slots := []testutils.RedisSlotRange{
+		{Start: 0, End: 8191, Addr: rsA.Addr},
+		{Start: 8192, End: 16383, Addr: rsB.Addr},
+	}
+	rsA.SetClusterSlots(slots)
+	rsB.SetClusterSlots(slots)
+
+	return rsA, rsB
+}
+
+func dialRedis(ctx context.Context, addr string) (redis.Conn, error) {
+	return redis.DialContext(ctx, "tcp", addr)
+}
+
+func TestRedisCache_Cluster(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	rsA, rsB := startRedisCluster(t)
+	defer rsA.Close()
+	defer rsB.Close()
+
+	ch := NewCluster([]string{rsA.Addr}, dialRedis)
+	defer ch.Close()
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	const size = 20
+
+	keys := make([]datastore.Key, 0, size)
+	list := make([]*Data, 0, size)
+	for i := 1; i <= size; i++ {
+		keys = append(keys, client.IDKey("Data", int64(i), nil))
+		list = append(list, &Data{Name: fmt.Sprintf("#%d", i)})
+	}
+	_, err := client.PutMulti(ctx, keys, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the keys are split across the nodes.
+	if v := rsA.Len() + rsB.Len(); v != size {
+		t.Errorf("unexpected: %v", v)
+	}
+	if rsA.Len() == 0 || rsB.Len() == 0 {
+		t.Errorf("unexpected: %v, %v", rsA.Len(), rsB.Len())
+	}
+
+	list = make([]*Data, size)
+	err = client.GetMulti(ctx, keys, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx, obj := range list {
+		if v := obj.Name; v != fmt.Sprintf("#%d", idx+1) {
+			t.Errorf("unexpected: %v", v)
+		}
+	}
+	if v := ms.Calls("GetMultiWithoutTx"); v != 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	err = client.DeleteMulti(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := rsA.Len() + rsB.Len(); v != 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestRedisCache_ClusterMoved(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	rsA, rsB := startRedisCluster(t)
+	defer rsA.Close()
+	defer rsB.Close()
+
+	ch := NewCluster([]string{rsA.Addr, rsB.Addr}, dialRedis)
+	defer ch.Close()
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	// load the slots.
+	err := client.Get(ctx, client.IDKey("Data", 1, nil), &Data{})
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatal(err)
+	}
+
+	// all slots are moved to A.
+	slots := []testutils.RedisSlotRange{
+		{Start: 0, End: 16383, Addr: rsA.Addr},
+	}
+	rsA.SetClusterSlots(slots)
+	rsB.SetClusterSlots(slots)
+
+	const size = 10
+
+	keys := make([]datastore.Key, 0, size)
+	list := make([]*Data, 0, size)
+	for i := 1; i <= size; i++ {
+		keys = append(keys, client.IDKey("Data", int64(i), nil))
+		list = append(list, &Data{Name: fmt.Sprintf("#%d", i)})
+	}
+	_, err = client.PutMulti(ctx, keys, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := rsA.Len(); v != size {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := rsB.Len(); v != 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := rsA.Calls("CLUSTER"); v != 2 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestRedisCache_ClusterAsk(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	rsA, rsB := startRedisCluster(t)
+	defer rsA.Close()
+	defer rsB.Close()
+
+	// the slots of A are migrating to B.
+	rsA.SetMigratingSlots(&testutils.RedisSlotRange{Start: 0, End: 8191, Addr: rsB.Addr})
+	rsB.SetImportingSlots(&testutils.RedisSlotRange{Start: 0, End: 8191, Addr: rsA.Addr})
+
+	ch := NewCluster([]string{rsA.Addr}, dialRedis)
+	defer ch.Close()
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	const size = 20
+
+	keys := make([]datastore.Key, 0, size)
+	list := make([]*Data, 0, size)
+	for i := 1; i <= size; i++ {
+		keys = append(keys, client.IDKey("Data", int64(i), nil))
+		list = append(list, &Data{Name: fmt.Sprintf("#%d", i)})
+	}
+	_, err := client.PutMulti(ctx, keys, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the new keys are written to B with ASKING.
+	if v := rsA.Len(); v != 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := rsB.Len(); v != size {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := rsB.Calls("ASKING"); v == 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	list = make([]*Data, size)
+	err = client.GetMulti(ctx, keys, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := ms.Calls("GetMultiWithoutTx"); v != 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// ASK doesn't reload the slots.
+	if v := rsA.Calls("CLUSTER"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestRedisCache_ClusterNodeFailure(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	rsA, rsB := startRedisCluster(t)
+	defer rsA.Close()
+
+	var logs []string
+	var m sync.Mutex
+	logf := func(ctx context.Context, format string, args ...interface{}) {
+		m.Lock()
+		defer m.Unlock()
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+
+	ch := NewCluster([]string{rsA.Addr}, dialRedis, WithLogger(logf))
+	defer ch.Close()
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	const size = 20
+
+	keys := make([]datastore.Key, 0, size)
+	list := make([]*Data, 0, size)
+	for i := 1; i <= size; i++ {
+		keys = append(keys, client.IDKey("Data", int64(i), nil))
+		list = append(list, &Data{Name: fmt.Sprintf("#%d", i)})
+	}
+	_, err := client.PutMulti(ctx, keys, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lenA, lenB := rsA.Len(), rsB.Len()
+	if lenA == 0 || lenB == 0 {
+		t.Fatalf("unexpected: %v, %v", lenA, lenB)
+	}
+
+	// the keys of B are missed, and loaded from Datastore.
+	rsB.Close()
+
+	list = make([]*Data, size)
+	err = client.GetMulti(ctx, keys, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx, obj := range list {
+		if v := obj.Name; v != fmt.Sprintf("#%d", idx+1) {
+			t.Errorf("unexpected: %v", v)
+		}
+	}
+	if v := ms.Calls("GetMultiWithoutTx"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	found := false
+	for _, log := range logs {
+		if strings.HasPrefix(log, fmt.Sprintf(`dsmiddleware/rediscache.GetMulti: node="%s" len=%d err=`, rsB.Addr, lenB)) {
+			found = true
+		}
+		if strings.HasPrefix(log, "dsmiddleware/rediscache.GetMulti: hit=") {
+			if v := fmt.Sprintf("dsmiddleware/rediscache.GetMulti: hit=%d miss=%d", lenA, lenB); log != v {
+				t.Errorf("unexpected: %v", log)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("unexpected: %v", logs)
+	}
+}
+
+func TestRedisCache_Codec(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	rs, err := testutils.StartRedisServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	conn, err := redis.Dial("tcp", rs.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var logs []string
+	logf := func(ctx context.Context, format string, args ...interface{}) {
+		t.Logf(format, args...)
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+
+	gobCh := New(conn)
+	client.AppendMiddleware(gobCh)
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+		At   time.Time
+		Loc  datastore.GeoPoint
+		Ref  datastore.Key
+	}
+
+	key := client.IDKey("Data", 1, nil)
+	_, err = client.Put(ctx, key, &Data{
+		Name: "A",
+		At:   time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC),
+		Loc:  datastore.GeoPoint{Lat: 35.6, Lng: 139.7},
+		Ref:  client.NameKey("Ref", "r", key),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Get(ctx, key, &Data{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// switch the format, the entry of gob is a cache miss.
+	client.RemoveMiddleware(gobCh)
+	client.RemoveMiddleware(ms)
+	protoCh := New(conn, WithCodec(storagecache.NewProtoCodec()), WithLogger(logf))
+	client.AppendMiddleware(protoCh)
+	client.AppendMiddleware(ms)
+
+	for i := 0; i < 2; i++ {
+		obj := &Data{}
+		err = client.Get(ctx, key, obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := obj.Name; v != "A" {
+			t.Errorf("unexpected: %v", v)
+		}
+		if v := obj.At; !v.Equal(time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)) {
+			t.Errorf("unexpected: %v", v)
+		}
+		if v := obj.Loc; v != (datastore.GeoPoint{Lat: 35.6, Lng: 139.7}) {
+			t.Errorf("unexpected: %v", v)
+		}
+		if v := obj.Ref; v == nil || !v.Equal(client.NameKey("Ref", "r", key)) {
+			t.Errorf("unexpected: %v", v)
+		}
+	}
+
+	if v := ms.Calls("GetMultiWithoutTx"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+	b, ok := rs.Get("mercari:rediscache:" + key.Encode())
+	if !ok {
+		t.Fatal("cache not found")
+	}
+	if v := b[0]; v != 0xDC {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	expected := heredoc.Doc(`
+		dsmiddleware/rediscache.GetMulti: incoming len=1
+		dsmiddleware/rediscache.GetMulti: decode error key=/Data,1 err=dsmiddleware/storagecache: unknown cache format
+		dsmiddleware/rediscache.GetMulti: hit=0 miss=1
+		dsmiddleware/rediscache.SetMulti: incoming len=1
+		dsmiddleware/rediscache.SetMulti: len=1
+		dsmiddleware/rediscache.GetMulti: incoming len=1
+		dsmiddleware/rediscache.GetMulti: hit=1 miss=0
+	`)
+	if v := strings.Join(logs, "\n") + "\n"; v != expected {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestRedisCache_ExpiresAt(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	rs, err := testutils.StartRedisServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	conn, err := redis.Dial("tcp", rs.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// ExpiresAt is reported without WithEarlyRefresh, for the early refresh by tieredcache.
+	ch := New(conn, WithExpireDuration(time.Minute))
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	key := client.NameKey("Data", "a", nil)
+	_, err = client.Put(ctx, key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cis, err := ch.GetMulti(ctx, []datastore.Key{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cis[0] == nil {
+		t.Fatal("cache not found")
+	}
+	if v := time.Until(cis[0].ExpiresAt); v <= 50*time.Second || time.Minute < v {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := rs.Calls("PTTL"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+// writeDuringGet places the lock of the writer during GetMultiWithoutTx, as the concurrent write does.
+type writeDuringGet struct {
+	datastore.Middleware
+	s storagecache.LockStorage
+}
+
+func (m *writeDuringGet) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	if err := m.s.LockMulti(info.Context, keys); err != nil {
+		return err
+	}
+	return info.Next.GetMultiWithoutTx(info, keys, psList)
+}
+
+func TestRedisCache_LockProtocol(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	rs, err := testutils.StartRedisServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	conn, err := redis.Dial("tcp", rs.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ch := New(conn, WithLockProtocol(time.Minute))
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	key := client.NameKey("Data", "a", nil)
+	cacheKey := "mercari:rediscache:" + key.Encode()
+	_, err = client.Put(ctx, key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the writer releases the lock, and doesn't fill the cache.
+	if _, ok := rs.Get(cacheKey); ok {
+		t.Fatal("unexpected cache")
+	}
+	if v := rs.Calls("SET"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// the reader fills the cache by the compare-and-swap.
+	for i := 0; i < 2; i++ {
+		obj := &Data{}
+		err = client.Get(ctx, key, obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := obj.Name; v != "a" {
+			t.Errorf("unexpected: %v", v)
+		}
+	}
+	if v := ms.Calls("GetMultiWithoutTx"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := rs.Calls("EXEC"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if b, _ := rs.Get(cacheKey); storagecache.IsLockValue(b) {
+		t.Errorf("unexpected: %v", b)
+	}
+
+	// the lock of the writer is the cache miss, and the reader doesn't fill over it.
+	locker := ch.(storagecache.LockStorage)
+	err = locker.LockMulti(ctx, []datastore.Key{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		err = client.Get(ctx, key, &Data{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v := ms.Calls("GetMultiWithoutTx"); v != 3 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if b, _ := rs.Get(cacheKey); !storagecache.IsLockValue(b) {
+		t.Errorf("unexpected: %v", b)
+	}
+}
+
+// failingConn fails Send of the command once.
+type failingConn struct {
+	redis.Conn
+	cmd string
+}
+
+func (c *failingConn) Send(commandName string, args ...interface{}) error {
+	if commandName == c.cmd {
+		c.cmd = ""
+		return fmt.Errorf("failed to send %s", commandName)
+	}
+	return c.Conn.Send(commandName, args...)
+}
+
+func TestRedisCache_LockProtocolDiscard(t *testing.T) {
+	ctx, client, _ := testutils.SetupOnMemory()
+
+	rs, err := testutils.StartRedisServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	conn, err := redis.Dial("tcp", rs.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fc := &failingConn{Conn: conn}
+	ch := New(fc, WithLockProtocol(time.Minute)).(*cacheHandler)
+
+	key := client.NameKey("Data", "a", nil)
+	locks, err := ch.AddLockMulti(ctx, []datastore.Key{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// SET in MULTI fails, the shared connection leaves MULTI.
+	fc.cmd = "SET"
+	ci := &storagecache.CacheItem{Key: key, PropertyList: datastore.PropertyList{{Name: "Name", Value: "a"}}}
+	err = ch.CompareAndSwapMulti(ctx, []*storagecache.CacheItem{ci}, locks)
+	if err == nil {
+		t.Fatal("unexpected: nil")
+	}
+	if v := rs.Calls("DISCARD"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	err = ch.CompareAndSwapMulti(ctx, []*storagecache.CacheItem{ci}, locks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cis, err := ch.GetMulti(ctx, []datastore.Key{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cis[0] == nil {
+		t.Fatal("unexpected: nil")
+	}
+	if v := cis[0].PropertyList[0].Value; v != "a" {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestRedisCache_LockProtocolStaleRead(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	rs, err := testutils.StartRedisServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	conn, err := redis.Dial("tcp", rs.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var logs []string
+	logf := func(ctx context.Context, format string, args ...interface{}) {
+		t.Logf(format, args...)
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+
+	ch := New(conn, WithLockProtocol(0), WithLogger(logf))
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(&writeDuringGet{Middleware: noop.New(), s: ch.(storagecache.LockStorage)})
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	key := client.NameKey("Data", "a", nil)
+	_, err = client.Put(ctx, key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Get(ctx, key, &Data{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the write happens after the reader adds the lock, the reader must not fill the cache.
+	b, ok := rs.Get("mercari:rediscache:" + key.Encode())
+	if !ok || !storagecache.IsLockValue(b) {
+		t.Errorf("unexpected: %v", b)
+	}
+	if v := rs.Calls("EXEC"); v != 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := rs.Calls("UNWATCH"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := logs[len(logs)-1]; v != "dsmiddleware/rediscache.CompareAndSwapMulti: swapped=0 conflicted=1" {
+		t.Errorf("unexpected: %v", v)
+	}
+}
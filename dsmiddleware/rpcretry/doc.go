@@ -7,5 +7,29 @@ Non idempotency operations (Commit, Rollback, and Next) are not automatically re
 By default, it retries up to 3 times.
 First wait 100 milliseconds, then wait exponentially back off.
 This value can be changed by option.
+WithJitter randomizes the back off by the decorrelated jitter.
+
+PutMultiWithoutTx with incomplete keys is not idempotent too,
+the retry may create the duplicated entity. It is retried only with WithRetryIncompleteKeyPut.
+
+By default, the errors except for some gRPC codes documented as non retryable are retried.
+WithRetryCodes replaces the rule, and WithRetryErrors adds the errors to retry.
+
+WithRetryBudget throttles retries by the token bucket, retries don't multiply the load during the outage.
+
+The call with NoRetry of CallOption is tried only once.
+
+The policy of each Middleware method is specified by WithMethodOptions.
+WithMethodOptions panics if the name isn't a method that rpcretry retries, so the misspelled name is found early.
+
+	mw := rpcretry.New(
+		rpcretry.WithRetryLimit(3),
+		rpcretry.WithJitter(),
+		rpcretry.WithRetryBudget(100, 0.1),
+		rpcretry.WithMethodOptions("GetMultiWithoutTx",
+			rpcretry.WithRetryLimit(5),
+			rpcretry.WithRetryCodes(codes.Unavailable, codes.DeadlineExceeded),
+		),
+	)
 */
 package rpcretry // import "go.mercari.io/datastore/dsmiddleware/rpcretry"
@@ -12,6 +12,7 @@ var _ datastore.Middleware = &glitchEmulator{}
 type glitchEmulator struct {
 	raised   map[string]map[string]int // raised["PutMultiWithoutTx"]["Data/1"] = 1
 	errCount int
+	err      error // raised instead of the default error if not nil
 }
 
 func (gm *glitchEmulator) keysToString(keys []datastore.Key) string {
@@ -34,6 +35,9 @@ func (gm *glitchEmulator) raiseError(opName string, keys []datastore.Key) error
 	cnt := gm.raised[opName][keysStr]
 	if cnt != gm.errCount {
 		gm.raised[opName][keysStr] = cnt + 1
+		if gm.err != nil {
+			return gm.err
+		}
 		return fmt.Errorf("error by *glitchEmulator: %s, keys=%s", opName, keysStr)
 	}
 
@@ -2,7 +2,10 @@ package rpcretry
 
 import (
 	"context"
+	"fmt"
 	"time"
+
+	"google.golang.org/grpc/codes"
 )
 
 // WithRetryLimit provides retry limit when RPC failed.
@@ -49,6 +52,106 @@ func (w *withMaxDoublings) Apply(rh *retryHandler) {
 	rh.maxDoublings = w.maxDoublings
 }
 
+// WithJitter creates a RetryOption that randomizes the backoff by the decorrelated jitter.
+// The wait is chosen between min backoff duration and 3 times of the previous wait,
+// and it is capped by max backoff duration. WithMaxDoublings is ignored.
+func WithJitter() RetryOption {
+	return &withJitter{}
+}
+
+type withJitter struct{}
+
+func (w *withJitter) Apply(rh *retryHandler) {
+	rh.jitter = true
+}
+
+// WithRetryCodes specifies the gRPC codes to retry, it replaces the default rule.
+// The errors not from gRPC are treated as codes.Unknown.
+func WithRetryCodes(cs ...codes.Code) RetryOption {
+	return &withRetryCodes{cs}
+}
+
+type withRetryCodes struct{ cs []codes.Code }
+
+func (w *withRetryCodes) Apply(rh *retryHandler) {
+	rh.retryCodes = make(map[codes.Code]bool)
+	for _, c := range w.cs {
+		rh.retryCodes[c] = true
+	}
+}
+
+// WithRetryErrors specifies the errors to retry in addition to the codes.
+func WithRetryErrors(errs ...error) RetryOption {
+	return &withRetryErrors{errs}
+}
+
+type withRetryErrors struct{ errs []error }
+
+func (w *withRetryErrors) Apply(rh *retryHandler) {
+	rh.retryErrors = append(rh.retryErrors, w.errs...)
+}
+
+// WithRetryBudget creates a RetryOption that throttles retries by the token bucket shared by all methods.
+// Each retryable failure takes a token, and each success returns tokenRatio tokens up to maxTokens.
+// Retries are stopped while tokens are less than or equal to half of maxTokens,
+// so retries don't multiply the load during the outage.
+func WithRetryBudget(maxTokens, tokenRatio float64) RetryOption {
+	return &withRetryBudget{&retryBudget{maxTokens: maxTokens, tokenRatio: tokenRatio, tokens: maxTokens}}
+}
+
+type withRetryBudget struct{ budget *retryBudget }
+
+func (w *withRetryBudget) Apply(rh *retryHandler) {
+	rh.budget = w.budget
+}
+
+// WithRetryIncompleteKeyPut creates a RetryOption that retries PutMultiWithoutTx with incomplete keys.
+// It isn't idempotent, the retry may create the duplicated entity when the failed request was actually applied.
+func WithRetryIncompleteKeyPut() RetryOption {
+	return &withRetryIncompleteKeyPut{}
+}
+
+type withRetryIncompleteKeyPut struct{}
+
+func (w *withRetryIncompleteKeyPut) Apply(rh *retryHandler) {
+	rh.retryIncompleteKeyPut = true
+}
+
+// retryMethods are the Middleware methods that are retried.
+var retryMethods = map[string]bool{
+	"AllocateIDs":          true,
+	"PutMultiWithoutTx":    true,
+	"PutMultiWithTx":       true,
+	"GetMultiWithoutTx":    true,
+	"GetMultiWithTx":       true,
+	"DeleteMultiWithoutTx": true,
+	"DeleteMultiWithTx":    true,
+	"GetAll":               true,
+	"Count":                true,
+}
+
+// WithMethodOptions specifies the policy of the Middleware method, e.g. "GetMultiWithoutTx".
+// The policy inherits the other options, and opts override them.
+// It panics if method isn't the Middleware method that is retried.
+func WithMethodOptions(method string, opts ...RetryOption) RetryOption {
+	if !retryMethods[method] {
+		panic(fmt.Sprintf("dsmiddleware/rpcretry: unknown method '%s'", method))
+	}
+	return &withMethodOptions{method, opts}
+}
+
+type withMethodOptions struct {
+	method string
+	opts   []RetryOption
+}
+
+func (w *withMethodOptions) Apply(rh *retryHandler) {
+	if rh.methodOpts == nil {
+		rh.methodOpts = make(map[string][]RetryOption)
+	}
+	rh.methodOpts[w.method] = append(rh.methodOpts[w.method], w.opts...)
+}
+
 // WithLogger creates a ClientOption that uses the specified logger.
 func WithLogger(logf func(ctx context.Context, format string, args ...interface{})) RetryOption {
 	return &withLogger{logf}
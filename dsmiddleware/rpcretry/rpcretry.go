@@ -3,6 +3,8 @@ package rpcretry
 import (
 	"context"
 	"math"
+	"math/rand"
+	"sync"
 	"time"
 
 	"go.mercari.io/datastore"
@@ -24,15 +26,36 @@ func New(opts ...RetryOption) datastore.Middleware {
 		opt.Apply(rh)
 	}
 
+	// policies of methods inherit the options of the middleware.
+	if len(rh.methodOpts) != 0 {
+		rh.methods = make(map[string]*retryHandler)
+		for method, opts := range rh.methodOpts {
+			mrh := *rh
+			mrh.methodOpts = nil
+			for _, opt := range opts {
+				opt.Apply(&mrh)
+			}
+			rh.methods[method] = &mrh
+		}
+	}
+
 	return rh
 }
 
 type retryHandler struct {
-	retryLimit         int
-	minBackoffDuration time.Duration
-	maxBackoffDuration time.Duration
-	maxDoublings       int
-	logf               func(ctx context.Context, format string, args ...interface{})
+	retryLimit            int
+	minBackoffDuration    time.Duration
+	maxBackoffDuration    time.Duration
+	maxDoublings          int
+	jitter                bool
+	retryCodes            map[codes.Code]bool
+	retryErrors           []error
+	budget                *retryBudget
+	retryIncompleteKeyPut bool
+	logf                  func(ctx context.Context, format string, args ...interface{})
+
+	methodOpts map[string][]RetryOption
+	methods    map[string]*retryHandler
 }
 
 // A RetryOption is an retry option for a retry middleware.
@@ -40,6 +63,55 @@ type RetryOption interface {
 	Apply(*retryHandler)
 }
 
+// retryBudget is the token bucket that throttles retries.
+// Each retryable failure takes a token, each success returns tokenRatio tokens,
+// and retries are permitted while more than half of maxTokens remain.
+type retryBudget struct {
+	m          sync.Mutex
+	maxTokens  float64
+	tokenRatio float64
+	tokens     float64
+}
+
+func (b *retryBudget) success() {
+	if b == nil {
+		return
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.tokens = math.Min(b.maxTokens, b.tokens+b.tokenRatio)
+}
+
+func (b *retryBudget) failure() {
+	if b == nil {
+		return
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.tokens = math.Max(0, b.tokens-1)
+}
+
+func (b *retryBudget) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	return b.maxTokens/2 < b.tokens
+}
+
+// policy returns the retry policy of the method.
+func (rh *retryHandler) policy(method string) *retryHandler {
+	if mrh, ok := rh.methods[method]; ok {
+		return mrh
+	}
+
+	return rh
+}
+
 func (rh *retryHandler) waitDuration(retry int) time.Duration {
 	d := 10 * time.Millisecond
 	if 0 <= rh.minBackoffDuration {
@@ -63,48 +135,106 @@ func (rh *retryHandler) waitDuration(retry int) time.Duration {
 	return time.Duration(wait)
 }
 
-func (rh *retryHandler) try(ctx context.Context, logPrefix string, f func() error) {
+// jitterWaitDuration returns the wait duration by the decorrelated jitter.
+// prev is the previous wait duration, or minBackoffDuration for the first retry.
+// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+func (rh *retryHandler) jitterWaitDuration(prev time.Duration, int63n func(n int64) int64) time.Duration {
+	base := 10 * time.Millisecond
+	if 0 <= rh.minBackoffDuration {
+		base = rh.minBackoffDuration
+	}
+
+	wait := base
+	if upper := prev * 3; base < upper {
+		wait = base + time.Duration(int63n(int64(upper-base)))
+	}
+
+	if 0 < rh.maxBackoffDuration && rh.maxBackoffDuration < wait {
+		wait = rh.maxBackoffDuration
+	}
+
+	return wait
+}
+
+func (rh *retryHandler) retryable(err error, try int) bool {
+	if _, ok := err.(datastore.MultiError); ok {
+		// If MultiError returns, it should not be fixed even if it is retried
+		return false
+	}
+	for _, retryErr := range rh.retryErrors {
+		if err == retryErr {
+			return true
+		}
+	}
+	if err == context.DeadlineExceeded || err == context.Canceled {
+		// for appengine datastore
+		return false
+	}
+
+	code := status.Code(err)
+	if rh.retryCodes != nil {
+		return rh.retryCodes[code]
+	}
+	if code == codes.Unknown {
+		return true
+	}
+
+	// for cloud datastore
+	// https://cloud.google.com/datastore/docs/concepts/errors?hl=en#error_codes
+	switch code {
+	case codes.Aborted,
+		codes.AlreadyExists,
+		codes.FailedPrecondition,
+		codes.InvalidArgument,
+		codes.NotFound,
+		codes.PermissionDenied,
+		codes.Unauthenticated:
+		return false
+	case codes.Internal:
+		// Do not retry this request more than once.
+		return try == 1
+	case codes.Canceled:
+		// not documented. but this error occurred by requester parameter.
+		return false
+	default:
+		return true
+	}
+}
+
+func (rh *retryHandler) try(ctx context.Context, method string, f func() error) {
+	if datastore.CallOptionsFromContext(ctx).NoRetry {
+		_ = f()
+		return
+	}
+
+	rh = rh.policy(method)
+	logPrefix := "middleware/rpcretry." + method
+
 	try := 1
+	d := rh.minBackoffDuration
 	for {
 		err := f()
 		if err == nil {
+			rh.budget.success()
 			return
-		} else if _, ok := err.(datastore.MultiError); ok {
-			// If MultiError returns, it should not be fixed even if it is retried
-			return
-		} else if err == context.DeadlineExceeded || err == context.Canceled {
-			// for appengine datastore
+		} else if !rh.retryable(err, try) {
 			return
-		} else if code := status.Code(err); code != codes.Unknown {
-			// for cloud datastore
-			// https://cloud.google.com/datastore/docs/concepts/errors?hl=en#error_codes
-			switch code {
-			case codes.Aborted,
-				codes.AlreadyExists,
-				codes.FailedPrecondition,
-				codes.InvalidArgument,
-				codes.NotFound,
-				codes.PermissionDenied,
-				codes.Unauthenticated:
-				return
-			case codes.Internal:
-				if try != 1 {
-					// Do not retry this request more than once.
-					return
-				}
-			case codes.Canceled:
-				// not documented. but this error occurred by requester parameter.
-				return
-			default:
-				// retry
-			}
 		}
+		rh.budget.failure()
 
 		if rh.retryLimit <= try {
 			break
 		}
+		if !rh.budget.allow() {
+			rh.logf(ctx, "%s: err=%s, retry budget is exhausted", logPrefix, err.Error())
+			return
+		}
 
-		d := rh.waitDuration(try)
+		if rh.jitter {
+			d = rh.jitterWaitDuration(d, rand.Int63n)
+		} else {
+			d = rh.waitDuration(try)
+		}
 		rh.logf(ctx, "%s: err=%s, will be retry #%d after %s", logPrefix, err.Error(), try, d.String())
 		t := time.NewTimer(d)
 		select {
@@ -116,9 +246,21 @@ func (rh *retryHandler) try(ctx context.Context, logPrefix string, f func() erro
 	}
 }
 
+// hasIncompleteKey reports whether keys contain the incomplete key.
+// The put of it isn't idempotent, the retry may create the duplicated entity.
+func hasIncompleteKey(keys []datastore.Key) bool {
+	for _, key := range keys {
+		if key != nil && key.Incomplete() {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (rh *retryHandler) AllocateIDs(info *datastore.MiddlewareInfo, keys []datastore.Key) (retKeys []datastore.Key, retErr error) {
 	next := info.Next
-	rh.try(info.Context, "middleware/rpcretry.AllocateIDs", func() error {
+	rh.try(info.Context, "AllocateIDs", func() error {
 		retKeys, retErr = next.AllocateIDs(info, keys)
 		return retErr
 	})
@@ -127,7 +269,10 @@ func (rh *retryHandler) AllocateIDs(info *datastore.MiddlewareInfo, keys []datas
 
 func (rh *retryHandler) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) (retKeys []datastore.Key, retErr error) {
 	next := info.Next
-	rh.try(info.Context, "middleware/rpcretry.PutMultiWithoutTx", func() error {
+	if hasIncompleteKey(keys) && !rh.policy("PutMultiWithoutTx").retryIncompleteKeyPut {
+		return next.PutMultiWithoutTx(info, keys, psList)
+	}
+	rh.try(info.Context, "PutMultiWithoutTx", func() error {
 		retKeys, retErr = next.PutMultiWithoutTx(info, keys, psList)
 		return retErr
 	})
@@ -136,7 +281,7 @@ func (rh *retryHandler) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys [
 
 func (rh *retryHandler) PutMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) (retPKeys []datastore.PendingKey, retErr error) {
 	next := info.Next
-	rh.try(info.Context, "middleware/rpcretry.PutMultiWithTx", func() error {
+	rh.try(info.Context, "PutMultiWithTx", func() error {
 		retPKeys, retErr = next.PutMultiWithTx(info, keys, psList)
 		return retErr
 	})
@@ -145,7 +290,7 @@ func (rh *retryHandler) PutMultiWithTx(info *datastore.MiddlewareInfo, keys []da
 
 func (rh *retryHandler) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) (retErr error) {
 	next := info.Next
-	rh.try(info.Context, "middleware/rpcretry.GetMultiWithoutTx", func() error {
+	rh.try(info.Context, "GetMultiWithoutTx", func() error {
 		retErr = next.GetMultiWithoutTx(info, keys, psList)
 		return retErr
 	})
@@ -154,7 +299,7 @@ func (rh *retryHandler) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys [
 
 func (rh *retryHandler) GetMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) (retErr error) {
 	next := info.Next
-	rh.try(info.Context, "middleware/rpcretry.GetMultiWithTx", func() error {
+	rh.try(info.Context, "GetMultiWithTx", func() error {
 		retErr = next.GetMultiWithTx(info, keys, psList)
 		return retErr
 	})
@@ -163,7 +308,7 @@ func (rh *retryHandler) GetMultiWithTx(info *datastore.MiddlewareInfo, keys []da
 
 func (rh *retryHandler) DeleteMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key) (retErr error) {
 	next := info.Next
-	rh.try(info.Context, "middleware/rpcretry.DeleteMultiWithoutTx", func() error {
+	rh.try(info.Context, "DeleteMultiWithoutTx", func() error {
 		retErr = next.DeleteMultiWithoutTx(info, keys)
 		return retErr
 	})
@@ -172,7 +317,7 @@ func (rh *retryHandler) DeleteMultiWithoutTx(info *datastore.MiddlewareInfo, key
 
 func (rh *retryHandler) DeleteMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key) (retErr error) {
 	next := info.Next
-	rh.try(info.Context, "middleware/rpcretry.DeleteMultiWithTx", func() error {
+	rh.try(info.Context, "DeleteMultiWithTx", func() error {
 		retErr = next.DeleteMultiWithTx(info, keys)
 		return retErr
 	})
@@ -193,7 +338,7 @@ func (rh *retryHandler) Run(info *datastore.MiddlewareInfo, q datastore.Query, q
 
 func (rh *retryHandler) GetAll(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, psList *[]datastore.PropertyList) (retKeys []datastore.Key, retErr error) {
 	next := info.Next
-	rh.try(info.Context, "middleware/rpcretry.GetAll", func() error {
+	rh.try(info.Context, "GetAll", func() error {
 		retKeys, retErr = next.GetAll(info, q, qDump, psList)
 		return retErr
 	})
@@ -207,7 +352,7 @@ func (rh *retryHandler) Next(info *datastore.MiddlewareInfo, q datastore.Query,
 
 func (rh *retryHandler) Count(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) (retCnt int, retErr error) {
 	next := info.Next
-	rh.try(info.Context, "middleware/rpcretry.Count", func() error {
+	rh.try(info.Context, "Count", func() error {
 		retCnt, retErr = next.Count(info, q, qDump)
 		return retErr
 	})
@@ -3,6 +3,7 @@ package rpcretry
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"regexp"
 	"strings"
@@ -14,6 +15,8 @@ import (
 	"go.mercari.io/datastore/dsmiddleware/dslog"
 	"go.mercari.io/datastore/internal/testutils"
 	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestRPCRetry_waitDuration(t *testing.T) {
@@ -794,3 +797,260 @@ func TestRPCRetry_Count(t *testing.T) {
 		t.Errorf("unexpected: %v", v)
 	}
 }
+
+func TestRPCRetry_jitterWaitDuration(t *testing.T) {
+	rh := &retryHandler{
+		minBackoffDuration: 10 * time.Millisecond,
+		maxBackoffDuration: 50 * time.Millisecond,
+	}
+	half := func(n int64) int64 { return n / 2 }
+
+	expectedList := []time.Duration{
+		20 * time.Millisecond, 35 * time.Millisecond, 50 * time.Millisecond,
+	}
+	d := rh.minBackoffDuration
+	for idx, expected := range expectedList {
+		d = rh.jitterWaitDuration(d, half)
+		if d != expected {
+			t.Errorf("#%d expected: %d, actual: %d", idx+1, expected, d)
+		}
+	}
+
+	// the wait is never less than min backoff duration.
+	zero := func(n int64) int64 { return 0 }
+	if v := rh.jitterWaitDuration(40*time.Millisecond, zero); v != rh.minBackoffDuration {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func setupOnMemoryRetry(t *testing.T, gm *glitchEmulator, opts ...RetryOption) (context.Context, datastore.Client, *testutils.OnMemoryDatastore, *[]string) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	var logs []string
+	logf := func(ctx context.Context, format string, args ...interface{}) {
+		t.Logf(format, args...)
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+
+	opts = append([]RetryOption{WithLogger(logf), WithMinBackoffDuration(1)}, opts...)
+	client.AppendMiddleware(New(opts...))
+	client.AppendMiddleware(gm)
+	client.AppendMiddleware(ms)
+
+	return ctx, client, ms, &logs
+}
+
+func TestRPCRetry_MethodOptions(t *testing.T) {
+	gm := &glitchEmulator{errCount: 3}
+	ctx, client, _, logs := setupOnMemoryRetry(t, gm,
+		WithRetryLimit(2),
+		WithMethodOptions("GetMultiWithoutTx", WithRetryLimit(4)),
+	)
+
+	type Data struct {
+		Name string
+	}
+
+	key := client.NameKey("Data", "a", nil)
+	_, err := client.Put(ctx, key, &Data{Name: "a"})
+	if err == nil {
+		t.Fatal("unexpected: nil")
+	}
+
+	err = client.Get(ctx, key, &Data{})
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("unexpected: %v", err)
+	}
+
+	expected := heredoc.Doc(`
+		## Put
+		middleware/rpcretry.PutMultiWithoutTx: err=error by *glitchEmulator: PutMultiWithoutTx, keys=/Data,a, will be retry #1 after 1ns
+		## Get
+		middleware/rpcretry.GetMultiWithoutTx: err=error by *glitchEmulator: GetMultiWithoutTx, keys=/Data,a, will be retry #1 after 1ns
+		middleware/rpcretry.GetMultiWithoutTx: err=error by *glitchEmulator: GetMultiWithoutTx, keys=/Data,a, will be retry #2 after 2ns
+		middleware/rpcretry.GetMultiWithoutTx: err=error by *glitchEmulator: GetMultiWithoutTx, keys=/Data,a, will be retry #3 after 4ns
+	`)
+	// strip `## FooBar` comment line
+	expected = regexp.MustCompile("(?m)^##.*\n").ReplaceAllString(expected, "")
+
+	if v := strings.Join(*logs, "\n") + "\n"; v != expected {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// the misspelled method isn't ignored silently.
+	func() {
+		defer func() {
+			if err := recover(); err == nil {
+				t.Error("unexpected: nil")
+			}
+		}()
+		WithMethodOptions("GetMultiWithoutTX", WithRetryLimit(4))
+	}()
+}
+
+func TestRPCRetry_RetryCodes(t *testing.T) {
+	errSentinel := errors.New("sentinel")
+
+	gm := &glitchEmulator{errCount: 1}
+	ctx, client, _, logs := setupOnMemoryRetry(t, gm,
+		WithRetryCodes(codes.Unavailable),
+		WithRetryErrors(errSentinel),
+	)
+
+	type Data struct {
+		Name string
+	}
+
+	// retryable code.
+	gm.err = status.Error(codes.Unavailable, "unavailable")
+	_, err := client.Put(ctx, client.NameKey("Data", "a", nil), &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// retryable error.
+	gm.err = errSentinel
+	_, err = client.Put(ctx, client.NameKey("Data", "b", nil), &Data{Name: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Internal and errors not from gRPC aren't in the codes.
+	gm.err = status.Error(codes.Internal, "internal")
+	_, err = client.Put(ctx, client.NameKey("Data", "c", nil), &Data{Name: "c"})
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("unexpected: %v", err)
+	}
+	gm.err = nil
+	_, err = client.Put(ctx, client.NameKey("Data", "d", nil), &Data{Name: "d"})
+	if err == nil {
+		t.Fatal("unexpected: nil")
+	}
+
+	expected := heredoc.Doc(`
+		middleware/rpcretry.PutMultiWithoutTx: err=rpc error: code = Unavailable desc = unavailable, will be retry #1 after 1ns
+		middleware/rpcretry.PutMultiWithoutTx: err=sentinel, will be retry #1 after 1ns
+	`)
+
+	if v := strings.Join(*logs, "\n") + "\n"; v != expected {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestRPCRetry_RetryBudget(t *testing.T) {
+	gm := &glitchEmulator{errCount: 100}
+	ctx, client, _, logs := setupOnMemoryRetry(t, gm,
+		WithRetryLimit(3),
+		WithRetryBudget(4, 1),
+	)
+
+	type Data struct {
+		Name string
+	}
+
+	// 4 tokens -> 3 tokens, retry -> 2 tokens, stop.
+	_, err := client.Put(ctx, client.NameKey("Data", "a", nil), &Data{Name: "a"})
+	if err == nil {
+		t.Fatal("unexpected: nil")
+	}
+	// 2 tokens -> 1 token, stop.
+	_, err = client.Put(ctx, client.NameKey("Data", "b", nil), &Data{Name: "b"})
+	if err == nil {
+		t.Fatal("unexpected: nil")
+	}
+
+	// successes return tokens.
+	gm.errCount = 0
+	for _, name := range []string{"c", "d"} {
+		_, err = client.Put(ctx, client.NameKey("Data", name, nil), &Data{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 3 tokens -> 2 tokens, stop. the budget is shared by methods.
+	gm.errCount = 100
+	err = client.Get(ctx, client.NameKey("Data", "c", nil), &Data{})
+	if err == nil {
+		t.Fatal("unexpected: nil")
+	}
+
+	expected := heredoc.Doc(`
+		## a
+		middleware/rpcretry.PutMultiWithoutTx: err=error by *glitchEmulator: PutMultiWithoutTx, keys=/Data,a, will be retry #1 after 1ns
+		middleware/rpcretry.PutMultiWithoutTx: err=error by *glitchEmulator: PutMultiWithoutTx, keys=/Data,a, retry budget is exhausted
+		## b
+		middleware/rpcretry.PutMultiWithoutTx: err=error by *glitchEmulator: PutMultiWithoutTx, keys=/Data,b, retry budget is exhausted
+		## c
+		middleware/rpcretry.GetMultiWithoutTx: err=error by *glitchEmulator: GetMultiWithoutTx, keys=/Data,c, retry budget is exhausted
+	`)
+	// strip `## FooBar` comment line
+	expected = regexp.MustCompile("(?m)^##.*\n").ReplaceAllString(expected, "")
+
+	if v := strings.Join(*logs, "\n") + "\n"; v != expected {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestRPCRetry_IncompleteKeyPut(t *testing.T) {
+	type Data struct {
+		Name string
+	}
+
+	{ // not retried by default.
+		gm := &glitchEmulator{errCount: 1}
+		ctx, client, ms, logs := setupOnMemoryRetry(t, gm)
+
+		_, err := client.Put(ctx, client.IncompleteKey("Data", nil), &Data{Name: "a"})
+		if err == nil {
+			t.Fatal("unexpected: nil")
+		}
+		if v := len(*logs); v != 0 {
+			t.Errorf("unexpected: %v", *logs)
+		}
+		if v := ms.Len(); v != 0 {
+			t.Errorf("unexpected: %v", v)
+		}
+	}
+	{ // opt in.
+		gm := &glitchEmulator{errCount: 1}
+		ctx, client, ms, logs := setupOnMemoryRetry(t, gm, WithRetryIncompleteKeyPut())
+
+		_, err := client.Put(ctx, client.IncompleteKey("Data", nil), &Data{Name: "a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := len(*logs); v != 1 {
+			t.Errorf("unexpected: %v", *logs)
+		}
+		if v := ms.Len(); v != 1 {
+			t.Errorf("unexpected: %v", v)
+		}
+	}
+}
+
+func TestRPCRetry_NoRetry(t *testing.T) {
+	gm := &glitchEmulator{errCount: 1}
+	ctx, client, _, logs := setupOnMemoryRetry(t, gm)
+
+	type Data struct {
+		Name string
+	}
+
+	_, err := client.Put(datastore.WithCallOptions(ctx, datastore.NoRetry()), client.NameKey("Data", "a", nil), &Data{Name: "a"})
+	if err == nil {
+		t.Fatal("unexpected: nil")
+	}
+	if v := len(*logs); v != 0 {
+		t.Errorf("unexpected: %v", *logs)
+	}
+
+	// the other calls are retried.
+	_, err = client.Put(ctx, client.NameKey("Data", "b", nil), &Data{Name: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := len(*logs); v != 1 {
+		t.Errorf("unexpected: %v", *logs)
+	}
+}
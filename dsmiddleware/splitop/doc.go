@@ -8,5 +8,6 @@ DO
 * split GetMulti operation to under 1000 entity per one action.
   * > Maximum number of keys allowed for a Lookup operation in the Cloud Datastore API : 1,000
 
+The call with NoSplit of CallOption is passed as is.
 */
 package splitop // import "go.mercari.io/datastore/dsmiddleware/splitop"
@@ -42,7 +42,7 @@ func (sh *splitHandler) AllocateIDs(info *datastore.MiddlewareInfo, keys []datas
 
 func (sh *splitHandler) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.Key, error) {
 	sh.logf(info.Context, "put %d keys", len(keys))
-	if sh.putSplitThreshold <= 0 || len(keys) <= sh.putSplitThreshold {
+	if sh.putSplitThreshold <= 0 || len(keys) <= sh.putSplitThreshold || info.CallOptions().NoSplit {
 		return info.Next.PutMultiWithoutTx(info, keys, psList)
 	}
 
@@ -84,7 +84,7 @@ func (sh *splitHandler) PutMultiWithTx(info *datastore.MiddlewareInfo, keys []da
 
 func (sh *splitHandler) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
 	sh.logf(info.Context, "get %d keys", len(keys))
-	if sh.getSplitThreshold <= 0 || len(keys) <= sh.getSplitThreshold {
+	if sh.getSplitThreshold <= 0 || len(keys) <= sh.getSplitThreshold || info.CallOptions().NoSplit {
 		return info.Next.GetMultiWithoutTx(info, keys, psList)
 	}
 	for len(psList) < len(keys) {
@@ -225,3 +225,42 @@ func TestSplitOp_HasNoSuchEntity(t *testing.T) {
 		t.Errorf("unexpected: %v", v)
 	}
 }
+
+func TestSplitOp_NoSplit(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	client.AppendMiddleware(New(
+		WithGetSplitThreshold(3),
+		WithPutSplitThreshold(2),
+	))
+	client.AppendMiddleware(ms)
+
+	type Data struct {
+		Name string
+	}
+
+	var keys []datastore.Key
+	var list []*Data
+	for i := 1; i <= 5; i++ {
+		keys = append(keys, client.IDKey("Data", int64(i), nil))
+		list = append(list, &Data{Name: fmt.Sprintf("Data %d", i)})
+	}
+
+	ctx = datastore.WithCallOptions(ctx, datastore.NoSplit())
+	_, err := client.PutMulti(ctx, keys, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list = make([]*Data, len(keys))
+	err = client.GetMulti(ctx, keys, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := ms.Calls("PutMultiWithoutTx"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := ms.Calls("GetMultiWithoutTx"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
@@ -0,0 +1,77 @@
+package storagecache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+
+	"go.mercari.io/datastore"
+)
+
+// ErrUnknownFormat is returned by Codec.Decode when the bytes are not encoded by the Codec.
+// Storage should treat it as the cache miss.
+var ErrUnknownFormat = errors.New("dsmiddleware/storagecache: unknown cache format")
+
+// Codec serializes CacheItem for Storage that holds bytes.
+type Codec interface {
+	Encode(ci *CacheItem) ([]byte, error)
+	// Decode restores CacheItem of the key.
+	Decode(key datastore.Key, b []byte) (*CacheItem, error)
+}
+
+// formatMagic is the first byte of the versioned format.
+// The gob stream never starts with it, so the formats are distinguishable.
+const formatMagic = 0xDC
+
+// gobTombstone is stored instead of the gob encoded PropertyList when the entity doesn't exist.
+// The gob stream never starts with 0x00, so it isn't confused with any entity.
+var gobTombstone = []byte("\x00nosuchentity")
+
+var _ Codec = gobCodec{}
+
+// NewGobCodec returns Codec that encodes PropertyList by encoding/gob.
+// It is the format used by default, the types of Key must be registered to gob.
+func NewGobCodec() Codec {
+	return gobCodec{}
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Encode(ci *CacheItem) ([]byte, error) {
+	if ci.NoSuchEntity {
+		return gobTombstone, nil
+	}
+
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	err := enc.Encode(ci.PropertyList)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Decode(key datastore.Key, b []byte) (*CacheItem, error) {
+	if len(b) == 0 || b[0] == formatMagic {
+		return nil, ErrUnknownFormat
+	}
+	if bytes.Equal(b, gobTombstone) {
+		return &CacheItem{
+			Key:          key,
+			NoSuchEntity: true,
+		}, nil
+	}
+
+	dec := gob.NewDecoder(bytes.NewBuffer(b))
+	var ps datastore.PropertyList
+	err := dec.Decode(&ps)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CacheItem{
+		Key:          key,
+		PropertyList: ps,
+	}, nil
+}
@@ -0,0 +1,216 @@
+package storagecache
+
+import (
+	"testing"
+	"time"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/internal/testutils"
+)
+
+func codecTestItem(client datastore.Client) *CacheItem {
+	key := client.NameKey("Data", "a", nil)
+	refKey := client.IDKey("Ref", 1, client.NameKey("Parent", "p", nil))
+
+	return &CacheItem{
+		Key: key,
+		PropertyList: datastore.PropertyList{
+			{Name: "Null", Value: nil},
+			{Name: "Int", Value: int64(-42)},
+			{Name: "Bool", Value: true},
+			{Name: "Str", Value: "hi"},
+			{Name: "Float", Value: 3.5},
+			{Name: "Key", Value: refKey},
+			{Name: "Time", Value: time.Date(2018, 1, 2, 3, 4, 5, 6000, time.UTC)},
+			{Name: "Geo", Value: datastore.GeoPoint{Lat: 35.6, Lng: 139.7}},
+			{Name: "Bytes", Value: []byte("raw"), NoIndex: true},
+			{Name: "Entity", Value: &datastore.Entity{
+				Properties: []datastore.Property{
+					{Name: "Inner", Value: "value"},
+				},
+			}},
+			{Name: "Array", Value: []interface{}{int64(1), "two", nil}},
+		},
+	}
+}
+
+func TestCodec_RoundTrip(t *testing.T) {
+	_, client, _ := testutils.SetupOnMemory()
+
+	for _, c := range []struct {
+		name  string
+		codec Codec
+	}{
+		{"gob", NewGobCodec()},
+		{"proto", NewProtoCodec()},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ci := codecTestItem(client)
+
+			b, err := c.codec.Encode(ci)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := c.codec.Decode(ci.Key, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !got.Key.Equal(ci.Key) {
+				t.Errorf("unexpected key: %v", got.Key)
+			}
+			if v := len(got.PropertyList); v != len(ci.PropertyList) {
+				t.Fatalf("unexpected: %v", v)
+			}
+			ps := got.PropertyList
+
+			if v := ps[0].Value; v != nil {
+				t.Errorf("unexpected: %v", v)
+			}
+			if v := ps[1].Value; v != int64(-42) {
+				t.Errorf("unexpected: %v", v)
+			}
+			if v := ps[2].Value; v != true {
+				t.Errorf("unexpected: %v", v)
+			}
+			if v := ps[3].Value; v != "hi" {
+				t.Errorf("unexpected: %v", v)
+			}
+			if v := ps[4].Value; v != 3.5 {
+				t.Errorf("unexpected: %v", v)
+			}
+			if v, ok := ps[5].Value.(datastore.Key); !ok || !v.Equal(ci.PropertyList[5].Value.(datastore.Key)) {
+				t.Errorf("unexpected: %v", ps[5].Value)
+			}
+			if v, ok := ps[6].Value.(time.Time); !ok || !v.Equal(ci.PropertyList[6].Value.(time.Time)) {
+				t.Errorf("unexpected: %v", ps[6].Value)
+			}
+			if v := ps[7].Value; v != (datastore.GeoPoint{Lat: 35.6, Lng: 139.7}) {
+				t.Errorf("unexpected: %v", v)
+			}
+			if v, ok := ps[8].Value.([]byte); !ok || string(v) != "raw" {
+				t.Errorf("unexpected: %v", ps[8].Value)
+			}
+			if v := ps[8].NoIndex; !v {
+				t.Errorf("unexpected: %v", v)
+			}
+			if e, ok := ps[9].Value.(*datastore.Entity); !ok {
+				t.Errorf("unexpected: %v", ps[9].Value)
+			} else {
+				if v := len(e.Properties); v != 1 {
+					t.Fatalf("unexpected: %v", v)
+				}
+				if v := e.Properties[0]; v.Name != "Inner" || v.Value != "value" {
+					t.Errorf("unexpected: %v", v)
+				}
+			}
+			if vs, ok := ps[10].Value.([]interface{}); !ok || len(vs) != 3 {
+				t.Errorf("unexpected: %v", ps[10].Value)
+			} else if vs[0] != int64(1) || vs[1] != "two" || vs[2] != nil {
+				t.Errorf("unexpected: %v", vs)
+			}
+		})
+	}
+}
+
+func TestProtoCodec_EntityKey(t *testing.T) {
+	_, client, _ := testutils.SetupOnMemory()
+
+	// gob can't restore the key of the nested entity.
+	key := client.NameKey("Data", "a", nil)
+	refKey := client.IDKey("Ref", 1, key)
+	ci := &CacheItem{
+		Key: key,
+		PropertyList: datastore.PropertyList{
+			{Name: "Entity", Value: &datastore.Entity{Key: refKey}},
+		},
+	}
+
+	codec := NewProtoCodec()
+	b, err := codec.Encode(ci)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := codec.Decode(key, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, ok := got.PropertyList[0].Value.(*datastore.Entity)
+	if !ok {
+		t.Fatalf("unexpected: %v", got.PropertyList[0].Value)
+	}
+	if !e.Key.Equal(refKey) {
+		t.Errorf("unexpected: %v", e.Key)
+	}
+	if v := e.Key.ParentKey(); v == nil || !v.Equal(key) {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestCodec_NoSuchEntity(t *testing.T) {
+	_, client, _ := testutils.SetupOnMemory()
+
+	key := client.NameKey("Data", "a", nil)
+
+	for _, codec := range []Codec{NewGobCodec(), NewProtoCodec()} {
+		b, err := codec.Encode(&CacheItem{Key: key, NoSuchEntity: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ci, err := codec.Decode(key, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ci.NoSuchEntity {
+			t.Errorf("unexpected: %v", ci.NoSuchEntity)
+		}
+		if v := len(ci.PropertyList); v != 0 {
+			t.Errorf("unexpected: %v", v)
+		}
+	}
+}
+
+func TestCodec_UnknownFormat(t *testing.T) {
+	_, client, _ := testutils.SetupOnMemory()
+
+	ci := codecTestItem(client)
+	gobCodec := NewGobCodec()
+	protoCodec := NewProtoCodec()
+
+	gobBytes, err := gobCodec.Encode(ci)
+	if err != nil {
+		t.Fatal(err)
+	}
+	protoBytes, err := protoCodec.Encode(ci)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := protoCodec.Decode(ci.Key, gobBytes); err != ErrUnknownFormat {
+		t.Errorf("unexpected: %v", err)
+	}
+	if _, err := gobCodec.Decode(ci.Key, protoBytes); err != ErrUnknownFormat {
+		t.Errorf("unexpected: %v", err)
+	}
+
+	// the future version.
+	protoBytes[1]++
+	if _, err := protoCodec.Decode(ci.Key, protoBytes); err != ErrUnknownFormat {
+		t.Errorf("unexpected: %v", err)
+	}
+}
+
+func TestCodec_UnsupportedType(t *testing.T) {
+	_, client, _ := testutils.SetupOnMemory()
+
+	ci := &CacheItem{
+		Key: client.NameKey("Data", "a", nil),
+		PropertyList: datastore.PropertyList{
+			{Name: "Int", Value: 1},
+		},
+	}
+	if _, err := NewProtoCodec().Encode(ci); err == nil {
+		t.Error("error expected")
+	}
+}
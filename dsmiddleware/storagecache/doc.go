@@ -14,6 +14,37 @@ delete all caches related to the Key recorded when committed.
 For now, no caching is made for the Entity that returned from the query.
 If you want to cache it, there is a way to query with KeysOnly first, and exec GetMulti next.
 
+With Options.NegativeCache, ErrNoSuchEntity of Get is also cached as the tombstone.
+The tombstone is overwritten by Put, and deleted by Delete or the commit of the transaction, the same as the Entity.
+Each storage has its own option to specify the expiration of the tombstone, it should be shorter than the Entity's.
+
+The storages that hold bytes serialize CacheItem by Codec.
+NewGobCodec is the default and compatible with the existing caches.
+NewProtoCodec is the compact format by the protocol buffers wire format, it starts with the format version.
+The entry that the Codec can't recognize, e.g. written by the other Codec or the other version, is treated as the cache miss,
+so the format can be switched without flushing the storage.
+
+With Options.Coalesce, the concurrent cache misses of the same key share one GetMultiWithoutTx to Datastore.
+The other requests wait for it and receive the same result, including the error.
+If the context of the request that fetches is canceled or exceeds the deadline, the others fetch by themselves.
+With Options.EarlyRefreshBeta, the hit entity is refreshed in the background before it expires,
+by the probabilistic early expiration that depends on the time to fetch from Datastore.
+It requires the storage that reports CacheItem.ExpiresAt, localcache and rediscache do it.
+dsmemcache and aememcache don't, memcache has no command to get the expiration, so the early refresh never happens with them.
+
+The entity read before Put or Delete may be stored to the cache after the write, and remains stale until it expires.
+With Options.LockProtocol and LockStorage, the writer places the lock before the write and deletes it after the write,
+the writes in the transaction are locked until the commit or the rollback.
+The reader places its own lock by add before the read, and fills the cache by compare-and-swap only if its lock remains.
+So the reader that races with the writer never fills the cache, and the next reader fills it.
+The lock is treated as the cache miss. The lock should outlive the transaction, and the early refresh is disabled.
+dsmemcache, aememcache and rediscache implement LockStorage, their WithLockProtocol enables it.
+
+CallOption changes the behavior for each call.
+With SkipCache, Get reads Datastore without the cache, and Put deletes the cache instead of setting it.
+With StrongRead, Get reads Datastore and fills the cache by the result, without sharing the read by Coalesce.
+Under Options.LockProtocol, StrongRead can't overwrite the entity already cached, because the add of its lock fails.
+
 In all operations, the key target is determined by KeyFilter.
 In order to make consistency easy, we recommend using the same settings throughout the application.
 */
@@ -0,0 +1,180 @@
+package storagecache
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"go.mercari.io/datastore"
+)
+
+// flight is the fetch of an entity from Datastore in progress.
+// ps, err and fetchErr are available after done is closed.
+type flight struct {
+	encoded string
+	done    chan struct{}
+	ps      datastore.PropertyList
+	err     error
+	// fetchErr is the error of the whole fetch, canceled is true if it is caused by the context of the fetcher.
+	fetchErr error
+	canceled bool
+}
+
+// flightWait is the index of the key that waits for the flight started by the other request.
+type flightWait struct {
+	idx int
+	f   *flight
+}
+
+// joinFlights starts the flights of the target keys, or waits for them if they are already in flight.
+// It returns the keys to be fetched by the caller and their flights, nil for the keys that are not the target.
+func (ch *cacheHandler) joinFlights(ctx context.Context, idxList []int, keys []datastore.Key) ([]int, []datastore.Key, []*flight, []*flightWait) {
+	fetchIdxList := make([]int, 0, len(keys))
+	fetchKeys := make([]datastore.Key, 0, len(keys))
+	flights := make([]*flight, 0, len(keys))
+	var waits []*flightWait
+
+	ch.flightM.Lock()
+	defer ch.flightM.Unlock()
+
+	for i, key := range keys {
+		if !ch.target(ctx, key) {
+			fetchIdxList = append(fetchIdxList, idxList[i])
+			fetchKeys = append(fetchKeys, key)
+			flights = append(flights, nil)
+			continue
+		}
+
+		encoded := key.Encode()
+		if f, ok := ch.flights[encoded]; ok {
+			waits = append(waits, &flightWait{idx: idxList[i], f: f})
+			continue
+		}
+		f := &flight{encoded: encoded, done: make(chan struct{})}
+		ch.flights[encoded] = f
+		fetchIdxList = append(fetchIdxList, idxList[i])
+		fetchKeys = append(fetchKeys, key)
+		flights = append(flights, f)
+	}
+
+	return fetchIdxList, fetchKeys, flights, waits
+}
+
+// forgetFlights detaches the flights of the written keys, the later readers start the new flights.
+// The flights started before the write may return the old entities, only their waiters receive them.
+func (ch *cacheHandler) forgetFlights(keys []datastore.Key) {
+	if !ch.coalesce {
+		return
+	}
+
+	ch.flightM.Lock()
+	defer ch.flightM.Unlock()
+
+	for _, key := range keys {
+		if key == nil || key.Incomplete() {
+			continue
+		}
+		delete(ch.flights, key.Encode())
+	}
+}
+
+// landFlights publishes the results of the flights to the waiters.
+// If err is not nil, the fetch failed entirely and the waiters receive it,
+// unless ctx of the fetcher is done, then the waiters fetch the keys by themselves.
+func (ch *cacheHandler) landFlights(ctx context.Context, flights []*flight, idxList []int, psList []datastore.PropertyList, errs []error, err error) {
+	if len(flights) == 0 {
+		return
+	}
+
+	ch.flightM.Lock()
+	defer ch.flightM.Unlock()
+
+	for i, f := range flights {
+		if f == nil {
+			continue
+		}
+		if err != nil {
+			f.fetchErr = err
+			f.canceled = ctx.Err() != nil || err == context.Canceled || err == context.DeadlineExceeded
+		} else {
+			f.ps = psList[idxList[i]]
+			f.err = errs[idxList[i]]
+		}
+		if ch.flights[f.encoded] == f {
+			delete(ch.flights, f.encoded)
+		}
+		close(f.done)
+	}
+}
+
+// shouldRefresh decides whether the hit item is refreshed early, by the probabilistic early expiration.
+// The refresh happens when now + delta * beta * -log(rand) passes the expiration, delta is the time to fetch.
+func (ch *cacheHandler) shouldRefresh(ci *CacheItem) bool {
+	if ch.earlyRefreshBeta <= 0 || ci.ExpiresAt.IsZero() {
+		return false
+	}
+	delta := atomic.LoadInt64(&ch.fetchNanos)
+	if delta <= 0 {
+		return false
+	}
+
+	r := ch.random()
+	if r <= 0 {
+		return true
+	}
+	gap := time.Duration(float64(delta) * ch.earlyRefreshBeta * -math.Log(r))
+
+	return !ch.now().Add(gap).Before(ci.ExpiresAt)
+}
+
+// refresh fetches the keys from Datastore in background, and stores them to the cache.
+// The keys already in flight are skipped. next is info.Next before the fetch, the bridge updates it by the call.
+func (ch *cacheHandler) refresh(info *datastore.MiddlewareInfo, next datastore.Middleware, keys []datastore.Key) {
+	idxList := make([]int, len(keys))
+	for idx := range idxList {
+		idxList[idx] = idx
+	}
+	_, keys, flights, _ := ch.joinFlights(info.Context, idxList, keys)
+	if len(keys) == 0 {
+		return
+	}
+
+	// the request context may be canceled after the response.
+	bgInfo := *info
+	bgInfo.Context = info.Client.Context()
+	bgInfo.Next = next
+
+	go func() {
+		idxList := make([]int, len(keys))
+		for idx := range idxList {
+			idxList[idx] = idx
+		}
+		psList := make([]datastore.PropertyList, len(keys))
+		errs := make([]error, len(keys))
+
+		err := ch.fetch(&bgInfo, idxList, keys, psList, errs)
+		ch.landFlights(bgInfo.Context, flights, idxList, psList, errs, err)
+		if err != nil {
+			ch.logf(bgInfo.Context, "dsmiddleware/storagecache.GetMultiWithoutTx: error on refresh err=%s", err.Error())
+			return
+		}
+
+		if ch.negativeCache {
+			return
+		}
+		// the tombstone isn't stored, remove the deleted entities.
+		var deletedKeys []datastore.Key
+		for idx, err := range errs {
+			if err == datastore.ErrNoSuchEntity {
+				deletedKeys = append(deletedKeys, keys[idx])
+			}
+		}
+		if len(deletedKeys) != 0 {
+			err := ch.s.DeleteMulti(bgInfo.Context, deletedKeys)
+			if err != nil {
+				ch.logf(bgInfo.Context, "dsmiddleware/storagecache.GetMultiWithoutTx: error on storage.DeleteMulti err=%s", err.Error())
+			}
+		}
+	}()
+}
@@ -0,0 +1,123 @@
+package storagecache
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"go.mercari.io/datastore"
+)
+
+// LockStorage is Storage that supports the lock protocol enabled by Options.LockProtocol.
+//
+// The writer overwrites the keys by the lock values before the write to Datastore, and deletes them after it.
+// The reader adds its own lock value to the missed key before the read from Datastore,
+// and fills the cache only if the lock value is still there.
+// So the reader that read the entity before the write never fills the cache by it after the write.
+type LockStorage interface {
+	Storage
+	// LockMulti overwrites the keys by the lock values, they expire after the lock duration.
+	LockMulti(ctx context.Context, keys []datastore.Key) error
+	// AddLockMulti stores the new lock values only if the keys don't exist.
+	// It returns the slice of the same length as keys, the element is the stored lock value or nil if the key exists.
+	AddLockMulti(ctx context.Context, keys []datastore.Key) ([][]byte, error)
+	// CompareAndSwapMulti stores the items only if the keys still have the lock values returned by AddLockMulti.
+	CompareAndSwapMulti(ctx context.Context, cis []*CacheItem, locks [][]byte) error
+}
+
+// lockPrefix starts the lock values, the codecs never produce it.
+const lockPrefix = "\x00lock:"
+
+// NewLockValue returns the unique lock value for LockStorage.
+func NewLockValue() []byte {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return []byte(lockPrefix + hex.EncodeToString(b[:]))
+}
+
+// IsLockValue reports whether the bytes are the lock value, Storage.GetMulti should treat it as the cache miss.
+func IsLockValue(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(lockPrefix))
+}
+
+// lockKeys places the lock values of the writer to the target keys.
+// The error is logged, the write to Datastore is not blocked by the storage.
+func (ch *cacheHandler) lockKeys(ctx context.Context, keys []datastore.Key) {
+	if ch.locker == nil {
+		return
+	}
+
+	lockKeys := make([]datastore.Key, 0, len(keys))
+	for _, key := range keys {
+		if key.Incomplete() || !ch.target(ctx, key) {
+			continue
+		}
+		lockKeys = append(lockKeys, key)
+	}
+	if len(lockKeys) == 0 {
+		return
+	}
+
+	err := ch.locker.LockMulti(ctx, lockKeys)
+	if err != nil {
+		ch.logf(ctx, "dsmiddleware/storagecache: error on storage.LockMulti err=%s", err.Error())
+	}
+}
+
+// addLocks places the lock values of the reader to the target keys, and returns them by the encoded key.
+// The keys that already exist in the storage, the cached entities or the locks of the others, are not in the result.
+func (ch *cacheHandler) addLocks(ctx context.Context, keys []datastore.Key) map[string][]byte {
+	lockKeys := make([]datastore.Key, 0, len(keys))
+	for _, key := range keys {
+		if !ch.target(ctx, key) {
+			continue
+		}
+		lockKeys = append(lockKeys, key)
+	}
+	if len(lockKeys) == 0 {
+		return nil
+	}
+
+	values, err := ch.locker.AddLockMulti(ctx, lockKeys)
+	if err != nil {
+		ch.logf(ctx, "dsmiddleware/storagecache.GetMultiWithoutTx: error on storage.AddLockMulti err=%s", err.Error())
+		return nil
+	}
+
+	locks := make(map[string][]byte, len(lockKeys))
+	for idx, key := range lockKeys {
+		if values[idx] == nil {
+			continue
+		}
+		locks[key.Encode()] = values[idx]
+	}
+
+	return locks
+}
+
+// compareAndSwap fills the cache by the items that have the lock values of the reader.
+func (ch *cacheHandler) compareAndSwap(ctx context.Context, cis []*CacheItem, locks map[string][]byte) {
+	if len(cis) == 0 || len(locks) == 0 {
+		return
+	}
+
+	lockedCis := make([]*CacheItem, 0, len(cis))
+	values := make([][]byte, 0, len(cis))
+	for _, ci := range cis {
+		value, ok := locks[ci.Key.Encode()]
+		if !ok {
+			continue
+		}
+		lockedCis = append(lockedCis, ci)
+		values = append(values, value)
+	}
+	if len(lockedCis) == 0 {
+		return
+	}
+
+	err := ch.locker.CompareAndSwapMulti(ctx, lockedCis, values)
+	if err != nil {
+		ch.logf(ctx, "dsmiddleware/storagecache.GetMultiWithoutTx: error on storage.CompareAndSwapMulti err=%s", err.Error())
+	}
+}
@@ -0,0 +1,443 @@
+package storagecache
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+
+	"go.mercari.io/datastore"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protoFormatVersion is the version of the format by protoCodec.
+// Increment it when the format changes, the entries of other versions become the cache misses.
+const protoFormatVersion = 1
+
+// protoHeaderLen is the length of magic, version and flags.
+const protoHeaderLen = 3
+
+const (
+	protoFlagNoSuchEntity = 1 << iota
+)
+
+// field numbers of the messages.
+//
+//	Body:     repeated Property property = 1;
+//	Property: string name = 1; bool no_index = 2; Value fields;
+//	Value:    oneof { bool null = 3; sint64 int = 4; bool bool = 5; string string = 6; double double = 7;
+//	          string key = 8; bytes time = 9; GeoPoint geo_point = 10; bytes bytes = 11;
+//	          Entity entity = 12; Array array = 13; }
+//	GeoPoint: double lat = 1; double lng = 2;
+//	Entity:   string key = 1; repeated Property property = 2;
+//	Array:    repeated Value value = 1;
+const (
+	fieldBodyProperty    protowire.Number = 1
+	fieldPropertyName    protowire.Number = 1
+	fieldPropertyNoIndex protowire.Number = 2
+	fieldValueNull       protowire.Number = 3
+	fieldValueInt        protowire.Number = 4
+	fieldValueBool       protowire.Number = 5
+	fieldValueString     protowire.Number = 6
+	fieldValueDouble     protowire.Number = 7
+	fieldValueKey        protowire.Number = 8
+	fieldValueTime       protowire.Number = 9
+	fieldValueGeoPoint   protowire.Number = 10
+	fieldValueBytes      protowire.Number = 11
+	fieldValueEntity     protowire.Number = 12
+	fieldValueArray      protowire.Number = 13
+	fieldGeoPointLat     protowire.Number = 1
+	fieldGeoPointLng     protowire.Number = 2
+	fieldEntityKey       protowire.Number = 1
+	fieldEntityProperty  protowire.Number = 2
+	fieldArrayValue      protowire.Number = 1
+)
+
+var errBrokenProto = errors.New("dsmiddleware/storagecache: broken cache data")
+
+var _ Codec = protoCodec{}
+
+// NewProtoCodec returns Codec that encodes PropertyList by the protocol buffers wire format.
+// It is more compact and faster than gob, and doesn't depend on the type registration.
+// The data starts with the header that has the format version, the other versions are ErrUnknownFormat.
+func NewProtoCodec() Codec {
+	return protoCodec{}
+}
+
+type protoCodec struct{}
+
+func (protoCodec) Encode(ci *CacheItem) ([]byte, error) {
+	var flags byte
+	if ci.NoSuchEntity {
+		flags |= protoFlagNoSuchEntity
+	}
+	b := []byte{formatMagic, protoFormatVersion, flags}
+	if ci.NoSuchEntity {
+		return b, nil
+	}
+
+	return appendProperties(b, fieldBodyProperty, ci.PropertyList)
+}
+
+func (protoCodec) Decode(key datastore.Key, b []byte) (*CacheItem, error) {
+	if len(b) < protoHeaderLen || b[0] != formatMagic || b[1] != protoFormatVersion {
+		return nil, ErrUnknownFormat
+	}
+	if b[2]&protoFlagNoSuchEntity != 0 {
+		return &CacheItem{
+			Key:          key,
+			NoSuchEntity: true,
+		}, nil
+	}
+
+	d := &protoDecoder{keyType: reflect.TypeOf(key)}
+	ps, err := d.properties(b[protoHeaderLen:], fieldBodyProperty)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CacheItem{
+		Key:          key,
+		PropertyList: ps,
+	}, nil
+}
+
+func appendProperties(b []byte, num protowire.Number, ps []datastore.Property) ([]byte, error) {
+	for _, p := range ps {
+		var pb []byte
+		pb = protowire.AppendTag(pb, fieldPropertyName, protowire.BytesType)
+		pb = protowire.AppendString(pb, p.Name)
+		if p.NoIndex {
+			pb = protowire.AppendTag(pb, fieldPropertyNoIndex, protowire.VarintType)
+			pb = protowire.AppendVarint(pb, 1)
+		}
+		pb, err := appendValue(pb, p.Value)
+		if err != nil {
+			return nil, fmt.Errorf("dsmiddleware/storagecache: property %s: %s", p.Name, err.Error())
+		}
+
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, pb)
+	}
+
+	return b, nil
+}
+
+func appendValue(b []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		b = protowire.AppendTag(b, fieldValueNull, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	case int64:
+		b = protowire.AppendTag(b, fieldValueInt, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeZigZag(v))
+	case bool:
+		b = protowire.AppendTag(b, fieldValueBool, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+	case string:
+		b = protowire.AppendTag(b, fieldValueString, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	case float64:
+		b = protowire.AppendTag(b, fieldValueDouble, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(v))
+	case datastore.Key:
+		if reflect.ValueOf(v).IsNil() {
+			b = protowire.AppendTag(b, fieldValueNull, protowire.VarintType)
+			b = protowire.AppendVarint(b, 1)
+			break
+		}
+		b = protowire.AppendTag(b, fieldValueKey, protowire.BytesType)
+		b = protowire.AppendString(b, v.Encode())
+	case time.Time:
+		tb, err := v.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, fieldValueTime, protowire.BytesType)
+		b = protowire.AppendBytes(b, tb)
+	case datastore.GeoPoint:
+		var gb []byte
+		gb = protowire.AppendTag(gb, fieldGeoPointLat, protowire.Fixed64Type)
+		gb = protowire.AppendFixed64(gb, math.Float64bits(v.Lat))
+		gb = protowire.AppendTag(gb, fieldGeoPointLng, protowire.Fixed64Type)
+		gb = protowire.AppendFixed64(gb, math.Float64bits(v.Lng))
+		b = protowire.AppendTag(b, fieldValueGeoPoint, protowire.BytesType)
+		b = protowire.AppendBytes(b, gb)
+	case []byte:
+		b = protowire.AppendTag(b, fieldValueBytes, protowire.BytesType)
+		b = protowire.AppendBytes(b, v)
+	case *datastore.Entity:
+		if v == nil {
+			b = protowire.AppendTag(b, fieldValueNull, protowire.VarintType)
+			b = protowire.AppendVarint(b, 1)
+			break
+		}
+		var eb []byte
+		if v.Key != nil {
+			eb = protowire.AppendTag(eb, fieldEntityKey, protowire.BytesType)
+			eb = protowire.AppendString(eb, v.Key.Encode())
+		}
+		eb, err := appendProperties(eb, fieldEntityProperty, v.Properties)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, fieldValueEntity, protowire.BytesType)
+		b = protowire.AppendBytes(b, eb)
+	case []interface{}:
+		var ab []byte
+		for _, v := range v {
+			vb, err := appendValue(nil, v)
+			if err != nil {
+				return nil, err
+			}
+			ab = protowire.AppendTag(ab, fieldArrayValue, protowire.BytesType)
+			ab = protowire.AppendBytes(ab, vb)
+		}
+		b = protowire.AppendTag(b, fieldValueArray, protowire.BytesType)
+		b = protowire.AppendBytes(b, ab)
+	default:
+		return nil, fmt.Errorf("unsupported type %T", v)
+	}
+
+	return b, nil
+}
+
+// protoDecoder restores Key values by the same type as the key of CacheItem.
+type protoDecoder struct {
+	keyType reflect.Type
+}
+
+func (d *protoDecoder) key(encoded string) (datastore.Key, error) {
+	if d.keyType == nil || d.keyType.Kind() != reflect.Ptr {
+		return nil, fmt.Errorf("dsmiddleware/storagecache: can't restore key by %v", d.keyType)
+	}
+	key, ok := reflect.New(d.keyType.Elem()).Interface().(datastore.Key)
+	if !ok {
+		return nil, fmt.Errorf("dsmiddleware/storagecache: can't restore key by %v", d.keyType)
+	}
+	err := key.UnmarshalJSON([]byte(`"` + encoded + `"`))
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// fields calls f with each field of the message.
+func (d *protoDecoder) fields(b []byte, f func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(b) != 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errBrokenProto
+		}
+		b = b[n:]
+
+		n, err := f(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			// skip the unknown field.
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return errBrokenProto
+		}
+		b = b[n:]
+	}
+
+	return nil
+}
+
+func (d *protoDecoder) properties(b []byte, num protowire.Number) (datastore.PropertyList, error) {
+	var ps datastore.PropertyList
+	err := d.fields(b, func(fieldNum protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if fieldNum != num || typ != protowire.BytesType {
+			return 0, nil
+		}
+		pb, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		p, err := d.property(pb)
+		if err != nil {
+			return 0, err
+		}
+		ps = append(ps, p)
+		return n, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ps, nil
+}
+
+func (d *protoDecoder) property(b []byte) (datastore.Property, error) {
+	var p datastore.Property
+	err := d.fields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case fieldPropertyName:
+			v, n := protowire.ConsumeString(b)
+			p.Name = v
+			return n, nil
+		case fieldPropertyNoIndex:
+			v, n := protowire.ConsumeVarint(b)
+			p.NoIndex = protowire.DecodeBool(v)
+			return n, nil
+		}
+		return d.value(num, b, &p.Value)
+	})
+
+	return p, err
+}
+
+// value decodes the value field, it returns 0 if the field isn't the value.
+func (d *protoDecoder) value(num protowire.Number, b []byte, dst *interface{}) (int, error) {
+	switch num {
+	case fieldValueNull:
+		_, n := protowire.ConsumeVarint(b)
+		*dst = nil
+		return n, nil
+	case fieldValueInt:
+		v, n := protowire.ConsumeVarint(b)
+		*dst = protowire.DecodeZigZag(v)
+		return n, nil
+	case fieldValueBool:
+		v, n := protowire.ConsumeVarint(b)
+		*dst = protowire.DecodeBool(v)
+		return n, nil
+	case fieldValueString:
+		v, n := protowire.ConsumeString(b)
+		*dst = v
+		return n, nil
+	case fieldValueDouble:
+		v, n := protowire.ConsumeFixed64(b)
+		*dst = math.Float64frombits(v)
+		return n, nil
+	case fieldValueKey:
+		v, n := protowire.ConsumeString(b)
+		if n < 0 {
+			return n, nil
+		}
+		key, err := d.key(v)
+		if err != nil {
+			return 0, err
+		}
+		*dst = key
+		return n, nil
+	case fieldValueTime:
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		var t time.Time
+		err := t.UnmarshalBinary(v)
+		if err != nil {
+			return 0, err
+		}
+		*dst = t
+		return n, nil
+	case fieldValueGeoPoint:
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		var g datastore.GeoPoint
+		err := d.fields(v, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+			switch num {
+			case fieldGeoPointLat:
+				v, n := protowire.ConsumeFixed64(b)
+				g.Lat = math.Float64frombits(v)
+				return n, nil
+			case fieldGeoPointLng:
+				v, n := protowire.ConsumeFixed64(b)
+				g.Lng = math.Float64frombits(v)
+				return n, nil
+			}
+			return 0, nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		*dst = g
+		return n, nil
+	case fieldValueBytes:
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		*dst = append([]byte{}, v...)
+		return n, nil
+	case fieldValueEntity:
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		e := &datastore.Entity{}
+		err := d.fields(v, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+			switch num {
+			case fieldEntityKey:
+				v, n := protowire.ConsumeString(b)
+				if n < 0 {
+					return n, nil
+				}
+				key, err := d.key(v)
+				if err != nil {
+					return 0, err
+				}
+				e.Key = key
+				return n, nil
+			case fieldEntityProperty:
+				v, n := protowire.ConsumeBytes(b)
+				if n < 0 {
+					return n, nil
+				}
+				p, err := d.property(v)
+				if err != nil {
+					return 0, err
+				}
+				e.Properties = append(e.Properties, p)
+				return n, nil
+			}
+			return 0, nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		*dst = e
+		return n, nil
+	case fieldValueArray:
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		vs := make([]interface{}, 0)
+		err := d.fields(v, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+			if num != fieldArrayValue {
+				return 0, nil
+			}
+			vb, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			var elem interface{}
+			err := d.fields(vb, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+				return d.value(num, b, &elem)
+			})
+			if err != nil {
+				return 0, err
+			}
+			vs = append(vs, elem)
+			return n, nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		*dst = vs
+		return n, nil
+	}
+
+	return 0, nil
+}
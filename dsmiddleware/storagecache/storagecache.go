@@ -2,7 +2,10 @@ package storagecache
 
 import (
 	"context"
+	"math/rand"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.mercari.io/datastore"
 )
@@ -12,11 +15,21 @@ var _ datastore.Middleware = &cacheHandler{}
 // New storage cache (interface) middleware creates & returns.
 func New(s Storage, opts *Options) datastore.Middleware {
 	ch := &cacheHandler{
-		s: s,
+		s:       s,
+		flights: make(map[string]*flight),
+		now:     time.Now,
+		random:  rand.Float64,
 	}
 	if opts != nil {
 		ch.logf = opts.Logf
 		ch.filters = opts.Filters
+		ch.stats = opts.StatsRecorder
+		ch.negativeCache = opts.NegativeCache
+		ch.coalesce = opts.Coalesce
+		ch.earlyRefreshBeta = opts.EarlyRefreshBeta
+		if opts.LockProtocol {
+			ch.locker, _ = s.(LockStorage)
+		}
 	}
 
 	if ch.logf == nil {
@@ -28,8 +41,29 @@ func New(s Storage, opts *Options) datastore.Middleware {
 
 // Options provides common option values for storage.
 type Options struct {
-	Logf    func(ctx context.Context, format string, args ...interface{})
-	Filters []KeyFilter
+	Logf          func(ctx context.Context, format string, args ...interface{})
+	Filters       []KeyFilter
+	StatsRecorder StatsRecorder
+	// NegativeCache stores the tombstone when GetMultiWithoutTx returns ErrNoSuchEntity.
+	NegativeCache bool
+	// Coalesce makes the concurrent misses of the same key share one GetMultiWithoutTx.
+	// The misses after the write of the key don't share the fetch started before it.
+	Coalesce bool
+	// EarlyRefreshBeta enables the probabilistic early refresh if it is positive.
+	// The hit entry is refreshed in background with the probability that rises as CacheItem.ExpiresAt approaches.
+	// The probability is scaled by the time to fetch from Datastore and the beta, 1 is the standard and larger refreshes earlier.
+	EarlyRefreshBeta float64
+	// LockProtocol makes the writers lock the keys and the readers fill the cache by compare-and-swap, if Storage is LockStorage.
+	// The reader that read the entity before the write never fills the cache by it after the write.
+	// The early refresh is disabled, the entry is never overwritten until it is deleted.
+	LockProtocol bool
+}
+
+// StatsRecorder receives the result of the cache lookup.
+// The error of Storage.GetMulti is recorded as the misses.
+type StatsRecorder interface {
+	RecordHits(ctx context.Context, keys []datastore.Key)
+	RecordMisses(ctx context.Context, keys []datastore.Key)
 }
 
 // Storage is the abstraction of storage that holds the cache data.
@@ -47,9 +81,14 @@ type KeyFilter func(ctx context.Context, key datastore.Key) bool
 type contextTx struct{}
 
 // CacheItem is serialized by Storage.
+// If NoSuchEntity is true, the item is the tombstone of the entity that doesn't exist.
+// Storage should keep it distinguishable from the entity that has no properties.
+// ExpiresAt is set by Storage.GetMulti if the storage knows it, the zero value means unknown.
 type CacheItem struct {
 	Key          datastore.Key
 	PropertyList datastore.PropertyList
+	NoSuchEntity bool
+	ExpiresAt    time.Time
 }
 
 // txOps represents the type of operation in the transaction.
@@ -73,10 +112,23 @@ type txOpLog struct {
 }
 
 type cacheHandler struct {
-	s       Storage
-	m       sync.Mutex
-	logf    func(ctx context.Context, format string, args ...interface{})
-	filters []KeyFilter
+	s                Storage
+	locker           LockStorage
+	m                sync.Mutex
+	logf             func(ctx context.Context, format string, args ...interface{})
+	filters          []KeyFilter
+	stats            StatsRecorder
+	negativeCache    bool
+	coalesce         bool
+	earlyRefreshBeta float64
+
+	// flightM guards flights, the fetches from Datastore in progress by the encoded key.
+	flightM sync.Mutex
+	flights map[string]*flight
+	// fetchNanos is the last duration of GetMultiWithoutTx to Datastore, used by the early refresh.
+	fetchNanos int64
+	now        func() time.Time
+	random     func() float64
 }
 
 func (ch *cacheHandler) target(ctx context.Context, key datastore.Key) bool {
@@ -95,7 +147,11 @@ func (ch *cacheHandler) AllocateIDs(info *datastore.MiddlewareInfo, keys []datas
 }
 
 func (ch *cacheHandler) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.Key, error) {
+	ch.lockKeys(info.Context, keys)
+	ch.forgetFlights(keys)
+
 	keys, err := info.Next.PutMultiWithoutTx(info, keys, psList)
+	ch.forgetFlights(keys)
 	if err != nil {
 		return nil, err
 	}
@@ -116,6 +172,18 @@ func (ch *cacheHandler) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys [
 	if len(cis) == 0 {
 		return keys, nil
 	}
+	if ch.locker != nil || info.CallOptions().SkipCache {
+		// release the locks or invalidate the cache, the next reader fills the cache.
+		lockedKeys := make([]datastore.Key, 0, len(cis))
+		for _, ci := range cis {
+			lockedKeys = append(lockedKeys, ci.Key)
+		}
+		err = ch.s.DeleteMulti(info.Context, lockedKeys)
+		if err != nil {
+			ch.logf(info.Context, "dsmiddleware/storagecache.GetMultiWithoutTx: error on storage.DeleteMulti err=%s", err.Error())
+		}
+		return keys, nil
+	}
 	err = ch.s.SetMulti(info.Context, cis)
 	if err != nil {
 		ch.logf(info.Context, "dsmiddleware/storagecache.GetMultiWithoutTx: error on storage.SetMulti err=%s", err.Error())
@@ -125,6 +193,9 @@ func (ch *cacheHandler) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys [
 }
 
 func (ch *cacheHandler) PutMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.PendingKey, error) {
+	// the locks must be placed before the commit, don't pass txCtx to appengine.APICall
+	ch.lockKeys(info.Client.Context(), keys)
+
 	pKeys, err := info.Next.PutMultiWithTx(info, keys, psList)
 
 	ch.m.Lock()
@@ -166,13 +237,27 @@ func (ch *cacheHandler) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys [
 	// 1. psListをkeysと同じ長さまで伸長し、任意の場所にindexアクセスできるようにする
 	// 2. 全てのtargetであるkeysについてキャッシュに問い合わせをし、結果があった場合psListに代入する
 	// 3. キャッシュに無かったものを後段に問い合わせる 結果があった場合psListに代入し、次回のためにキャッシュにも入れる
+	//    ErrNoSuchEntityだった場合、NegativeCacheが有効ならtombstoneをキャッシュに入れる
+	//    Coalesceが有効なら、他のリクエストが取得中のKeyは問い合わせずにその結果を待つ
+	//    LockProtocolが有効なら、問い合わせの前にロックを置き、ロックが残っている場合だけキャッシュに入れる
+	// 4. EarlyRefreshBetaが有効なら、期限の近いキャッシュをバックグラウンドで取得し直す
+	// CallOptionsのSkipCacheが指定されていたら、キャッシュを使わずに後段に問い合わせる
+	// CallOptionsのStrongReadが指定されていたら、step 2を行わずに全て後段に問い合わせ、キャッシュを更新する
+
+	callOpts := info.CallOptions()
+	if callOpts.SkipCache {
+		return info.Next.GetMultiWithoutTx(info, keys, psList)
+	}
+	next := info.Next
 
 	// step 1
 	for len(psList) < len(keys) {
 		psList = append(psList, nil)
 	}
+	errs := make([]error, len(keys))
+	var refreshKeys []datastore.Key
 
-	{ // step 2
+	if !callOpts.StrongRead { // step 2
 		filteredIdxList := make([]int, 0, len(keys))
 		filteredKey := make([]datastore.Key, 0, len(keys))
 		for idx, key := range keys {
@@ -186,77 +271,166 @@ func (ch *cacheHandler) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys [
 			cis, err := ch.s.GetMulti(info.Context, filteredKey)
 			if err != nil {
 				ch.logf(info.Context, "dsmiddleware/storagecache.GetMultiWithoutTx: error on storage.GetMulti err=%s", err.Error())
+				if ch.stats != nil {
+					ch.stats.RecordMisses(info.Context, filteredKey)
+				}
 
 				return info.Next.GetMultiWithoutTx(info, keys, psList)
 			}
 
+			var hitKeys, missKeys []datastore.Key
 			for idx, ci := range cis {
-				if ci != nil {
+				if ci != nil && ch.shouldRefresh(ci) {
+					refreshKeys = append(refreshKeys, filteredKey[idx])
+				}
+				if ci != nil && ci.NoSuchEntity {
+					baseIdx := filteredIdxList[idx]
+					errs[baseIdx] = datastore.ErrNoSuchEntity
+					hitKeys = append(hitKeys, filteredKey[idx])
+				} else if ci != nil {
 					baseIdx := filteredIdxList[idx]
 					psList[baseIdx] = ci.PropertyList
+					hitKeys = append(hitKeys, filteredKey[idx])
+				} else {
+					missKeys = append(missKeys, filteredKey[idx])
+				}
+			}
+			if ch.stats != nil {
+				if len(hitKeys) != 0 {
+					ch.stats.RecordHits(info.Context, hitKeys)
+				}
+				if len(missKeys) != 0 {
+					ch.stats.RecordMisses(info.Context, missKeys)
 				}
 			}
 		}
 	}
 
-	var errs []error
 	{ // step 3
 		missingIdxList := make([]int, 0, len(keys))
 		missingKey := make([]datastore.Key, 0, len(keys))
 		for idx, ps := range psList {
-			if ps == nil {
+			if ps == nil && errs[idx] == nil {
 				missingIdxList = append(missingIdxList, idx)
 				missingKey = append(missingKey, keys[idx])
 			}
 		}
 
+		var flights []*flight
+		var waits []*flightWait
+		// the flights started before the call may not see the latest writes.
+		if ch.coalesce && !callOpts.StrongRead {
+			missingIdxList, missingKey, flights, waits = ch.joinFlights(info.Context, missingIdxList, missingKey)
+		}
+
 		if len(missingKey) != 0 {
-			cis := make([]*CacheItem, 0, len(missingKey))
-
-			missingPsList := make([]datastore.PropertyList, len(missingKey))
-			err := info.Next.GetMultiWithoutTx(info, missingKey, missingPsList)
-			if merr, ok := err.(datastore.MultiError); ok {
-				errs = make([]error, len(keys))
-				for idx, err := range merr {
-					baseIdx := missingIdxList[idx]
-					if err != nil {
-						errs[baseIdx] = err
-						continue
-					}
-					psList[baseIdx] = missingPsList[idx]
-					if ch.target(info.Context, missingKey[idx]) {
-						cis = append(cis, &CacheItem{
-							Key:          missingKey[idx],
-							PropertyList: missingPsList[idx],
-						})
-					}
-				}
-			} else if err != nil {
+			err := ch.fetch(info, missingIdxList, missingKey, psList, errs)
+			ch.landFlights(info.Context, flights, missingIdxList, psList, errs, err)
+			if err != nil {
 				return err
-			} else {
-				for idx := range missingKey {
-					baseIdx := missingIdxList[idx]
-					psList[baseIdx] = missingPsList[idx]
-					if ch.target(info.Context, missingKey[idx]) {
-						cis = append(cis, &CacheItem{
-							Key:          missingKey[idx],
-							PropertyList: missingPsList[idx],
-						})
-					}
-				}
 			}
+		}
 
-			if len(cis) != 0 {
-				err := ch.s.SetMulti(info.Context, cis)
-				if err != nil {
-					ch.logf(info.Context, "dsmiddleware/storagecache.GetMultiWithoutTx: error on storage.SetMulti err=%s", err.Error())
-				}
+		retryIdxList := make([]int, 0, len(waits))
+		retryKey := make([]datastore.Key, 0, len(waits))
+		for _, w := range waits {
+			select {
+			case <-w.f.done:
+			case <-info.Context.Done():
+				return info.Context.Err()
+			}
+			if w.f.canceled {
+				// the fetcher gave up by its own context, it doesn't mean the failure of this request.
+				retryIdxList = append(retryIdxList, w.idx)
+				retryKey = append(retryKey, keys[w.idx])
+				continue
+			} else if w.f.fetchErr != nil {
+				return w.f.fetchErr
+			} else if w.f.err != nil {
+				errs[w.idx] = w.f.err
+				continue
+			}
+			psList[w.idx] = append(datastore.PropertyList(nil), w.f.ps...)
+		}
+
+		if len(retryKey) != 0 {
+			err := ch.fetch(info, retryIdxList, retryKey, psList, errs)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if 0 < ch.earlyRefreshBeta && ch.locker == nil && len(refreshKeys) != 0 {
+		ch.refresh(info, next, refreshKeys)
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return datastore.MultiError(errs)
+		}
+	}
+
+	return nil
+}
+
+// fetch gets the entities of missingKey from the next middleware, and stores them to the cache.
+// The results are set to psList and errs at missingIdxList.
+func (ch *cacheHandler) fetch(info *datastore.MiddlewareInfo, missingIdxList []int, missingKey []datastore.Key, psList []datastore.PropertyList, errs []error) error {
+	cis := make([]*CacheItem, 0, len(missingKey))
+
+	var locks map[string][]byte
+	if ch.locker != nil {
+		locks = ch.addLocks(info.Context, missingKey)
+	}
+
+	missingPsList := make([]datastore.PropertyList, len(missingKey))
+	fetchStart := time.Now()
+	err := info.Next.GetMultiWithoutTx(info, missingKey, missingPsList)
+	atomic.StoreInt64(&ch.fetchNanos, int64(time.Since(fetchStart)))
+	if merr, ok := err.(datastore.MultiError); ok {
+		for idx, err := range merr {
+			baseIdx := missingIdxList[idx]
+			if err == datastore.ErrNoSuchEntity && ch.negativeCache && ch.target(info.Context, missingKey[idx]) {
+				cis = append(cis, &CacheItem{
+					Key:          missingKey[idx],
+					NoSuchEntity: true,
+				})
+			}
+			if err != nil {
+				errs[baseIdx] = err
+				continue
+			}
+			psList[baseIdx] = missingPsList[idx]
+			if ch.target(info.Context, missingKey[idx]) {
+				cis = append(cis, &CacheItem{
+					Key:          missingKey[idx],
+					PropertyList: missingPsList[idx],
+				})
+			}
+		}
+	} else if err != nil {
+		return err
+	} else {
+		for idx := range missingKey {
+			baseIdx := missingIdxList[idx]
+			psList[baseIdx] = missingPsList[idx]
+			if ch.target(info.Context, missingKey[idx]) {
+				cis = append(cis, &CacheItem{
+					Key:          missingKey[idx],
+					PropertyList: missingPsList[idx],
+				})
 			}
 		}
 	}
 
-	if len(errs) != 0 {
-		return datastore.MultiError(errs)
+	if ch.locker != nil {
+		ch.compareAndSwap(info.Context, cis, locks)
+	} else if len(cis) != 0 {
+		err := ch.s.SetMulti(info.Context, cis)
+		if err != nil {
+			ch.logf(info.Context, "dsmiddleware/storagecache.GetMultiWithoutTx: error on storage.SetMulti err=%s", err.Error())
+		}
 	}
 
 	return nil
@@ -294,7 +468,11 @@ func (ch *cacheHandler) GetMultiWithTx(info *datastore.MiddlewareInfo, keys []da
 }
 
 func (ch *cacheHandler) DeleteMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	ch.lockKeys(info.Context, keys)
+	ch.forgetFlights(keys)
+
 	err := info.Next.DeleteMultiWithoutTx(info, keys)
+	ch.forgetFlights(keys)
 
 	filteredKeys := make([]datastore.Key, 0, len(keys))
 	for _, key := range keys {
@@ -317,6 +495,9 @@ func (ch *cacheHandler) DeleteMultiWithoutTx(info *datastore.MiddlewareInfo, key
 }
 
 func (ch *cacheHandler) DeleteMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	// the locks must be placed before the commit, don't pass txCtx to appengine.APICall
+	ch.lockKeys(info.Client.Context(), keys)
+
 	err := info.Next.DeleteMultiWithTx(info, keys)
 
 	ch.m.Lock()
@@ -387,6 +568,7 @@ func (ch *cacheHandler) PostCommit(info *datastore.MiddlewareInfo, tx datastore.
 	// don't pass txCtx to appengine.APICall
 	// otherwise, `transaction context has expired` will be occur
 	baseCtx := info.Client.Context()
+	ch.forgetFlights(filteredKeys)
 	sErr := ch.s.DeleteMulti(baseCtx, filteredKeys)
 	nErr := info.Next.PostCommit(info, tx, commit)
 	if sErr != nil {
@@ -405,9 +587,33 @@ func (ch *cacheHandler) PostRollback(info *datastore.MiddlewareInfo, tx datastor
 		return info.Next.PostRollback(info, tx)
 	}
 
+	logs := txOpMap[tx]
 	delete(txOpMap, tx)
 
-	return info.Next.PostRollback(info, tx)
+	if ch.locker == nil {
+		return info.Next.PostRollback(info, tx)
+	}
+
+	// release the locks of the writes that never happen.
+	lockedKeys := make([]datastore.Key, 0, len(logs))
+	for _, log := range logs {
+		if log.Ops == txGetOp || log.Key == nil {
+			continue
+		}
+		lockedKeys = append(lockedKeys, log.Key)
+	}
+	if len(lockedKeys) == 0 {
+		return info.Next.PostRollback(info, tx)
+	}
+
+	baseCtx := info.Client.Context()
+	sErr := ch.s.DeleteMulti(baseCtx, lockedKeys)
+	nErr := info.Next.PostRollback(info, tx)
+	if sErr != nil {
+		ch.logf(info.Context, "dsmiddleware/storagecache.PostRollback: error on storage.DeleteMulti err=%s", sErr.Error())
+	}
+
+	return nErr
 }
 
 func (ch *cacheHandler) Run(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) datastore.Iterator {
@@ -0,0 +1,71 @@
+package tieredcache
+
+import (
+	"context"
+	"sync"
+
+	"go.mercari.io/datastore"
+)
+
+// Invalidation is the message to delete the entities from the near caches of the other instances.
+type Invalidation struct {
+	// Source identifies the instance that published the message, the instance ignores its own messages.
+	Source string
+	Keys   []datastore.Key
+	// Flush means that the invalidations may be lost, the near caches are flushed entirely.
+	// It is delivered by Bus when the Bus recovers from the failure.
+	Flush bool
+}
+
+// Bus delivers the invalidations between the instances.
+type Bus interface {
+	Publish(ctx context.Context, inv *Invalidation) error
+	// Subscribe registers the handler, the returned func unregisters it.
+	Subscribe(handler func(ctx context.Context, inv *Invalidation)) (unsubscribe func(), err error)
+}
+
+var _ Bus = &localBus{}
+
+// NewLocalBus creates & returns the Bus that delivers the invalidations in the process.
+// It is useful when the process has multiple clients, and for tests.
+func NewLocalBus() Bus {
+	return &localBus{
+		handlers: make(map[int]func(ctx context.Context, inv *Invalidation)),
+	}
+}
+
+type localBus struct {
+	m        sync.RWMutex
+	nextID   int
+	handlers map[int]func(ctx context.Context, inv *Invalidation)
+}
+
+func (b *localBus) Publish(ctx context.Context, inv *Invalidation) error {
+	b.m.RLock()
+	handlers := make([]func(ctx context.Context, inv *Invalidation), 0, len(b.handlers))
+	for _, handler := range b.handlers {
+		handlers = append(handlers, handler)
+	}
+	b.m.RUnlock()
+
+	for _, handler := range handlers {
+		handler(ctx, inv)
+	}
+
+	return nil
+}
+
+func (b *localBus) Subscribe(handler func(ctx context.Context, inv *Invalidation)) (func(), error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	id := b.nextID
+	b.nextID++
+	b.handlers[id] = handler
+
+	return func() {
+		b.m.Lock()
+		defer b.m.Unlock()
+		delete(b.handlers, id)
+	}, nil
+}
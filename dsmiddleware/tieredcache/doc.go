@@ -0,0 +1,34 @@
+/*
+Package tieredcache handles Put, Get etc to Datastore and provides caching by two storages, the near cache and the far cache.
+How the cache is used is explained in the storagecache package's document.
+
+Typically, the near cache is localcache and the far cache is rediscache shared by the instances.
+Get reads the near cache first, and fills it from the far cache.
+Put writes through both of them, and broadcasts the invalidation to the other instances by Bus.
+The other instances delete the entities from their near caches.
+Delete and the commit of the transaction broadcast the invalidation too, but the fills of the caches by Get don't.
+
+	bus := tieredcache.NewRedisBus(pool.Get(), pool.Dial, "mercari:tieredcache", client.DecodeKey)
+	ch := tieredcache.New(
+		localcache.New(localcache.WithMaxEntries(10000)),
+		rediscache.New(conn),
+		tieredcache.WithBus(bus),
+	)
+	defer ch.Close()
+	client.AppendMiddleware(ch)
+
+The near and far storages are not appended to the client, they are used by tieredcache.
+
+The fill of the near cache is versioned by the invalidations.
+If an invalidation of the key arrives while the far cache is read,
+the read entity may be stale and it is not stored in the near cache.
+
+The invalidations published while the subscription of the Bus is broken are lost.
+The Bus delivers Invalidation with Flush after it subscribes again, and the near cache is flushed.
+The near cache is required to have FlushLocalCache method like localcache for it.
+
+Related document.
+
+https://godoc.org/go.mercari.io/datastore/dsmiddleware/storagecache
+*/
+package tieredcache // import "go.mercari.io/datastore/dsmiddleware/tieredcache"
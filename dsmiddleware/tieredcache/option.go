@@ -0,0 +1,130 @@
+package tieredcache
+
+import (
+	"context"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/dsmiddleware/storagecache"
+)
+
+// WithIncludeKinds creates a ClientOption that selects the Kind specified as the cache target.
+func WithIncludeKinds(kinds ...string) CacheOption {
+	return &withIncludeKinds{kinds}
+}
+
+type withIncludeKinds struct{ kinds []string }
+
+func (w *withIncludeKinds) Apply(o *cacheHandler) {
+	o.stOpts.Filters = append(o.stOpts.Filters, func(ctx context.Context, key datastore.Key) bool {
+		for _, incKind := range w.kinds {
+			if key.Kind() == incKind {
+				return true
+			}
+		}
+
+		return false
+	})
+}
+
+// WithExcludeKinds creates a ClientOption that selects the Kind unspecified as the cache target.
+func WithExcludeKinds(kinds ...string) CacheOption {
+	return &withExcludeKinds{kinds}
+}
+
+type withExcludeKinds struct{ kinds []string }
+
+func (w *withExcludeKinds) Apply(o *cacheHandler) {
+	o.stOpts.Filters = append(o.stOpts.Filters, func(ctx context.Context, key datastore.Key) bool {
+		for _, excKind := range w.kinds {
+			if key.Kind() == excKind {
+				return false
+			}
+		}
+
+		return true
+	})
+}
+
+// WithKeyFilter creates a ClientOption that selects the Keys specified as the cache target.
+func WithKeyFilter(f storagecache.KeyFilter) CacheOption {
+	return &withKeyFilter{f}
+}
+
+type withKeyFilter struct{ f storagecache.KeyFilter }
+
+func (w *withKeyFilter) Apply(o *cacheHandler) {
+	o.stOpts.Filters = append(o.stOpts.Filters, func(ctx context.Context, key datastore.Key) bool {
+		return w.f(ctx, key)
+	})
+}
+
+// WithLogger creates a ClientOption that uses the specified logger.
+func WithLogger(logf func(ctx context.Context, format string, args ...interface{})) CacheOption {
+	return &withLogger{logf}
+}
+
+type withLogger struct {
+	logf func(ctx context.Context, format string, args ...interface{})
+}
+
+func (w *withLogger) Apply(o *cacheHandler) {
+	o.logf = w.logf
+}
+
+// WithStatsRecorder creates a ClientOption that reports cache hits and misses to the specified recorder.
+func WithStatsRecorder(r storagecache.StatsRecorder) CacheOption {
+	return &withStatsRecorder{r}
+}
+
+type withStatsRecorder struct{ r storagecache.StatsRecorder }
+
+func (w *withStatsRecorder) Apply(o *cacheHandler) {
+	o.stOpts.StatsRecorder = w.r
+}
+
+// WithBus creates a ClientOption that broadcasts the invalidations to the other instances by the Bus.
+func WithBus(bus Bus) CacheOption {
+	return &withBus{bus}
+}
+
+type withBus struct{ bus Bus }
+
+func (w *withBus) Apply(o *cacheHandler) {
+	o.bus = w.bus
+}
+
+// WithNegativeCache creates a ClientOption that caches ErrNoSuchEntity as the tombstone in both storages.
+// The expiration of the tombstone is specified by the option of each storage, e.g. localcache.WithNegativeExpireDuration.
+func WithNegativeCache() CacheOption {
+	return &withNegativeCache{}
+}
+
+type withNegativeCache struct{}
+
+func (w *withNegativeCache) Apply(o *cacheHandler) {
+	o.stOpts.NegativeCache = true
+}
+
+// WithCoalescing creates a ClientOption that makes the concurrent cache misses of the same key share one fetch from Datastore.
+func WithCoalescing() CacheOption {
+	return &withCoalescing{}
+}
+
+type withCoalescing struct{}
+
+func (w *withCoalescing) Apply(o *cacheHandler) {
+	o.stOpts.Coalesce = true
+}
+
+// WithEarlyRefresh creates a ClientOption that refreshes the entities near the expiration in the background.
+// The probability of the refresh rises as the expiration approaches, beta scales it and 1 is the standard.
+// The expiration reported by the storage that hits is used, the refresh writes both storages.
+func WithEarlyRefresh(beta float64) CacheOption {
+	return &withEarlyRefresh{beta}
+}
+
+type withEarlyRefresh struct{ beta float64 }
+
+func (w *withEarlyRefresh) Apply(o *cacheHandler) {
+	o.stOpts.EarlyRefreshBeta = w.beta
+}
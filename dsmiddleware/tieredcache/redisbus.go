@@ -0,0 +1,213 @@
+package tieredcache
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"go.mercari.io/datastore"
+)
+
+var _ Bus = &redisBus{}
+
+const minResubscribeBackoff = 100 * time.Millisecond
+const maxResubscribeBackoff = 30 * time.Second
+
+// NewRedisBus creates & returns the Bus by Redis pub/sub.
+// pubConn publishes the invalidations, and the connection made by dialSub is dedicated to the subscription of the channel.
+// decodeKey restores the key from the message, e.g. datastore.Client.DecodeKey.
+// When the subscription is broken, the bus dials again with the exponential backoff,
+// and delivers the Invalidation with Flush because the messages in the gap are lost.
+// The subscription continues until all handlers are unsubscribed.
+func NewRedisBus(pubConn redis.Conn, dialSub func() (redis.Conn, error), channel string, decodeKey func(encoded string) (datastore.Key, error)) Bus {
+	return &redisBus{
+		pubConn:   pubConn,
+		dialSub:   dialSub,
+		channel:   channel,
+		decodeKey: decodeKey,
+		handlers:  make(map[int]func(ctx context.Context, inv *Invalidation)),
+	}
+}
+
+type redisBus struct {
+	pubM    sync.Mutex
+	pubConn redis.Conn
+
+	dialSub   func() (redis.Conn, error)
+	channel   string
+	decodeKey func(encoded string) (datastore.Key, error)
+
+	m        sync.RWMutex
+	psc      *redis.PubSubConn // nil means not subscribed
+	nextID   int
+	handlers map[int]func(ctx context.Context, inv *Invalidation)
+}
+
+type redisMessage struct {
+	Source string   `json:"source"`
+	Keys   []string `json:"keys"`
+}
+
+func (b *redisBus) Publish(ctx context.Context, inv *Invalidation) error {
+	msg := &redisMessage{
+		Source: inv.Source,
+		Keys:   make([]string, 0, len(inv.Keys)),
+	}
+	for _, key := range inv.Keys {
+		msg.Keys = append(msg.Keys, key.Encode())
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	b.pubM.Lock()
+	defer b.pubM.Unlock()
+
+	_, err = b.pubConn.Do("PUBLISH", b.channel, payload)
+	return err
+}
+
+func (b *redisBus) Subscribe(handler func(ctx context.Context, inv *Invalidation)) (func(), error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.psc == nil {
+		psc, err := b.subscribe()
+		if err != nil {
+			return nil, err
+		}
+		b.psc = psc
+		go b.receive(psc)
+	}
+
+	id := b.nextID
+	b.nextID++
+	b.handlers[id] = handler
+
+	return func() {
+		b.m.Lock()
+		defer b.m.Unlock()
+		delete(b.handlers, id)
+		if len(b.handlers) == 0 && b.psc != nil {
+			// receive stops by the error of the closed connection.
+			b.psc.Close()
+			b.psc = nil
+		}
+	}, nil
+}
+
+func (b *redisBus) subscribe() (*redis.PubSubConn, error) {
+	conn, err := b.dialSub()
+	if err != nil {
+		return nil, err
+	}
+	psc := &redis.PubSubConn{Conn: conn}
+	err = psc.Subscribe(b.channel)
+	if err != nil {
+		psc.Close()
+		return nil, err
+	}
+
+	return psc, nil
+}
+
+// active reports whether psc is still the subscription of the bus.
+func (b *redisBus) active(psc *redis.PubSubConn) bool {
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	return b.psc == psc
+}
+
+// resubscribe dials again with the backoff until it succeeds or the bus is unsubscribed.
+func (b *redisBus) resubscribe(old *redis.PubSubConn) *redis.PubSubConn {
+	backoff := minResubscribeBackoff
+	for {
+		time.Sleep(backoff)
+		if !b.active(old) {
+			return nil
+		}
+
+		psc, err := b.subscribe()
+		if err == nil {
+			b.m.Lock()
+			defer b.m.Unlock()
+			if b.psc != old {
+				psc.Close()
+				return nil
+			}
+			b.psc = psc
+			return psc
+		}
+
+		backoff *= 2
+		if maxResubscribeBackoff < backoff {
+			backoff = maxResubscribeBackoff
+		}
+	}
+}
+
+func (b *redisBus) receive(psc *redis.PubSubConn) {
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			inv, err := b.decode(v.Data)
+			if err != nil {
+				// the broken message can't invalidate anything.
+				continue
+			}
+			b.dispatch(inv)
+		case error:
+			psc.Close()
+			if !b.active(psc) {
+				return
+			}
+			psc = b.resubscribe(psc)
+			if psc == nil {
+				return
+			}
+			// the messages published while the subscription was broken are lost.
+			b.dispatch(&Invalidation{Flush: true})
+		}
+	}
+}
+
+func (b *redisBus) dispatch(inv *Invalidation) {
+	ctx := context.Background()
+
+	b.m.RLock()
+	handlers := make([]func(ctx context.Context, inv *Invalidation), 0, len(b.handlers))
+	for _, handler := range b.handlers {
+		handlers = append(handlers, handler)
+	}
+	b.m.RUnlock()
+
+	for _, handler := range handlers {
+		handler(ctx, inv)
+	}
+}
+
+func (b *redisBus) decode(data []byte) (*Invalidation, error) {
+	var msg redisMessage
+	err := json.Unmarshal(data, &msg)
+	if err != nil {
+		return nil, err
+	}
+
+	inv := &Invalidation{
+		Source: msg.Source,
+		Keys:   make([]datastore.Key, 0, len(msg.Keys)),
+	}
+	for _, encoded := range msg.Keys {
+		key, err := b.decodeKey(encoded)
+		if err != nil {
+			return nil, err
+		}
+		inv.Keys = append(inv.Keys, key)
+	}
+
+	return inv, nil
+}
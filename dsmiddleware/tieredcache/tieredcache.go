@@ -0,0 +1,361 @@
+package tieredcache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/dsmiddleware/storagecache"
+)
+
+var _ storagecache.Storage = &cacheHandler{}
+var _ datastore.Middleware = &cacheHandler{}
+
+// New tiered cache middleware creates & returns.
+// near is read first and filled from far, typically near is localcache and far is rediscache.
+func New(near, far storagecache.Storage, opts ...CacheOption) CacheHandler {
+	ch := &cacheHandler{
+		near:        near,
+		far:         far,
+		stOpts:      &storagecache.Options{},
+		reads:       make(map[uint64]int),
+		invalidated: make(map[string]uint64),
+	}
+
+	for _, opt := range opts {
+		opt.Apply(ch)
+	}
+
+	s := storagecache.New(ch, ch.stOpts)
+	ch.Middleware = s
+
+	if ch.logf == nil {
+		ch.logf = func(ctx context.Context, format string, args ...interface{}) {}
+	}
+
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	ch.source = hex.EncodeToString(b[:])
+
+	if ch.bus != nil {
+		unsubscribe, err := ch.bus.Subscribe(ch.handleInvalidation)
+		if err != nil {
+			ch.logf(context.Background(), "dsmiddleware/tieredcache.New: error on bus.Subscribe err=%s", err.Error())
+		} else {
+			ch.unsubscribe = unsubscribe
+		}
+	}
+
+	return ch
+}
+
+// CacheHandler is the tiered cache middleware.
+type CacheHandler interface {
+	datastore.Middleware
+	storagecache.Storage
+
+	// Close stops receiving the invalidations from Bus.
+	Close()
+}
+
+type cacheHandler struct {
+	datastore.Middleware
+	stOpts *storagecache.Options
+
+	near        storagecache.Storage
+	far         storagecache.Storage
+	bus         Bus
+	source      string
+	unsubscribe func()
+	logf        func(ctx context.Context, format string, args ...interface{})
+
+	// m guards the versions, and serializes the fill and the invalidation of the near cache.
+	m       sync.Mutex
+	version uint64
+	// reads holds the number of the active reads for each version.
+	reads map[uint64]int
+	// invalidated holds the version that invalidated the key, it is needed while the older reads are active.
+	invalidated map[string]uint64
+	// flushed is the version that flushed the near cache.
+	flushed uint64
+}
+
+// contextWrite marks the context of the write through by PutMultiWithoutTx, its value is *cacheHandler.
+type contextWrite struct{}
+
+// flusher is the near storage that can delete all entities, e.g. localcache.
+type flusher interface {
+	FlushLocalCache()
+}
+
+// A CacheOption is an cache option for a tiered cache middleware.
+type CacheOption interface {
+	Apply(*cacheHandler)
+}
+
+func (ch *cacheHandler) Close() {
+	ch.m.Lock()
+	defer ch.m.Unlock()
+
+	if ch.unsubscribe != nil {
+		ch.unsubscribe()
+		ch.unsubscribe = nil
+	}
+}
+
+// beginRead returns the current version. The entities read from far after it
+// are stored in near only if their keys are not invalidated since the version.
+func (ch *cacheHandler) beginRead() uint64 {
+	ch.m.Lock()
+	defer ch.m.Unlock()
+
+	ch.reads[ch.version]++
+	return ch.version
+}
+
+func (ch *cacheHandler) endRead(version uint64) {
+	ch.m.Lock()
+	defer ch.m.Unlock()
+
+	ch.reads[version]--
+	if ch.reads[version] != 0 {
+		return
+	}
+	delete(ch.reads, version)
+
+	if len(ch.reads) == 0 {
+		if len(ch.invalidated) != 0 {
+			// no reads can be affected by the recorded invalidations.
+			ch.invalidated = make(map[string]uint64)
+		}
+		return
+	}
+
+	oldest := ch.version
+	for v := range ch.reads {
+		if v < oldest {
+			oldest = v
+		}
+	}
+	if oldest < version {
+		// the older read is still active, it needs the same invalidations.
+		return
+	}
+	for keyStr, v := range ch.invalidated {
+		// the reads of the version or later can't be affected by the invalidation of the version.
+		if v <= oldest {
+			delete(ch.invalidated, keyStr)
+		}
+	}
+}
+
+// invalidate records the new version of the keys. The caller must hold the lock.
+func (ch *cacheHandler) invalidate(keys []datastore.Key) {
+	ch.version++
+	if len(ch.reads) == 0 {
+		return
+	}
+	for _, key := range keys {
+		ch.invalidated[key.Encode()] = ch.version
+	}
+}
+
+func (ch *cacheHandler) publish(ctx context.Context, keys []datastore.Key) error {
+	if ch.bus == nil || len(keys) == 0 {
+		return nil
+	}
+
+	err := ch.bus.Publish(ctx, &Invalidation{
+		Source: ch.source,
+		Keys:   keys,
+	})
+	if err != nil {
+		ch.logf(ctx, "dsmiddleware/tieredcache: error on bus.Publish err=%s", err.Error())
+	}
+
+	return err
+}
+
+func (ch *cacheHandler) handleInvalidation(ctx context.Context, inv *Invalidation) {
+	if inv.Source == ch.source {
+		return
+	}
+
+	ch.m.Lock()
+	defer ch.m.Unlock()
+
+	if inv.Flush {
+		ch.flush(ctx)
+		return
+	}
+
+	ch.logf(ctx, "dsmiddleware/tieredcache.handleInvalidation: len=%d", len(inv.Keys))
+
+	ch.invalidate(inv.Keys)
+	err := ch.near.DeleteMulti(ctx, inv.Keys)
+	if err != nil {
+		ch.logf(ctx, "dsmiddleware/tieredcache.handleInvalidation: error on near.DeleteMulti err=%s", err.Error())
+	}
+}
+
+// flush deletes all entities of the near cache, and rejects the fills of the reads in progress.
+// The caller must hold the lock.
+func (ch *cacheHandler) flush(ctx context.Context) {
+	ch.version++
+	ch.flushed = ch.version
+
+	f, ok := ch.near.(flusher)
+	if !ok {
+		ch.logf(ctx, "dsmiddleware/tieredcache.handleInvalidation: the near cache can't be flushed, it may have stale entities")
+		return
+	}
+	ch.logf(ctx, "dsmiddleware/tieredcache.handleInvalidation: flush the near cache")
+	f.FlushLocalCache()
+}
+
+func (ch *cacheHandler) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.Key, error) {
+	// SetMulti by the write through publishes the invalidation, the fills by GetMultiWithoutTx don't.
+	info.Context = context.WithValue(info.Context, contextWrite{}, ch)
+	return ch.Middleware.PutMultiWithoutTx(info, keys, psList)
+}
+
+func (ch *cacheHandler) SetMulti(ctx context.Context, cis []*storagecache.CacheItem) error {
+	ch.logf(ctx, "dsmiddleware/tieredcache.SetMulti: incoming len=%d", len(cis))
+
+	farErr := ch.far.SetMulti(ctx, cis)
+	if farErr != nil {
+		ch.logf(ctx, "dsmiddleware/tieredcache.SetMulti: error on far.SetMulti err=%s", farErr.Error())
+	}
+
+	keys := make([]datastore.Key, 0, len(cis))
+	for _, ci := range cis {
+		keys = append(keys, ci.Key)
+	}
+
+	ch.m.Lock()
+	ch.invalidate(keys)
+	nearErr := ch.near.SetMulti(ctx, cis)
+	ch.m.Unlock()
+	if nearErr != nil {
+		ch.logf(ctx, "dsmiddleware/tieredcache.SetMulti: error on near.SetMulti err=%s", nearErr.Error())
+	}
+
+	var pubErr error
+	if ctx.Value(contextWrite{}) == ch {
+		pubErr = ch.publish(ctx, keys)
+	}
+
+	if farErr != nil {
+		return farErr
+	} else if nearErr != nil {
+		return nearErr
+	}
+
+	return pubErr
+}
+
+func (ch *cacheHandler) GetMulti(ctx context.Context, keys []datastore.Key) ([]*storagecache.CacheItem, error) {
+	ch.logf(ctx, "dsmiddleware/tieredcache.GetMulti: incoming len=%d", len(keys))
+
+	version := ch.beginRead()
+	defer ch.endRead(version)
+
+	resultList, err := ch.near.GetMulti(ctx, keys)
+	if err != nil {
+		ch.logf(ctx, "dsmiddleware/tieredcache.GetMulti: error on near.GetMulti err=%s", err.Error())
+		resultList = make([]*storagecache.CacheItem, len(keys))
+	}
+
+	missingIdxList := make([]int, 0, len(keys))
+	missingKeys := make([]datastore.Key, 0, len(keys))
+	for idx, ci := range resultList {
+		if ci == nil {
+			missingIdxList = append(missingIdxList, idx)
+			missingKeys = append(missingKeys, keys[idx])
+		}
+	}
+	if len(missingKeys) == 0 {
+		ch.logf(ctx, "dsmiddleware/tieredcache.GetMulti: near=%d far=0", len(keys))
+		return resultList, nil
+	}
+
+	farList, err := ch.far.GetMulti(ctx, missingKeys)
+	if err != nil {
+		ch.logf(ctx, "dsmiddleware/tieredcache.GetMulti: error on far.GetMulti err=%s", err.Error())
+		return resultList, nil
+	}
+
+	fills := make([]*storagecache.CacheItem, 0, len(farList))
+	for idx, ci := range farList {
+		if ci == nil {
+			continue
+		}
+		resultList[missingIdxList[idx]] = ci
+		fills = append(fills, ci)
+	}
+
+	ch.logf(ctx, "dsmiddleware/tieredcache.GetMulti: near=%d far=%d", len(keys)-len(missingKeys), len(fills))
+
+	if len(fills) != 0 {
+		ch.fill(ctx, version, fills)
+	}
+
+	return resultList, nil
+}
+
+// fill stores the entities read from far in near, except the keys invalidated after the version.
+func (ch *cacheHandler) fill(ctx context.Context, version uint64, cis []*storagecache.CacheItem) {
+	ch.m.Lock()
+	defer ch.m.Unlock()
+
+	if version < ch.flushed {
+		ch.logf(ctx, "dsmiddleware/tieredcache.GetMulti: flushed while reading")
+		return
+	}
+
+	fresh := make([]*storagecache.CacheItem, 0, len(cis))
+	for _, ci := range cis {
+		if version < ch.invalidated[ci.Key.Encode()] {
+			ch.logf(ctx, "dsmiddleware/tieredcache.GetMulti: invalidated while reading key=%s", ci.Key.String())
+			continue
+		}
+		fresh = append(fresh, ci)
+	}
+	if len(fresh) == 0 {
+		return
+	}
+
+	err := ch.near.SetMulti(ctx, fresh)
+	if err != nil {
+		ch.logf(ctx, "dsmiddleware/tieredcache.GetMulti: error on near.SetMulti err=%s", err.Error())
+	}
+}
+
+func (ch *cacheHandler) DeleteMulti(ctx context.Context, keys []datastore.Key) error {
+	ch.logf(ctx, "dsmiddleware/tieredcache.DeleteMulti: incoming len=%d", len(keys))
+
+	farErr := ch.far.DeleteMulti(ctx, keys)
+	if farErr != nil {
+		ch.logf(ctx, "dsmiddleware/tieredcache.DeleteMulti: error on far.DeleteMulti err=%s", farErr.Error())
+	}
+
+	ch.m.Lock()
+	ch.invalidate(keys)
+	nearErr := ch.near.DeleteMulti(ctx, keys)
+	ch.m.Unlock()
+	if nearErr != nil {
+		ch.logf(ctx, "dsmiddleware/tieredcache.DeleteMulti: error on near.DeleteMulti err=%s", nearErr.Error())
+	}
+
+	pubErr := ch.publish(ctx, keys)
+
+	if farErr != nil {
+		return farErr
+	} else if nearErr != nil {
+		return nearErr
+	}
+
+	return pubErr
+}
@@ -0,0 +1,490 @@
+package tieredcache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/dsmiddleware/localcache"
+	"go.mercari.io/datastore/dsmiddleware/storagecache"
+	"go.mercari.io/datastore/internal/testutils"
+)
+
+type Data struct {
+	Name string
+}
+
+// hookedStorage calls afterGet after GetMulti of the storage.
+type hookedStorage struct {
+	storagecache.Storage
+	afterGet func()
+}
+
+func (s *hookedStorage) GetMulti(ctx context.Context, keys []datastore.Key) ([]*storagecache.CacheItem, error) {
+	cis, err := s.Storage.GetMulti(ctx, keys)
+	if s.afterGet != nil {
+		s.afterGet()
+	}
+	return cis, err
+}
+
+// fakeSubConn is the connection of the subscription, it returns the replies or the errors sent to replies.
+type fakeSubConn struct {
+	replies   chan interface{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newFakeSubConn() *fakeSubConn {
+	return &fakeSubConn{
+		replies: make(chan interface{}, 1),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (c *fakeSubConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *fakeSubConn) Err() error { return nil }
+
+func (c *fakeSubConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	return nil, nil
+}
+
+func (c *fakeSubConn) Send(commandName string, args ...interface{}) error { return nil }
+
+func (c *fakeSubConn) Flush() error { return nil }
+
+func (c *fakeSubConn) Receive() (interface{}, error) {
+	select {
+	case v := <-c.replies:
+		if err, ok := v.(error); ok {
+			return nil, err
+		}
+		return v, nil
+	case <-c.closed:
+		return nil, errors.New("closed")
+	}
+}
+
+// writeCtx returns the context of the write through by ch.
+func writeCtx(ctx context.Context, ch CacheHandler) context.Context {
+	return context.WithValue(ctx, contextWrite{}, ch)
+}
+
+func item(key datastore.Key, name string) *storagecache.CacheItem {
+	return &storagecache.CacheItem{
+		Key:          key,
+		PropertyList: datastore.PropertyList{{Name: "Name", Value: name}},
+	}
+}
+
+func TestTieredCache_Basic(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	near := localcache.New()
+	far := localcache.New()
+	ch := New(near, far)
+	defer ch.Close()
+	client.AppendMiddleware(ch)
+	client.AppendMiddleware(ms)
+
+	key := client.NameKey("Data", "a", nil)
+
+	// Put writes through both.
+	_, err := client.Put(ctx, key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := near.HasCache(key); !v {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := far.HasCache(key); !v {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// Get fills near from far.
+	near.FlushLocalCache()
+	obj := &Data{}
+	err = client.Get(ctx, key, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := obj.Name; v != "a" {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := near.HasCache(key); !v {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := ms.Calls("GetMultiWithoutTx"); v != 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// Delete deletes from both.
+	err = client.Delete(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := near.HasCache(key); v {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := far.HasCache(key); v {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestTieredCache_Invalidation(t *testing.T) {
+	ctx, client, _ := testutils.SetupOnMemory()
+
+	bus := NewLocalBus()
+	far := localcache.New()
+	nearA := localcache.New()
+	nearB := localcache.New()
+	chA := New(nearA, far, WithBus(bus))
+	defer chA.Close()
+	chB := New(nearB, far, WithBus(bus))
+	defer chB.Close()
+
+	key := client.NameKey("Data", "a", nil)
+
+	err := chA.SetMulti(writeCtx(ctx, chA), []*storagecache.CacheItem{item(key, "before")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cis, err := chB.GetMulti(ctx, []datastore.Key{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := cis[0].PropertyList[0].Value; v != "before" {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := nearB.HasCache(key); !v {
+		t.Fatalf("unexpected: %v", v)
+	}
+
+	// the write of A deletes the near cache of B, but not of A.
+	err = chA.SetMulti(writeCtx(ctx, chA), []*storagecache.CacheItem{item(key, "after")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := nearA.HasCache(key); !v {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := nearB.HasCache(key); v {
+		t.Errorf("unexpected: %v", v)
+	}
+	cis, err = chB.GetMulti(ctx, []datastore.Key{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := cis[0].PropertyList[0].Value; v != "after" {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// the fill of the near cache isn't broadcasted.
+	err = chB.SetMulti(ctx, []*storagecache.CacheItem{item(key, "after")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := nearA.HasCache(key); !v {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// the delete of B is broadcasted too.
+	err = chB.DeleteMulti(ctx, []datastore.Key{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := nearA.HasCache(key); v {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// closed instance doesn't receive the invalidation.
+	err = chA.SetMulti(writeCtx(ctx, chA), []*storagecache.CacheItem{item(key, "a")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chA.Close()
+	err = chB.SetMulti(writeCtx(ctx, chB), []*storagecache.CacheItem{item(key, "b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := nearA.HasCache(key); !v {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestTieredCache_InvalidationByClient(t *testing.T) {
+	ctx, clientA, ms := testutils.SetupOnMemory()
+	_, clientB, _ := testutils.SetupOnMemory()
+
+	bus := NewLocalBus()
+	far := localcache.New()
+	nearA := localcache.New()
+	nearB := localcache.New()
+	chA := New(nearA, far, WithBus(bus))
+	defer chA.Close()
+	chB := New(nearB, far, WithBus(bus))
+	defer chB.Close()
+	clientA.AppendMiddleware(chA)
+	clientA.AppendMiddleware(ms)
+	clientB.AppendMiddleware(chB)
+	clientB.AppendMiddleware(ms)
+
+	key := clientA.NameKey("Data", "a", nil)
+	_, err := clientA.Put(ctx, key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the read of B fills its near cache, A keeps its near cache.
+	err = clientB.Get(ctx, key, &Data{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := nearB.HasCache(key); !v {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := nearA.HasCache(key); !v {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// the read through from Datastore isn't broadcasted either.
+	nearB.FlushLocalCache()
+	far.FlushLocalCache()
+	err = clientB.Get(ctx, key, &Data{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := nearA.HasCache(key); !v {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// the write of B deletes the near cache of A.
+	_, err = clientB.Put(ctx, key, &Data{Name: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := nearA.HasCache(key); v {
+		t.Errorf("unexpected: %v", v)
+	}
+	obj := &Data{}
+	err = clientA.Get(ctx, key, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := obj.Name; v != "b" {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// Delete is broadcasted too.
+	err = clientB.Delete(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := nearA.HasCache(key); v {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestTieredCache_InvalidatedWhileReading(t *testing.T) {
+	ctx, client, _ := testutils.SetupOnMemory()
+
+	key := client.NameKey("Data", "a", nil)
+
+	bus := NewLocalBus()
+	far := localcache.New()
+	err := far.SetMulti(ctx, []*storagecache.CacheItem{item(key, "before")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nearA := localcache.New()
+	chA := New(nearA, far, WithBus(bus))
+	defer chA.Close()
+
+	// B reads "before" from far, and A writes "after" before B fills the near cache.
+	hooked := &hookedStorage{Storage: far}
+	nearB := localcache.New()
+	chB := New(nearB, hooked, WithBus(bus))
+	defer chB.Close()
+
+	hooked.afterGet = func() {
+		hooked.afterGet = nil
+		err := chA.SetMulti(writeCtx(ctx, chA), []*storagecache.CacheItem{item(key, "after")})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cis, err := chB.GetMulti(ctx, []datastore.Key{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := cis[0].PropertyList[0].Value; v != "before" {
+		t.Errorf("unexpected: %v", v)
+	}
+	// the stale entity isn't stored.
+	if v := nearB.HasCache(key); v {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	cis, err = chB.GetMulti(ctx, []datastore.Key{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := cis[0].PropertyList[0].Value; v != "after" {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := nearB.HasCache(key); !v {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestTieredCache_OverlappedReads(t *testing.T) {
+	_, client, _ := testutils.SetupOnMemory()
+
+	ch := New(localcache.New(), localcache.New()).(*cacheHandler)
+	keyA := client.NameKey("Data", "a", nil)
+	keyB := client.NameKey("Data", "b", nil)
+
+	// the reads overlap each other, there is always an active read.
+	v1 := ch.beginRead()
+	ch.m.Lock()
+	ch.invalidate([]datastore.Key{keyA})
+	ch.m.Unlock()
+	v2 := ch.beginRead()
+	ch.m.Lock()
+	ch.invalidate([]datastore.Key{keyB})
+	ch.m.Unlock()
+
+	// a can't affect the read of v2.
+	ch.endRead(v1)
+	if _, ok := ch.invalidated[keyA.Encode()]; ok {
+		t.Errorf("unexpected: %v", ok)
+	}
+	if _, ok := ch.invalidated[keyB.Encode()]; !ok {
+		t.Errorf("unexpected: %v", ok)
+	}
+
+	v3 := ch.beginRead()
+	ch.endRead(v2)
+	if v := len(ch.invalidated); v != 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+	ch.endRead(v3)
+	if v := len(ch.reads); v != 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestTieredCache_RedisBusGap(t *testing.T) {
+	ctx, client, _ := testutils.SetupOnMemory()
+
+	dialed := make(chan *fakeSubConn, 2)
+	dialSub := func() (redis.Conn, error) {
+		conn := newFakeSubConn()
+		dialed <- conn
+		return conn, nil
+	}
+
+	near := localcache.New()
+	ch := New(near, localcache.New(), WithBus(NewRedisBus(nil, dialSub, "mercari:tieredcache:test", client.DecodeKey)))
+
+	keyA := client.NameKey("Data", "a", nil)
+	keyB := client.NameKey("Data", "b", nil)
+	err := near.SetMulti(ctx, []*storagecache.CacheItem{item(keyA, "a"), item(keyB, "b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := <-dialed
+	conn.replies <- []interface{}{[]byte("message"), []byte("mercari:tieredcache:test"), []byte(`{"source":"other","keys":["` + keyA.Encode() + `"]}`)}
+
+	// the subscription is broken, the bus subscribes again and flushes the near cache.
+	conn.replies <- errors.New("broken")
+	conn = <-dialed
+
+	deadline := time.Now().Add(5 * time.Second)
+	for near.HasCache(keyB) {
+		if time.Now().After(deadline) {
+			t.Fatal("the near cache is not flushed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v := near.HasCache(keyA); v {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// the connection is closed by the last unsubscribe.
+	ch.Close()
+	select {
+	case <-conn.closed:
+	case <-time.After(time.Second):
+		t.Error("the connection is not closed")
+	}
+}
+
+func TestTieredCache_RedisBus(t *testing.T) {
+	ctx, client, _ := testutils.SetupOnMemory()
+
+	dial := func() redis.Conn {
+		conn, err := net.Dial("tcp", os.Getenv("REDIS_HOST")+":"+os.Getenv("REDIS_PORT"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return redis.NewConn(conn, time.Second, time.Second)
+	}
+	dialSub := func() (redis.Conn, error) {
+		conn, err := net.Dial("tcp", os.Getenv("REDIS_HOST")+":"+os.Getenv("REDIS_PORT"))
+		if err != nil {
+			return nil, err
+		}
+		// the subscription waits for the messages without the read timeout.
+		return redis.NewConn(conn, 0, time.Second), nil
+	}
+	pubA := dial()
+	defer pubA.Close()
+	pubB := dial()
+	defer pubB.Close()
+
+	far := localcache.New()
+	nearA := localcache.New()
+	nearB := localcache.New()
+	chA := New(nearA, far, WithBus(NewRedisBus(pubA, dialSub, "mercari:tieredcache:test", client.DecodeKey)))
+	defer chA.Close()
+	chB := New(nearB, far, WithBus(NewRedisBus(pubB, dialSub, "mercari:tieredcache:test", client.DecodeKey)))
+	defer chB.Close()
+
+	key := client.NameKey("Data", "a", nil)
+	err := nearB.SetMulti(ctx, []*storagecache.CacheItem{item(key, "before")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = chA.SetMulti(writeCtx(ctx, chA), []*storagecache.CacheItem{item(key, "after")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for nearB.HasCache(key) {
+		if time.Now().After(deadline) {
+			t.Fatal("the invalidation is not delivered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v := nearA.HasCache(key); !v {
+		t.Errorf("unexpected: %v", v)
+	}
+}
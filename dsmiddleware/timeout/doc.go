@@ -0,0 +1,28 @@
+/*
+Package timeout applies the timeout for each operation type, and hedges the idempotent reads.
+
+	th := timeout.New(
+		timeout.WithTimeout(timeout.OpGet, 500*time.Millisecond),
+		timeout.WithTimeout(timeout.OpPut, 2*time.Second),
+		timeout.WithTimeout(timeout.OpQuery, 10*time.Second),
+		timeout.WithTimeout(timeout.OpCommit, 5*time.Second),
+		timeout.WithHedging(0.95, 20*time.Millisecond),
+	)
+	client.AppendMiddleware(th)
+
+The timeout is applied on top of MiddlewareInfo.Context, the middlewares after it receive the context with the deadline.
+The timeout of OpQuery covers Run and the iteration by Iterator.Next.
+
+Operations in the transaction and Commit use the context of the transaction.
+The timeout of OpCommit is applied by TransactionContext.
+
+	ctx, cancel := th.TransactionContext(ctx)
+	defer cancel()
+	_, err := client.RunInTransaction(ctx, f)
+
+With WithHedging, GetMultiWithoutTx, and GetAll and Count of eventual consistency queries are hedged.
+If the request doesn't return in the latency of the percentile of recent requests,
+the same request is sent again, and the result arrived first is returned.
+Stats reports how often hedging happened.
+*/
+package timeout // import "go.mercari.io/datastore/dsmiddleware/timeout"
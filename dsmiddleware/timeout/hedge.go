@@ -0,0 +1,137 @@
+package timeout
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/internal/errcode"
+)
+
+const (
+	// latencySamples is the number of recent latencies to calculate the percentile.
+	latencySamples = 100
+	// minSamples is the number of latencies required before hedging.
+	minSamples = 20
+)
+
+// latencies holds recent latencies of an operation type.
+type latencies struct {
+	m       sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func (l *latencies) add(d time.Duration) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if len(l.samples) < latencySamples {
+		l.samples = append(l.samples, d)
+		return
+	}
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % latencySamples
+}
+
+// percentile returns the latency of the percentile, ok is false if samples are insufficient.
+func (l *latencies) percentile(p float64) (d time.Duration, ok bool) {
+	l.m.Lock()
+	samples := make([]time.Duration, len(l.samples))
+	copy(samples, l.samples)
+	l.m.Unlock()
+
+	if len(samples) < minSamples {
+		return 0, false
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	idx := int(math.Ceil(p*float64(len(samples)))) - 1
+	if idx < 0 {
+		idx = 0
+	} else if len(samples) <= idx {
+		idx = len(samples) - 1
+	}
+
+	return samples[idx], true
+}
+
+type hedging struct {
+	percentile float64
+	minDelay   time.Duration
+}
+
+// hedgeResult is the result of a request. apply writes the result to the arguments of the caller.
+type hedgeResult struct {
+	apply  func()
+	err    error
+	hedged bool
+}
+
+func (th *timeoutHandler) hedgeDelay(op Op) (time.Duration, bool) {
+	if th.hedging == nil {
+		return 0, false
+	}
+	d, ok := th.latencies[op].percentile(th.hedging.percentile)
+	if !ok {
+		return 0, false
+	}
+	if d < th.hedging.minDelay {
+		d = th.hedging.minDelay
+	}
+
+	return d, true
+}
+
+// hedge calls f, and calls it again if the first call doesn't return in the hedge delay.
+// The result arrived first is applied, and the other is canceled.
+// f must not modify the arguments of the caller until apply is called.
+func (th *timeoutHandler) hedge(info *datastore.MiddlewareInfo, op Op, f func(info *datastore.MiddlewareInfo) (apply func(), err error)) error {
+	delay, ok := th.hedgeDelay(op)
+
+	atomic.AddInt64(&th.requests, 1)
+	start := time.Now()
+
+	ctx, cancel := context.WithCancel(info.Context)
+	defer cancel()
+
+	// the buffer is enough for both requests, the loser doesn't block.
+	ch := make(chan *hedgeResult, 2)
+	call := func(hedged bool) {
+		// each request has own MiddlewareInfo, the bridge updates Next of it.
+		callInfo := *info
+		callInfo.Context = ctx
+		apply, err := f(&callInfo)
+		ch <- &hedgeResult{apply: apply, err: err, hedged: hedged}
+	}
+	go call(false)
+
+	var r *hedgeResult
+	if ok {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		select {
+		case r = <-ch:
+		case <-t.C:
+			atomic.AddInt64(&th.hedged, 1)
+			th.logf(info.Context, "dsmiddleware/timeout: send hedged request of %s after %s", op, delay)
+			go call(true)
+			r = <-ch
+		}
+	} else {
+		r = <-ch
+	}
+
+	if r.hedged {
+		atomic.AddInt64(&th.hedgeWins, 1)
+	}
+	if r.err == nil || errcode.IsNoSuchEntity(r.err) {
+		th.latencies[op].add(time.Since(start))
+	}
+	r.apply()
+
+	return r.err
+}
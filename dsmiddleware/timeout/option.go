@@ -0,0 +1,49 @@
+package timeout
+
+import (
+	"context"
+	"time"
+)
+
+// WithTimeout specifies the timeout of the operation type.
+// It is applied on top of the context, the shorter deadline wins.
+func WithTimeout(op Op, d time.Duration) Option {
+	return &withTimeout{op, d}
+}
+
+type withTimeout struct {
+	op Op
+	d  time.Duration
+}
+
+func (w *withTimeout) Apply(th *timeoutHandler) {
+	th.timeouts[w.op] = w.d
+}
+
+// WithHedging creates a Option that sends the hedged request of idempotent reads.
+// If the request doesn't return in the latency of the percentile (e.g. 0.95) of recent requests,
+// the same request is sent again, and the result arrived first is used.
+// minDelay is the lower bound of the delay.
+// GetMultiWithoutTx, and GetAll and Count of eventual consistency queries are hedged.
+func WithHedging(percentile float64, minDelay time.Duration) Option {
+	return &withHedging{&hedging{percentile: percentile, minDelay: minDelay}}
+}
+
+type withHedging struct{ hedging *hedging }
+
+func (w *withHedging) Apply(th *timeoutHandler) {
+	th.hedging = w.hedging
+}
+
+// WithLogger creates a Option that uses the specified logger.
+func WithLogger(logf func(ctx context.Context, format string, args ...interface{})) Option {
+	return &withLogger{logf}
+}
+
+type withLogger struct {
+	logf func(ctx context.Context, format string, args ...interface{})
+}
+
+func (w *withLogger) Apply(th *timeoutHandler) {
+	th.logf = w.logf
+}
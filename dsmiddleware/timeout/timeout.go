@@ -0,0 +1,276 @@
+package timeout
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mercari.io/datastore"
+)
+
+var _ datastore.Middleware = &timeoutHandler{}
+
+// Op is the type of operations that share the timeout.
+type Op string
+
+const (
+	// OpGet represents GetMultiWithoutTx.
+	OpGet Op = "Get"
+	// OpPut represents PutMultiWithoutTx.
+	OpPut Op = "Put"
+	// OpDelete represents DeleteMultiWithoutTx.
+	OpDelete Op = "Delete"
+	// OpQuery represents GetAll, Count and Run. The timeout of Run covers the iteration by Iterator.Next.
+	OpQuery Op = "Query"
+	// OpAllocateIDs represents AllocateIDs.
+	OpAllocateIDs Op = "AllocateIDs"
+	// OpCommit represents the transaction. It is applied by Handler.TransactionContext.
+	OpCommit Op = "Commit"
+)
+
+// Stats is the statistics of hedging.
+type Stats struct {
+	// Requests is the number of requests that can be hedged.
+	Requests int64
+	// Hedged is the number of requests that sent the hedged request.
+	Hedged int64
+	// HedgeWins is the number of requests that the hedged request returned first.
+	HedgeWins int64
+}
+
+// Handler is the timeout middleware.
+type Handler interface {
+	datastore.Middleware
+
+	// Stats returns the statistics of hedging.
+	Stats() Stats
+	// TransactionContext returns the context with the timeout of OpCommit.
+	// Commit isn't sent through middlewares, use it as the context of NewTransaction or RunInTransaction.
+	TransactionContext(ctx context.Context) (context.Context, context.CancelFunc)
+}
+
+// New timeout middleware creates & returns.
+func New(opts ...Option) Handler {
+	th := &timeoutHandler{
+		timeouts: make(map[Op]time.Duration),
+		latencies: map[Op]*latencies{
+			OpGet:   {},
+			OpQuery: {},
+		},
+		cancels: make(map[datastore.Iterator]*iterCancel),
+	}
+
+	for _, opt := range opts {
+		opt.Apply(th)
+	}
+
+	if th.logf == nil {
+		th.logf = func(ctx context.Context, format string, args ...interface{}) {}
+	}
+
+	return th
+}
+
+// A Option is an option for timeout.
+type Option interface {
+	Apply(*timeoutHandler)
+}
+
+type timeoutHandler struct {
+	// counters are accessed atomically, keep them 64-bit aligned.
+	requests  int64
+	hedged    int64
+	hedgeWins int64
+
+	timeouts  map[Op]time.Duration
+	hedging   *hedging
+	latencies map[Op]*latencies
+	logf      func(ctx context.Context, format string, args ...interface{})
+
+	m sync.Mutex
+	// cancels holds the cancel functions of the iterators, they are called when the iteration ends.
+	// the iterators abandoned before the end are removed after their deadline by Run.
+	cancels map[datastore.Iterator]*iterCancel
+}
+
+type iterCancel struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (th *timeoutHandler) Stats() Stats {
+	return Stats{
+		Requests:  atomic.LoadInt64(&th.requests),
+		Hedged:    atomic.LoadInt64(&th.hedged),
+		HedgeWins: atomic.LoadInt64(&th.hedgeWins),
+	}
+}
+
+func (th *timeoutHandler) TransactionContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d := th.timeouts[OpCommit]; 0 < d {
+		return context.WithTimeout(ctx, d)
+	}
+
+	return context.WithCancel(ctx)
+}
+
+// withTimeout returns the copy of info with the timeout of op.
+// If op has no timeout, info itself and nil are returned.
+func (th *timeoutHandler) withTimeout(info *datastore.MiddlewareInfo, op Op) (*datastore.MiddlewareInfo, context.CancelFunc) {
+	d := th.timeouts[op]
+	if d <= 0 {
+		return info, nil
+	}
+
+	ctx, cancel := context.WithTimeout(info.Context, d)
+	newInfo := *info
+	newInfo.Context = ctx
+
+	return &newInfo, cancel
+}
+
+func (th *timeoutHandler) AllocateIDs(info *datastore.MiddlewareInfo, keys []datastore.Key) ([]datastore.Key, error) {
+	info, cancel := th.withTimeout(info, OpAllocateIDs)
+	if cancel != nil {
+		defer cancel()
+	}
+
+	return info.Next.AllocateIDs(info, keys)
+}
+
+func (th *timeoutHandler) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.Key, error) {
+	info, cancel := th.withTimeout(info, OpPut)
+	if cancel != nil {
+		defer cancel()
+	}
+
+	return info.Next.PutMultiWithoutTx(info, keys, psList)
+}
+
+func (th *timeoutHandler) PutMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.PendingKey, error) {
+	// operations in the transaction use the context of the transaction.
+	return info.Next.PutMultiWithTx(info, keys, psList)
+}
+
+func (th *timeoutHandler) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	info, cancel := th.withTimeout(info, OpGet)
+	if cancel != nil {
+		defer cancel()
+	}
+
+	if th.hedging == nil {
+		return info.Next.GetMultiWithoutTx(info, keys, psList)
+	}
+
+	return th.hedge(info, OpGet, func(info *datastore.MiddlewareInfo) (func(), error) {
+		hedgePsList := make([]datastore.PropertyList, len(psList))
+		err := info.Next.GetMultiWithoutTx(info, keys, hedgePsList)
+		return func() {
+			copy(psList, hedgePsList)
+		}, err
+	})
+}
+
+func (th *timeoutHandler) GetMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	return info.Next.GetMultiWithTx(info, keys, psList)
+}
+
+func (th *timeoutHandler) DeleteMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	info, cancel := th.withTimeout(info, OpDelete)
+	if cancel != nil {
+		defer cancel()
+	}
+
+	return info.Next.DeleteMultiWithoutTx(info, keys)
+}
+
+func (th *timeoutHandler) DeleteMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	return info.Next.DeleteMultiWithTx(info, keys)
+}
+
+func (th *timeoutHandler) PostCommit(info *datastore.MiddlewareInfo, tx datastore.Transaction, commit datastore.Commit) error {
+	return info.Next.PostCommit(info, tx, commit)
+}
+
+func (th *timeoutHandler) PostRollback(info *datastore.MiddlewareInfo, tx datastore.Transaction) error {
+	return info.Next.PostRollback(info, tx)
+}
+
+func (th *timeoutHandler) Run(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) datastore.Iterator {
+	info, cancel := th.withTimeout(info, OpQuery)
+	iter := info.Next.Run(info, q, qDump)
+	if cancel != nil {
+		th.m.Lock()
+		for abandoned, c := range th.cancels {
+			if c.ctx.Err() != nil {
+				delete(th.cancels, abandoned)
+				c.cancel()
+			}
+		}
+		th.cancels[iter] = &iterCancel{ctx: info.Context, cancel: cancel}
+		th.m.Unlock()
+	}
+
+	return iter
+}
+
+func (th *timeoutHandler) GetAll(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, psList *[]datastore.PropertyList) ([]datastore.Key, error) {
+	info, cancel := th.withTimeout(info, OpQuery)
+	if cancel != nil {
+		defer cancel()
+	}
+
+	if th.hedging == nil || !qDump.EventualConsistency {
+		return info.Next.GetAll(info, q, qDump, psList)
+	}
+
+	var keys []datastore.Key
+	err := th.hedge(info, OpQuery, func(info *datastore.MiddlewareInfo) (func(), error) {
+		var hedgePsList []datastore.PropertyList
+		hedgeKeys, err := info.Next.GetAll(info, q, qDump, &hedgePsList)
+		return func() {
+			keys = hedgeKeys
+			*psList = append(*psList, hedgePsList...)
+		}, err
+	})
+
+	return keys, err
+}
+
+func (th *timeoutHandler) Next(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, iter datastore.Iterator, ps *datastore.PropertyList) (datastore.Key, error) {
+	key, err := info.Next.Next(info, q, qDump, iter, ps)
+	if err != nil {
+		// the iteration ends with iterator.Done or the error.
+		th.m.Lock()
+		c, ok := th.cancels[iter]
+		delete(th.cancels, iter)
+		th.m.Unlock()
+		if ok {
+			c.cancel()
+		}
+	}
+
+	return key, err
+}
+
+func (th *timeoutHandler) Count(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) (int, error) {
+	info, cancel := th.withTimeout(info, OpQuery)
+	if cancel != nil {
+		defer cancel()
+	}
+
+	if th.hedging == nil || !qDump.EventualConsistency {
+		return info.Next.Count(info, q, qDump)
+	}
+
+	var count int
+	err := th.hedge(info, OpQuery, func(info *datastore.MiddlewareInfo) (func(), error) {
+		hedgeCount, err := info.Next.Count(info, q, qDump)
+		return func() {
+			count = hedgeCount
+		}, err
+	})
+
+	return count, err
+}
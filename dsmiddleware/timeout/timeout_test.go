@@ -0,0 +1,202 @@
+package timeout
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/dsmiddleware/noop"
+	"go.mercari.io/datastore/internal/testutils"
+)
+
+type Data struct {
+	Name string
+}
+
+// deadlineRecorder records the deadline of the context.
+type deadlineRecorder struct {
+	datastore.Middleware
+	deadlines map[string]time.Duration
+}
+
+func (m *deadlineRecorder) record(ctx context.Context, op string) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		m.deadlines[op] = 0
+		return
+	}
+	m.deadlines[op] = time.Until(deadline)
+}
+
+func (m *deadlineRecorder) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.Key, error) {
+	m.record(info.Context, "Put")
+	return m.Middleware.PutMultiWithoutTx(info, keys, psList)
+}
+
+func (m *deadlineRecorder) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	m.record(info.Context, "Get")
+	return m.Middleware.GetMultiWithoutTx(info, keys, psList)
+}
+
+func (m *deadlineRecorder) DeleteMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	m.record(info.Context, "Delete")
+	return m.Middleware.DeleteMultiWithoutTx(info, keys)
+}
+
+// slowGet blocks GetMultiWithoutTx of the specified call until the context is done.
+type slowGet struct {
+	datastore.Middleware
+	calls    int32
+	slowCall int32
+}
+
+func (m *slowGet) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	if atomic.AddInt32(&m.calls, 1) == m.slowCall {
+		<-info.Context.Done()
+		return info.Context.Err()
+	}
+	return m.Middleware.GetMultiWithoutTx(info, keys, psList)
+}
+
+func TestTimeout_Deadline(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	recorder := &deadlineRecorder{Middleware: ms, deadlines: make(map[string]time.Duration)}
+	client.AppendMiddleware(New(
+		WithTimeout(OpGet, 1*time.Second),
+		WithTimeout(OpPut, 10*time.Second),
+	))
+	// the deadline is passed through other middlewares.
+	client.AppendMiddleware(noop.New())
+	client.AppendMiddleware(recorder)
+
+	key := client.NameKey("Data", "a", nil)
+	_, err := client.Put(ctx, key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Get(ctx, key, &Data{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Delete(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := recorder.deadlines["Put"]; v <= 9*time.Second || 10*time.Second < v {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := recorder.deadlines["Get"]; v <= 0 || time.Second < v {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := recorder.deadlines["Delete"]; v != 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// the shorter deadline of the context wins.
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err = client.Put(ctx, key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := recorder.deadlines["Put"]; 100*time.Millisecond < v {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestTimeout_Exceeded(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	client.AppendMiddleware(New(WithTimeout(OpGet, 50*time.Millisecond)))
+	client.AppendMiddleware(&slowGet{Middleware: ms, slowCall: 1})
+
+	err := client.Get(ctx, client.NameKey("Data", "a", nil), &Data{})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("unexpected: %v", err)
+	}
+}
+
+func TestTimeout_AbandonedIterator(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	mw := New(WithTimeout(OpQuery, 20*time.Millisecond))
+	client.AppendMiddleware(mw)
+	client.AppendMiddleware(ms)
+
+	// the iterator isn't iterated to the end.
+	client.Run(ctx, client.NewQuery("Data"))
+	time.Sleep(30 * time.Millisecond)
+
+	// the cancel function of the abandoned iterator is removed after the deadline.
+	client.Run(ctx, client.NewQuery("Data"))
+	th := mw.(*timeoutHandler)
+	th.m.Lock()
+	defer th.m.Unlock()
+	if v := len(th.cancels); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestTimeout_Hedging(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	th := New(WithHedging(0.95, 10*time.Millisecond))
+	client.AppendMiddleware(th)
+	client.AppendMiddleware(&slowGet{Middleware: ms, slowCall: minSamples + 1})
+
+	key := client.NameKey("Data", "a", nil)
+	_, err := client.Put(ctx, key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no hedging until enough latencies are recorded.
+	for i := 0; i < minSamples; i++ {
+		err = client.Get(ctx, key, &Data{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v := th.Stats(); v.Requests != minSamples || v.Hedged != 0 {
+		t.Fatalf("unexpected: %+v", v)
+	}
+
+	obj := &Data{}
+	err = client.Get(ctx, key, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Name != "a" {
+		t.Errorf("unexpected: %v", obj.Name)
+	}
+	if v := th.Stats(); v.Requests != minSamples+1 || v.Hedged != 1 || v.HedgeWins != 1 {
+		t.Errorf("unexpected: %+v", v)
+	}
+
+	// strong consistency queries aren't hedged.
+	_, err = client.Count(ctx, client.NewQuery("Data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := th.Stats(); v.Requests != minSamples+1 {
+		t.Errorf("unexpected: %+v", v)
+	}
+}
+
+func TestTimeout_TransactionContext(t *testing.T) {
+	th := New(WithTimeout(OpCommit, time.Second))
+
+	ctx, cancel := th.TransactionContext(context.Background())
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		t.Fatal("unexpected: no deadline")
+	}
+	if v := time.Until(deadline); v <= 0 || time.Second < v {
+		t.Errorf("unexpected: %v", v)
+	}
+}
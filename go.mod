@@ -14,6 +14,7 @@ require (
 	github.com/favclip/testerator/v2 v2.0.0
 	github.com/golang/protobuf v1.5.2
 	github.com/gomodule/redigo v1.8.5
+	github.com/klauspost/compress v1.10.10
 	golang.org/x/lint v0.0.0-20210508222113-6edffad5e616
 	golang.org/x/net v0.0.0-20210503060351-7fd8e65b6420
 	golang.org/x/oauth2 v0.0.0-20210819190943-2bc19b11175f
@@ -22,4 +23,5 @@ require (
 	google.golang.org/api v0.56.0
 	google.golang.org/appengine v1.6.7
 	google.golang.org/grpc v1.40.0
+	google.golang.org/protobuf v1.27.1
 )
@@ -0,0 +1,70 @@
+// Package errcode classifies errors of Datastore operations by gRPC code names.
+package errcode
+
+import (
+	"context"
+
+	"go.mercari.io/datastore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Code returns the gRPC code name of err.
+// If err is MultiError, the code of the most interesting element is returned.
+func Code(err error) string {
+	if err == nil {
+		return codes.OK.String()
+	}
+
+	if merr, ok := err.(datastore.MultiError); ok {
+		var first error
+		for _, err := range merr {
+			if err == nil {
+				continue
+			}
+			if first == nil {
+				first = err
+			}
+			if err != datastore.ErrNoSuchEntity {
+				// the error other than NotFound is more interesting.
+				return Code(err)
+			}
+		}
+		if first == nil {
+			return codes.OK.String()
+		}
+		err = first
+	}
+
+	switch err {
+	case datastore.ErrNoSuchEntity:
+		return codes.NotFound.String()
+	case datastore.ErrConcurrentTransaction:
+		return codes.Aborted.String()
+	case context.Canceled:
+		return codes.Canceled.String()
+	case context.DeadlineExceeded:
+		return codes.DeadlineExceeded.String()
+	}
+
+	return status.Code(err).String()
+}
+
+// IsNoSuchEntity reports whether err consists of ErrNoSuchEntity only.
+// It is the normal result of Get.
+func IsNoSuchEntity(err error) bool {
+	if err == datastore.ErrNoSuchEntity {
+		return true
+	}
+	merr, ok := err.(datastore.MultiError)
+	if !ok {
+		return false
+	}
+	for _, err := range merr {
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return false
+		}
+	}
+
+	return true
+}
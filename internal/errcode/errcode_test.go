@@ -0,0 +1,39 @@
+package errcode
+
+import (
+	"errors"
+	"testing"
+
+	"go.mercari.io/datastore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCode(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected string
+	}{
+		{nil, "OK"},
+		{datastore.ErrNoSuchEntity, "NotFound"},
+		{datastore.ErrConcurrentTransaction, "Aborted"},
+		{datastore.MultiError{nil, datastore.ErrNoSuchEntity}, "NotFound"},
+		{datastore.MultiError{datastore.ErrNoSuchEntity, datastore.ErrConcurrentTransaction}, "Aborted"},
+		{status.Error(codes.Unavailable, "unavailable"), "Unavailable"},
+		{errors.New("error"), "Unknown"},
+	}
+	for _, c := range cases {
+		if v := Code(c.err); v != c.expected {
+			t.Errorf("unexpected: %v, %v", c.err, v)
+		}
+	}
+}
+
+func TestIsNoSuchEntity(t *testing.T) {
+	if !IsNoSuchEntity(datastore.MultiError{nil, datastore.ErrNoSuchEntity}) {
+		t.Errorf("unexpected")
+	}
+	if IsNoSuchEntity(datastore.MultiError{datastore.ErrNoSuchEntity, errors.New("error")}) {
+		t.Errorf("unexpected")
+	}
+}
@@ -0,0 +1,83 @@
+// Package estimate calculates the approximate storage size of entities.
+// The calculation follows the storage size rules of Cloud Datastore,
+// see https://cloud.google.com/datastore/docs/concepts/storage-size .
+package estimate
+
+import (
+	"time"
+
+	"go.mercari.io/datastore"
+)
+
+const (
+	entityOverhead = 32
+	keyOverhead    = 16
+)
+
+// EntitySize returns the approximate size of the entity in bytes.
+func EntitySize(key datastore.Key, ps []datastore.Property) int {
+	size := entityOverhead + PropertiesSize(ps)
+	if key != nil {
+		size += KeySize(key)
+	}
+
+	return size
+}
+
+// KeySize returns the approximate size of the key in bytes.
+func KeySize(key datastore.Key) int {
+	size := keyOverhead + len(key.Namespace()) + 1
+	for k := key; k != nil; k = k.ParentKey() {
+		size += len(k.Kind()) + 1
+		if k.Name() != "" {
+			size += len(k.Name()) + 1
+		} else {
+			size += 8
+		}
+	}
+
+	return size
+}
+
+// PropertiesSize returns the approximate size of the properties in bytes.
+func PropertiesSize(ps []datastore.Property) int {
+	size := 0
+	for _, p := range ps {
+		size += len(p.Name) + 1 + ValueSize(p.Value)
+	}
+
+	return size
+}
+
+// ValueSize returns the approximate size of the property value in bytes.
+func ValueSize(v interface{}) int {
+	switch v := v.(type) {
+	case nil:
+		return 1
+	case bool:
+		return 1
+	case int64, float64, time.Time:
+		return 8
+	case string:
+		return len(v) + 1
+	case []byte:
+		return len(v)
+	case datastore.GeoPoint:
+		return 16
+	case datastore.Key:
+		return KeySize(v)
+	case *datastore.Entity:
+		if v == nil {
+			return 1
+		}
+		return EntitySize(v.Key, v.Properties)
+	case []interface{}:
+		size := 0
+		for _, elem := range v {
+			size += ValueSize(elem)
+		}
+		return size
+	}
+
+	return 8
+}
@@ -0,0 +1,37 @@
+// Package redisslot calculates the hash slot of Redis Cluster.
+// see https://redis.io/docs/reference/cluster-spec/#key-distribution-model .
+package redisslot
+
+import "strings"
+
+// Count is the number of the hash slots.
+const Count = 16384
+
+// Slot returns the hash slot of the key.
+// If the key contains the hash tag like "{user1000}.following", only the tag is hashed.
+func Slot(key string) int {
+	if start := strings.IndexByte(key, '{'); start != -1 {
+		if end := strings.IndexByte(key[start+1:], '}'); 0 < end {
+			key = key[start+1 : start+1+end]
+		}
+	}
+
+	return int(crc16(key) % Count)
+}
+
+// crc16 is CRC-16/XMODEM.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
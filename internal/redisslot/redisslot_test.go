@@ -0,0 +1,28 @@
+package redisslot
+
+import "testing"
+
+func TestSlot(t *testing.T) {
+	cases := []struct {
+		key      string
+		expected int
+	}{
+		// the values are from CLUSTER KEYSLOT of Redis.
+		{"", 0},
+		{"foo", 12182},
+		{"bar", 5061},
+		{"123456789", 12739},
+		{"{user1000}.following", 3443},
+		{"{user1000}.followers", 3443},
+		{"user1000", 3443},
+		{"foo{}{bar}", 8363},
+		{"foo{{bar}}zap", 4015},
+		{"foo{bar}{zap}", 5061},
+	}
+
+	for _, c := range cases {
+		if v := Slot(c.key); v != c.expected {
+			t.Errorf("unexpected: key=%s %v", c.key, v)
+		}
+	}
+}
@@ -59,7 +59,7 @@ func (cb *MiddlewareBridge) AllocateIDs(info *datastore.MiddlewareInfo, keys []d
 		otb:  cb.otb,
 		oib:  cb.oib,
 		mws:  cb.mws[1:],
-		Info: cb.Info,
+		Info: info,
 	}
 	left.Info.Next = left
 
@@ -77,7 +77,7 @@ func (cb *MiddlewareBridge) PutMultiWithoutTx(info *datastore.MiddlewareInfo, ke
 		otb:  cb.otb,
 		oib:  cb.oib,
 		mws:  cb.mws[1:],
-		Info: cb.Info,
+		Info: info,
 	}
 	left.Info.Next = left
 
@@ -95,7 +95,7 @@ func (cb *MiddlewareBridge) PutMultiWithTx(info *datastore.MiddlewareInfo, keys
 		otb:  cb.otb,
 		oib:  cb.oib,
 		mws:  cb.mws[1:],
-		Info: cb.Info,
+		Info: info,
 	}
 	left.Info.Next = left
 
@@ -113,7 +113,7 @@ func (cb *MiddlewareBridge) GetMultiWithoutTx(info *datastore.MiddlewareInfo, ke
 		otb:  cb.otb,
 		oib:  cb.oib,
 		mws:  cb.mws[1:],
-		Info: cb.Info,
+		Info: info,
 	}
 	left.Info.Next = left
 
@@ -131,7 +131,7 @@ func (cb *MiddlewareBridge) GetMultiWithTx(info *datastore.MiddlewareInfo, keys
 		otb:  cb.otb,
 		oib:  cb.oib,
 		mws:  cb.mws[1:],
-		Info: cb.Info,
+		Info: info,
 	}
 	left.Info.Next = left
 
@@ -149,7 +149,7 @@ func (cb *MiddlewareBridge) DeleteMultiWithoutTx(info *datastore.MiddlewareInfo,
 		otb:  cb.otb,
 		oib:  cb.oib,
 		mws:  cb.mws[1:],
-		Info: cb.Info,
+		Info: info,
 	}
 	left.Info.Next = left
 
@@ -167,7 +167,7 @@ func (cb *MiddlewareBridge) DeleteMultiWithTx(info *datastore.MiddlewareInfo, ke
 		otb:  cb.otb,
 		oib:  cb.oib,
 		mws:  cb.mws[1:],
-		Info: cb.Info,
+		Info: info,
 	}
 	left.Info.Next = left
 
@@ -185,7 +185,7 @@ func (cb *MiddlewareBridge) PostCommit(info *datastore.MiddlewareInfo, tx datast
 		otb:  cb.otb,
 		oib:  cb.oib,
 		mws:  cb.mws[1:],
-		Info: cb.Info,
+		Info: info,
 	}
 	left.Info.Next = left
 
@@ -203,7 +203,7 @@ func (cb *MiddlewareBridge) PostRollback(info *datastore.MiddlewareInfo, tx data
 		otb:  cb.otb,
 		oib:  cb.oib,
 		mws:  cb.mws[1:],
-		Info: cb.Info,
+		Info: info,
 	}
 	left.Info.Next = left
 
@@ -221,7 +221,7 @@ func (cb *MiddlewareBridge) Run(info *datastore.MiddlewareInfo, q datastore.Quer
 		otb:  cb.otb,
 		oib:  cb.oib,
 		mws:  cb.mws[1:],
-		Info: cb.Info,
+		Info: info,
 	}
 	left.Info.Next = left
 
@@ -239,7 +239,7 @@ func (cb *MiddlewareBridge) GetAll(info *datastore.MiddlewareInfo, q datastore.Q
 		otb:  cb.otb,
 		oib:  cb.oib,
 		mws:  cb.mws[1:],
-		Info: cb.Info,
+		Info: info,
 	}
 	left.Info.Next = left
 
@@ -257,7 +257,7 @@ func (cb *MiddlewareBridge) Next(info *datastore.MiddlewareInfo, q datastore.Que
 		otb:  cb.otb,
 		oib:  cb.oib,
 		mws:  cb.mws[1:],
-		Info: cb.Info,
+		Info: info,
 	}
 	left.Info.Next = left
 
@@ -275,7 +275,7 @@ func (cb *MiddlewareBridge) Count(info *datastore.MiddlewareInfo, q datastore.Qu
 		otb:  cb.otb,
 		oib:  cb.oib,
 		mws:  cb.mws[1:],
-		Info: cb.Info,
+		Info: info,
 	}
 	left.Info.Next = left
 
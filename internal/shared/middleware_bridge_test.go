@@ -0,0 +1,123 @@
+package shared_test
+
+import (
+	"context"
+	"testing"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/dsmiddleware/noop"
+	"go.mercari.io/datastore/internal/testutils"
+)
+
+type Data struct {
+	Name string
+}
+
+type contextKey struct{}
+
+// twice passes the copy of info with the new Context to the next middleware twice.
+type twice struct {
+	datastore.Middleware
+}
+
+func (m *twice) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	// the bridge updates info.Next by the call, it must be captured to call again.
+	next := info.Next
+	newInfo := *info
+	newInfo.Context = context.WithValue(info.Context, contextKey{}, "twice")
+
+	err := next.GetMultiWithoutTx(&newInfo, keys, psList)
+	if err != nil {
+		return err
+	}
+	return next.GetMultiWithoutTx(&newInfo, keys, psList)
+}
+
+// recorder records the Context value that the middleware receives.
+type recorder struct {
+	datastore.Middleware
+	values []interface{}
+}
+
+func (m *recorder) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	m.values = append(m.values, info.Context.Value(contextKey{}))
+	return info.Next.GetMultiWithoutTx(info, keys, psList)
+}
+
+func TestMiddlewareBridge_Info(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	rec := &recorder{Middleware: noop.New()}
+	client.AppendMiddleware(&twice{Middleware: noop.New()})
+	client.AppendMiddleware(rec)
+	client.AppendMiddleware(ms)
+
+	key := client.NameKey("Data", "a", nil)
+	_, err := client.Put(ctx, key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj := &Data{}
+	err = client.Get(ctx, key, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := obj.Name; v != "a" {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// both calls reach the next middleware with the new Context.
+	if v := len(rec.values); v != 2 {
+		t.Fatalf("unexpected: %v", v)
+	}
+	for _, v := range rec.values {
+		if v != "twice" {
+			t.Errorf("unexpected: %v", v)
+		}
+	}
+	if v := ms.Calls("GetMultiWithoutTx"); v != 2 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+// txValue sets the Context value in PutMultiWithTx, and records it in PostCommit.
+type txValue struct {
+	datastore.Middleware
+	value interface{}
+}
+
+func (m *txValue) PutMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.PendingKey, error) {
+	info.Context = context.WithValue(info.Context, contextKey{}, "tx")
+	return info.Next.PutMultiWithTx(info, keys, psList)
+}
+
+func (m *txValue) PostCommit(info *datastore.MiddlewareInfo, tx datastore.Transaction, commit datastore.Commit) error {
+	m.value = info.Context.Value(contextKey{})
+	return info.Next.PostCommit(info, tx, commit)
+}
+
+func TestMiddlewareBridge_TransactionInfo(t *testing.T) {
+	ctx, client, ms := testutils.SetupOnMemory()
+
+	mw := &txValue{Middleware: noop.New()}
+	tx := ms.NewTransaction(ctx, client, noop.New(), mw, noop.New(), ms)
+
+	key := client.NameKey("Data", "a", nil)
+	_, err := tx.PutMultiWithTx([]datastore.Key{key}, []datastore.PropertyList{{{Name: "Name", Value: "a"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the Context set in the transaction reaches PostCommit.
+	if v := mw.value; v != "tx" {
+		t.Errorf("unexpected: %v", v)
+	}
+	if _, ok := ms.Raw(key); !ok {
+		t.Errorf("unexpected: %v", ok)
+	}
+}
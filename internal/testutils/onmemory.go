@@ -0,0 +1,375 @@
+package testutils
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/clouddatastore"
+	"google.golang.org/api/iterator"
+)
+
+var _ datastore.Middleware = &OnMemoryDatastore{}
+
+var errNotSupported = errors.New("testutils: operation is not supported by OnMemoryDatastore")
+
+// SetupOnMemory returns Client that doesn't connect to any Datastore and Middleware that emulates Datastore on memory.
+// Append the returned middleware at the end of the chain, it never passes the RPC to the next.
+// Transaction is supported only by OnMemoryDatastore.NewTransaction, and filtered query is not supported.
+func SetupOnMemory() (context.Context, datastore.Client, *OnMemoryDatastore) {
+	ctx := context.Background()
+	client, err := clouddatastore.FromClient(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	return ctx, client, NewOnMemoryDatastore()
+}
+
+// NewOnMemoryDatastore returns the Middleware that emulates Datastore on memory.
+func NewOnMemoryDatastore() *OnMemoryDatastore {
+	return &OnMemoryDatastore{
+		entities: make(map[string]*datastore.Entity),
+		calls:    make(map[string]int),
+	}
+}
+
+// OnMemoryDatastore stores entities in machine local memory instead of Datastore.
+type OnMemoryDatastore struct {
+	m        sync.Mutex
+	entities map[string]*datastore.Entity
+	lastID   int64
+	calls    map[string]int
+}
+
+// Calls returns count of the operation called.
+func (ms *OnMemoryDatastore) Calls(opName string) int {
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	return ms.calls[opName]
+}
+
+// Raw returns stored PropertyList as it is.
+func (ms *OnMemoryDatastore) Raw(key datastore.Key) (datastore.PropertyList, bool) {
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	e, ok := ms.entities[key.Encode()]
+	if !ok {
+		return nil, false
+	}
+
+	return datastore.PropertyList(e.Properties), true
+}
+
+// SetRaw stores PropertyList as it is without any Middleware.
+func (ms *OnMemoryDatastore) SetRaw(key datastore.Key, ps datastore.PropertyList) {
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	ms.entities[key.Encode()] = &datastore.Entity{Key: key, Properties: ps}
+}
+
+// Len returns count of stored entities.
+func (ms *OnMemoryDatastore) Len() int {
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	return len(ms.entities)
+}
+
+func (ms *OnMemoryDatastore) called(opName string) {
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	ms.calls[opName]++
+}
+
+func (ms *OnMemoryDatastore) completeKey(client datastore.Client, key datastore.Key) datastore.Key {
+	ms.lastID++
+	newKey := client.IDKey(key.Kind(), ms.lastID, key.ParentKey())
+	newKey.SetNamespace(key.Namespace())
+
+	return newKey
+}
+
+// AllocateIDs assigns sequential IDs to keys.
+func (ms *OnMemoryDatastore) AllocateIDs(info *datastore.MiddlewareInfo, keys []datastore.Key) ([]datastore.Key, error) {
+	ms.called("AllocateIDs")
+
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	retKeys := make([]datastore.Key, 0, len(keys))
+	for _, key := range keys {
+		retKeys = append(retKeys, ms.completeKey(info.Client, key))
+	}
+
+	return retKeys, nil
+}
+
+// PutMultiWithoutTx stores entities.
+func (ms *OnMemoryDatastore) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.Key, error) {
+	ms.called("PutMultiWithoutTx")
+
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	retKeys := make([]datastore.Key, 0, len(keys))
+	for idx, key := range keys {
+		if key.Incomplete() {
+			key = ms.completeKey(info.Client, key)
+		}
+		ps := make(datastore.PropertyList, len(psList[idx]))
+		copy(ps, psList[idx])
+		ms.entities[key.Encode()] = &datastore.Entity{Key: key, Properties: ps}
+		retKeys = append(retKeys, key)
+	}
+
+	return retKeys, nil
+}
+
+// PutMultiWithTx buffers entities until the commit, only in OnMemoryTransaction.
+func (ms *OnMemoryDatastore) PutMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.PendingKey, error) {
+	ms.called("PutMultiWithTx")
+
+	tx, ok := info.Transaction.(*OnMemoryTransaction)
+	if !ok {
+		return nil, errNotSupported
+	}
+
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	pKeys := make([]datastore.PendingKey, 0, len(keys))
+	for idx, key := range keys {
+		if key.Incomplete() {
+			key = ms.completeKey(info.Client, key)
+		}
+		ps := make(datastore.PropertyList, len(psList[idx]))
+		copy(ps, psList[idx])
+		tx.writes = append(tx.writes, &onMemoryWrite{key: key, entity: &datastore.Entity{Key: key, Properties: ps}})
+		pKeys = append(pKeys, &onMemoryPendingKey{ctx: info.Context, key: key})
+	}
+
+	return pKeys, nil
+}
+
+// GetMultiWithoutTx loads stored entities.
+func (ms *OnMemoryDatastore) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	ms.called("GetMultiWithoutTx")
+
+	return ms.getMulti(keys, psList)
+}
+
+func (ms *OnMemoryDatastore) getMulti(keys []datastore.Key, psList []datastore.PropertyList) error {
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	merr := make(datastore.MultiError, len(keys))
+	foundErr := false
+	for idx, key := range keys {
+		e, ok := ms.entities[key.Encode()]
+		if !ok {
+			merr[idx] = datastore.ErrNoSuchEntity
+			foundErr = true
+			continue
+		}
+		ps := make(datastore.PropertyList, len(e.Properties))
+		copy(ps, e.Properties)
+		psList[idx] = ps
+	}
+	if foundErr {
+		return merr
+	}
+
+	return nil
+}
+
+// GetMultiWithTx loads stored entities, only in OnMemoryTransaction.
+// The writes buffered in the transaction aren't visible, as Datastore.
+func (ms *OnMemoryDatastore) GetMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	ms.called("GetMultiWithTx")
+
+	if _, ok := info.Transaction.(*OnMemoryTransaction); !ok {
+		return errNotSupported
+	}
+
+	return ms.getMulti(keys, psList)
+}
+
+// DeleteMultiWithoutTx removes entities.
+func (ms *OnMemoryDatastore) DeleteMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	ms.called("DeleteMultiWithoutTx")
+
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	for _, key := range keys {
+		delete(ms.entities, key.Encode())
+	}
+
+	return nil
+}
+
+// DeleteMultiWithTx buffers the deletions until the commit, only in OnMemoryTransaction.
+func (ms *OnMemoryDatastore) DeleteMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	ms.called("DeleteMultiWithTx")
+
+	tx, ok := info.Transaction.(*OnMemoryTransaction)
+	if !ok {
+		return errNotSupported
+	}
+
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	for _, key := range keys {
+		tx.writes = append(tx.writes, &onMemoryWrite{key: key})
+	}
+
+	return nil
+}
+
+// PostCommit does nothing.
+func (ms *OnMemoryDatastore) PostCommit(info *datastore.MiddlewareInfo, tx datastore.Transaction, commit datastore.Commit) error {
+	return nil
+}
+
+// PostRollback does nothing.
+func (ms *OnMemoryDatastore) PostRollback(info *datastore.MiddlewareInfo, tx datastore.Transaction) error {
+	return nil
+}
+
+func (ms *OnMemoryDatastore) query(qDump *datastore.QueryDump) ([]*datastore.Entity, error) {
+	if len(qDump.Filter) != 0 || len(qDump.Order) != 0 || len(qDump.Project) != 0 || qDump.Start != nil || qDump.End != nil {
+		return nil, errNotSupported
+	}
+
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	list := make([]*datastore.Entity, 0, len(ms.entities))
+	for _, e := range ms.entities {
+		if qDump.Kind != "" && e.Key.Kind() != qDump.Kind {
+			continue
+		}
+		if e.Key.Namespace() != qDump.Namespace {
+			continue
+		}
+		if qDump.Ancestor != nil && !hasAncestor(e.Key, qDump.Ancestor) {
+			continue
+		}
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Key.String() < list[j].Key.String()
+	})
+
+	if qDump.Offset != 0 {
+		if len(list) < qDump.Offset {
+			list = nil
+		} else {
+			list = list[qDump.Offset:]
+		}
+	}
+	if 0 < qDump.Limit && qDump.Limit < len(list) {
+		list = list[:qDump.Limit]
+	}
+
+	return list, nil
+}
+
+func hasAncestor(key, ancestor datastore.Key) bool {
+	for k := key; k != nil; k = k.ParentKey() {
+		if k.Equal(ancestor) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Run returns iterator that loads entities directly, the Next operation doesn't go through middlewares.
+func (ms *OnMemoryDatastore) Run(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) datastore.Iterator {
+	ms.called("Run")
+
+	list, err := ms.query(qDump)
+	return &onMemoryIterator{ctx: info.Context, list: list, keysOnly: qDump.KeysOnly, err: err}
+}
+
+// GetAll returns entities which matched by kind and ancestor.
+func (ms *OnMemoryDatastore) GetAll(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, psList *[]datastore.PropertyList) ([]datastore.Key, error) {
+	ms.called("GetAll")
+
+	list, err := ms.query(qDump)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]datastore.Key, 0, len(list))
+	for _, e := range list {
+		keys = append(keys, e.Key)
+		if !qDump.KeysOnly {
+			ps := make(datastore.PropertyList, len(e.Properties))
+			copy(ps, e.Properties)
+			*psList = append(*psList, ps)
+		}
+	}
+
+	return keys, nil
+}
+
+// Next is not supported.
+func (ms *OnMemoryDatastore) Next(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, iter datastore.Iterator, ps *datastore.PropertyList) (datastore.Key, error) {
+	ms.called("Next")
+	return nil, errNotSupported
+}
+
+// Count returns count of entities which matched by kind and ancestor.
+func (ms *OnMemoryDatastore) Count(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) (int, error) {
+	ms.called("Count")
+
+	list, err := ms.query(qDump)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(list), nil
+}
+
+type onMemoryIterator struct {
+	ctx      context.Context
+	list     []*datastore.Entity
+	keysOnly bool
+	err      error
+}
+
+func (it *onMemoryIterator) Next(dst interface{}) (datastore.Key, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	if len(it.list) == 0 {
+		return nil, iterator.Done
+	}
+
+	e := it.list[0]
+	it.list = it.list[1:]
+	if !it.keysOnly && dst != nil {
+		ps := make(datastore.PropertyList, len(e.Properties))
+		copy(ps, e.Properties)
+		err := datastore.LoadEntity(it.ctx, dst, &datastore.Entity{Key: e.Key, Properties: ps})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return e.Key, nil
+}
+
+func (it *onMemoryIterator) Cursor() (datastore.Cursor, error) {
+	return nil, errNotSupported
+}
@@ -0,0 +1,471 @@
+package testutils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mercari.io/datastore/internal/redisslot"
+)
+
+// RedisSlotRange is the range of the hash slots served by the node of Redis Cluster.
+type RedisSlotRange struct {
+	Start int
+	End   int
+	Addr  string
+}
+
+// RedisServer is the in-process Redis stand-in for tests.
+// It supports PING, GET, MGET, SET (with NX, EX or PX), DEL, PTTL, FLUSHALL, CLUSTER SLOTS, ASKING
+// and the transaction by WATCH, UNWATCH, MULTI, EXEC and DISCARD.
+type RedisServer struct {
+	Addr string
+
+	l         net.Listener
+	m         sync.Mutex
+	conns     map[net.Conn]bool
+	data      map[string]*redisValue
+	calls     map[string]int
+	slots     []RedisSlotRange
+	migrating *RedisSlotRange // the slots moving to Addr, the missing keys are replied by ASK
+	importing *RedisSlotRange // the slots moving from Addr, the keys are served after ASKING
+	version   uint64
+	versions  map[string]uint64 // the version of the last modification by the key, WATCH compares it
+}
+
+// redisSession is the transaction state of a connection.
+type redisSession struct {
+	asking  bool
+	watched map[string]uint64
+	multi   bool
+	queued  [][]string
+}
+
+type redisValue struct {
+	b        []byte
+	expireAt time.Time
+}
+
+// StartRedisServer starts RedisServer on the loopback address.
+func StartRedisServer() (*RedisServer, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	rs := &RedisServer{
+		Addr:     l.Addr().String(),
+		l:        l,
+		conns:    make(map[net.Conn]bool),
+		data:     make(map[string]*redisValue),
+		calls:    make(map[string]int),
+		versions: make(map[string]uint64),
+	}
+	go rs.serve()
+
+	return rs, nil
+}
+
+// SetClusterSlots makes the server a node of Redis Cluster.
+// The keys of the slots served by the other nodes are replied by MOVED.
+func (rs *RedisServer) SetClusterSlots(slots []RedisSlotRange) {
+	rs.m.Lock()
+	defer rs.m.Unlock()
+	rs.slots = slots
+}
+
+// SetMigratingSlots makes the slots of r migrate to r.Addr.
+// The keys that the server doesn't have are replied by ASK, nil stops the migration.
+func (rs *RedisServer) SetMigratingSlots(r *RedisSlotRange) {
+	rs.m.Lock()
+	defer rs.m.Unlock()
+	rs.migrating = r
+}
+
+// SetImportingSlots makes the server accept the keys of the slots of r after ASKING, r.Addr is the source node.
+// nil stops the import.
+func (rs *RedisServer) SetImportingSlots(r *RedisSlotRange) {
+	rs.m.Lock()
+	defer rs.m.Unlock()
+	rs.importing = r
+}
+
+// Calls returns count of the command called.
+func (rs *RedisServer) Calls(cmd string) int {
+	rs.m.Lock()
+	defer rs.m.Unlock()
+	return rs.calls[strings.ToUpper(cmd)]
+}
+
+// Get returns the value of the key.
+func (rs *RedisServer) Get(key string) ([]byte, bool) {
+	rs.m.Lock()
+	defer rs.m.Unlock()
+	v := rs.get(key)
+	if v == nil {
+		return nil, false
+	}
+	return v.b, true
+}
+
+// Len returns count of the stored keys.
+func (rs *RedisServer) Len() int {
+	rs.m.Lock()
+	defer rs.m.Unlock()
+	return len(rs.data)
+}
+
+// Close stops the server and closes all connections, the clients see it as the node failure.
+func (rs *RedisServer) Close() error {
+	err := rs.l.Close()
+
+	rs.m.Lock()
+	defer rs.m.Unlock()
+	for conn := range rs.conns {
+		conn.Close()
+	}
+
+	return err
+}
+
+func (rs *RedisServer) serve() {
+	for {
+		conn, err := rs.l.Accept()
+		if err != nil {
+			return
+		}
+		rs.m.Lock()
+		rs.conns[conn] = true
+		rs.m.Unlock()
+
+		go rs.handle(conn)
+	}
+}
+
+func (rs *RedisServer) handle(conn net.Conn) {
+	defer func() {
+		rs.m.Lock()
+		delete(rs.conns, conn)
+		rs.m.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	sess := &redisSession{}
+	for {
+		args, err := readRedisCommand(r)
+		if err != nil {
+			return
+		}
+		rs.exec(sess, w, args)
+		// flush after the pipelined commands are processed.
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func readRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, errors.New("testutils: inline command is not supported")
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args = append(args, string(b[:size]))
+	}
+
+	return args, nil
+}
+
+func (rs *RedisServer) get(key string) *redisValue {
+	v, ok := rs.data[key]
+	if !ok {
+		return nil
+	}
+	if !v.expireAt.IsZero() && !time.Now().Before(v.expireAt) {
+		rs.delete(key)
+		return nil
+	}
+	return v
+}
+
+func (rs *RedisServer) set(key string, v *redisValue) {
+	rs.data[key] = v
+	rs.touch(key)
+}
+
+func (rs *RedisServer) delete(key string) {
+	delete(rs.data, key)
+	rs.touch(key)
+}
+
+// touch bumps the version of the key, the transactions watching it fail.
+func (rs *RedisServer) touch(key string) {
+	rs.version++
+	rs.versions[key] = rs.version
+}
+
+// checkSlots returns the error reply if the keys aren't served by the node.
+// asking is true if the command follows ASKING.
+func (rs *RedisServer) checkSlots(keys []string, asking bool) string {
+	if len(rs.slots) == 0 || len(keys) == 0 {
+		return ""
+	}
+
+	slot := redisslot.Slot(keys[0])
+	for _, key := range keys[1:] {
+		if redisslot.Slot(key) != slot {
+			return "CROSSSLOT Keys in request don't hash to the same slot"
+		}
+	}
+	if asking && rs.importing != nil && rs.importing.Start <= slot && slot <= rs.importing.End {
+		return ""
+	}
+	for _, r := range rs.slots {
+		if r.Start <= slot && slot <= r.End {
+			if r.Addr != rs.Addr {
+				return fmt.Sprintf("MOVED %d %s", slot, r.Addr)
+			}
+			if rs.migrating != nil && rs.migrating.Start <= slot && slot <= rs.migrating.End {
+				for _, key := range keys {
+					if rs.get(key) == nil {
+						return fmt.Sprintf("ASK %d %s", slot, rs.migrating.Addr)
+					}
+				}
+			}
+			return ""
+		}
+	}
+
+	return "CLUSTERDOWN Hash slot not served"
+}
+
+func (rs *RedisServer) exec(sess *redisSession, w *bufio.Writer, args []string) {
+	rs.m.Lock()
+	defer rs.m.Unlock()
+
+	if len(args) == 0 {
+		writeRedisError(w, "ERR empty command")
+		return
+	}
+	cmd := strings.ToUpper(args[0])
+	rs.calls[cmd]++
+
+	switch cmd {
+	case "MULTI":
+		if sess.multi {
+			writeRedisError(w, "ERR MULTI calls can not be nested")
+			return
+		}
+		sess.multi = true
+		w.WriteString("+OK\r\n")
+		return
+	case "EXEC":
+		if !sess.multi {
+			writeRedisError(w, "ERR EXEC without MULTI")
+			return
+		}
+		queued, watched := sess.queued, sess.watched
+		sess.multi, sess.queued, sess.watched = false, nil, nil
+		for key, version := range watched {
+			if rs.versions[key] != version {
+				w.WriteString("*-1\r\n")
+				return
+			}
+		}
+		fmt.Fprintf(w, "*%d\r\n", len(queued))
+		for _, args := range queued {
+			rs.command(sess, w, args)
+		}
+		return
+	case "DISCARD":
+		if !sess.multi {
+			writeRedisError(w, "ERR DISCARD without MULTI")
+			return
+		}
+		sess.multi, sess.queued, sess.watched = false, nil, nil
+		w.WriteString("+OK\r\n")
+		return
+	}
+
+	if sess.multi {
+		if cmd == "WATCH" {
+			writeRedisError(w, "ERR WATCH inside MULTI is not allowed")
+			return
+		}
+		sess.queued = append(sess.queued, args)
+		w.WriteString("+QUEUED\r\n")
+		return
+	}
+
+	if cmd == "ASKING" {
+		sess.asking = true
+		w.WriteString("+OK\r\n")
+		return
+	}
+	rs.command(sess, w, args)
+}
+
+func (rs *RedisServer) command(sess *redisSession, w *bufio.Writer, args []string) {
+	cmd := strings.ToUpper(args[0])
+	// ASKING affects only the next command.
+	asking := sess.asking
+	sess.asking = false
+
+	var keys []string
+	switch cmd {
+	case "GET", "SET", "PTTL":
+		if len(args) < 2 {
+			writeRedisError(w, "ERR wrong number of arguments")
+			return
+		}
+		keys = args[1:2]
+	case "MGET", "DEL", "WATCH":
+		keys = args[1:]
+	}
+	if msg := rs.checkSlots(keys, asking); msg != "" {
+		writeRedisError(w, msg)
+		return
+	}
+
+	switch cmd {
+	case "WATCH":
+		if sess.watched == nil {
+			sess.watched = make(map[string]uint64)
+		}
+		for _, key := range keys {
+			rs.get(key)
+			sess.watched[key] = rs.versions[key]
+		}
+		w.WriteString("+OK\r\n")
+	case "UNWATCH":
+		sess.watched = nil
+		w.WriteString("+OK\r\n")
+	case "PING":
+		w.WriteString("+PONG\r\n")
+	case "GET":
+		writeRedisBulk(w, rs.get(args[1]))
+	case "MGET":
+		fmt.Fprintf(w, "*%d\r\n", len(keys))
+		for _, key := range keys {
+			writeRedisBulk(w, rs.get(key))
+		}
+	case "SET":
+		if len(args) < 3 {
+			writeRedisError(w, "ERR wrong number of arguments")
+			return
+		}
+		v := &redisValue{b: []byte(args[2])}
+		nx := false
+		for i := 3; i < len(args); i++ {
+			opt := strings.ToUpper(args[i])
+			if opt == "NX" {
+				nx = true
+				continue
+			}
+			if i+1 == len(args) {
+				writeRedisError(w, "ERR syntax error")
+				return
+			}
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				writeRedisError(w, "ERR value is not an integer or out of range")
+				return
+			}
+			switch opt {
+			case "EX":
+				v.expireAt = time.Now().Add(time.Duration(n) * time.Second)
+			case "PX":
+				v.expireAt = time.Now().Add(time.Duration(n) * time.Millisecond)
+			}
+		}
+		if nx && rs.get(args[1]) != nil {
+			w.WriteString("$-1\r\n")
+			return
+		}
+		rs.set(args[1], v)
+		w.WriteString("+OK\r\n")
+	case "DEL":
+		cnt := 0
+		for _, key := range keys {
+			if rs.get(key) != nil {
+				rs.delete(key)
+				cnt++
+			}
+		}
+		fmt.Fprintf(w, ":%d\r\n", cnt)
+	case "PTTL":
+		v := rs.get(args[1])
+		switch {
+		case v == nil:
+			w.WriteString(":-2\r\n")
+		case v.expireAt.IsZero():
+			w.WriteString(":-1\r\n")
+		default:
+			fmt.Fprintf(w, ":%d\r\n", time.Until(v.expireAt)/time.Millisecond)
+		}
+	case "FLUSHALL":
+		for key := range rs.data {
+			rs.touch(key)
+		}
+		rs.data = make(map[string]*redisValue)
+		w.WriteString("+OK\r\n")
+	case "CLUSTER":
+		if len(args) != 2 || strings.ToUpper(args[1]) != "SLOTS" || len(rs.slots) == 0 {
+			writeRedisError(w, "ERR This instance has cluster support disabled")
+			return
+		}
+		fmt.Fprintf(w, "*%d\r\n", len(rs.slots))
+		for _, r := range rs.slots {
+			host, port, _ := net.SplitHostPort(r.Addr)
+			fmt.Fprintf(w, "*3\r\n:%d\r\n:%d\r\n*2\r\n$%d\r\n%s\r\n:%s\r\n", r.Start, r.End, len(host), host, port)
+		}
+	default:
+		writeRedisError(w, fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+}
+
+func writeRedisError(w *bufio.Writer, msg string) {
+	w.WriteString("-" + msg + "\r\n")
+}
+
+func writeRedisBulk(w *bufio.Writer, v *redisValue) {
+	if v == nil {
+		w.WriteString("$-1\r\n")
+		return
+	}
+	fmt.Fprintf(w, "$%d\r\n", len(v.b))
+	w.Write(v.b)
+	w.WriteString("\r\n")
+}
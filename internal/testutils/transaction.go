@@ -0,0 +1,162 @@
+package testutils
+
+import (
+	"context"
+	"errors"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/internal/shared"
+)
+
+var _ datastore.Transaction = &OnMemoryTransaction{}
+var _ datastore.Commit = &onMemoryCommit{}
+
+var errFinished = errors.New("testutils: transaction is already committed or rolled back")
+
+// OnMemoryTransaction calls the middlewares in the transaction as the client does, without Datastore.
+// The middlewares receive it as MiddlewareInfo.Transaction, and the same MiddlewareInfo is shared until PostCommit or PostRollback.
+// The writes are buffered by OnMemoryDatastore, and applied by Commit.
+// The methods of datastore.Transaction that take the structs are not supported.
+type OnMemoryTransaction struct {
+	ms       *OnMemoryDatastore
+	mws      []datastore.Middleware
+	info     *datastore.MiddlewareInfo
+	writes   []*onMemoryWrite
+	finished bool
+}
+
+// onMemoryWrite is the buffered write, entity is nil for the deletion.
+type onMemoryWrite struct {
+	key    datastore.Key
+	entity *datastore.Entity
+}
+
+type onMemoryPendingKey struct {
+	ctx context.Context
+	key datastore.Key
+}
+
+func (p *onMemoryPendingKey) StoredContext() context.Context {
+	return p.ctx
+}
+
+type onMemoryCommit struct{}
+
+func (c *onMemoryCommit) Key(p datastore.PendingKey) datastore.Key {
+	return p.(*onMemoryPendingKey).key
+}
+
+// NewTransaction begins the transaction that passes the operations to mws.
+// mws should end with OnMemoryDatastore, as the middlewares of the client.
+func (ms *OnMemoryDatastore) NewTransaction(ctx context.Context, client datastore.Client, mws ...datastore.Middleware) *OnMemoryTransaction {
+	tx := &OnMemoryTransaction{
+		ms:  ms,
+		mws: mws,
+	}
+	tx.info = &datastore.MiddlewareInfo{
+		Context:     ctx,
+		Client:      client,
+		Transaction: tx,
+	}
+
+	return tx
+}
+
+func (tx *OnMemoryTransaction) bridge() *shared.MiddlewareBridge {
+	return shared.NewCacheBridge(tx.info, nil, nil, nil, tx.mws)
+}
+
+// PutMultiWithTx passes PutMultiWithTx to the middlewares.
+func (tx *OnMemoryTransaction) PutMultiWithTx(keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.PendingKey, error) {
+	if tx.finished {
+		return nil, errFinished
+	}
+	return tx.bridge().PutMultiWithTx(tx.info, keys, psList)
+}
+
+// GetMultiWithTx passes GetMultiWithTx to the middlewares.
+func (tx *OnMemoryTransaction) GetMultiWithTx(keys []datastore.Key, psList []datastore.PropertyList) error {
+	if tx.finished {
+		return errFinished
+	}
+	return tx.bridge().GetMultiWithTx(tx.info, keys, psList)
+}
+
+// DeleteMultiWithTx passes DeleteMultiWithTx to the middlewares.
+func (tx *OnMemoryTransaction) DeleteMultiWithTx(keys []datastore.Key) error {
+	if tx.finished {
+		return errFinished
+	}
+	return tx.bridge().DeleteMultiWithTx(tx.info, keys)
+}
+
+// Commit applies the buffered writes, and passes PostCommit to the middlewares.
+func (tx *OnMemoryTransaction) Commit() (datastore.Commit, error) {
+	if tx.finished {
+		return nil, errFinished
+	}
+	tx.finished = true
+
+	tx.ms.m.Lock()
+	for _, w := range tx.writes {
+		if w.entity == nil {
+			delete(tx.ms.entities, w.key.Encode())
+		} else {
+			tx.ms.entities[w.key.Encode()] = w.entity
+		}
+	}
+	tx.ms.m.Unlock()
+
+	commit := &onMemoryCommit{}
+	err := tx.bridge().PostCommit(tx.info, tx, commit)
+	if err != nil {
+		return nil, err
+	}
+
+	return commit, nil
+}
+
+// Rollback discards the buffered writes, and passes PostRollback to the middlewares.
+func (tx *OnMemoryTransaction) Rollback() error {
+	if tx.finished {
+		return errFinished
+	}
+	tx.finished = true
+
+	return tx.bridge().PostRollback(tx.info, tx)
+}
+
+// Get is not supported.
+func (tx *OnMemoryTransaction) Get(key datastore.Key, dst interface{}) error {
+	return errNotSupported
+}
+
+// GetMulti is not supported.
+func (tx *OnMemoryTransaction) GetMulti(keys []datastore.Key, dst interface{}) error {
+	return errNotSupported
+}
+
+// Put is not supported.
+func (tx *OnMemoryTransaction) Put(key datastore.Key, src interface{}) (datastore.PendingKey, error) {
+	return nil, errNotSupported
+}
+
+// PutMulti is not supported.
+func (tx *OnMemoryTransaction) PutMulti(keys []datastore.Key, src interface{}) ([]datastore.PendingKey, error) {
+	return nil, errNotSupported
+}
+
+// Delete is not supported.
+func (tx *OnMemoryTransaction) Delete(key datastore.Key) error {
+	return errNotSupported
+}
+
+// DeleteMulti is not supported.
+func (tx *OnMemoryTransaction) DeleteMulti(keys []datastore.Key) error {
+	return errNotSupported
+}
+
+// Batch is not supported.
+func (tx *OnMemoryTransaction) Batch() *datastore.TransactionBatch {
+	return nil
+}
@@ -0,0 +1,34 @@
+/*
+Package lease provides the distributed lease (mutex) stored in Datastore.
+
+A lease is a named lock entity, it is acquired, renewed and released through transactions.
+It can be used for the leader election of cron-like singleton jobs running on many instances.
+
+	l := lease.New(client, "daily-batch", lease.WithTTL(30*time.Second))
+	lock, err := l.Acquire(ctx)
+	if err == lease.ErrLeaseHeld {
+		// another instance is the leader.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer lock.Release(ctx)
+
+	// lock.Context() is cancelled when the lease is lost.
+	return doJob(lock.Context(), lock.Token())
+
+The Lock renews the lease in background at WithRenewInterval until it is released.
+When the renewal fails and the lease expires, or another holder takes the lease,
+the context returned by Lock.Context is cancelled.
+
+Acquire fails with ErrLeaseHeld while the lease is held, even by the same holder,
+so the holder that runs the job concurrently doesn't get two Locks.
+Reacquire with the token of the held lease takes it over, e.g. after the restart of the process.
+
+Every acquisition increments the fencing token.
+Pass the token to the storage that the job writes, and reject the write with an older token,
+so the writes from the holder that lost the lease are never applied.
+
+The expiration is decided by the clock of each instance, keep the TTL long enough for the clock skew.
+*/
+package lease // import "go.mercari.io/datastore/lease"
@@ -0,0 +1,349 @@
+package lease
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.mercari.io/datastore"
+)
+
+const (
+	defaultTTL  = 30 * time.Second
+	defaultKind = "Lease"
+)
+
+// ErrLeaseHeld is returned by Acquire when the lease is held, even by the same holder.
+var ErrLeaseHeld = errors.New("lease: lease is held")
+
+// ErrLeaseLost is returned when the lease is expired or taken by another holder.
+var ErrLeaseLost = errors.New("lease: lease is lost")
+
+type entity struct {
+	Holder     string
+	Token      int64     `datastore:",noindex"`
+	ExpiresAt  time.Time `datastore:",noindex"`
+	AcquiredAt time.Time `datastore:",noindex"`
+	RenewedAt  time.Time `datastore:",noindex"`
+}
+
+// Status represents the current state of the lease entity.
+type Status struct {
+	Holder    string
+	Token     int64
+	ExpiresAt time.Time
+}
+
+// Held reports whether the lease is held by someone at now.
+func (s *Status) Held(now time.Time) bool {
+	return s.Holder != "" && now.Before(s.ExpiresAt)
+}
+
+// New returns the Lease identified by name.
+func New(client datastore.Client, name string, opts ...Option) *Lease {
+	l := &Lease{
+		client: client,
+		name:   name,
+		ttl:    defaultTTL,
+		kind:   defaultKind,
+	}
+
+	for _, opt := range opts {
+		opt.Apply(l)
+	}
+
+	if l.renewInterval == 0 {
+		l.renewInterval = l.ttl / 3
+	}
+	if l.holder == "" {
+		l.holder = defaultHolder()
+	}
+	if l.logf == nil {
+		l.logf = func(ctx context.Context, format string, args ...interface{}) {}
+	}
+
+	return l
+}
+
+// A Option is an option for Lease.
+type Option interface {
+	Apply(*Lease)
+}
+
+// Lease is the named lock stored in Datastore.
+type Lease struct {
+	client        datastore.Client
+	name          string
+	ttl           time.Duration
+	renewInterval time.Duration
+	holder        string
+	kind          string
+	logf          func(ctx context.Context, format string, args ...interface{})
+}
+
+func defaultHolder() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(b))
+}
+
+// Name returns the name of the lease.
+func (l *Lease) Name() string {
+	return l.name
+}
+
+// Holder returns the identity of the holder.
+func (l *Lease) Holder() string {
+	return l.holder
+}
+
+func (l *Lease) key() datastore.Key {
+	return l.client.NameKey(l.kind, l.name, nil)
+}
+
+// Status returns the current state of the lease entity.
+func (l *Lease) Status(ctx context.Context) (*Status, error) {
+	e := &entity{}
+	err := l.client.Get(ctx, l.key(), e)
+	if err == datastore.ErrNoSuchEntity {
+		return &Status{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &Status{Holder: e.Holder, Token: e.Token, ExpiresAt: e.ExpiresAt}, nil
+}
+
+// Acquire takes the lease. It returns ErrLeaseHeld when the lease is held, by another holder or by the same holder.
+// The returned Lock holds the context derived from ctx, it is cancelled when the lease is lost or released.
+func (l *Lease) Acquire(ctx context.Context) (*Lock, error) {
+	return l.acquire(ctx, 0)
+}
+
+// Reacquire takes over the lease that the same holder holds with token, e.g. after the restart of the process.
+// The token is incremented, so the Lock acquired with token is lost.
+// It returns ErrLeaseHeld when the lease is held by another holder or with the other token.
+func (l *Lease) Reacquire(ctx context.Context, token int64) (*Lock, error) {
+	return l.acquire(ctx, token)
+}
+
+// acquire takes the lease, token is the token of the lease held by the same holder, or 0.
+func (l *Lease) acquire(ctx context.Context, token int64) (*Lock, error) {
+	var e *entity
+	_, err := l.client.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		e = &entity{}
+		err := tx.Get(l.key(), e)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		now := time.Now()
+		own := token != 0 && e.Holder == l.holder && e.Token == token
+		if e.Holder != "" && now.Before(e.ExpiresAt) && !own {
+			return ErrLeaseHeld
+		}
+
+		e.Holder = l.holder
+		e.Token++
+		e.ExpiresAt = now.Add(l.ttl)
+		e.AcquiredAt = now
+		e.RenewedAt = now
+		_, err = tx.Put(l.key(), e)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	l.logf(ctx, "lease.Acquire: name=%s holder=%s token=%d", l.name, l.holder, e.Token)
+
+	lockCtx, cancel := context.WithCancel(ctx)
+	lk := &Lock{
+		lease:     l,
+		token:     e.Token,
+		ctx:       lockCtx,
+		cancel:    cancel,
+		expiresAt: e.ExpiresAt,
+	}
+	lk.timer = time.AfterFunc(time.Until(e.ExpiresAt), lk.expire)
+	if 0 < l.renewInterval {
+		go lk.keepAlive()
+	}
+
+	return lk, nil
+}
+
+// Lock represents the acquired lease.
+type Lock struct {
+	lease  *Lease
+	token  int64
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	m         sync.Mutex
+	expiresAt time.Time
+	timer     *time.Timer
+	lost      bool
+}
+
+// Token returns the fencing token. It increases every time the lease is acquired.
+func (lk *Lock) Token() int64 {
+	return lk.token
+}
+
+// Holder returns the identity of the holder.
+func (lk *Lock) Holder() string {
+	return lk.lease.holder
+}
+
+// ExpiresAt returns the time when the lease expires unless it is renewed.
+func (lk *Lock) ExpiresAt() time.Time {
+	lk.m.Lock()
+	defer lk.m.Unlock()
+
+	return lk.expiresAt
+}
+
+// Context returns the context that is cancelled when the lease is lost or released.
+func (lk *Lock) Context() context.Context {
+	return lk.ctx
+}
+
+func (lk *Lock) markLost(reason string) {
+	lk.m.Lock()
+	defer lk.m.Unlock()
+
+	if lk.lost {
+		return
+	}
+	lk.lost = true
+	lk.timer.Stop()
+	lk.cancel()
+
+	lk.lease.logf(lk.ctx, "lease: name=%s holder=%s token=%d is finished, %s", lk.lease.name, lk.lease.holder, lk.token, reason)
+}
+
+func (lk *Lock) expire() {
+	lk.markLost("expired")
+}
+
+func (lk *Lock) keepAlive() {
+	ticker := time.NewTicker(lk.lease.renewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lk.ctx.Done():
+			return
+		case <-ticker.C:
+			err := lk.Renew(lk.ctx)
+			if err == ErrLeaseLost {
+				return
+			} else if err != nil {
+				// retry at next tick until the lease expires.
+				lk.lease.logf(lk.ctx, "lease.keepAlive: name=%s renew failed err=%s", lk.lease.name, err.Error())
+			}
+		}
+	}
+}
+
+// Renew extends the lease by TTL. It returns ErrLeaseLost when the lease is expired or taken by another holder.
+func (lk *Lock) Renew(ctx context.Context) error {
+	lk.m.Lock()
+	lost := lk.lost
+	lk.m.Unlock()
+	if lost {
+		return ErrLeaseLost
+	}
+
+	l := lk.lease
+	var expiresAt time.Time
+	_, err := l.client.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		e := &entity{}
+		err := tx.Get(l.key(), e)
+		if err == datastore.ErrNoSuchEntity {
+			return ErrLeaseLost
+		} else if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if e.Holder != l.holder || e.Token != lk.token || !now.Before(e.ExpiresAt) {
+			return ErrLeaseLost
+		}
+
+		e.ExpiresAt = now.Add(l.ttl)
+		e.RenewedAt = now
+		expiresAt = e.ExpiresAt
+		_, err = tx.Put(l.key(), e)
+		return err
+	})
+	if err == ErrLeaseLost {
+		lk.markLost("taken by another holder")
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	lk.m.Lock()
+	defer lk.m.Unlock()
+	if lk.lost {
+		// expired while renewing.
+		return ErrLeaseLost
+	}
+	lk.expiresAt = expiresAt
+	lk.timer.Stop()
+	lk.timer = time.AfterFunc(time.Until(expiresAt), lk.expire)
+
+	return nil
+}
+
+// Release gives up the lease, then the context of Lock is cancelled.
+// The fencing token is kept in the entity, so the next acquisition gets the larger token.
+func (lk *Lock) Release(ctx context.Context) error {
+	lk.m.Lock()
+	lost := lk.lost
+	lk.m.Unlock()
+	if lost {
+		return ErrLeaseLost
+	}
+
+	l := lk.lease
+	_, err := l.client.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		e := &entity{}
+		err := tx.Get(l.key(), e)
+		if err == datastore.ErrNoSuchEntity {
+			return ErrLeaseLost
+		} else if err != nil {
+			return err
+		}
+		if e.Holder != l.holder || e.Token != lk.token {
+			return ErrLeaseLost
+		}
+
+		e.Holder = ""
+		e.ExpiresAt = time.Now()
+		_, err = tx.Put(l.key(), e)
+		return err
+	})
+	if err == ErrLeaseLost {
+		lk.markLost("taken by another holder")
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	lk.markLost("released")
+
+	return nil
+}
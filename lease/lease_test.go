@@ -0,0 +1,21 @@
+package lease_test
+
+import (
+	"testing"
+
+	"go.mercari.io/datastore/internal/testutils"
+	"go.mercari.io/datastore/testsuite"
+	leasesuite "go.mercari.io/datastore/testsuite/lease"
+)
+
+func TestLease(t *testing.T) {
+	for name, test := range leasesuite.TestSuite {
+		t.Run(name, func(t *testing.T) {
+			ctx, client, cleanUp := testutils.SetupCloudDatastore(t)
+			defer cleanUp()
+
+			ctx = testsuite.WrapCloudFlag(ctx)
+			test(ctx, t, client)
+		})
+	}
+}
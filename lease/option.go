@@ -0,0 +1,64 @@
+package lease
+
+import (
+	"context"
+	"time"
+)
+
+// WithTTL specifies the lifetime of the lease. default is 30 seconds.
+func WithTTL(d time.Duration) Option {
+	return &withTTL{d}
+}
+
+type withTTL struct{ d time.Duration }
+
+func (w *withTTL) Apply(o *Lease) {
+	o.ttl = w.d
+}
+
+// WithRenewInterval specifies the interval of the renewal in background. default is 1/3 of TTL.
+// Negative value disables the renewal in background, call Lock.Renew by yourself.
+func WithRenewInterval(d time.Duration) Option {
+	return &withRenewInterval{d}
+}
+
+type withRenewInterval struct{ d time.Duration }
+
+func (w *withRenewInterval) Apply(o *Lease) {
+	o.renewInterval = w.d
+}
+
+// WithHolder specifies the identity of the holder. default is generated from the hostname and process ID.
+func WithHolder(holder string) Option {
+	return &withHolder{holder}
+}
+
+type withHolder struct{ holder string }
+
+func (w *withHolder) Apply(o *Lease) {
+	o.holder = w.holder
+}
+
+// WithKind specifies the Kind of the lease entity. default is "Lease".
+func WithKind(kind string) Option {
+	return &withKind{kind}
+}
+
+type withKind struct{ kind string }
+
+func (w *withKind) Apply(o *Lease) {
+	o.kind = w.kind
+}
+
+// WithLogger creates a Option that uses the specified logger.
+func WithLogger(logf func(ctx context.Context, format string, args ...interface{})) Option {
+	return &withLogger{logf}
+}
+
+type withLogger struct {
+	logf func(ctx context.Context, format string, args ...interface{})
+}
+
+func (w *withLogger) Apply(o *Lease) {
+	o.logf = w.logf
+}
@@ -0,0 +1,294 @@
+package namespace
+
+import (
+	"context"
+	"errors"
+
+	"go.mercari.io/datastore"
+)
+
+var _ datastore.Client = &Client{}
+
+// ErrNamespaceMismatch is returned when the key or the query belongs to the other namespace.
+var ErrNamespaceMismatch = errors.New("namespace: key or query belongs to the other namespace")
+
+// A Option is an option for Client.
+type Option interface {
+	Apply(*Client)
+}
+
+// Client is the datastore.Client bound to a namespace.
+type Client struct {
+	client  datastore.Client
+	ns      string
+	rewrite bool
+}
+
+// NewClient returns the Client that creates the keys and the queries in ns,
+// and rejects the keys and the queries of the other namespaces.
+func NewClient(client datastore.Client, ns string, opts ...Option) *Client {
+	c := &Client{
+		client: client,
+		ns:     ns,
+	}
+	for _, opt := range opts {
+		opt.Apply(c)
+	}
+
+	return c
+}
+
+// Namespace returns the namespace bound to the client.
+func (c *Client) Namespace() string {
+	return c.ns
+}
+
+// Unwrap returns the client that isn't bound to the namespace.
+func (c *Client) Unwrap() datastore.Client {
+	return c.client
+}
+
+// matches reports whether key and all of its ancestors belong to the namespace.
+func (c *Client) matches(key datastore.Key) bool {
+	for k := key; k != nil; k = k.ParentKey() {
+		if k.Namespace() != c.ns {
+			return false
+		}
+	}
+	return true
+}
+
+// rebuild returns the copy of key that belongs to the namespace with all of its ancestors.
+// key itself is not modified, it may be shared with the other callers.
+func (c *Client) rebuild(key datastore.Key) datastore.Key {
+	if key == nil || c.matches(key) {
+		return key
+	}
+
+	parent := c.rebuild(key.ParentKey())
+	var newKey datastore.Key
+	if key.Name() != "" {
+		newKey = c.client.NameKey(key.Kind(), key.Name(), parent)
+	} else if key.ID() != 0 {
+		newKey = c.client.IDKey(key.Kind(), key.ID(), parent)
+	} else {
+		newKey = c.client.IncompleteKey(key.Kind(), parent)
+	}
+	newKey.SetNamespace(c.ns)
+	return newKey
+}
+
+func (c *Client) bindKey(key datastore.Key) (datastore.Key, error) {
+	if key == nil || c.matches(key) {
+		return key, nil
+	}
+	if !c.rewrite {
+		return nil, ErrNamespaceMismatch
+	}
+
+	return c.rebuild(key), nil
+}
+
+func (c *Client) bindKeys(keys []datastore.Key) ([]datastore.Key, error) {
+	var newKeys []datastore.Key
+	for idx, key := range keys {
+		newKey, err := c.bindKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if newKey != key && newKeys == nil {
+			newKeys = make([]datastore.Key, len(keys))
+			copy(newKeys, keys)
+		}
+		if newKeys != nil {
+			newKeys[idx] = newKey
+		}
+	}
+	if newKeys == nil {
+		return keys, nil
+	}
+
+	return newKeys, nil
+}
+
+func (c *Client) bindQuery(q datastore.Query) (datastore.Query, error) {
+	if bq, ok := q.(*query); ok {
+		q = bq.q
+	}
+
+	qDump := q.Dump()
+	if qDump.Namespace != c.ns {
+		if !c.rewrite {
+			return nil, ErrNamespaceMismatch
+		}
+		q = q.Namespace(c.ns)
+	}
+	if qDump.Ancestor != nil {
+		ancestor, err := c.bindKey(qDump.Ancestor)
+		if err != nil {
+			return nil, err
+		}
+		if ancestor != qDump.Ancestor {
+			q = q.Ancestor(ancestor)
+		}
+	}
+
+	return q, nil
+}
+
+func (c *Client) Get(ctx context.Context, key datastore.Key, dst interface{}) error {
+	key, err := c.bindKey(key)
+	if err != nil {
+		return err
+	}
+	return c.client.Get(ctx, key, dst)
+}
+
+func (c *Client) GetMulti(ctx context.Context, keys []datastore.Key, dst interface{}) error {
+	keys, err := c.bindKeys(keys)
+	if err != nil {
+		return err
+	}
+	return c.client.GetMulti(ctx, keys, dst)
+}
+
+func (c *Client) Put(ctx context.Context, key datastore.Key, src interface{}) (datastore.Key, error) {
+	key, err := c.bindKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.Put(ctx, key, src)
+}
+
+func (c *Client) PutMulti(ctx context.Context, keys []datastore.Key, src interface{}) ([]datastore.Key, error) {
+	keys, err := c.bindKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.PutMulti(ctx, keys, src)
+}
+
+func (c *Client) Delete(ctx context.Context, key datastore.Key) error {
+	key, err := c.bindKey(key)
+	if err != nil {
+		return err
+	}
+	return c.client.Delete(ctx, key)
+}
+
+func (c *Client) DeleteMulti(ctx context.Context, keys []datastore.Key) error {
+	keys, err := c.bindKeys(keys)
+	if err != nil {
+		return err
+	}
+	return c.client.DeleteMulti(ctx, keys)
+}
+
+func (c *Client) NewTransaction(ctx context.Context) (datastore.Transaction, error) {
+	tx, err := c.client.NewTransaction(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &transaction{tx: tx, c: c}, nil
+}
+
+func (c *Client) RunInTransaction(ctx context.Context, f func(tx datastore.Transaction) error) (datastore.Commit, error) {
+	return c.client.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		return f(&transaction{tx: tx, c: c})
+	})
+}
+
+func (c *Client) Run(ctx context.Context, q datastore.Query) datastore.Iterator {
+	q, err := c.bindQuery(q)
+	if err != nil {
+		return &errIterator{err: err}
+	}
+	return c.client.Run(ctx, q)
+}
+
+func (c *Client) AllocateIDs(ctx context.Context, keys []datastore.Key) ([]datastore.Key, error) {
+	keys, err := c.bindKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.AllocateIDs(ctx, keys)
+}
+
+func (c *Client) Count(ctx context.Context, q datastore.Query) (int, error) {
+	q, err := c.bindQuery(q)
+	if err != nil {
+		return 0, err
+	}
+	return c.client.Count(ctx, q)
+}
+
+func (c *Client) GetAll(ctx context.Context, q datastore.Query, dst interface{}) ([]datastore.Key, error) {
+	q, err := c.bindQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.GetAll(ctx, q, dst)
+}
+
+// IncompleteKey creates a new incomplete key in the namespace.
+func (c *Client) IncompleteKey(kind string, parent datastore.Key) datastore.Key {
+	key := c.client.IncompleteKey(kind, parent)
+	key.SetNamespace(c.ns)
+	return key
+}
+
+// NameKey creates a new key with a name in the namespace.
+func (c *Client) NameKey(kind, name string, parent datastore.Key) datastore.Key {
+	key := c.client.NameKey(kind, name, parent)
+	key.SetNamespace(c.ns)
+	return key
+}
+
+// IDKey creates a new key with an ID in the namespace.
+func (c *Client) IDKey(kind string, id int64, parent datastore.Key) datastore.Key {
+	key := c.client.IDKey(kind, id, parent)
+	key.SetNamespace(c.ns)
+	return key
+}
+
+// NewQuery creates a new Query in the namespace.
+func (c *Client) NewQuery(kind string) datastore.Query {
+	return &query{q: c.client.NewQuery(kind).Namespace(c.ns)}
+}
+
+// Close closes the client that isn't bound to the namespace.
+func (c *Client) Close() error {
+	return c.client.Close()
+}
+
+func (c *Client) DecodeKey(encoded string) (datastore.Key, error) {
+	return c.client.DecodeKey(encoded)
+}
+
+func (c *Client) DecodeCursor(s string) (datastore.Cursor, error) {
+	return c.client.DecodeCursor(s)
+}
+
+// Batch creates batch mode objects that operate through the client.
+func (c *Client) Batch() *datastore.Batch {
+	return &datastore.Batch{Client: c}
+}
+
+// AppendMiddleware to the client that isn't bound to the namespace.
+// It affects all clients bound to the namespaces over the client.
+func (c *Client) AppendMiddleware(middleware datastore.Middleware) {
+	c.client.AppendMiddleware(middleware)
+}
+
+// RemoveMiddleware from the client that isn't bound to the namespace.
+func (c *Client) RemoveMiddleware(middleware datastore.Middleware) bool {
+	return c.client.RemoveMiddleware(middleware)
+}
+
+func (c *Client) Context() context.Context {
+	return c.client.Context()
+}
+
+func (c *Client) SetContext(ctx context.Context) {
+	c.client.SetContext(ctx)
+}
@@ -0,0 +1,285 @@
+package namespace
+
+import (
+	"testing"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/boom"
+	"go.mercari.io/datastore/internal/testutils"
+)
+
+type Data struct {
+	Name string
+}
+
+func TestClient_Keys(t *testing.T) {
+	ctx, baseClient, ms := testutils.SetupOnMemory()
+	baseClient.AppendMiddleware(ms)
+
+	client := NewClient(baseClient, "a")
+
+	parent := client.NameKey("Parent", "p", nil)
+	keys := []datastore.Key{
+		client.NameKey("Data", "a", parent),
+		client.IDKey("Data", 1, nil),
+		client.IncompleteKey("Data", nil),
+	}
+	for _, key := range keys {
+		if v := key.Namespace(); v != "a" {
+			t.Errorf("unexpected: %v", v)
+		}
+	}
+
+	keys, err := client.PutMulti(ctx, keys, []*Data{{Name: "a"}, {Name: "b"}, {Name: "c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if _, ok := ms.Raw(key); !ok {
+			t.Errorf("unexpected: %v", key)
+		}
+	}
+
+	obj := &Data{}
+	err = client.Get(ctx, keys[0], obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := obj.Name; v != "a" {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// the keys of the other namespaces are rejected before RPC.
+	otherKey := baseClient.NameKey("Data", "a", nil)
+	err = client.Get(ctx, otherKey, &Data{})
+	if err != ErrNamespaceMismatch {
+		t.Errorf("unexpected: %v", err)
+	}
+	_, err = client.Put(ctx, otherKey, &Data{})
+	if err != ErrNamespaceMismatch {
+		t.Errorf("unexpected: %v", err)
+	}
+	err = client.DeleteMulti(ctx, []datastore.Key{keys[1], otherKey})
+	if err != ErrNamespaceMismatch {
+		t.Errorf("unexpected: %v", err)
+	}
+	// the ancestors are also checked.
+	_, err = client.Put(ctx, client.NameKey("Data", "a", baseClient.NameKey("Parent", "p", nil)), &Data{})
+	if err != ErrNamespaceMismatch {
+		t.Errorf("unexpected: %v", err)
+	}
+	if v := ms.Calls("PutMultiWithoutTx"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := ms.Calls("DeleteMultiWithoutTx"); v != 0 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestClient_Rewrite(t *testing.T) {
+	ctx, baseClient, ms := testutils.SetupOnMemory()
+	baseClient.AppendMiddleware(ms)
+
+	client := NewClient(baseClient, "a", WithRewrite())
+
+	otherKey := baseClient.NameKey("Data", "a", baseClient.IDKey("Parent", 1, nil))
+	key, err := client.Put(ctx, otherKey, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := key.Namespace(); v != "a" {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := key.ParentKey().Namespace(); v != "a" {
+		t.Errorf("unexpected: %v", v)
+	}
+	// the given key is not modified.
+	if v := otherKey.Namespace(); v != "" {
+		t.Errorf("unexpected: %v", v)
+	}
+	if _, ok := ms.Raw(otherKey); ok {
+		t.Errorf("unexpected: %v", ok)
+	}
+
+	obj := &Data{}
+	err = client.Get(ctx, otherKey, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := obj.Name; v != "a" {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	var list []*Data
+	_, err = client.GetAll(ctx, baseClient.NewQuery("Data"), &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := len(list); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestClient_Query(t *testing.T) {
+	ctx, baseClient, ms := testutils.SetupOnMemory()
+	baseClient.AppendMiddleware(ms)
+
+	clientA := NewClient(baseClient, "a")
+	clientB := NewClient(baseClient, "b")
+
+	_, err := clientA.Put(ctx, clientA.NameKey("Data", "a", nil), &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = clientB.Put(ctx, clientB.NameKey("Data", "b", nil), &Data{Name: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var list []*Data
+	keys, err := clientA.GetAll(ctx, clientA.NewQuery("Data"), &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := len(keys); v != 1 {
+		t.Fatalf("unexpected: %v", v)
+	}
+	if v := list[0].Name; v != "a" {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	cnt, err := clientB.Count(ctx, clientB.NewQuery("Data").KeysOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := cnt; v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// the queries of the other namespaces are rejected.
+	_, err = clientA.GetAll(ctx, clientB.NewQuery("Data"), &list)
+	if err != ErrNamespaceMismatch {
+		t.Errorf("unexpected: %v", err)
+	}
+	_, err = clientA.Run(ctx, baseClient.NewQuery("Data")).Next(&Data{})
+	if err != ErrNamespaceMismatch {
+		t.Errorf("unexpected: %v", err)
+	}
+	_, err = clientA.Count(ctx, clientA.NewQuery("Data").Ancestor(baseClient.NameKey("Data", "a", nil)))
+	if err != ErrNamespaceMismatch {
+		t.Errorf("unexpected: %v", err)
+	}
+	if v := ms.Calls("GetAll"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestClient_Batch(t *testing.T) {
+	ctx, baseClient, ms := testutils.SetupOnMemory()
+	baseClient.AppendMiddleware(ms)
+
+	client := NewClient(baseClient, "a")
+
+	b := client.Batch()
+	b.Put(client.NameKey("Data", "a", nil), &Data{Name: "a"}, nil)
+	err := b.Exec(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ms.Raw(client.NameKey("Data", "a", nil)); !ok {
+		t.Errorf("unexpected: %v", ok)
+	}
+
+	b.Put(baseClient.NameKey("Data", "b", nil), &Data{Name: "b"}, nil)
+	err = b.Exec(ctx)
+	if err == nil {
+		t.Fatal(err)
+	}
+	if v := ms.Calls("PutMultiWithoutTx"); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestClient_Boom(t *testing.T) {
+	ctx, baseClient, ms := testutils.SetupOnMemory()
+	baseClient.AppendMiddleware(ms)
+
+	type User struct {
+		ID   string `datastore:"-" boom:"id"`
+		Name string
+	}
+
+	bm := boom.FromClient(ctx, NewClient(baseClient, "a"))
+	key, err := bm.Put(&User{ID: "alice", Name: "Alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := key.Namespace(); v != "a" {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	user := &User{ID: "alice"}
+	err = bm.Get(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := user.Name; v != "Alice" {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// the entity in the other namespace isn't visible.
+	err = boom.FromClient(ctx, NewClient(baseClient, "b")).Get(&User{ID: "alice"})
+	if err != datastore.ErrNoSuchEntity {
+		t.Errorf("unexpected: %v", err)
+	}
+}
+
+func TestClient_Transaction(t *testing.T) {
+	ctx, baseClient, cleanUp := testutils.SetupCloudDatastore(t)
+	defer cleanUp()
+
+	client := NewClient(baseClient, "a")
+
+	key := client.NameKey("Data", "a", nil)
+	_, err := client.Put(ctx, key, &Data{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		// CleanUpAllEntities doesn't see the namespaces.
+		client.Delete(ctx, key)
+	}()
+
+	_, err = client.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		// the query created by the client can be used in the transaction.
+		var list []*Data
+		_, err := client.GetAll(ctx, client.NewQuery("Data").Ancestor(key).Transaction(tx), &list)
+		if err != nil {
+			return err
+		}
+		if v := len(list); v != 1 {
+			t.Errorf("unexpected: %v", v)
+		}
+
+		err = tx.Get(baseClient.NameKey("Data", "a", nil), &Data{})
+		if err != ErrNamespaceMismatch {
+			t.Errorf("unexpected: %v", err)
+		}
+
+		b := tx.Batch()
+		b.Put(key, &Data{Name: "b"}, nil)
+		return b.Exec()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj := &Data{}
+	err = client.Get(ctx, key, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := obj.Name; v != "b" {
+		t.Errorf("unexpected: %v", v)
+	}
+}
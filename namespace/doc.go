@@ -0,0 +1,22 @@
+/*
+Package namespace provides the Client bound to a namespace, for the multi-tenancy by namespaces.
+
+The keys created by IncompleteKey, NameKey and IDKey and the queries created by NewQuery belong to the namespace.
+Get, Put, Delete, AllocateIDs and the queries reject the keys and the queries of the other namespaces by ErrNamespaceMismatch,
+including the ancestors, before any RPC. With WithRewrite, they are rewritten into the namespace instead.
+
+	client := namespace.NewClient(baseClient, tenantID)
+	key := client.NameKey("User", "alice", nil) // key.Namespace() == tenantID
+	_, err := client.Put(ctx, key, user)
+
+The transactions, Batch and TransactionBatch created by the client check the keys in the same way.
+boom works on the client by boom.FromClient.
+
+	bm := boom.FromClient(ctx, namespace.NewClient(baseClient, tenantID))
+
+The query that is used in the transaction should be created by NewQuery of the client,
+it passes the original transaction to the query.
+
+The middlewares are shared with the original client, AppendMiddleware and RemoveMiddleware affect it.
+*/
+package namespace // import "go.mercari.io/datastore/namespace"
@@ -0,0 +1,13 @@
+package namespace
+
+// WithRewrite makes the client rewrite the keys and the queries of the other namespaces into its namespace, instead of rejecting them.
+// The keys are copied, the given keys are not modified.
+func WithRewrite() Option {
+	return &withRewrite{}
+}
+
+type withRewrite struct{}
+
+func (w *withRewrite) Apply(o *Client) {
+	o.rewrite = true
+}
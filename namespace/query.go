@@ -0,0 +1,87 @@
+package namespace
+
+import (
+	"go.mercari.io/datastore"
+)
+
+var _ datastore.Query = &query{}
+var _ datastore.Iterator = &errIterator{}
+
+// query is the datastore.Query created by Client.
+// It passes the original transaction to the query, the implementations of the client require it.
+type query struct {
+	q datastore.Query
+}
+
+func (q *query) Ancestor(ancestor datastore.Key) datastore.Query {
+	return &query{q: q.q.Ancestor(ancestor)}
+}
+
+func (q *query) EventualConsistency() datastore.Query {
+	return &query{q: q.q.EventualConsistency()}
+}
+
+func (q *query) Namespace(ns string) datastore.Query {
+	return &query{q: q.q.Namespace(ns)}
+}
+
+func (q *query) Transaction(t datastore.Transaction) datastore.Query {
+	return &query{q: q.q.Transaction(unwrapTransaction(t))}
+}
+
+func (q *query) Filter(filterStr string, value interface{}) datastore.Query {
+	return &query{q: q.q.Filter(filterStr, value)}
+}
+
+func (q *query) Order(fieldName string) datastore.Query {
+	return &query{q: q.q.Order(fieldName)}
+}
+
+func (q *query) Project(fieldNames ...string) datastore.Query {
+	return &query{q: q.q.Project(fieldNames...)}
+}
+
+func (q *query) Distinct() datastore.Query {
+	return &query{q: q.q.Distinct()}
+}
+
+func (q *query) DistinctOn(fieldNames ...string) datastore.Query {
+	return &query{q: q.q.DistinctOn(fieldNames...)}
+}
+
+func (q *query) KeysOnly() datastore.Query {
+	return &query{q: q.q.KeysOnly()}
+}
+
+func (q *query) Limit(limit int) datastore.Query {
+	return &query{q: q.q.Limit(limit)}
+}
+
+func (q *query) Offset(offset int) datastore.Query {
+	return &query{q: q.q.Offset(offset)}
+}
+
+func (q *query) Start(c datastore.Cursor) datastore.Query {
+	return &query{q: q.q.Start(c)}
+}
+
+func (q *query) End(c datastore.Cursor) datastore.Query {
+	return &query{q: q.q.End(c)}
+}
+
+func (q *query) Dump() *datastore.QueryDump {
+	return q.q.Dump()
+}
+
+// errIterator is returned by Run for the query that is rejected.
+type errIterator struct {
+	err error
+}
+
+func (it *errIterator) Next(dst interface{}) (datastore.Key, error) {
+	return nil, it.err
+}
+
+func (it *errIterator) Cursor() (datastore.Cursor, error) {
+	return nil, it.err
+}
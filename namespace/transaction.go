@@ -0,0 +1,81 @@
+package namespace
+
+import (
+	"go.mercari.io/datastore"
+)
+
+var _ datastore.Transaction = &transaction{}
+
+// transaction is the datastore.Transaction that checks the keys as the Client does.
+type transaction struct {
+	tx datastore.Transaction
+	c  *Client
+}
+
+// unwrapTransaction returns the original transaction, the query needs it.
+func unwrapTransaction(tx datastore.Transaction) datastore.Transaction {
+	if btx, ok := tx.(*transaction); ok {
+		return btx.tx
+	}
+	return tx
+}
+
+func (tx *transaction) Get(key datastore.Key, dst interface{}) error {
+	key, err := tx.c.bindKey(key)
+	if err != nil {
+		return err
+	}
+	return tx.tx.Get(key, dst)
+}
+
+func (tx *transaction) GetMulti(keys []datastore.Key, dst interface{}) error {
+	keys, err := tx.c.bindKeys(keys)
+	if err != nil {
+		return err
+	}
+	return tx.tx.GetMulti(keys, dst)
+}
+
+func (tx *transaction) Put(key datastore.Key, src interface{}) (datastore.PendingKey, error) {
+	key, err := tx.c.bindKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return tx.tx.Put(key, src)
+}
+
+func (tx *transaction) PutMulti(keys []datastore.Key, src interface{}) ([]datastore.PendingKey, error) {
+	keys, err := tx.c.bindKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+	return tx.tx.PutMulti(keys, src)
+}
+
+func (tx *transaction) Delete(key datastore.Key) error {
+	key, err := tx.c.bindKey(key)
+	if err != nil {
+		return err
+	}
+	return tx.tx.Delete(key)
+}
+
+func (tx *transaction) DeleteMulti(keys []datastore.Key) error {
+	keys, err := tx.c.bindKeys(keys)
+	if err != nil {
+		return err
+	}
+	return tx.tx.DeleteMulti(keys)
+}
+
+func (tx *transaction) Commit() (datastore.Commit, error) {
+	return tx.tx.Commit()
+}
+
+func (tx *transaction) Rollback() error {
+	return tx.tx.Rollback()
+}
+
+func (tx *transaction) Batch() *datastore.TransactionBatch {
+	return &datastore.TransactionBatch{Transaction: tx}
+}
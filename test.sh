@@ -29,3 +29,13 @@ export MEMCACHE_ADDR=localhost:11211
 # Connect Cloud Datastore (production env)
 # (if you need login) → gcloud auth application-default login
 go test $packages -count 1 -p 1 -coverpkg=./... -covermode=atomic -coverprofile=coverage.txt $@
+
+# dsmiddleware/dstrace and dsmiddleware/dsmetrics/* are the nested modules that require the newer Go.
+case `go env GOVERSION` in
+go1.2[1-9]*)
+    for module in dsmiddleware/dstrace dsmiddleware/dsmetrics/otelmetrics dsmiddleware/dsmetrics/prommetrics
+    do
+        (cd $module && go vet ./... && go test ./... -count 1 -p 1 $@)
+    done
+    ;;
+esac
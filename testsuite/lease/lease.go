@@ -0,0 +1,212 @@
+package lease
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/lease"
+	"go.mercari.io/datastore/testsuite"
+)
+
+// TestSuite contains all the test cases that this package provides.
+var TestSuite = map[string]testsuite.Test{
+	"Lease_AcquireAndRelease": acquireAndRelease,
+	"Lease_Expire":            expire,
+	"Lease_Renew":             renew,
+	"Lease_AcquireTwice":      acquireTwice,
+}
+
+func init() {
+	testsuite.MergeTestSuite(TestSuite)
+}
+
+func acquireAndRelease(ctx context.Context, t *testing.T, client datastore.Client) {
+	defer func() {
+		err := client.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	l1 := lease.New(client, "job", lease.WithHolder("a"), lease.WithTTL(10*time.Second))
+	l2 := lease.New(client, "job", lease.WithHolder("b"), lease.WithTTL(10*time.Second))
+
+	lk1, err := l1.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := lk1.Holder(); v != "a" {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := lk1.Token(); v != 1 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	_, err = l2.Acquire(ctx)
+	if err != lease.ErrLeaseHeld {
+		t.Fatalf("unexpected: %v", err)
+	}
+
+	status, err := l2.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Holder != "a" || status.Token != 1 || !status.Held(time.Now()) {
+		t.Errorf("unexpected: %+v", status)
+	}
+
+	err = lk1.Release(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-lk1.Context().Done():
+	default:
+		t.Errorf("context is not cancelled")
+	}
+
+	lk2, err := l2.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lk2.Release(ctx)
+	if v := lk2.Token(); v != 2 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	// released lock can't be used.
+	err = lk1.Renew(ctx)
+	if err != lease.ErrLeaseLost {
+		t.Errorf("unexpected: %v", err)
+	}
+}
+
+func expire(ctx context.Context, t *testing.T, client datastore.Client) {
+	defer func() {
+		err := client.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	l1 := lease.New(client, "job", lease.WithHolder("a"), lease.WithTTL(500*time.Millisecond), lease.WithRenewInterval(-1))
+	l2 := lease.New(client, "job", lease.WithHolder("b"), lease.WithTTL(10*time.Second))
+
+	lk1, err := l1.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-lk1.Context().Done():
+	case <-time.After(3 * time.Second):
+		t.Fatalf("context is not cancelled")
+	}
+
+	lk2, err := l2.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lk2.Release(ctx)
+	if lk2.Token() <= lk1.Token() {
+		t.Errorf("unexpected: %v, %v", lk1.Token(), lk2.Token())
+	}
+
+	err = lk1.Release(ctx)
+	if err != lease.ErrLeaseLost {
+		t.Errorf("unexpected: %v", err)
+	}
+}
+
+func renew(ctx context.Context, t *testing.T, client datastore.Client) {
+	defer func() {
+		err := client.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	l1 := lease.New(client, "job", lease.WithHolder("a"), lease.WithTTL(1*time.Second), lease.WithRenewInterval(200*time.Millisecond))
+	l2 := lease.New(client, "job", lease.WithHolder("b"), lease.WithTTL(1*time.Second))
+
+	lk1, err := l1.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := lk1.ExpiresAt()
+
+	// renewed in background, the lease outlives TTL.
+	time.Sleep(1500 * time.Millisecond)
+
+	select {
+	case <-lk1.Context().Done():
+		t.Fatalf("context is cancelled")
+	default:
+	}
+	if !expiresAt.Before(lk1.ExpiresAt()) {
+		t.Errorf("unexpected: %v, %v", expiresAt, lk1.ExpiresAt())
+	}
+
+	_, err = l2.Acquire(ctx)
+	if err != lease.ErrLeaseHeld {
+		t.Fatalf("unexpected: %v", err)
+	}
+
+	err = lk1.Release(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func acquireTwice(ctx context.Context, t *testing.T, client datastore.Client) {
+	defer func() {
+		err := client.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	l1 := lease.New(client, "job", lease.WithHolder("a"), lease.WithTTL(10*time.Second))
+	l2 := lease.New(client, "job", lease.WithHolder("a"), lease.WithTTL(10*time.Second))
+
+	lk1, err := l1.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same holder can't acquire the held lease.
+	_, err = l1.Acquire(ctx)
+	if err != lease.ErrLeaseHeld {
+		t.Fatalf("unexpected: %v", err)
+	}
+	_, err = l2.Acquire(ctx)
+	if err != lease.ErrLeaseHeld {
+		t.Fatalf("unexpected: %v", err)
+	}
+	_, err = l2.Reacquire(ctx, lk1.Token()+1)
+	if err != lease.ErrLeaseHeld {
+		t.Fatalf("unexpected: %v", err)
+	}
+
+	// the token of the held lease takes it over.
+	lk2, err := l2.Reacquire(ctx, lk1.Token())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lk2.Release(ctx)
+	if v := lk2.Token(); v != lk1.Token()+1 {
+		t.Errorf("unexpected: %v", v)
+	}
+
+	err = lk1.Renew(ctx)
+	if err != lease.ErrLeaseLost {
+		t.Errorf("unexpected: %v", err)
+	}
+	select {
+	case <-lk1.Context().Done():
+	default:
+		t.Errorf("context is not cancelled")
+	}
+}